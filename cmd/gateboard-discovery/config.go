@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"time"
 
 	"github.com/udhos/gateboard/gateboard"
@@ -10,6 +11,9 @@ type appConfig struct {
 	accountsFile         string
 	interval             time.Duration
 	gateboardServerURL   string
+	gateboardTLSCert     string
+	gateboardTLSKey      string
+	gateboardTLSCA       string
 	debug                bool
 	dryRun               bool
 	save                 string
@@ -38,6 +42,9 @@ func newConfig(me string) appConfig {
 		accountsFile:         env.String("ACCOUNTS", "discovery-accounts.yaml"),
 		interval:             env.Duration("INTERVAL", 0),
 		gateboardServerURL:   env.String("GATEBOARD_SERVER_URL", "http://localhost:8080/gateway"),
+		gateboardTLSCert:     env.String("GATEBOARD_TLS_CERT", ""), // client certificate for mutual TLS
+		gateboardTLSKey:      env.String("GATEBOARD_TLS_KEY", ""),
+		gateboardTLSCA:       env.String("GATEBOARD_TLS_CA", ""), // CA bundle to verify server, empty uses system roots
 		debug:                env.Bool("DEBUG", true),
 		dryRun:               env.Bool("DRY_RUN", true),
 		save:                 env.String("SAVE", "server"), // server, webhook, sqs, sns, lambda
@@ -58,3 +65,11 @@ func newConfig(me string) appConfig {
 		otelTraceEnable:      env.Bool("OTEL_TRACE_ENABLE", true),
 	}
 }
+
+// serverTLSConfig returns nil when no TLS option is set, keeping default TLS settings.
+func serverTLSConfig(config appConfig) (*tls.Config, error) {
+	if config.gateboardTLSCert == "" && config.gateboardTLSKey == "" && config.gateboardTLSCA == "" {
+		return nil, nil
+	}
+	return gateboard.TLSClientConfig(config.gateboardTLSCert, config.gateboardTLSKey, config.gateboardTLSCA)
+}
@@ -73,7 +73,11 @@ func main() {
 	var save saver
 	switch config.save {
 	case "server":
-		save = newSaverServer(config.gateboardServerURL)
+		tlsConfig, errTLS := serverTLSConfig(config)
+		if errTLS != nil {
+			log.Fatalf("gateboard server tls: %v", errTLS)
+		}
+		save = newSaverServer(config.gateboardServerURL, tlsConfig)
 	case "webhook":
 		save = newSaverWebhook(config.webhookURL, config.webhookToken, config.webhookMethod)
 	case "sqs":
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -31,10 +32,13 @@ type saver interface {
 
 type saverServer struct {
 	serverURL string
+	client    http.Client
 }
 
-func newSaverServer(serverURL string) *saverServer {
-	s := saverServer{serverURL: serverURL}
+// newSaverServer creates a saver for the gateboard server.
+// tlsConfig is optional, see gateboard.TLSClientConfig.
+func newSaverServer(serverURL string, tlsConfig *tls.Config) *saverServer {
+	s := saverServer{serverURL: serverURL, client: httpClientTLS(tlsConfig)}
 	return &s
 }
 
@@ -65,9 +69,7 @@ func (s *saverServer) save(ctx context.Context, tracer trace.Tracer, name, id, w
 		return errReq
 	}
 
-	client := httpClient()
-
-	resp, errDo := client.Do(req)
+	resp, errDo := s.client.Do(req)
 	if errDo != nil {
 		traceError(span, errDo.Error())
 		return errDo
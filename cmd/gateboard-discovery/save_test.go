@@ -146,7 +146,7 @@ func testSaverServer(t *testing.T, data testCaseSaverServer) {
 		return
 	}
 
-	saver := newSaverServer(u)
+	saver := newSaverServer(u, nil)
 
 	const debug = true
 
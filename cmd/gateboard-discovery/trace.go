@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -26,3 +27,13 @@ func traceError(span trace.Span, description string) {
 func httpClient() http.Client {
 	return http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 }
+
+// httpClientTLS creates a client with its own transport, since tlsConfig must not leak into http.DefaultTransport.
+func httpClientTLS(tlsConfig *tls.Config) http.Client {
+	if tlsConfig == nil {
+		return httpClient()
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return http.Client{Transport: otelhttp.NewTransport(transport)}
+}
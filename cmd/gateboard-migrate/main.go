@@ -0,0 +1,126 @@
+/*
+This is the main package for gateboard-migrate, which copies every gateway
+from one repository into another, keeping changes, last_update, token
+and history:
+
+	gateboard-migrate -source old.yaml -destination new.yaml
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "github.com/KimMachineGun/automemlimit"
+	"github.com/udhos/boilerplate/boilerplate"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+func main() {
+
+	var (
+		showVersion                  bool
+		source, sourceName           string
+		destination, destinationName string
+		debug                        bool
+		opt                          = migrateOptions{verify: true, history: true, page: migratePage}
+	)
+
+	flag.BoolVar(&showVersion, "version", showVersion, "show version")
+	flag.StringVar(&source, "source", "", "source repository list, in REPO_LIST format")
+	flag.StringVar(&sourceName, "source-name", "", "source repository name, required if source lists many")
+	flag.StringVar(&destination, "destination", "", "destination repository list, in REPO_LIST format")
+	flag.StringVar(&destinationName, "destination-name", "", "destination repository name, required if destination lists many")
+	flag.BoolVar(&opt.dryRun, "dry-run", opt.dryRun, "report what would be copied without writing")
+	flag.StringVar(&opt.state, "state", "gateboard-migrate.state", "file recording the last copied gateway, for -resume")
+	flag.BoolVar(&opt.resume, "resume", opt.resume, "continue after the gateway recorded in -state by a previous run")
+	flag.BoolVar(&opt.verify, "verify", opt.verify, "compare record counts and checksums after copying")
+	flag.BoolVar(&opt.verifyOnly, "verify-only", opt.verifyOnly, "only compare repositories")
+	flag.BoolVar(&opt.history, "history", opt.history, "copy gateway history")
+	flag.IntVar(&opt.page, "page", opt.page, "gateways read from each repository per request")
+	flag.BoolVar(&debug, "debug", debug, "enable debug logging")
+	flag.Parse()
+
+	me := filepath.Base(os.Args[0])
+
+	{
+		v := boilerplate.LongVersion(me + " version=" + version)
+		if showVersion {
+			fmt.Print(v)
+			fmt.Println()
+			return
+		}
+		zlog.Infof("%s", v)
+	}
+
+	if source == "" || destination == "" || opt.page < 1 {
+		fmt.Fprintf(os.Stderr, "%s: -source and -destination are required, -page must be positive\n", me)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	env := gateboard.NewEnv(me)
+	secretRoleArn := env.String("SECRET_ROLE_ARN", "")
+
+	src, errSrc := openRepo(me, secretRoleArn, source, sourceName, debug)
+	if errSrc != nil {
+		zlog.Fatalf("%s: source: %v", me, errSrc)
+	}
+
+	dst, errDst := openRepo(me, secretRoleArn, destination, destinationName, debug)
+	if errDst != nil {
+		zlog.Fatalf("%s: destination: %v", me, errDst)
+	}
+
+	report, errMigrate := migrate(context.TODO(), src, dst, opt, os.Stdout)
+
+	closeRepo(context.TODO(), src)
+	closeRepo(context.TODO(), dst)
+
+	if errMigrate != nil {
+		zlog.Fatalf("%s: %v", me, errMigrate)
+	}
+
+	if report.differences > 0 {
+		os.Exit(1)
+	}
+}
+
+// openRepo creates the repository listed in file, selected by name
+// when the file lists more than one.
+func openRepo(sessionName, secretRoleArn, file, name string, debug bool) (repository.Repository, error) {
+	list, errConf := repository.LoadConfig(file)
+	if errConf != nil {
+		return nil, errConf
+	}
+
+	var found []repository.Config
+	for _, c := range list {
+		if name == "" || c.Name == name {
+			found = append(found, c)
+		}
+	}
+
+	if len(found) != 1 {
+		return nil, fmt.Errorf("%s: found %d repositories named '%s', expecting one", file, len(found), name)
+	}
+
+	return repository.New(sessionName, secretRoleArn, found[0], debug)
+}
+
+// closeRepo releases connections held by r.
+func closeRepo(ctx context.Context, r repository.Repository) {
+	const me = "closeRepo"
+	c, ok := r.(repository.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(ctx); err != nil {
+		zlog.Errorf("%s: %s: %v", me, r.RepoName(), err)
+	}
+}
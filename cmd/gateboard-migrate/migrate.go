@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// migratePage is the default number of gateways read per dump request.
+const migratePage = 1000
+
+type migrateOptions struct {
+	dryRun     bool   // report what would be copied, write nothing
+	resume     bool   // continue after the gateway recorded in state
+	state      string // file recording the last copied gateway, empty means none
+	verify     bool   // compare repositories after copying
+	verifyOnly bool   // only compare repositories
+	history    bool   // copy history
+	page       int    // gateways read from each repository per dump request
+}
+
+// migrateRecord holds the fields compared by verification. last_update is
+// truncated to seconds, the coarsest precision kept by any repository.
+type migrateRecord struct {
+	gatewayName string
+	gatewayID   string
+	changes     int64
+	lastUpdate  time.Time
+	token       string
+	deleted     bool
+}
+
+func newMigrateRecord(body gateboard.BodyGetReply) migrateRecord {
+	return migrateRecord{
+		gatewayName: body.GatewayName,
+		gatewayID:   body.GatewayID,
+		changes:     body.Changes,
+		lastUpdate:  body.LastUpdate.Truncate(time.Second).UTC(),
+		token:       body.Token,
+		deleted:     body.Deleted,
+	}
+}
+
+func (m migrateRecord) String() string {
+	return fmt.Sprintf("gateway_id=%q changes=%d last_update=%s token_set=%t deleted=%t",
+		m.gatewayID, m.changes, m.lastUpdate.Format(time.RFC3339), m.token != "", m.deleted)
+}
+
+// canonical feeds the checksum, the token is included since it must be carried over.
+func (m migrateRecord) canonical() string {
+	return fmt.Sprintf("%q %q %d %s %q %t\n",
+		m.gatewayName, m.gatewayID, m.changes, m.lastUpdate.Format(time.RFC3339), m.token, m.deleted)
+}
+
+// migrateBody rebuilds a gateway from a dump item.
+func migrateBody(item map[string]interface{}) gateboard.BodyGetReply {
+	return gateboard.BodyGetReply{
+		GatewayName: repository.DumpName(item),
+		GatewayID:   repository.DumpString(item["gateway_id"]),
+		Changes:     repository.DumpInt64(item["changes"]),
+		LastUpdate:  repository.DumpTime(item["last_update"]),
+		Token:       repository.DumpString(item["token"]),
+		Deleted:     repository.DumpBool(item["deleted"]),
+	}
+}
+
+type migrateReport struct {
+	copied      int
+	differences int
+}
+
+// migratePager walks a repository in gateway name order, a page at a time,
+// so no more than a page per repository is held in memory.
+type migratePager struct {
+	repo  repository.Repository
+	page  repository.Dump
+	after string // cursor for the next page
+	limit int
+	done  bool
+}
+
+func newMigratePager(r repository.Repository, after string, limit int) *migratePager {
+	return &migratePager{repo: r, after: after, limit: limit}
+}
+
+// next returns the following gateway, or nil when there are no more.
+func (p *migratePager) next(ctx context.Context) (map[string]interface{}, error) {
+	for len(p.page) == 0 {
+		if p.done {
+			return nil, nil
+		}
+		page, errDump := p.repo.Dump(ctx, repository.DumpFilter{After: p.after, Limit: p.limit})
+		if errDump != nil {
+			return nil, fmt.Errorf("dump %s after '%s': %v", p.repo.RepoName(), p.after, errDump)
+		}
+		p.done = len(page) < p.limit
+		if len(page) > 0 {
+			p.after = repository.DumpName(page[len(page)-1])
+		}
+		p.page = page
+	}
+	item := p.page[0]
+	p.page = p.page[1:]
+	return item, nil
+}
+
+// migrateJoin walks src and dst in lockstep, calling visit once for each
+// gateway name found in either, with nil for the side missing it.
+func migrateJoin(ctx context.Context, src, dst *migratePager, visit func(s, d map[string]interface{}) error) error {
+	s, errSrc := src.next(ctx)
+	if errSrc != nil {
+		return errSrc
+	}
+	d, errDst := dst.next(ctx)
+	if errDst != nil {
+		return errDst
+	}
+
+	for s != nil || d != nil {
+		var err error
+		switch {
+		case d == nil || (s != nil && repository.DumpName(s) < repository.DumpName(d)):
+			if err = visit(s, nil); err == nil {
+				s, err = src.next(ctx)
+			}
+		case s == nil || repository.DumpName(d) < repository.DumpName(s):
+			if err = visit(nil, d); err == nil {
+				d, err = dst.next(ctx)
+			}
+		default:
+			if err = visit(s, d); err == nil {
+				if s, err = src.next(ctx); err == nil {
+					d, err = dst.next(ctx)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrate copies src into dst, then optionally verifies dst against src.
+// Both repositories are read page by page in gateway name order.
+// Progress and differences are written to out.
+func migrate(ctx context.Context, src, dst repository.Repository, opt migrateOptions, out io.Writer) (migrateReport, error) {
+	const me = "migrate"
+
+	var report migrateReport
+
+	if opt.page < 1 {
+		opt.page = migratePage
+	}
+
+	restorer, canRestore := dst.(repository.Restorer)
+	if !canRestore && !opt.dryRun && !opt.verifyOnly {
+		return report, fmt.Errorf("%s: destination %s cannot preserve changes counter", me, dst.RepoName())
+	}
+
+	if !opt.verifyOnly {
+		after, errState := migrateLoadState(opt)
+		if errState != nil {
+			return report, errState
+		}
+
+		zlog.Infof("%s: copying gateways after '%s' from %s to %s (dry-run=%t)",
+			me, after, src.RepoName(), dst.RepoName(), opt.dryRun)
+
+		var errCopy error
+		if opt.dryRun {
+			errCopy = migrateJoin(ctx, newMigratePager(src, after, opt.page), newMigratePager(dst, after, opt.page),
+				func(s, d map[string]interface{}) error {
+					if s == nil {
+						return nil // migrate leaves gateways missing in source untouched
+					}
+					migrateDryRun(s, d, out)
+					report.copied++
+					return nil
+				})
+		} else {
+			errCopy = migrateCopy(ctx, src, restorer, after, opt, &report)
+		}
+		if errCopy != nil {
+			return report, fmt.Errorf("%s: %v", me, errCopy)
+		}
+
+		fmt.Fprintf(out, "copied=%d resumed_after=%q dry_run=%t\n",
+			report.copied, after, opt.dryRun)
+	}
+
+	if opt.verify || opt.verifyOnly {
+		differences, errVerify := migrateVerify(ctx, src, dst, opt.page, out)
+		if errVerify != nil {
+			return report, errVerify
+		}
+		report.differences = differences
+	}
+
+	return report, nil
+}
+
+// migrateCopy restores every gateway from src sorting after the given name.
+// The last copied gateway is recorded in the state file once per page.
+func migrateCopy(ctx context.Context, src repository.Repository, restorer repository.Restorer,
+	after string, opt migrateOptions, report *migrateReport) error {
+
+	const me = "migrateCopy"
+
+	if !opt.resume {
+		if errSave := migrateSaveState(opt, ""); errSave != nil {
+			return errSave
+		}
+	}
+
+	pager := newMigratePager(src, after, opt.page)
+
+	var last string
+
+	for {
+		item, errNext := pager.next(ctx)
+		if errNext != nil {
+			return errNext
+		}
+		if item == nil {
+			break
+		}
+
+		body := migrateBody(item)
+
+		var history []gateboard.HistoryEntry
+		if opt.history {
+			h, errHistory := src.History(ctx, body.GatewayName)
+			if errHistory != nil {
+				return fmt.Errorf("history %s: %v", body.GatewayName, errHistory)
+			}
+			history = h
+		}
+
+		if errRestore := restorer.Restore(ctx, body, history); errRestore != nil {
+			return fmt.Errorf("restore %s: %v", body.GatewayName, errRestore)
+		}
+
+		report.copied++
+		last = body.GatewayName
+
+		if report.copied%opt.page == 0 {
+			if errSave := migrateSaveState(opt, last); errSave != nil {
+				return errSave
+			}
+			zlog.Infof("%s: progress: copied=%d last=%s", me, report.copied, last)
+		}
+	}
+
+	if last == "" {
+		return nil
+	}
+
+	return migrateSaveState(opt, last)
+}
+
+// migrateDryRun reports what copying the source item s would do to the
+// destination item d, nil when missing.
+func migrateDryRun(s, d map[string]interface{}, out io.Writer) {
+	body := migrateBody(s)
+	switch {
+	case d == nil:
+		fmt.Fprintf(out, "create %s: %s\n", body.GatewayName, newMigrateRecord(body))
+	case newMigrateRecord(migrateBody(d)) != newMigrateRecord(body):
+		fmt.Fprintf(out, "overwrite %s: %s => %s\n", body.GatewayName, newMigrateRecord(migrateBody(d)), newMigrateRecord(body))
+	}
+}
+
+// migrateLoadState returns the last gateway copied by a previous run,
+// or an empty name when starting from the beginning.
+func migrateLoadState(opt migrateOptions) (string, error) {
+	if !opt.resume || opt.state == "" {
+		return "", nil
+	}
+
+	f, errOpen := os.Open(opt.state)
+	if errors.Is(errOpen, os.ErrNotExist) {
+		return "", nil
+	}
+	if errOpen != nil {
+		return "", fmt.Errorf("migrate: state: %v", errOpen)
+	}
+	defer f.Close()
+
+	var last string
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		last = strings.TrimSpace(scanner.Text())
+	}
+
+	return last, scanner.Err()
+}
+
+// migrateSaveState records the last copied gateway, the cursor for -resume.
+func migrateSaveState(opt migrateOptions, last string) error {
+	if opt.state == "" {
+		return nil
+	}
+	if errWrite := os.WriteFile(opt.state, []byte(last+"\n"), 0o640); errWrite != nil {
+		return fmt.Errorf("state: %v", errWrite)
+	}
+	return nil
+}
+
+// migrateVerify compares record counts and checksums, and lists differences.
+// Both repositories are walked in gateway name order, so checksums are
+// computed incrementally and only differences are written out.
+func migrateVerify(ctx context.Context, src, dst repository.Repository, page int, out io.Writer) (int, error) {
+	var (
+		srcSum      = sha256.New()
+		dstSum      = sha256.New()
+		srcCount    int
+		dstCount    int
+		differences int
+	)
+
+	errJoin := migrateJoin(ctx, newMigratePager(src, "", page), newMigratePager(dst, "", page),
+		func(s, d map[string]interface{}) error {
+			var sr, dr migrateRecord
+			if s != nil {
+				sr = newMigrateRecord(migrateBody(s))
+				io.WriteString(srcSum, sr.canonical())
+				srcCount++
+			}
+			if d != nil {
+				dr = newMigrateRecord(migrateBody(d))
+				io.WriteString(dstSum, dr.canonical())
+				dstCount++
+			}
+			switch {
+			case d == nil:
+				fmt.Fprintf(out, "missing in destination: %s\n", sr.gatewayName)
+			case s == nil:
+				fmt.Fprintf(out, "missing in source: %s\n", dr.gatewayName)
+			case sr != dr:
+				fmt.Fprintf(out, "differs: %s: source: %s destination: %s\n", sr.gatewayName, sr, dr)
+			default:
+				return nil
+			}
+			differences++
+			return nil
+		})
+	if errJoin != nil {
+		return 0, fmt.Errorf("migrate: verify: %v", errJoin)
+	}
+
+	fmt.Fprintf(out, "source:      %s records=%d sha256=%s\n", src.RepoName(), srcCount, hex.EncodeToString(srcSum.Sum(nil)))
+	fmt.Fprintf(out, "destination: %s records=%d sha256=%s\n", dst.RepoName(), dstCount, hex.EncodeToString(dstSum.Sum(nil)))
+
+	if differences == 0 {
+		fmt.Fprintln(out, "verify: ok")
+	} else {
+		fmt.Fprintf(out, "verify: %d differences\n", differences)
+	}
+
+	return differences, nil
+}
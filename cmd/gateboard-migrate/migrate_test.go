@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+func newTestRepo(t *testing.T, name string) repository.Repository {
+	r, errRepo := repository.New("test", "", repository.Config{Kind: "mem", Name: name}, false)
+	if errRepo != nil {
+		t.Fatalf("repo %s: %v", name, errRepo)
+	}
+	return r
+}
+
+func countGateways(t *testing.T, r repository.Repository) int {
+	d, errDump := r.Dump(context.TODO(), repository.DumpFilter{})
+	if errDump != nil {
+		t.Fatalf("dump: %v", errDump)
+	}
+	return len(d)
+}
+
+// go test -count=1 -run TestMigrate ./cmd/gateboard-migrate
+func TestMigrate(t *testing.T) {
+	ctx := context.TODO()
+
+	src := newTestRepo(t, "src")
+	dst := newTestRepo(t, "dst")
+
+	for _, gw := range []string{"gw1", "gw2", "gw3"} {
+		if errPut := src.Put(ctx, gw, "id1", "test", repository.AnyChanges); errPut != nil {
+			t.Fatalf("put: %v", errPut)
+		}
+	}
+	if errPut := src.Put(ctx, "gw1", "id2", "test", repository.AnyChanges); errPut != nil {
+		t.Fatalf("put: %v", errPut)
+	}
+	if errToken := src.PutToken(ctx, "gw2", "secret"); errToken != nil {
+		t.Fatalf("putToken: %v", errToken)
+	}
+	if errDelete := src.Delete(ctx, "gw3", "test"); errDelete != nil {
+		t.Fatalf("delete: %v", errDelete)
+	}
+
+	state := filepath.Join(t.TempDir(), "state")
+
+	// dry run writes nothing
+
+	report, errDry := migrate(ctx, src, dst, migrateOptions{dryRun: true, state: state, history: true, page: 2}, io.Discard)
+	if errDry != nil {
+		t.Fatalf("dry run: %v", errDry)
+	}
+	if report.copied != 3 {
+		t.Errorf("dry run: expected 3 gateways, got %d", report.copied)
+	}
+	if n := countGateways(t, dst); n != 0 {
+		t.Errorf("dry run: expected empty destination, got %d gateways", n)
+	}
+	if _, errStat := os.Stat(state); !os.IsNotExist(errStat) {
+		t.Errorf("dry run: unexpected state file: %v", errStat)
+	}
+
+	// copy all, pages smaller than the repository
+
+	report, errMigrate := migrate(ctx, src, dst, migrateOptions{state: state, verify: true, history: true, page: 2}, io.Discard)
+	if errMigrate != nil {
+		t.Fatalf("migrate: %v", errMigrate)
+	}
+	if report.copied != 3 || report.differences != 0 {
+		t.Errorf("migrate: expected 3 copied and no differences, got %d copied %d differences", report.copied, report.differences)
+	}
+
+	for _, gw := range []string{"gw1", "gw2", "gw3"} {
+		s, _ := src.Get(ctx, gw)
+		d, errGet := dst.Get(ctx, gw)
+		if errGet != nil {
+			t.Errorf("%s: get: %v", gw, errGet)
+		}
+		if s != d {
+			t.Errorf("%s: source=%v destination=%v", gw, s, d)
+		}
+		sh, _ := src.History(ctx, gw)
+		dh, _ := dst.History(ctx, gw)
+		if len(sh) != len(dh) {
+			t.Errorf("%s: source history=%d destination history=%d", gw, len(sh), len(dh))
+		}
+	}
+
+	// resume continues after the last copied gateway
+
+	last, errState := migrateLoadState(migrateOptions{state: state, resume: true})
+	if errState != nil || last != "gw3" {
+		t.Errorf("state: expected gw3, got '%s': %v", last, errState)
+	}
+
+	report, errResume := migrate(ctx, src, dst, migrateOptions{state: state, resume: true, page: 2}, io.Discard)
+	if errResume != nil {
+		t.Fatalf("resume: %v", errResume)
+	}
+	if report.copied != 0 {
+		t.Errorf("resume: expected 0 copied, got %d", report.copied)
+	}
+
+	// verify reports differences
+
+	if errPut := dst.Put(ctx, "gw1", "id3", "test", repository.AnyChanges); errPut != nil {
+		t.Fatalf("put: %v", errPut)
+	}
+	if errPut := dst.Put(ctx, "gw4", "id1", "test", repository.AnyChanges); errPut != nil {
+		t.Fatalf("put: %v", errPut)
+	}
+
+	var out strings.Builder
+
+	report, errVerify := migrate(ctx, src, dst, migrateOptions{verifyOnly: true, page: 2}, &out)
+	if errVerify != nil {
+		t.Fatalf("verify: %v", errVerify)
+	}
+	if report.differences != 2 {
+		t.Errorf("verify: expected 2 differences, got %d: %s", report.differences, out.String())
+	}
+	if !strings.Contains(out.String(), "differs: gw1:") || !strings.Contains(out.String(), "missing in source: gw4") {
+		t.Errorf("verify: unexpected report: %s", out.String())
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// authRule grants access to gateway name prefixes for callers whose
+// token carries all the listed claims. A claim holding a list matches
+// when any of its elements equals the value. The prefix "*" means any gateway.
+type authRule struct {
+	Claims map[string]string `yaml:"claims"`
+	Read   []string          `yaml:"read"`
+	Write  []string          `yaml:"write"`
+}
+
+// authGrant holds the gateway name prefixes granted to an authenticated caller.
+type authGrant struct {
+	subject string
+	read    []string
+	write   []string
+}
+
+const authGrantKey = "gateboard.authGrant"
+
+// authenticator validates JWT bearer tokens against a JWKS.
+type authenticator struct {
+	keyfunc jwt.Keyfunc
+	parser  *jwt.Parser
+	rules   []authRule // nil grants full access to any valid token
+}
+
+func loadAuthRules(input string) ([]authRule, error) {
+
+	const me = "loadAuthRules"
+
+	reader, errOpen := os.Open(input)
+	if errOpen != nil {
+		return nil, fmt.Errorf("%s: open file: %s: %v", me, input, errOpen)
+	}
+	defer reader.Close()
+
+	buf, errRead := io.ReadAll(reader)
+	if errRead != nil {
+		return nil, fmt.Errorf("%s: read file: %s: %v", me, input, errRead)
+	}
+
+	var rules []authRule
+
+	errYaml := yaml.Unmarshal(buf, &rules)
+	if errYaml != nil {
+		return rules, fmt.Errorf("%s: parse yaml: %s: %v", me, input, errYaml)
+	}
+
+	return rules, nil
+}
+
+// newAuthenticator loads keys from AUTH_JWKS, either a local file or an URL.
+// Keys retrieved from URL are periodically refreshed.
+func newAuthenticator(ctx context.Context, config appConfig) (*authenticator, error) {
+
+	var k keyfunc.Keyfunc
+
+	if strings.HasPrefix(config.authJWKS, "https://") || strings.HasPrefix(config.authJWKS, "http://") {
+		kf, errURL := keyfunc.NewDefaultCtx(ctx, []string{config.authJWKS})
+		if errURL != nil {
+			return nil, fmt.Errorf("jwks url: %s: %v", config.authJWKS, errURL)
+		}
+		k = kf
+	} else {
+		buf, errRead := os.ReadFile(config.authJWKS)
+		if errRead != nil {
+			return nil, fmt.Errorf("jwks file: %v", errRead)
+		}
+		kf, errJSON := keyfunc.NewJWKSetJSON(buf)
+		if errJSON != nil {
+			return nil, fmt.Errorf("jwks file: %s: %v", config.authJWKS, errJSON)
+		}
+		k = kf
+	}
+
+	options := []jwt.ParserOption{
+		// asymmetric only: the JWKS is public
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512",
+			"ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithLeeway(config.authClockSkew),
+		jwt.WithExpirationRequired(),
+	}
+	if config.authIssuer != "" {
+		options = append(options, jwt.WithIssuer(config.authIssuer))
+	}
+	if config.authAudience != "" {
+		options = append(options, jwt.WithAudience(config.authAudience))
+	}
+
+	a := &authenticator{
+		keyfunc: k.Keyfunc,
+		parser:  jwt.NewParser(options...),
+	}
+
+	if config.authRules != "" {
+		rules, errRules := loadAuthRules(config.authRules)
+		if errRules != nil {
+			return nil, errRules
+		}
+		a.rules = rules
+	}
+
+	return a, nil
+}
+
+func claimMatch(claim any, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []any:
+		for _, e := range v {
+			if claimMatch(e, value) {
+				return true
+			}
+		}
+		return false
+	case nil:
+		return false
+	}
+	return fmt.Sprint(claim) == value
+}
+
+// grant evaluates rules against the claims.
+func (a *authenticator) grant(claims jwt.MapClaims) *authGrant {
+	g := &authGrant{}
+	g.subject, _ = claims.GetSubject()
+
+	if a.rules == nil {
+		g.read = []string{"*"}
+		g.write = []string{"*"}
+		return g
+	}
+
+	for _, r := range a.rules {
+		matched := true
+		for name, value := range r.Claims {
+			if !claimMatch(claims[name], value) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			g.read = append(g.read, r.Read...)
+			g.write = append(g.write, r.Write...)
+		}
+	}
+
+	return g
+}
+
+// authenticate validates the bearer token from the Authorization header.
+func (a *authenticator) authenticate(header string) (*authGrant, error) {
+	bearer, found := strings.CutPrefix(header, "Bearer ")
+	if !found || bearer == "" {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+
+	claims := jwt.MapClaims{}
+	if _, errParse := a.parser.ParseWithClaims(bearer, claims, a.keyfunc); errParse != nil {
+		return nil, errParse
+	}
+
+	return a.grant(claims), nil
+}
+
+func prefixAllowed(prefixes []string, gatewayName string) bool {
+	for _, p := range prefixes {
+		if p == "*" || strings.HasPrefix(gatewayName, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the caller may access gatewayName.
+// A nil grant means authentication is disabled.
+func (g *authGrant) allowed(gatewayName string, write bool) bool {
+	if g == nil {
+		return true
+	}
+	if write {
+		return prefixAllowed(g.write, gatewayName)
+	}
+	return prefixAllowed(g.read, gatewayName)
+}
+
+// authGrantFrom retrieves the grant recorded by middlewareAuth.
+func authGrantFrom(c *gin.Context) *authGrant {
+	g, _ := c.Get(authGrantKey)
+	grant, _ := g.(*authGrant)
+	return grant
+}
+
+// middlewareAuth requires a valid JWT bearer token on every route except
+// /admin, which is protected by ADMIN_TOKEN.
+// Access to a single gateway addressed in the path is checked here;
+// handlers addressing gateways in query or body check the grant themselves.
+func middlewareAuth(app *application) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		const me = "middlewareAuth"
+
+		if strings.HasPrefix(c.FullPath(), "/admin/") {
+			c.Next()
+			return
+		}
+
+		grant, errAuth := app.auth.authenticate(c.GetHeader("Authorization"))
+		if errAuth != nil {
+			zlog.CtxErrorf(c.Request.Context(), "%s: %s %s: %v", me, c.Request.Method, c.Request.URL.Path, errAuth)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gateboard.BodyGetReply{Error: "unauthorized"})
+			return
+		}
+
+		c.Set(authGrantKey, grant)
+
+		if c.FullPath() == pathGateway {
+			name := strings.TrimPrefix(c.Param("gateway_name"), "/")
+			write := c.Request.Method != http.MethodGet
+			switch c.Request.Method {
+			case http.MethodGet:
+				name = strings.TrimSuffix(name, suffixHistory)
+			case http.MethodPost:
+				name = strings.TrimSuffix(name, suffixRollback)
+			}
+			if !grant.allowed(name, write) {
+				zlog.CtxErrorf(c.Request.Context(), "%s: sub=%s %s %s: forbidden",
+					me, grant.subject, c.Request.Method, c.Request.URL.Path)
+				c.AbortWithStatusJSON(http.StatusForbidden, gateboard.BodyGetReply{
+					GatewayName: name,
+					Error:       "forbidden",
+				})
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
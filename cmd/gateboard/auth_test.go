@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+const testAuthRules = `
+- claims:
+    groups: readers
+  read: ["123:"]
+- claims:
+    sub: discovery
+  read: ["*"]
+  write: ["123:"]
+`
+
+// writeTestJWKS saves the public key as a JWKS file.
+func writeTestJWKS(t *testing.T, key *ecdsa.PrivateKey, kid string) string {
+	pub, errPub := key.PublicKey.ECDH()
+	if errPub != nil {
+		t.Fatalf("ecdh: %v", errPub)
+	}
+	point := pub.Bytes() // 0x04 || x || y
+	size := (len(point) - 1) / 2
+	jwks := map[string]any{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": kid,
+			"alg": "ES256",
+			"use": "sig",
+			"x":   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+			"y":   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+		}},
+	}
+	buf, errJSON := json.Marshal(jwks)
+	if errJSON != nil {
+		t.Fatalf("jwks: %v", errJSON)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if errWrite := os.WriteFile(path, buf, 0o600); errWrite != nil {
+		t.Fatalf("jwks: %v", errWrite)
+	}
+	return path
+}
+
+func signTestToken(t *testing.T, key *ecdsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = kid
+	s, errSign := token.SignedString(key)
+	if errSign != nil {
+		t.Fatalf("sign: %v", errSign)
+	}
+	return s
+}
+
+func newTestAppAuth(t *testing.T, jwks, rules string) *application {
+	const me = "gateboard_app_test"
+
+	os.Setenv("REPO_LIST", "testdata/repo_mem.yaml")
+
+	app := &application{
+		me:     me,
+		config: newConfig(me),
+	}
+
+	app.config.authJWKS = jwks
+	app.config.authIssuer = "issuer1"
+	app.config.authAudience = "gateboard"
+	app.config.authClockSkew = time.Minute
+
+	if rules != "" {
+		app.config.authRules = filepath.Join(t.TempDir(), "auth.yaml")
+		if errWrite := os.WriteFile(app.config.authRules, []byte(rules), 0o600); errWrite != nil {
+			t.Fatalf("rules: %v", errWrite)
+		}
+	}
+
+	initApplication(app, ":8080")
+
+	return app
+}
+
+// go test -v -run TestAuth ./cmd/gateboard
+func TestAuth(t *testing.T) {
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		t.Fatalf("key: %v", errKey)
+	}
+	otherKey, errOther := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errOther != nil {
+		t.Fatalf("key: %v", errOther)
+	}
+
+	app := newTestAppAuth(t, writeTestJWKS(t, key, "k1"), testAuthRules)
+
+	for _, name := range []string{"123:gw1", "456:gw2"} {
+		if errPut := repoPutMultiple(context.TODO(), app, name, "id1", "test", repository.AnyChanges); errPut != nil {
+			t.Fatalf("put: %v", errPut)
+		}
+	}
+
+	now := time.Now()
+
+	claims := func(sub string, extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": sub,
+			"iss": "issuer1",
+			"aud": "gateboard",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range extra {
+			c[k] = v
+		}
+		return c
+	}
+
+	reader := signTestToken(t, key, "k1", claims("alice", jwt.MapClaims{"groups": []string{"ops", "readers"}}))
+	discovery := signTestToken(t, key, "k1", claims("discovery", nil))
+	nobody := signTestToken(t, key, "k1", claims("bob", nil))
+
+	table := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		bearer string
+		status int
+	}{
+		{"no token", "GET", "/gateway/123:gw1", "", "", 401},
+		{"garbage token", "GET", "/gateway/123:gw1", "", "garbage", 401},
+		{"foreign key", "GET", "/gateway/123:gw1", "", signTestToken(t, otherKey, "k1", claims("alice", nil)), 401},
+		{"wrong issuer", "GET", "/gateway/123:gw1", "", signTestToken(t, key, "k1", claims("discovery", jwt.MapClaims{"iss": "issuer2"})), 401},
+		{"wrong audience", "GET", "/gateway/123:gw1", "", signTestToken(t, key, "k1", claims("discovery", jwt.MapClaims{"aud": "other"})), 401},
+		{"expired", "GET", "/gateway/123:gw1", "", signTestToken(t, key, "k1", claims("discovery", jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})), 401},
+		{"expired within skew", "GET", "/gateway/123:gw1", "", signTestToken(t, key, "k1", claims("discovery", jwt.MapClaims{"exp": now.Add(-time.Second).Unix()})), 200},
+		{"no expiration", "GET", "/gateway/123:gw1", "", signTestToken(t, key, "k1", jwt.MapClaims{"sub": "discovery", "iss": "issuer1", "aud": "gateboard"}), 401},
+		{"reader get", "GET", "/gateway/123:gw1", "", reader, 200},
+		{"reader history", "GET", "/gateway/123:gw1/history", "", reader, 200},
+		{"reader get other", "GET", "/gateway/456:gw2", "", reader, 403},
+		{"reader put", "PUT", "/gateway/123:gw1", `{"gateway_id":"id2"}`, reader, 403},
+		{"reader delete", "DELETE", "/gateway/123:gw1", "", reader, 403},
+		{"nobody get", "GET", "/gateway/123:gw1", "", nobody, 403},
+		{"discovery get other", "GET", "/gateway/456:gw2", "", discovery, 200},
+		{"discovery put", "PUT", "/gateway/123:gw1", `{"gateway_id":"id2"}`, discovery, 200},
+		{"discovery put other", "PUT", "/gateway/456:gw2", `{"gateway_id":"id2"}`, discovery, 403},
+		{"discovery rollback other", "POST", "/gateway/456:gw2/rollback?to=1", "", discovery, 403},
+		{"admin bypasses jwt", "PUT", "/admin/token/123:gw1", "", "", 403},
+	}
+
+	for _, data := range table {
+		req, errReq := http.NewRequest(data.method, data.path, strings.NewReader(data.body))
+		if errReq != nil {
+			t.Fatalf("%s: NewRequest: %v", data.name, errReq)
+		}
+		if data.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+data.bearer)
+		}
+		w := httptest.NewRecorder()
+		app.serverMain.router.ServeHTTP(w, req)
+		if w.Code != data.status {
+			t.Errorf("%s: %s %s: expected status=%d got=%d: %s",
+				data.name, data.method, data.path, data.status, w.Code, w.Body.String())
+		}
+	}
+
+	// dump hides gateways the caller cannot read
+
+	req, _ := http.NewRequest("GET", "/dump", nil)
+	req.Header.Set("Authorization", "Bearer "+reader)
+	w := httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	if names := dumpNames(t, w); len(names) != 1 || names[0] != "123:gw1" {
+		t.Errorf("dump: expected only 123:gw1, got %v", names)
+	}
+
+	// batch reports forbidden items
+
+	req, _ = http.NewRequest("POST", "/gateways:batchGet", strings.NewReader(`{"gateway_names":["123:gw1","456:gw2"]}`))
+	req.Header.Set("Authorization", "Bearer "+reader)
+	w = httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	var reply gateboard.BodyBatchGetReply
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &reply); errJSON != nil {
+		t.Fatalf("batchGet: json: %v: %s", errJSON, w.Body.String())
+	}
+	if len(reply.Gateways) != 2 || reply.Gateways[0].Status != 200 || reply.Gateways[1].Status != 403 {
+		t.Errorf("batchGet: unexpected reply: %+v", reply)
+	}
+
+	// watch refuses names the caller cannot read
+
+	req, _ = http.NewRequest("GET", "/watch?names=123:gw1,456:gw2", nil)
+	req.Header.Set("Authorization", "Bearer "+reader)
+	w = httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("watch: expected status 403, got %d", w.Code)
+	}
+}
+
+// go test -v -run TestAuthNoRules ./cmd/gateboard
+func TestAuthNoRules(t *testing.T) {
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		t.Fatalf("key: %v", errKey)
+	}
+
+	app := newTestAppAuth(t, writeTestJWKS(t, key, "k1"), "")
+
+	token := signTestToken(t, key, "k1", jwt.MapClaims{
+		"sub": "anyone",
+		"iss": "issuer1",
+		"aud": []string{"other", "gateboard"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	req, _ := http.NewRequest("PUT", "/gateway/gw1", strings.NewReader(`{"gateway_id":"id1"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("without rules any valid token should write: status=%d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// gin would take a colon inside a static route as a path parameter,
+// hence batch paths are matched by a single parameter route.
+const (
+	pathAction   = "/:action"
+	pathBatchGet = "gateways:batchGet"
+	pathBatchPut = "gateways:batchPut"
+)
+
+// gatewayAction routes POST /gateways:batchGet and POST /gateways:batchPut.
+func gatewayAction(c *gin.Context, app *application) {
+	switch action := c.Param("action"); action {
+	case pathBatchGet:
+		gatewayBatchGet(c, app)
+	case pathBatchPut:
+		gatewayBatchPut(c, app)
+	default:
+		c.JSON(http.StatusNotFound, gateboard.BodyBatchPutReply{
+			Error: "gatewayAction: unsupported path: /" + action,
+		})
+	}
+}
+
+// batchRun calls f for every item in 0..size-1 with at most concurrency calls in flight.
+func batchRun(size, concurrency int, f func(i int)) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+
+	for i := range size {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// batchSizeError checks the number of items in a batch request.
+func batchSizeError(app *application, size int) error {
+	if size < 1 {
+		return fmt.Errorf("empty batch")
+	}
+	if size > app.config.batchMaxItems {
+		return fmt.Errorf("batch too large: items=%d BATCH_MAX_ITEMS=%d",
+			size, app.config.batchMaxItems)
+	}
+	return nil
+}
+
+func gatewayBatchGet(c *gin.Context, app *application) {
+	const me = "gatewayBatchGet"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	out := gateboard.BodyBatchGetReply{
+		Gateways: []gateboard.BatchGetItem{},
+		TTL:      app.config.TTL,
+	}
+
+	dec := yaml.NewDecoder(c.Request.Body)
+	var in gateboard.BodyBatchGetRequest
+	if errYaml := dec.Decode(&in); errYaml != nil {
+		out.Error = fmt.Sprintf("%s: body yaml: %v", me, errYaml)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	if errSize := batchSizeError(app, len(in.GatewayNames)); errSize != nil {
+		out.Error = fmt.Sprintf("%s: %v", me, errSize)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	zlog.CtxInfof(ctx, "%s: items=%d", me, len(in.GatewayNames))
+
+	// avoid gin context timeout or cancel to affect repository query
+	const timeout = 5 * time.Second
+	ctx2 := context.WithoutCancel(ctx)
+	ctx2, cancel := context.WithTimeout(ctx2, timeout)
+	defer cancel()
+
+	out.Gateways = make([]gateboard.BatchGetItem, len(in.GatewayNames))
+
+	grant := authGrantFrom(c)
+
+	batchRun(len(in.GatewayNames), app.config.batchConcurrency, func(i int) {
+		out.Gateways[i] = batchGetOne(ctx2, app, grant, in.GatewayNames[i])
+	})
+
+	c.JSON(http.StatusOK, out)
+}
+
+func batchGetOne(ctx context.Context, app *application, grant *authGrant, gatewayName string) gateboard.BatchGetItem {
+	const me = "batchGetOne"
+
+	item := gateboard.BatchGetItem{GatewayName: gatewayName}
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		item.Status = http.StatusBadRequest
+		item.Error = errVal.Error()
+		return item
+	}
+
+	if !grant.allowed(gatewayName, false) {
+		item.Status = http.StatusForbidden
+		item.Error = "forbidden"
+		return item
+	}
+
+	var errID error
+
+	if app.config.groupCache {
+		// cache query
+		var cached cachedGateway
+		cached, _, errID = cacheGet(ctx, app, gatewayName)
+		item.GatewayID = cached.GatewayID
+		item.Changes = cached.Changes
+	} else {
+		// direct query
+		var body gateboard.BodyGetReply
+		body, _, errID = repoGetMultiple(ctx, app, gatewayName)
+		item.GatewayID = body.GatewayID
+		item.Changes = body.Changes
+	}
+
+	switch errID {
+	case nil:
+		item.Status = http.StatusOK
+	case repository.ErrGatewayNotFound:
+		item.Status = http.StatusNotFound
+		item.GatewayID = ""
+		item.Error = fmt.Sprintf("%s: not found: %v", me, errID)
+	default:
+		item.Status = http.StatusInternalServerError
+		item.GatewayID = ""
+		item.Error = fmt.Sprintf("%s: error: %v", me, errID)
+	}
+
+	zlog.CtxDebugf(ctx, app.config.debug || item.Status == http.StatusInternalServerError,
+		"%s: gateway_name=%s status=%d error:%v", me, gatewayName, item.Status, errID)
+
+	return item
+}
+
+func gatewayBatchPut(c *gin.Context, app *application) {
+	const me = "gatewayBatchPut"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	out := gateboard.BodyBatchPutReply{
+		Gateways: []gateboard.BatchPutResult{},
+	}
+
+	dec := yaml.NewDecoder(c.Request.Body)
+	var in gateboard.BodyBatchPutRequest
+	if errYaml := dec.Decode(&in); errYaml != nil {
+		out.Error = fmt.Sprintf("%s: body yaml: %v", me, errYaml)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	if errSize := batchSizeError(app, len(in.Gateways)); errSize != nil {
+		out.Error = fmt.Sprintf("%s: %v", me, errSize)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	zlog.CtxInfof(ctx, "%s: items=%d", me, len(in.Gateways))
+
+	source := sourceHTTP(c)
+
+	grant := authGrantFrom(c)
+
+	out.Gateways = make([]gateboard.BatchPutResult, len(in.Gateways))
+
+	batchRun(len(in.Gateways), app.config.batchConcurrency, func(i int) {
+		out.Gateways[i] = batchPutOne(ctx, app, grant, in.Gateways[i], source)
+	})
+
+	c.JSON(http.StatusOK, out)
+}
+
+func batchPutOne(ctx context.Context, app *application, grant *authGrant, in gateboard.BatchPutItem, source string) gateboard.BatchPutResult {
+	const me = "batchPutOne"
+
+	gatewayName := in.GatewayName
+	gatewayID := strings.TrimSpace(in.GatewayID)
+
+	result := gateboard.BatchPutResult{
+		GatewayName: gatewayName,
+		GatewayID:   gatewayID,
+	}
+
+	fail := func(status int, format string, a ...any) gateboard.BatchPutResult {
+		result.Status = status
+		result.Error = fmt.Sprintf(format, a...)
+		zlog.CtxErrorf(ctx, "%s: gateway_name=%s status=%d: %s",
+			me, gatewayName, status, result.Error)
+		return result
+	}
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		return fail(http.StatusBadRequest, "%v", errVal)
+	}
+
+	if !grant.allowed(gatewayName, true) {
+		return fail(http.StatusForbidden, "forbidden")
+	}
+
+	if gatewayID == "" {
+		return fail(http.StatusBadRequest, "invalid blank gateway_id")
+	}
+
+	expectedChanges := repository.AnyChanges
+	if in.ExpectedChanges != nil {
+		if *in.ExpectedChanges < 0 {
+			return fail(http.StatusBadRequest, "invalid negative expected_changes=%d", *in.ExpectedChanges)
+		}
+		expectedChanges = *in.ExpectedChanges
+	}
+
+	if app.config.writeToken {
+		if invalidToken(ctx, app, gatewayName, in.Token) {
+			return fail(http.StatusUnauthorized, "invalid token")
+		}
+	}
+
+	errPut := repoWriteRetry(ctx, app, nil, me, gatewayName, func() error {
+		return repoPutMultiple(ctx, app, gatewayName, gatewayID, source, expectedChanges)
+	})
+	if errPut == repository.ErrConflict {
+		return fail(http.StatusConflict, "%s: expected_changes=%d: %v", me, expectedChanges, errPut)
+	}
+	if _, partial := errPut.(errWritePolicy); partial {
+		return fail(http.StatusServiceUnavailable, "%v", errPut)
+	}
+	if errPut != nil {
+		return fail(http.StatusInternalServerError, "%v", errPut)
+	}
+
+	gatewayChanged(ctx, app, gatewayName)
+
+	result.Status = http.StatusOK
+
+	return result
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/gateboard"
+)
+
+func sendBatch(t *testing.T, app *application, path, body string, out interface{}) int {
+	req, errReq := http.NewRequest("POST", path, strings.NewReader(body))
+	if errReq != nil {
+		t.Fatalf("NewRequest: %v", errReq)
+	}
+	w := httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	t.Logf("POST %s: status=%d response: %s", path, w.Code, w.Body.String())
+	if errJSON := json.Unmarshal(w.Body.Bytes(), out); errJSON != nil {
+		t.Errorf("POST %s: json error: %v", path, errJSON)
+	}
+	return w.Code
+}
+
+// go test -v -run TestBatch ./cmd/gateboard
+func TestBatch(t *testing.T) {
+	app := newTestApp(false)
+
+	var putReply gateboard.BodyBatchPutReply
+	status := sendBatch(t, app, "/gateways:batchPut",
+		`{"gateways":[
+			{"gateway_name":"gw1","gateway_id":"id1"},
+			{"gateway_name":"gw2","gateway_id":"id2"},
+			{"gateway_name":"gw3","gateway_id":""},
+			{"gateway_name":"gw1","gateway_id":"id3","expected_changes":5}
+		]}`, &putReply)
+	if status != 200 {
+		t.Errorf("batchPut: status=%d", status)
+	}
+
+	expectedPut := []int{200, 200, 400, 409}
+	if len(putReply.Gateways) != len(expectedPut) {
+		t.Fatalf("batchPut: expected %d results, got %d", len(expectedPut), len(putReply.Gateways))
+	}
+	for i, result := range putReply.Gateways {
+		if result.Status != expectedPut[i] {
+			t.Errorf("batchPut: item=%d gateway=%s status=%d expected=%d error=%s",
+				i, result.GatewayName, result.Status, expectedPut[i], result.Error)
+		}
+	}
+
+	var getReply gateboard.BodyBatchGetReply
+	status = sendBatch(t, app, "/gateways:batchGet",
+		`{"gateway_names":["gw1","gw2","gw3",""]}`, &getReply)
+	if status != 200 {
+		t.Errorf("batchGet: status=%d", status)
+	}
+
+	expectedGet := []struct {
+		id     string
+		status int
+	}{
+		{"id1", 200},
+		{"id2", 200},
+		{"", 404},
+		{"", 400},
+	}
+	if len(getReply.Gateways) != len(expectedGet) {
+		t.Fatalf("batchGet: expected %d results, got %d", len(expectedGet), len(getReply.Gateways))
+	}
+	for i, item := range getReply.Gateways {
+		if item.Status != expectedGet[i].status || item.GatewayID != expectedGet[i].id {
+			t.Errorf("batchGet: item=%d gateway=%s id=%s status=%d expected id=%s status=%d",
+				i, item.GatewayName, item.GatewayID, item.Status, expectedGet[i].id, expectedGet[i].status)
+		}
+	}
+	if getReply.TTL != app.config.TTL {
+		t.Errorf("batchGet: TTL=%d expected=%d", getReply.TTL, app.config.TTL)
+	}
+
+	// request-level errors
+
+	if status := sendBatch(t, app, "/gateways:batchGet", `{"gateway_names":[]}`, &getReply); status != 400 {
+		t.Errorf("batchGet empty: status=%d", status)
+	}
+
+	if status := sendBatch(t, app, "/gateways:batchOther", `{}`, &getReply); status != 404 {
+		t.Errorf("unsupported action: status=%d", status)
+	}
+
+	app.config.batchMaxItems = 1
+	if status := sendBatch(t, app, "/gateways:batchGet", `{"gateway_names":["gw1","gw2"]}`, &getReply); status != 400 {
+		t.Errorf("batchGet too large: status=%d", status)
+	}
+}
+
+// go test -v -run TestBatchWriteToken ./cmd/gateboard
+func TestBatchWriteToken(t *testing.T) {
+	app := newTestApp(true)
+	repoPutTokenMultiple(t.Context(), app, "gw1", "good_token")
+
+	var putReply gateboard.BodyBatchPutReply
+	sendBatch(t, app, "/gateways:batchPut",
+		`{"gateways":[
+			{"gateway_name":"gw1","gateway_id":"id1","token":"good_token"},
+			{"gateway_name":"gw1","gateway_id":"id2","token":"bad_token"},
+			{"gateway_name":"gw2","gateway_id":"id2"}
+		]}`, &putReply)
+
+	expectedPut := []int{200, 401, 401}
+	if len(putReply.Gateways) != len(expectedPut) {
+		t.Fatalf("batchPut: expected %d results, got %d", len(expectedPut), len(putReply.Gateways))
+	}
+	for i, result := range putReply.Gateways {
+		if result.Status != expectedPut[i] {
+			t.Errorf("batchPut: item=%d gateway=%s status=%d expected=%d error=%s",
+				i, result.GatewayName, result.Status, expectedPut[i], result.Error)
+		}
+	}
+}
+
+// go test -v -run TestBatchRun ./cmd/gateboard
+func TestBatchRun(t *testing.T) {
+	const size = 50
+	const concurrency = 3
+
+	var lock sync.Mutex
+	var running, maxRunning int
+	done := make([]bool, size)
+
+	batchRun(size, concurrency, func(i int) {
+		lock.Lock()
+		running++
+		maxRunning = max(maxRunning, running)
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		running--
+		done[i] = true
+		lock.Unlock()
+	})
+
+	for i, d := range done {
+		if !d {
+			t.Errorf("item %d not processed", i)
+		}
+	}
+	if maxRunning > concurrency {
+		t.Errorf("concurrency exceeded: max=%d limit=%d", maxRunning, concurrency)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // calls pass through
+	breakerHalfOpen                     // a single probe call passes through
+	breakerOpen                         // calls fail immediately
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+var errRepositoryCircuitOpen = errors.New("repository: circuit breaker open")
+
+// repoBreaker is a circuit breaker wrapping a repository.
+// It opens after BREAKER_FAILURES consecutive failures, failing calls
+// immediately with errRepositoryCircuitOpen. After BREAKER_OPEN_DURATION
+// it half-opens, letting one probe call through: success closes it,
+// failure opens it again.
+// Not found and conflict are proper answers, hence not failures.
+type repoBreaker struct {
+	repository.Repository
+	maxFailures int
+	openFor     time.Duration
+
+	mutex    sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newRepoBreaker(repo repository.Repository, maxFailures int, openFor time.Duration) *repoBreaker {
+	b := &repoBreaker{
+		Repository:  repo,
+		maxFailures: maxFailures,
+		openFor:     openFor,
+	}
+	recordRepositoryCircuit(repo.RepoName(), breakerClosed)
+	return b
+}
+
+// allow reports whether a call may proceed.
+func (b *repoBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openFor {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false // a probe is already in flight
+		}
+		b.probing = true
+		return true
+	}
+
+	return true
+}
+
+// done records the outcome of an allowed call.
+// A call canceled by the caller proves nothing about the repository:
+// it neither counts as failure nor as success, and a canceled probe
+// leaves the circuit half-open for the next one.
+func (b *repoBreaker) done(err error) {
+	canceled := errors.Is(err, context.Canceled)
+	failed := err != nil &&
+		err != repository.ErrGatewayNotFound &&
+		err != repository.ErrConflict &&
+		!canceled
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if canceled {
+		if b.state == breakerHalfOpen {
+			b.probing = false
+		}
+		return
+	}
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.open()
+		} else {
+			b.failures = 0
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	if !failed {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerClosed && b.failures >= b.maxFailures {
+		b.open()
+	}
+}
+
+func (b *repoBreaker) open() {
+	b.openedAt = time.Now()
+	b.setState(breakerOpen)
+}
+
+func (b *repoBreaker) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+	zlog.Infof("repoBreaker: repo=%s circuit %s -> %s (consecutive failures: %d)",
+		b.RepoName(), b.state, s, b.failures)
+	b.state = s
+	recordRepositoryCircuit(b.RepoName(), s)
+}
+
+func (b *repoBreaker) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	if !b.allow() {
+		return gateboard.BodyGetReply{}, errRepositoryCircuitOpen
+	}
+	body, err := b.Repository.Get(ctx, gatewayName)
+	b.done(err)
+	return body, err
+}
+
+func (b *repoBreaker) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	if !b.allow() {
+		return errRepositoryCircuitOpen
+	}
+	err := b.Repository.Put(ctx, gatewayName, gatewayID, source, expectedChanges)
+	b.done(err)
+	return err
+}
+
+func (b *repoBreaker) Delete(ctx context.Context, gatewayName, source string) error {
+	if !b.allow() {
+		return errRepositoryCircuitOpen
+	}
+	err := b.Repository.Delete(ctx, gatewayName, source)
+	b.done(err)
+	return err
+}
+
+func (b *repoBreaker) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	if !b.allow() {
+		return nil, errRepositoryCircuitOpen
+	}
+	list, err := b.Repository.History(ctx, gatewayName)
+	b.done(err)
+	return list, err
+}
+
+func (b *repoBreaker) Purge(ctx context.Context, gatewayName string) error {
+	if !b.allow() {
+		return errRepositoryCircuitOpen
+	}
+	err := b.Repository.Purge(ctx, gatewayName)
+	b.done(err)
+	return err
+}
+
+func (b *repoBreaker) Dump(ctx context.Context, filter repository.DumpFilter) (repository.Dump, error) {
+	if !b.allow() {
+		return nil, errRepositoryCircuitOpen
+	}
+	d, err := b.Repository.Dump(ctx, filter)
+	b.done(err)
+	return d, err
+}
+
+func (b *repoBreaker) PutToken(ctx context.Context, gatewayName, token string) error {
+	if !b.allow() {
+		return errRepositoryCircuitOpen
+	}
+	err := b.Repository.PutToken(ctx, gatewayName, token)
+	b.done(err)
+	return err
+}
+
+func (b *repoBreaker) Close(ctx context.Context) error {
+	if c, ok := b.Repository.(repository.Closer); ok {
+		return c.Close(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// flakyRepo is a mem repository failing get and put while broken.
+// Get also honors context cancelation, as the real backends do.
+type flakyRepo struct {
+	repository.Repository
+	broken bool
+}
+
+func (r *flakyRepo) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	if err := ctx.Err(); err != nil {
+		return gateboard.BodyGetReply{}, err
+	}
+	if r.broken {
+		return gateboard.BodyGetReply{}, errors.New("repo flaky broken")
+	}
+	return r.Repository.Get(ctx, gatewayName)
+}
+
+func (r *flakyRepo) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	if r.broken {
+		return errors.New("repo flaky broken")
+	}
+	return r.Repository.Put(ctx, gatewayName, gatewayID, source, expectedChanges)
+}
+
+// go test -v -run TestRepoBreaker ./cmd/gateboard
+func TestRepoBreaker(t *testing.T) {
+	repo, errRepo := repository.New("test", "", repository.Config{Kind: "mem", Name: "breaker"}, false)
+	if errRepo != nil {
+		t.Fatalf("repo: %v", errRepo)
+	}
+	mem := &flakyRepo{Repository: repo}
+	b := newRepoBreaker(mem, 3, 100*time.Millisecond)
+
+	ctx := context.TODO()
+
+	// not found is a proper answer
+	for range 5 {
+		if _, err := b.Get(ctx, "missing"); err != repository.ErrGatewayNotFound {
+			t.Fatalf("expected not found, got: %v", err)
+		}
+	}
+	if b.state != breakerClosed {
+		t.Fatalf("not found must not open the circuit: state=%s", b.state)
+	}
+
+	mem.broken = true
+
+	for i := range 3 {
+		if err := b.Put(ctx, "gw1", "id1", "test", repository.AnyChanges); err == nil || err == errRepositoryCircuitOpen {
+			t.Fatalf("failure %d: expected repository error, got: %v", i+1, err)
+		}
+	}
+	if b.state != breakerOpen {
+		t.Fatalf("expected open circuit after 3 failures: state=%s", b.state)
+	}
+
+	if _, err := b.Get(ctx, "gw1"); err != errRepositoryCircuitOpen {
+		t.Errorf("open circuit: expected %v, got: %v", errRepositoryCircuitOpen, err)
+	}
+
+	// failed probe opens the circuit again
+
+	time.Sleep(150 * time.Millisecond)
+
+	if _, err := b.Get(ctx, "gw1"); err == nil || err == errRepositoryCircuitOpen {
+		t.Errorf("half-open probe: expected repository error, got: %v", err)
+	}
+	if b.state != breakerOpen {
+		t.Fatalf("expected open circuit after failed probe: state=%s", b.state)
+	}
+
+	// canceled probe keeps the circuit half-open
+
+	mem.broken = false
+
+	time.Sleep(150 * time.Millisecond)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.Get(canceled, "gw1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled probe: expected %v, got: %v", context.Canceled, err)
+	}
+	if b.state != breakerHalfOpen || b.probing {
+		t.Fatalf("expected idle half-open circuit after canceled probe: state=%s probing=%t", b.state, b.probing)
+	}
+
+	// successful probe closes the circuit
+
+	if err := b.Put(ctx, "gw1", "id1", "test", repository.AnyChanges); err != nil {
+		t.Errorf("half-open probe: %v", err)
+	}
+	if b.state != breakerClosed {
+		t.Errorf("expected closed circuit after successful probe: state=%s", b.state)
+	}
+}
+
+// go test -v -run TestRepoBreakerSkipsRepo ./cmd/gateboard
+func TestRepoBreakerSkipsRepo(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_goodnbad.yaml")
+
+	for range app.config.breakerFailures {
+		repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges)
+	}
+
+	b, isBreaker := app.repositories().list[1].(*repoBreaker)
+	if !isBreaker {
+		t.Fatalf("expected repository wrapped by circuit breaker")
+	}
+	if b.state != breakerOpen {
+		t.Errorf("expected broken repository circuit open: state=%s", b.state)
+	}
+
+	begin := time.Now()
+	if err := repoPutMultiple(context.TODO(), app, "gw1", "id2", "test", repository.AnyChanges); err != nil {
+		t.Errorf("put: %v", err)
+	}
+	if elap := time.Since(begin); elap > 50*time.Millisecond {
+		t.Errorf("open circuit should fail fast, took %v", elap)
+	}
+}
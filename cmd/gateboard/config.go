@@ -5,6 +5,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/udhos/boilerplate/envconfig"
 	"github.com/udhos/gateboard/gateboard"
 )
 
@@ -20,11 +21,25 @@ type appConfig struct {
 	TTL                       int
 	repoList                  string
 	repoTimeout               time.Duration
+	readPolicy                string
+	readHedgeDelay            time.Duration
+	readFreshestQuorum        bool
+	breakerFailures           int
+	breakerOpenDuration       time.Duration
+	repoReloadWatch           bool
+	repoCloseDelay            time.Duration
+	repoChangeFeed            bool
 	applicationAddr           string
+	applicationTLS            tlsListenerConfig
 	healthAddr                string
 	healthPath                string
+	healthTLS                 tlsListenerConfig
+	readyPath                 string
+	readyPolicy               string
+	readyTimeout              time.Duration
 	metricsAddr               string
 	metricsPath               string
+	metricsTLS                tlsListenerConfig
 	metricsMaskPath           bool
 	metricsNamespace          string
 	metricsBucketsLatencyHTTP []float64
@@ -37,8 +52,24 @@ type appConfig struct {
 	otelTraceEnable           bool
 	writeRetry                int
 	writeRetryInterval        time.Duration
+	writePolicy               string
 	writeToken                bool
+	tombstoneTTL              time.Duration
+	tombstonePurgeInterval    time.Duration
+	repairInterval            time.Duration
+	batchMaxItems             int
+	batchConcurrency          int
+	watchMaxWait              time.Duration
+	watchPollInterval         time.Duration
 	tokens                    string
+	tokenHashKey              string
+	tokenRotationGrace        time.Duration
+	adminToken                string
+	authJWKS                  string
+	authIssuer                string
+	authAudience              string
+	authClockSkew             time.Duration
+	authRules                 string
 	groupCache                bool
 	groupCachePort            string
 	groupCacheExpire          time.Duration
@@ -63,11 +94,25 @@ func newConfig(roleSessionName string) appConfig {
 		TTL:                       env.Int("TTL", 300), // seconds
 		repoList:                  env.String("REPO_LIST", "repo.yaml"),
 		repoTimeout:               env.Duration("REPO_TIMEOUT", 15*time.Second),
+		readPolicy:                env.String("READ_POLICY", "fastest"), // fastest, ordered, freshest
+		readHedgeDelay:            env.Duration("READ_HEDGE_DELAY", 50*time.Millisecond),
+		readFreshestQuorum:        env.Bool("READ_FRESHEST_QUORUM", false), // freshest waits for a majority rather than all repositories
+		breakerFailures:           env.Int("BREAKER_FAILURES", 5),          // consecutive failures to open a repository circuit, 0 disables the breaker
+		breakerOpenDuration:       env.Duration("BREAKER_OPEN_DURATION", 30*time.Second),
+		repoReloadWatch:           env.Bool("REPO_RELOAD_WATCH", true),              // reload REPO_LIST on change, SIGHUP always reloads
+		repoCloseDelay:            env.Duration("REPO_CLOSE_DELAY", 30*time.Second), // removed repositories are closed after this delay
+		repoChangeFeed:            env.Bool("REPO_CHANGE_FEED", true),               // notify watchers of changes reported by repositories (etcd, consul, kubernetes)
 		applicationAddr:           env.String("LISTEN_ADDR", ":8080"),
+		applicationTLS:            envTLS(env, "LISTEN"),
 		healthAddr:                env.String("HEALTH_ADDR", ":8888"),
 		healthPath:                env.String("HEALTH_PATH", "/health"),
+		healthTLS:                 envTLS(env, "HEALTH"),
+		readyPath:                 env.String("READY_PATH", "/ready"),
+		readyPolicy:               env.String("READY_POLICY", "all"), // any, all, quorum: how many repositories down make the pod not ready
+		readyTimeout:              env.Duration("READY_TIMEOUT", 3*time.Second),
 		metricsAddr:               env.String("METRICS_ADDR", ":3000"),
 		metricsPath:               env.String("METRICS_PATH", "/metrics"),
+		metricsTLS:                envTLS(env, "METRICS"),
 		metricsMaskPath:           env.Bool("METRICS_MASK_PATH", true),
 		metricsNamespace:          env.String("METRICS_NAMESPACE", ""),
 		metricsBucketsLatencyHTTP: env.Float64Slice("METRICS_BUCKETS_LATENCY_HTTP", []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5, 10}),
@@ -80,8 +125,24 @@ func newConfig(roleSessionName string) appConfig {
 		otelTraceEnable:           env.Bool("OTEL_TRACE_ENABLE", true),
 		writeRetry:                env.Int("WRITE_RETRY", 3),
 		writeRetryInterval:        env.Duration("WRITE_RETRY_INTERVAL", 1*time.Second),
-		writeToken:                env.Bool("WRITE_TOKEN", false), // require write token in PUT payload
-		tokens:                    env.String("TOKENS", ""),       // preload write tokens from this file "tokens.yaml"
+		writePolicy:               env.String("WRITE_POLICY", "any"), // any, all, quorum, min:N: how many repositories must accept a write
+		writeToken:                env.Bool("WRITE_TOKEN", false),    // require write token in PUT payload
+		tokens:                    env.String("TOKENS", ""),          // preload write tokens from this file "tokens.yaml"
+		tokenHashKey:              env.String("TOKEN_HASH_KEY", ""),  // required by WRITE_TOKEN, TOKENS, ADMIN_TOKEN; changing the key invalidates stored tokens
+		tokenRotationGrace:        env.Duration("TOKEN_ROTATION_GRACE", time.Hour),
+		adminToken:                env.String("ADMIN_TOKEN", ""), // bearer token for /admin endpoints, empty disables them
+		authJWKS:                  env.String("AUTH_JWKS", ""),   // JWKS file or URL, empty disables JWT authentication
+		authIssuer:                env.String("AUTH_ISSUER", ""),
+		authAudience:              env.String("AUTH_AUDIENCE", ""),
+		authClockSkew:             env.Duration("AUTH_CLOCK_SKEW", 30*time.Second),
+		authRules:                 env.String("AUTH_RULES", ""), // rules file "auth.yaml", empty grants full access to any valid token
+		tombstoneTTL:              env.Duration("TOMBSTONE_TTL", 168*time.Hour),
+		tombstonePurgeInterval:    env.Duration("TOMBSTONE_PURGE_INTERVAL", time.Hour), // 0 disables purging
+		repairInterval:            env.Duration("REPAIR_INTERVAL", time.Hour),          // 0 disables periodic repair between repositories
+		batchMaxItems:             env.Int("BATCH_MAX_ITEMS", 1000),
+		batchConcurrency:          env.Int("BATCH_CONCURRENCY", 10), // max items processed concurrently per batch request
+		watchMaxWait:              env.Duration("WATCH_MAX_WAIT", time.Minute),
+		watchPollInterval:         env.Duration("WATCH_POLL_INTERVAL", 10*time.Second), // 0 disables polling, watchers then see only changes made by this instance
 		groupCache:                env.Bool("GROUP_CACHE", false),
 		groupCachePort:            env.String("GROUP_CACHE_PORT", ":5000"),
 		groupCacheExpire:          env.Duration("GROUP_CACHE_EXPIRE", 180*time.Second),
@@ -91,6 +152,16 @@ func newConfig(roleSessionName string) appConfig {
 	}
 }
 
+// envTLS extracts TLS options for a listener from env vars PREFIX_TLS_*.
+func envTLS(env *envconfig.Env, prefix string) tlsListenerConfig {
+	return tlsListenerConfig{
+		certFile:     env.String(prefix+"_TLS_CERT", ""), // empty disables TLS
+		keyFile:      env.String(prefix+"_TLS_KEY", ""),
+		clientCAFile: env.String(prefix+"_TLS_CLIENT_CA", ""), // enables mutual TLS
+		minVersion:   env.String(prefix+"_TLS_MIN_VERSION", "1.2"),
+	}
+}
+
 // envString extracts string from env var.
 // It returns the provided defaultValue if the env var is empty.
 // The string returned is also recorded in logs.
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/modernprogram/groupcache/v2"
 	"gopkg.in/yaml.v3"
 )
 
@@ -38,6 +39,28 @@ var testTable = []testCase{
 	{"GET non-existing gateway url-like", "GET", "/gateway/http://a:5555/b/c", "", 404, expectAnyID},
 	{"PUT gateway url-like", "PUT", "/gateway/http://a:5555/b/c", `{"gateway_id":"id1"}`, 200, "id1"},
 	{"GET existing gateway url-like", "GET", "/gateway/http://a:5555/b/c", "", 200, "id1"},
+	{"DELETE empty gateway", "DELETE", "/gateway/", "", 400, expectAnyID},
+	{"DELETE gateway", "DELETE", "/gateway/gw1", "", 200, expectAnyID},
+	{"GET deleted gateway", "GET", "/gateway/gw1", "", 404, expectAnyID},
+	{"DELETE deleted gateway", "DELETE", "/gateway/gw1", "", 200, expectAnyID},
+	{"PUT deleted gateway", "PUT", "/gateway/gw1", `{"gateway_id":"id3"}`, 200, "id3"},
+	{"GET recreated gateway", "GET", "/gateway/gw1", "", 200, "id3"},
+	{"GET history", "GET", "/gateway/gw1/history", "", 200, expectAnyID},
+	{"GET history non-existing gateway", "GET", "/gateway/gw2/history", "", 404, expectAnyID},
+	{"GET history url-like", "GET", "/gateway/http://a:5555/b/c/history", "", 200, expectAnyID},
+	{"POST rollback", "POST", "/gateway/gw1/rollback?to=1", "", 200, "id1"},
+	{"GET rolled back gateway", "GET", "/gateway/gw1", "", 200, "id1"},
+	{"POST rollback to deletion", "POST", "/gateway/gw1/rollback?to=4", "", 400, expectAnyID},
+	{"POST rollback to missing change", "POST", "/gateway/gw1/rollback?to=100", "", 404, expectAnyID},
+	{"POST rollback bad change", "POST", "/gateway/gw1/rollback?to=x", "", 400, expectAnyID},
+	{"POST rollback url-like", "POST", "/gateway/http://a:5555/b/c/rollback?to=1", "", 200, "id1"},
+	{"POST unsupported path", "POST", "/gateway/gw1", "", 404, expectAnyID},
+	{"PUT create-only gateway", "PUT", "/gateway/gw3", `{"gateway_id":"id1","expected_changes":0}`, 200, "id1"},
+	{"PUT create-only existing gateway", "PUT", "/gateway/gw3", `{"gateway_id":"id2","expected_changes":0}`, 409, "id2"},
+	{"PUT compare-and-swap", "PUT", "/gateway/gw3", `{"gateway_id":"id2","expected_changes":1}`, 200, "id2"},
+	{"PUT compare-and-swap stale", "PUT", "/gateway/gw3", `{"gateway_id":"id3","expected_changes":1}`, 409, "id3"},
+	{"GET swapped gateway", "GET", "/gateway/gw3", "", 200, "id2"},
+	{"PUT negative expected_changes", "PUT", "/gateway/gw3", `{"gateway_id":"id3","expected_changes":-1}`, 400, "id3"},
 }
 
 var testWriteTokenNoToken = []testCase{
@@ -55,6 +78,9 @@ var testWriteTokenNoToken = []testCase{
 	{"bad token 2: PUT update gateway", "PUT", "/gateway/gw1", `{"gateway_id":"id2","token":"BAD_TOKEN"}`, 401, "id2"},
 	{"bad token 3: PUT update gateway 2", "PUT", "/gateway/gw1", `{"gateway_id":"id2","token":"BAD_TOKEN"}`, 401, "id2"},
 	{"bad token 4: PUT gateway url-like", "PUT", "/gateway/http://a:5555/b/c", `{"gateway_id":"id1","token":"BAD_TOKEN"}`, 401, "id1"},
+
+	{"missing token 5: DELETE gateway", "DELETE", "/gateway/gw1", "", 401, expectAnyID},
+	{"bad token 5: DELETE gateway", "DELETE", "/gateway/gw1", `{"token":"BAD_TOKEN"}`, 401, expectAnyID},
 }
 
 var testWriteTokenWithToken = []testCase{
@@ -72,6 +98,15 @@ var testWriteTokenWithToken = []testCase{
 	{"good token 2: PUT update gateway", "PUT", "/gateway/gw1", `{"gateway_id":"id2","token":"good_token"}`, 200, "id2"},
 	{"good token 3: PUT update gateway 2", "PUT", "/gateway/gw1", `{"gateway_id":"id2","token":"good_token"}`, 200, "id2"},
 	{"good token 4: PUT gateway url-like", "PUT", "/gateway/http://a:5555/b/c", `{"gateway_id":"id1","token":"good_token"}`, 200, "id1"},
+
+	{"missing token 5: DELETE gateway", "DELETE", "/gateway/gw1", "", 401, expectAnyID},
+	{"bad token 5: DELETE gateway", "DELETE", "/gateway/gw1", `{"token":"BAD_TOKEN"}`, 401, expectAnyID},
+	{"good token 5: DELETE gateway", "DELETE", "/gateway/gw1", `{"token":"good_token"}`, 200, expectAnyID},
+	{"good token 6: GET deleted gateway", "GET", "/gateway/gw1", "", 404, expectAnyID},
+	{"good token 7: PUT deleted gateway", "PUT", "/gateway/gw1", `{"gateway_id":"id3","token":"good_token"}`, 200, "id3"},
+
+	{"missing token 8: POST rollback", "POST", "/gateway/gw1/rollback?to=1", "", 401, expectAnyID},
+	{"good token 8: POST rollback", "POST", "/gateway/gw1/rollback?to=1", `{"token":"good_token"}`, 200, "id1"},
 }
 
 // go test -v -run TestController ./cmd/gateboard
@@ -84,6 +119,108 @@ func TestController(t *testing.T) {
 	testController(t, app, testWriteTokenWithToken)
 }
 
+// go test -v -run TestControllerIfMatch ./cmd/gateboard
+func TestControllerIfMatch(t *testing.T) {
+	app := newTestApp(false)
+
+	send := func(method, path, body, ifMatch string) *httptest.ResponseRecorder {
+		req, errReq := http.NewRequest(method, path, strings.NewReader(body))
+		if errReq != nil {
+			t.Fatalf("NewRequest: %v", errReq)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		app.serverMain.router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("PUT", "/gateway/gw1", `{"gateway_id":"id1"}`, ""); w.Code != 200 {
+		t.Fatalf("PUT: status=%d", w.Code)
+	}
+
+	etag := send("GET", "/gateway/gw1", "", "").Header().Get("ETag")
+	if etag != `"1"` {
+		t.Errorf("GET: unexpected ETag: %s", etag)
+	}
+
+	table := []struct {
+		name           string
+		ifMatch        string
+		expectedStatus int
+	}{
+		{"matching etag", etag, 200},
+		{"stale etag", etag, 409},
+		{"bare changes", "2", 200},
+		{"weak etag", `W/"3"`, 200},
+		{"any", "*", 200},
+		{"bad header", "abc", 400},
+	}
+
+	for _, data := range table {
+		w := send("PUT", "/gateway/gw1", `{"gateway_id":"id2"}`, data.ifMatch)
+		if w.Code != data.expectedStatus {
+			t.Errorf("%s: If-Match=%s status=%d expectedStatus=%d response=%s",
+				data.name, data.ifMatch, w.Code, data.expectedStatus, w.Body.String())
+		}
+	}
+
+	// body field takes precedence over header
+	if w := send("PUT", "/gateway/gw1", `{"gateway_id":"id3","expected_changes":5}`, `"0"`); w.Code != 200 {
+		t.Errorf("expected_changes precedence: status=%d response=%s", w.Code, w.Body.String())
+	}
+}
+
+// go test -v -run TestControllerIfMatchGroupCache ./cmd/gateboard
+func TestControllerIfMatchGroupCache(t *testing.T) {
+	app := newTestApp(false)
+	app.config.groupCache = true
+	app.cache = newGatewayCache(app, groupcache.NewWorkspace())
+
+	send := func(method, path, body, ifMatch string) *httptest.ResponseRecorder {
+		req, errReq := http.NewRequest(method, path, strings.NewReader(body))
+		if errReq != nil {
+			t.Fatalf("NewRequest: %v", errReq)
+		}
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		app.serverMain.router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, id := range []string{"id1", "id2"} {
+		if w := send("PUT", "/gateway/gw1", `{"gateway_id":"`+id+`"}`, ""); w.Code != 200 {
+			t.Fatalf("PUT: status=%d", w.Code)
+		}
+	}
+
+	// first GET fills the cache, second GET is served from it
+	for i := range 2 {
+		w := send("GET", "/gateway/gw1", "", "")
+		if etag := w.Header().Get("ETag"); etag != `"2"` {
+			t.Errorf("GET %d: unexpected ETag: %s", i, etag)
+		}
+		if !strings.Contains(w.Body.String(), `"id2"`) {
+			t.Errorf("GET %d: unexpected body: %s", i, w.Body.String())
+		}
+	}
+
+	if w := send("PUT", "/gateway/gw1", `{"gateway_id":"id3"}`, `"1"`); w.Code != 409 {
+		t.Errorf("stale etag: status=%d response=%s", w.Code, w.Body.String())
+	}
+	if w := send("PUT", "/gateway/gw1", `{"gateway_id":"id3"}`, `"2"`); w.Code != 200 {
+		t.Errorf("matching etag: status=%d response=%s", w.Code, w.Body.String())
+	}
+
+	// write evicts the cached entry
+	if etag := send("GET", "/gateway/gw1", "", "").Header().Get("ETag"); etag != `"3"` {
+		t.Errorf("GET after write: unexpected ETag: %s", etag)
+	}
+}
+
 func testController(t *testing.T, app *application, table []testCase) {
 	for _, data := range table {
 
@@ -107,7 +244,7 @@ func testController(t *testing.T, app *application, table []testCase) {
 		}
 
 		if data.expectedID != expectAnyID {
-			response := map[string]string{}
+			response := map[string]any{}
 			errYaml := yaml.Unmarshal(w.Body.Bytes(), &response)
 			if errYaml != nil {
 				t.Errorf("%s: ERROR %s %s body='%s' status=%d responseBody='%v' yaml error: %v",
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+// headerDumpNext carries the cursor for the next page of GET /dump.
+// It is absent on the last page.
+const headerDumpNext = "X-Dump-Next"
+
+type dumpQuery struct {
+	filter repository.DumpFilter // filter.Limit 0 means unlimited, filter.After is the decoded cursor
+	ndjson bool
+}
+
+// parseDumpQuery parses GET /dump?prefix=&account=&region=&updated_since=&limit=&next=&format=ndjson
+func parseDumpQuery(c *gin.Context) (dumpQuery, error) {
+	q := dumpQuery{
+		filter: repository.DumpFilter{
+			Prefix:  c.Query("prefix"),
+			Account: c.Query("account"),
+			Region:  c.Query("region"),
+		},
+	}
+
+	if str := c.Query("updated_since"); str != "" {
+		t, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return q, fmt.Errorf("bad query parameter updated_since='%s': %v", str, err)
+		}
+		q.filter.UpdatedSince = t
+	}
+
+	if str := c.Query("limit"); str != "" {
+		limit, err := strconv.Atoi(str)
+		if err != nil || limit < 0 {
+			return q, fmt.Errorf("bad query parameter limit='%s'", str)
+		}
+		q.filter.Limit = limit
+	}
+
+	if str := c.Query("next"); str != "" {
+		after, err := base64.RawURLEncoding.DecodeString(str)
+		if err != nil || len(after) == 0 {
+			return q, fmt.Errorf("bad query parameter next='%s'", str)
+		}
+		q.filter.After = string(after)
+	}
+
+	switch format := c.Query("format"); format {
+	case "":
+		q.ndjson = strings.Contains(c.GetHeader("Accept"), "application/x-ndjson")
+	case "json":
+	case "ndjson":
+		q.ndjson = true
+	default:
+		return q, fmt.Errorf("bad query parameter format='%s'", format)
+	}
+
+	return q, nil
+}
+
+// encodeDumpNext encodes the cursor for the page following gateway name last.
+func encodeDumpNext(last string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(last))
+}
+
+// dumpWriter writes dump entries to the response as they arrive.
+// The status and content type are sent along with the first entry,
+// so errors found before it can still be reported as error responses.
+type dumpWriter struct {
+	c       *gin.Context
+	ndjson  bool
+	started bool
+}
+
+func (w *dumpWriter) start() {
+	w.started = true
+	if w.ndjson {
+		w.c.Header("Content-Type", "application/x-ndjson")
+	} else {
+		w.c.Header("Content-Type", "application/json; charset=utf-8")
+	}
+	w.c.Status(http.StatusOK)
+}
+
+func (w *dumpWriter) write(item map[string]interface{}) error {
+	buf, errJSON := json.Marshal(item)
+	if errJSON != nil {
+		return errJSON
+	}
+
+	var prefix string
+	if !w.started {
+		w.start()
+		if !w.ndjson {
+			prefix = "["
+		}
+	} else if !w.ndjson {
+		prefix = ","
+	}
+
+	if _, err := io.WriteString(w.c.Writer, prefix); err != nil {
+		return err
+	}
+	if _, err := w.c.Writer.Write(buf); err != nil {
+		return err
+	}
+	if w.ndjson {
+		if _, err := io.WriteString(w.c.Writer, "\n"); err != nil {
+			return err
+		}
+		w.c.Writer.Flush()
+	}
+
+	return nil
+}
+
+// close terminates a complete dump, which may have no entries at all.
+func (w *dumpWriter) close() {
+	switch {
+	case w.ndjson:
+		if !w.started {
+			w.start()
+		}
+	case !w.started:
+		w.start()
+		io.WriteString(w.c.Writer, "[]")
+	default:
+		io.WriteString(w.c.Writer, "]")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+func getDump(t *testing.T, app *application, query url.Values, accept string) *httptest.ResponseRecorder {
+	path := "/dump?" + query.Encode()
+	req, errReq := http.NewRequest("GET", path, nil)
+	if errReq != nil {
+		t.Fatalf("NewRequest: %v", errReq)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	t.Logf("GET %s: status=%d next=%s", path, w.Code, w.Header().Get(headerDumpNext))
+	return w
+}
+
+func dumpNames(t *testing.T, w *httptest.ResponseRecorder) []string {
+	var dump []map[string]interface{}
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &dump); errJSON != nil {
+		t.Fatalf("json error: %v: %s", errJSON, w.Body.String())
+	}
+	var names []string
+	for _, item := range dump {
+		names = append(names, item["gateway_name"].(string))
+	}
+	return names
+}
+
+// go test -v -run TestGatewayDump ./cmd/gateboard
+func TestGatewayDump(t *testing.T) {
+	app := newTestApp(false)
+
+	for _, name := range []string{
+		"123:us-east-1:gw1",
+		"123:us-east-1:gw2",
+		"123:sa-east-1:gw3",
+		"456:us-east-1:gw4",
+		"gw5",
+	} {
+		if errPut := repoPutMultiple(context.TODO(), app, name, "id", "test", repository.AnyChanges); errPut != nil {
+			t.Fatalf("put %s: %v", name, errPut)
+		}
+	}
+
+	if errDelete := repoDeleteMultiple(context.TODO(), app, "gw5", "test"); errDelete != nil {
+		t.Fatalf("delete: %v", errDelete)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+
+	table := []struct {
+		name     string
+		query    url.Values
+		status   int
+		expected []string
+	}{
+		{"all", url.Values{}, 200, []string{"123:sa-east-1:gw3", "123:us-east-1:gw1", "123:us-east-1:gw2", "456:us-east-1:gw4"}},
+		{"prefix", url.Values{"prefix": {"123:us"}}, 200, []string{"123:us-east-1:gw1", "123:us-east-1:gw2"}},
+		{"account", url.Values{"account": {"123"}}, 200, []string{"123:sa-east-1:gw3", "123:us-east-1:gw1", "123:us-east-1:gw2"}},
+		{"region", url.Values{"region": {"us-east-1"}}, 200, []string{"123:us-east-1:gw1", "123:us-east-1:gw2", "456:us-east-1:gw4"}},
+		{"account and region", url.Values{"account": {"456"}, "region": {"us-east-1"}}, 200, []string{"456:us-east-1:gw4"}},
+		{"updated in the future", url.Values{"updated_since": {future}}, 200, []string{}},
+		{"bad updated_since", url.Values{"updated_since": {"yesterday"}}, 400, nil},
+		{"bad limit", url.Values{"limit": {"-1"}}, 400, nil},
+		{"bad next", url.Values{"next": {"!"}}, 400, nil},
+		{"bad format", url.Values{"format": {"xml"}}, 400, nil},
+	}
+
+	for _, data := range table {
+		t.Run(data.name, func(t *testing.T) {
+			w := getDump(t, app, data.query, "")
+			if w.Code != data.status {
+				t.Fatalf("expected status=%d got=%d: %s", data.status, w.Code, w.Body.String())
+			}
+			if data.status != 200 {
+				return
+			}
+			names := dumpNames(t, w)
+			if len(names) != len(data.expected) {
+				t.Fatalf("expected %v got %v", data.expected, names)
+			}
+			for i := range names {
+				if names[i] != data.expected[i] {
+					t.Errorf("expected %v got %v", data.expected, names)
+				}
+			}
+		})
+	}
+
+	// pagination
+
+	var pages [][]string
+	query := url.Values{"limit": {"3"}}
+	for {
+		w := getDump(t, app, query, "")
+		if w.Code != 200 {
+			t.Fatalf("pagination: status=%d: %s", w.Code, w.Body.String())
+		}
+		pages = append(pages, dumpNames(t, w))
+		next := w.Header().Get(headerDumpNext)
+		if next == "" {
+			break
+		}
+		query.Set("next", next)
+	}
+	if len(pages) != 2 || len(pages[0]) != 3 || len(pages[1]) != 1 || pages[1][0] != "456:us-east-1:gw4" {
+		t.Errorf("pagination: unexpected pages: %v", pages)
+	}
+
+	// ndjson
+
+	for _, accept := range []string{"", "application/x-ndjson"} {
+		query := url.Values{"region": {"us-east-1"}}
+		if accept == "" {
+			query.Set("format", "ndjson")
+		}
+		w := getDump(t, app, query, accept)
+		if w.Code != 200 {
+			t.Fatalf("ndjson: status=%d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("ndjson: unexpected content-type: %s", ct)
+		}
+		var lines int
+		scanner := bufio.NewScanner(w.Body)
+		for scanner.Scan() {
+			var item map[string]interface{}
+			if errJSON := json.Unmarshal(scanner.Bytes(), &item); errJSON != nil {
+				t.Errorf("ndjson: line %d: %v", lines, errJSON)
+			}
+			lines++
+		}
+		if lines != 3 {
+			t.Errorf("ndjson: expected 3 lines, got %d", lines)
+		}
+	}
+}
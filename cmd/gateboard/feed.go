@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+// repoWatcher is implemented by repositories able to report changes
+// performed by any server instance, not just this one.
+type repoWatcher interface {
+	// WatchChanges calls changed for every gateway written or removed,
+	// until ctx is canceled or the watch fails.
+	WatchChanges(ctx context.Context, changed func(gatewayName string)) error
+}
+
+// repoFeedRetry is the pause before restarting a failed watch.
+const repoFeedRetry = 5 * time.Second
+
+// asRepoWatcher looks through the circuit breaker for a repoWatcher.
+func asRepoWatcher(r repository.Repository) (repoWatcher, bool) {
+	if b, isBreaker := r.(*repoBreaker); isBreaker {
+		r = b.Repository
+	}
+	w, ok := r.(repoWatcher)
+	return w, ok
+}
+
+// syncRepoFeeds starts change feeds for repositories in set supporting them,
+// and stops feeds for repositories no longer in set. Feeds of repositories
+// kept across reloads keep running. It does nothing unless REPO_CHANGE_FEED
+// is enabled. Must be called with app.reposMutex held.
+func syncRepoFeeds(app *application, set *repoSet) {
+	if app.feeds == nil {
+		return
+	}
+
+	current := map[repository.Repository]bool{}
+
+	for _, r := range set.list {
+		current[r] = true
+		if _, running := app.feeds[r]; running {
+			continue
+		}
+		w, ok := asRepoWatcher(r)
+		if !ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		app.feeds[r] = cancel
+		go runRepoFeed(ctx, app, w, r.RepoName())
+	}
+
+	for r, cancel := range app.feeds {
+		if !current[r] {
+			cancel()
+			delete(app.feeds, r)
+		}
+	}
+}
+
+// runRepoFeed forwards changes reported by w to gatewayChanged,
+// restarting the watch on failure.
+func runRepoFeed(ctx context.Context, app *application, w repoWatcher, repoName string) {
+	const me = "runRepoFeed"
+
+	zlog.Infof("%s: repo=%s: change feed started", me, repoName)
+
+	changed := func(gatewayName string) {
+		zlog.Debugf(app.config.debug, "%s: repo=%s: changed: %s", me, repoName, gatewayName)
+		gatewayChanged(ctx, app, gatewayName)
+	}
+
+	for {
+		err := w.WatchChanges(ctx, changed)
+		if ctx.Err() != nil {
+			zlog.Infof("%s: repo=%s: change feed stopped", me, repoName)
+			return
+		}
+		zlog.Errorf("%s: repo=%s: watch: %v (restarting in %v)", me, repoName, err, repoFeedRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(repoFeedRetry):
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+// watchedRepo is a mem repository reporting changes pushed into its channel.
+type watchedRepo struct {
+	repository.Repository
+	changes chan string
+	stopped chan struct{}
+}
+
+func (r *watchedRepo) WatchChanges(ctx context.Context, changed func(gatewayName string)) error {
+	for {
+		select {
+		case name := <-r.changes:
+			changed(name)
+		case <-ctx.Done():
+			close(r.stopped)
+			return ctx.Err()
+		}
+	}
+}
+
+// go test -v -run TestRepoFeed ./cmd/gateboard
+func TestRepoFeed(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+
+	mem, errRepo := repository.New("test", "", repository.Config{Kind: "mem", Name: "watched"}, false)
+	if errRepo != nil {
+		t.Fatalf("repo: %v", errRepo)
+	}
+
+	watched := &watchedRepo{
+		Repository: mem,
+		changes:    make(chan string),
+		stopped:    make(chan struct{}),
+	}
+
+	// feed must be found behind the circuit breaker
+	set := &repoSet{list: []repository.Repository{newRepoBreaker(watched, 5, time.Second)}}
+
+	app.feeds = map[repository.Repository]context.CancelFunc{}
+	syncRepoFeeds(app, set)
+	if len(app.feeds) != 1 {
+		t.Fatalf("expected 1 running feed, got %d", len(app.feeds))
+	}
+
+	ch := app.watch.subscribe([]string{"gw1"})
+	defer app.watch.unsubscribe(ch, []string{"gw1"})
+
+	watched.changes <- "gw1" // change performed by another instance
+
+	select {
+	case name := <-ch:
+		if name != "gw1" {
+			t.Errorf("expected notification for gw1, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("missing notification from repository feed")
+	}
+
+	// repository removed by reload
+
+	syncRepoFeeds(app, &repoSet{})
+	if len(app.feeds) != 0 {
+		t.Errorf("expected no running feed, got %d", len(app.feeds))
+	}
+
+	select {
+	case <-watched.stopped:
+	case <-time.After(time.Second):
+		t.Errorf("feed of removed repository not stopped")
+	}
+}
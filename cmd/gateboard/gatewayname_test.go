@@ -36,6 +36,17 @@ var gatewayNameTestTable = []gatewayNameTestCase{
 	{"}ab{", "}ab{", expectError},
 	{"all invalid chars", " {}$", expectError},
 	{"some valid chars", ",:/a3-_[]", expectOk},
+	{"history suffix", "abc/history", expectError},
+	{"rollback suffix", "abc/rollback", expectError},
+	{"history inside", "abc/history/def", expectOk},
+	{"history no slash", "abchistory", expectOk},
+	{"s3 index", ".index", expectError},
+	{"s3 index leading slash", "/.index", expectError},
+	{"s3 index dot dot", "a/../.index", expectError},
+	{"s3 index prefix", ".indexes", expectOk},
+	{"s3 history", ".history/gw1/00000000000000000001", expectError},
+	{"s3 history dir", ".history", expectError},
+	{"s3 history inside", "a/.history/gw1", expectOk},
 }
 
 func TestGatewayName(t *testing.T) {
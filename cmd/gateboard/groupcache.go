@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"log"
 	"net/http"
 	"time"
@@ -83,35 +84,7 @@ func startGroupcache(app *application) func() {
 	// create cache
 	//
 
-	// https://talks.golang.org/2013/oscon-dl.slide#46
-	//
-	// 64 MB max per-node memory usage
-
-	getter := groupcache.GetterFunc(
-		func(ctx context.Context, gatewayName string, dest groupcache.Sink,
-			_ *groupcache.Info) error {
-
-			out, _, errID := repoGetMultiple(ctx, app, gatewayName)
-			if errID != nil {
-				return errID
-			}
-
-			var expire time.Time // zero value for expire means no expiration
-			if app.config.groupCacheExpire != 0 {
-				expire = time.Now().Add(app.config.groupCacheExpire)
-			}
-
-			return dest.SetString(out.GatewayID, expire)
-		})
-
-	cacheOptions := groupcache.Options{
-		Workspace:       workspace,
-		Name:            "gateways",
-		CacheBytesLimit: app.config.groupCacheSizeBytes,
-		Getter:          getter,
-	}
-
-	app.cache = groupcache.NewGroupWithWorkspace(cacheOptions)
+	app.cache = newGatewayCache(app, workspace)
 
 	//
 	// expose prometheus metrics for groupcache
@@ -156,3 +129,64 @@ func startGroupcache(app *application) func() {
 		closeExporterDogstatsd()
 	}
 }
+
+// cachedGateway is the value held by the gateway cache. changes is kept
+// so that replies served from the cache carry the ETag for compare-and-swap.
+type cachedGateway struct {
+	GatewayID string `json:"gateway_id"`
+	Changes   int64  `json:"changes"`
+}
+
+func newGatewayCache(app *application, workspace *groupcache.Workspace) *groupcache.Group {
+
+	// https://talks.golang.org/2013/oscon-dl.slide#46
+	//
+	// 64 MB max per-node memory usage
+
+	getter := groupcache.GetterFunc(
+		func(ctx context.Context, gatewayName string, dest groupcache.Sink,
+			_ *groupcache.Info) error {
+
+			out, _, errID := repoGetMultiple(ctx, app, gatewayName)
+			if errID != nil {
+				return errID
+			}
+
+			var expire time.Time // zero value for expire means no expiration
+			if app.config.groupCacheExpire != 0 {
+				expire = time.Now().Add(app.config.groupCacheExpire)
+			}
+
+			value, errJSON := json.Marshal(cachedGateway{GatewayID: out.GatewayID, Changes: out.Changes})
+			if errJSON != nil {
+				return errJSON
+			}
+
+			return dest.SetBytes(value, expire)
+		})
+
+	cacheOptions := groupcache.Options{
+		Workspace:       workspace,
+		Name:            "gateways",
+		CacheBytesLimit: app.config.groupCacheSizeBytes,
+		Getter:          getter,
+	}
+
+	return groupcache.NewGroupWithWorkspace(cacheOptions)
+}
+
+// cacheGet queries the gateway cache. ok is false for values cached by
+// previous versions, holding only the gateway id: changes is then unknown.
+func cacheGet(ctx context.Context, app *application, gatewayName string) (cachedGateway, bool, error) {
+	var value []byte
+	if errGet := app.cache.Get(ctx, gatewayName, groupcache.AllocatingByteSliceSink(&value), nil); errGet != nil {
+		return cachedGateway{}, false, errGet
+	}
+
+	var cached cachedGateway
+	if errJSON := json.Unmarshal(value, &cached); errJSON != nil {
+		return cachedGateway{GatewayID: string(value)}, false, nil
+	}
+
+	return cached, true, nil
+}
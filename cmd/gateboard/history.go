@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	suffixHistory  = "/history"
+	suffixRollback = "/rollback"
+)
+
+// gatewayGetOrHistory routes GET /gateway/{name}/history to gatewayHistory,
+// and GET /gateway/{name}?wait=... to gatewayWait.
+// Gateway names may contain slashes, hence the catch-all route must be split by suffix.
+func gatewayGetOrHistory(c *gin.Context, app *application) {
+	name := strings.TrimPrefix(c.Param("gateway_name"), "/")
+	if gatewayName, found := strings.CutSuffix(name, suffixHistory); found {
+		gatewayHistory(c, app, gatewayName)
+		return
+	}
+	if _, found := c.GetQuery("wait"); found {
+		gatewayWait(c, app, name)
+		return
+	}
+	gatewayGet(c, app)
+}
+
+// gatewayPost routes POST /gateway/{name}/rollback to gatewayRollback.
+func gatewayPost(c *gin.Context, app *application) {
+	name := strings.TrimPrefix(c.Param("gateway_name"), "/")
+	if gatewayName, found := strings.CutSuffix(name, suffixRollback); found {
+		gatewayRollback(c, app, gatewayName)
+		return
+	}
+	c.JSON(http.StatusNotFound, gateboard.BodyPutReply{
+		GatewayName: name,
+		Error:       "gatewayPost: unsupported path",
+	})
+}
+
+// repoHistoryMultiple returns history from the first repository that answers successfully.
+// Repositories are queried in configuration order because each repository keeps
+// its own changes counter, and rollback must refer to a stable history.
+func repoHistoryMultiple(ctx context.Context, app *application, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoHistoryMultiple"
+
+	repoList := app.repositories().list
+
+	// create trace span
+	ctxNew, span := newSpan(ctx, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	if len(repoList) < 1 {
+		err := fmt.Errorf("%s: empty repo list", me)
+		traceError(span, err.Error())
+		return nil, err
+	}
+
+	var errLast error
+
+	for i, repo := range repoList {
+
+		begin := time.Now()
+		list, err := repo.History(ctxNew, gatewayName)
+		elap := time.Since(begin)
+
+		zlog.CtxDebugf(ctxNew, app.config.debug || err != nil,
+			"%s: attempt=%d/%d repo=%s gateway_name=%s error:%v",
+			me, i+1, len(repoList), repo.RepoName(), gatewayName, err)
+
+		if err == nil {
+			recordRepositoryLatency("history", repoStatusOK, repo.RepoName(), elap)
+			return list, nil
+		}
+
+		errLast = err
+		traceError(span, err.Error())
+		recordRepositoryLatency("history", repoStatusError, repo.RepoName(), elap)
+	}
+
+	return nil, errLast
+}
+
+func gatewayHistory(c *gin.Context, app *application, gatewayName string) {
+	const me = "gatewayHistory"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s", me, gatewayName)
+
+	out := gateboard.BodyHistoryReply{
+		GatewayName: gatewayName,
+		History:     []gateboard.HistoryEntry{},
+	}
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		out.Error = errVal.Error()
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	history, errHistory := repoHistoryMultiple(ctx, app, gatewayName)
+	if errHistory != nil {
+		out.Error = fmt.Sprintf("%s: error: %v", me, errHistory)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusInternalServerError, out)
+		return
+	}
+
+	if len(history) < 1 {
+		out.Error = fmt.Sprintf("%s: not found: %v", me, repository.ErrGatewayNotFound)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusNotFound, out)
+		return
+	}
+
+	out.History = history
+
+	c.JSON(http.StatusOK, out)
+}
+
+func gatewayRollback(c *gin.Context, app *application, gatewayName string) {
+	const me = "gatewayRollback"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	to := c.Query("to")
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s to=%s", me, gatewayName, to)
+
+	var out gateboard.BodyPutReply
+	out.GatewayName = gatewayName
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		out.Error = errVal.Error()
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	changes, errConv := strconv.ParseInt(to, 10, 64)
+	if errConv != nil {
+		out.Error = fmt.Sprintf("%s: bad query parameter to='%s': %v", me, to, errConv)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	//
+	// parse optional body to get token
+	//
+
+	dec := yaml.NewDecoder(c.Request.Body)
+	var in gateboard.BodyRollbackRequest
+	errYaml := dec.Decode(&in)
+	if errYaml != nil && errYaml != io.EOF {
+		out.Error = fmt.Sprintf("%s: body yaml: %v", me, errYaml)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	//
+	// check write token
+	//
+
+	if app.config.writeToken {
+		if invalidToken(ctx, app, gatewayName, in.Token) {
+			out.Error = "invalid token"
+			traceError(span, out.Error)
+			zlog.CtxErrorf(ctx, "%s", out.Error)
+			c.JSON(http.StatusUnauthorized, out)
+			return
+		}
+	}
+
+	//
+	// find previous gateway_id
+	//
+
+	history, errHistory := repoHistoryMultiple(ctx, app, gatewayName)
+	if errHistory != nil {
+		out.Error = fmt.Sprintf("%s: history error: %v", me, errHistory)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusInternalServerError, out)
+		return
+	}
+
+	var entry gateboard.HistoryEntry
+	var found bool
+	for _, e := range history {
+		if e.Changes == changes {
+			entry = e
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		out.Error = fmt.Sprintf("%s: changes=%d not found in history", me, changes)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusNotFound, out)
+		return
+	}
+
+	if entry.Deleted || entry.GatewayID == "" {
+		out.Error = fmt.Sprintf("%s: changes=%d is a deletion, use DELETE instead", me, changes)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	out.GatewayID = entry.GatewayID
+
+	//
+	// restore gateway_id
+	//
+
+	source := fmt.Sprintf("rollback:%d:%s", changes, sourceHTTP(c))
+
+	errPut := repoWriteRetry(ctx, app, span, me, gatewayName, func() error {
+		accepted, err := repoPutMultipleAccepted(ctx, app, gatewayName, entry.GatewayID, source, repository.AnyChanges)
+		out.Accepted = accepted
+		return err
+	})
+	if _, partial := errPut.(errWritePolicy); partial {
+		// written to some repositories, but fewer than required
+		out.Error = errPut.Error()
+		c.JSON(http.StatusServiceUnavailable, out)
+		return
+	}
+	if errPut != nil {
+		out.Error = errPut.Error()
+		c.JSON(http.StatusInternalServerError, out)
+		return
+	}
+
+	gatewayChanged(ctx, app, gatewayName)
+
+	c.JSON(http.StatusOK, out)
+}
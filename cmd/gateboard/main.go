@@ -13,14 +13,18 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	_ "github.com/KimMachineGun/automemlimit"
+	"github.com/fsnotify/fsnotify"
 	ginzap "github.com/gin-contrib/zap"
 	"github.com/gin-gonic/gin"
 	"github.com/modernprogram/groupcache/v2"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
@@ -42,8 +46,13 @@ type application struct {
 	tracer                    trace.Tracer
 	sqsClient                 queue
 	config                    appConfig
-	repoConf                  []repoConfig
-	repoList                  []repository
+	repos                     atomic.Pointer[repoSet]
+	reposMutex                sync.Mutex                                   // serializes reloads
+	feeds                     map[repository.Repository]context.CancelFunc // running change feeds, guarded by reposMutex
+	repairMutex               sync.Mutex                                   // one repair at a time
+	writePolicy               writePolicy
+	watch                     *watchHub
+	auth                      *authenticator
 	dogstatsdClientGroupcache *dogstatsdclient.Client
 }
 
@@ -74,65 +83,108 @@ func main() {
 		zlog.LoggerConfig.Level.SetLevel(zap.DebugLevel)
 	}
 
-	queueURL := app.config.queueURL
+	//
+	// initialize tracing
+	//
+
+	if app.config.otelTraceEnable {
+		options := oteltrace.TraceOptions{
+			DefaultService:     me,
+			NoopTracerProvider: false,
+			Debug:              true,
+		}
+
+		tracer, cancel, errTracer := oteltrace.TraceStart(options)
+
+		if errTracer != nil {
+			log.Fatalf("tracer: %v", errTracer)
+		}
+
+		defer cancel()
+
+		app.tracer = tracer
+	} else {
+		app.tracer = oteltrace.NewNoopTracer()
+	}
+
+	//
+	// init application
+	//
+	initApplication(app, app.config.applicationAddr)
 
 	//
 	// preload write tokens
 	//
 
+	if errKey := checkTokenHashKey(app.config); errKey != nil {
+		zlog.Fatalf("%v", errKey)
+	}
+
 	if app.config.tokens != "" {
 		tokens, errTokens := loadTokens(app.config.tokens)
 		if errTokens != nil {
 			zlog.Fatalf("error loading tokens from file %s: %v",
 				app.config.tokens, errTokens)
 		}
-		for gw, tk := range tokens {
-			errPut := repoPutTokenMultiple(context.TODO(), app, gw, tk)
-			if errPut != nil {
-				zlog.Fatalf("error preloading token for gateway '%s' into repo: %v",
-					gw, errPut)
-			}
+		if errPreload := preloadTokens(context.TODO(), app, tokens); errPreload != nil {
+			zlog.Fatalf("error preloading token into repo: %v", errPreload)
 		}
 		zlog.Infof("preloaded %d tokens from file: %s", len(tokens), app.config.tokens)
 	}
 
 	//
-	// sqs listener
+	// sqs listener, started once repositories and watch hub are ready
 	//
 
-	if queueURL != "" {
+	if queueURL := app.config.queueURL; queueURL != "" {
 		app.sqsClient = initClient("main", queueURL, app.config.sqsRoleARN, me)
 		go sqsListener(app)
 	}
 
 	//
-	// initialize tracing
+	// start tombstone purger
 	//
 
-	if app.config.otelTraceEnable {
-		options := oteltrace.TraceOptions{
-			DefaultService:     me,
-			NoopTracerProvider: false,
-			Debug:              true,
-		}
+	if app.config.tombstonePurgeInterval > 0 {
+		go tombstonePurger(app)
+	}
 
-		tracer, cancel, errTracer := oteltrace.TraceStart(options)
+	//
+	// start anti-entropy repair
+	//
 
-		if errTracer != nil {
-			log.Fatalf("tracer: %v", errTracer)
-		}
+	if app.config.repairInterval > 0 {
+		go repairer(app)
+	}
 
-		defer cancel()
+	//
+	// subscribe to repository change feeds
+	//
 
-		app.tracer = tracer
-	} else {
-		app.tracer = oteltrace.NewNoopTracer()
+	if app.config.repoChangeFeed {
+		app.reposMutex.Lock()
+		app.feeds = map[repository.Repository]context.CancelFunc{}
+		syncRepoFeeds(app, app.repositories())
+		app.reposMutex.Unlock()
 	}
 
 	//
-	// init application
+	// reload repositories on SIGHUP or REPO_LIST change
 	//
-	initApplication(app, app.config.applicationAddr)
+
+	{
+		var watcher *fsnotify.Watcher
+		if app.config.repoReloadWatch {
+			w, errWatch := fsnotify.NewWatcher()
+			if errWatch != nil {
+				zlog.Errorf("repo list: watch disabled: %v", errWatch)
+			} else {
+				defer w.Close()
+				watcher = w
+			}
+		}
+		go repoReloader(app, watcher)
+	}
 
 	//
 	// start application server
@@ -140,7 +192,7 @@ func main() {
 
 	go func() {
 		zlog.Infof("application server: listening on %s", app.config.applicationAddr)
-		err := app.serverMain.server.ListenAndServe()
+		err := listenAndServe(app.serverMain.server, "application", app.config.applicationTLS)
 		zlog.Infof("application server: exited: %v", err)
 	}()
 
@@ -159,10 +211,20 @@ func main() {
 			fmt.Fprintln(w, "health ok")
 		})
 
+		switch app.config.readyPolicy {
+		case readyPolicyAny, readyPolicyAll, readyPolicyQuorum:
+		default:
+			zlog.Fatalf("bad READY_POLICY='%s', valid values: %s, %s, %s",
+				app.config.readyPolicy, readyPolicyAny, readyPolicyAll, readyPolicyQuorum)
+		}
+		zlog.Infof("registering route: %s %s policy=%s",
+			app.config.healthAddr, app.config.readyPath, app.config.readyPolicy)
+		mux.HandleFunc(app.config.readyPath, readinessHandler(app))
+
 		go func() {
 			zlog.Infof("health server: listening on %s %s",
 				app.config.healthAddr, app.config.healthPath)
-			err := app.serverHealth.ListenAndServe()
+			err := listenAndServe(app.serverHealth, "health", app.config.healthTLS)
 			zlog.Infof("health server: exited: %v", err)
 		}()
 	}
@@ -182,7 +244,7 @@ func main() {
 		go func() {
 			zlog.Infof("metrics server: listening on %s %s",
 				app.config.metricsAddr, app.config.metricsPath)
-			err := app.serverMetrics.ListenAndServe()
+			err := listenAndServe(app.serverMetrics, "metrics", app.config.metricsTLS)
 			zlog.Infof("metrics server: exited: %v", err)
 		}()
 	}
@@ -223,26 +285,44 @@ func initApplication(app *application, addr string) {
 	//
 
 	{
-		repoList, errRepo := loadRepoConf(app.config.repoList)
+		policy, errPolicy := parseWritePolicy(app.config.writePolicy)
+		if errPolicy != nil {
+			zlog.Fatalf("WRITE_POLICY: %v", errPolicy)
+		}
+		app.writePolicy = policy
+	}
+
+	switch app.config.readPolicy {
+	case readPolicyFastest, readPolicyOrdered, readPolicyFreshest:
+	default:
+		zlog.Fatalf("bad READ_POLICY='%s', valid values: %s, %s, %s",
+			app.config.readPolicy, readPolicyFastest, readPolicyOrdered, readPolicyFreshest)
+	}
+
+	{
+		repoList, errRepo := repository.LoadConfig(app.config.repoList)
 		if errRepo != nil {
 			zlog.Fatalf("load repo list: error: %s: %v", app.config.repoList, errRepo)
 		}
 		if len(repoList) < 1 {
 			zlog.Fatalf("load repo list: empty: %s", app.config.repoList)
 		}
-		app.repoConf = repoList
-	}
+		if errPolicy := app.writePolicy.check(len(repoList)); errPolicy != nil {
+			zlog.Fatalf("WRITE_POLICY: %s: %v", app.config.repoList, errPolicy)
+		}
 
-	log.Printf("repo list: %s: %s", app.config.repoList,
-		toJSON(context.TODO(), app.repoConf))
+		log.Printf("repo list: %s: %s", app.config.repoList,
+			toJSON(context.TODO(), repoList))
 
-	for i, conf := range app.repoConf {
-		log.Printf("initializing repository: [%d/%d]: %s",
-			i+1, len(app.repoConf), conf.Kind)
-		r := createRepo(me, app.config.secretRoleArn, conf, app.config.debug)
-		app.repoList = append(app.repoList, r)
+		set, _, errSet := newRepoSet(me, app.config, repoList, nil)
+		if errSet != nil {
+			zlog.Fatalf("%v", errSet)
+		}
+		app.repos.Store(set)
 	}
 
+	app.watch = newWatchHub()
+
 	//
 	// start group cache
 	//
@@ -272,13 +352,38 @@ func initApplication(app *application, addr string) {
 		app.serverMain.router.Use(gin.Logger())
 	}
 
-	const pathGateway = "/gateway/*gateway_name"
+	if app.config.authJWKS != "" {
+		auth, errAuth := newAuthenticator(context.Background(), app.config)
+		if errAuth != nil {
+			zlog.Fatalf("auth: %v", errAuth)
+		}
+		app.auth = auth
+		app.serverMain.router.Use(middlewareAuth(app))
+		zlog.Infof("auth: jwks=%s issuer=%s audience=%s rules=%s",
+			app.config.authJWKS, app.config.authIssuer, app.config.authAudience, app.config.authRules)
+	}
+
 	zlog.Infof("registering route: %s %s", addr, pathGateway)
-	app.serverMain.router.GET(pathGateway, func(c *gin.Context) { gatewayGet(c, app) })
+	app.serverMain.router.GET(pathGateway, func(c *gin.Context) { gatewayGetOrHistory(c, app) })
 	app.serverMain.router.PUT(pathGateway, func(c *gin.Context) { gatewayPut(c, app) })
+	app.serverMain.router.DELETE(pathGateway, func(c *gin.Context) { gatewayDelete(c, app) })
+	app.serverMain.router.POST(pathGateway, func(c *gin.Context) { gatewayPost(c, app) })
+	app.serverMain.router.POST(pathAction, func(c *gin.Context) { gatewayAction(c, app) })
 	app.serverMain.router.GET("/dump", func(c *gin.Context) { gatewayDump(c, app) })
+	app.serverMain.router.GET("/watch", func(c *gin.Context) { gatewayWatch(c, app) })
+
+	const pathAdminToken = "/admin/token/*gateway_name"
+	zlog.Infof("registering route: %s %s", addr, pathAdminToken)
+	app.serverMain.router.PUT(pathAdminToken, func(c *gin.Context) { adminTokenPut(c, app) })
+	app.serverMain.router.DELETE(pathAdminToken, func(c *gin.Context) { adminTokenDelete(c, app) })
+
+	const pathAdminRepair = "/admin/repair"
+	zlog.Infof("registering route: %s %s", addr, pathAdminRepair)
+	app.serverMain.router.POST(pathAdminRepair, func(c *gin.Context) { adminRepair(c, app) })
 }
 
+const pathGateway = "/gateway/*gateway_name"
+
 func shutdown(app *application) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -9,6 +9,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/udhos/dogstatsdclient/dogstatsdclient"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
 )
 
 const (
@@ -20,6 +21,14 @@ const (
 type metrics struct {
 	latencySpring   *prometheus.HistogramVec
 	latencyRepo     *prometheus.HistogramVec
+	repoReload      *prometheus.CounterVec
+	repoCount       prometheus.Gauge
+	repoDivergence  *prometheus.GaugeVec
+	repoRepair      *prometheus.CounterVec
+	repoCircuit     *prometheus.GaugeVec
+	repoIndexLag    *prometheus.GaugeVec
+	repoIndexFail   *prometheus.CounterVec
+	repoHistoryFail *prometheus.CounterVec
 	dogstatsdClient *dogstatsdclient.Client
 }
 
@@ -37,6 +46,105 @@ func recordRepositoryLatency(method, status, repo string, elapsed time.Duration)
 	}
 }
 
+// recordRepositoryReload counts reload attempts. size is the number
+// of repositories in use after a successful reload.
+func recordRepositoryReload(status string, size int) {
+	if metric == nil {
+		return
+	}
+	if metric.repoReload != nil {
+		metric.repoReload.WithLabelValues(status).Inc()
+		if status == repoStatusOK {
+			metric.repoCount.Set(float64(size))
+		}
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Count("repository_reload", 1, []string{"status:" + status}, 1)
+		if status == repoStatusOK {
+			metric.dogstatsdClient.Gauge("repositories", float64(size), nil, 1)
+		}
+	}
+}
+
+// recordRepositoryDivergence reports the divergent entries found in repo by the last repair.
+func recordRepositoryDivergence(repo string, divergent int) {
+	if metric == nil {
+		return
+	}
+	if metric.repoDivergence != nil {
+		metric.repoDivergence.WithLabelValues(repo).Set(float64(divergent))
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Gauge("repository_divergent_entries", float64(divergent), []string{"repo:" + repo}, 1)
+	}
+}
+
+// recordRepositoryRepair counts entries rewritten by repair.
+func recordRepositoryRepair(repo, status string) {
+	if metric == nil {
+		return
+	}
+	if metric.repoRepair != nil {
+		metric.repoRepair.WithLabelValues(repo, status).Inc()
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Count("repository_repair", 1, []string{"repo:" + repo, "status:" + status}, 1)
+	}
+}
+
+// recordRepositoryCircuit reports the circuit breaker state: 0=closed 1=half-open 2=open.
+func recordRepositoryCircuit(repo string, state breakerState) {
+	if metric == nil {
+		return
+	}
+	if metric.repoCircuit != nil {
+		metric.repoCircuit.WithLabelValues(repo).Set(float64(state))
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Gauge("repository_circuit_state", float64(state), []string{"repo:" + repo}, 1)
+	}
+}
+
+// recordRepositoryIndexLag reports the age of the oldest change not yet
+// merged into the repository index object.
+func recordRepositoryIndexLag(repo string, lag time.Duration) {
+	if metric == nil {
+		return
+	}
+	if metric.repoIndexLag != nil {
+		metric.repoIndexLag.WithLabelValues(repo).Set(lag.Seconds())
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Gauge("repository_index_lag_seconds", lag.Seconds(), []string{"repo:" + repo}, 1)
+	}
+}
+
+// recordRepositoryIndexFailure counts failed updates of the repository index object.
+func recordRepositoryIndexFailure(repo string) {
+	if metric == nil {
+		return
+	}
+	if metric.repoIndexFail != nil {
+		metric.repoIndexFail.WithLabelValues(repo).Inc()
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Count("repository_index_failures", 1, []string{"repo:" + repo}, 1)
+	}
+}
+
+// recordRepositoryHistoryFailure counts changes saved without their history entry.
+func recordRepositoryHistoryFailure(repo string) {
+	if metric == nil {
+		return
+	}
+	if metric.repoHistoryFail != nil {
+		metric.repoHistoryFail.WithLabelValues(repo).Inc()
+	}
+	if metric.dogstatsdClient != nil {
+		metric.dogstatsdClient.Count("repository_history_failures", 1, []string{"repo:" + repo}, 1)
+	}
+}
+
 var (
 	dimensionsSpring     = []string{"method", "status", "uri"}
 	dimensionsRepository = []string{"method", "status", "repo"}
@@ -51,6 +159,9 @@ func initMetrics(namespace string, latencyBucketsHTTP,
 	}
 	metric = newMetrics(namespace, latencyBucketsHTTP, latencyBucketsRepo,
 		prometheusEnable, dogstatsdEnable)
+	repository.RecordIndexLag = recordRepositoryIndexLag
+	repository.RecordIndexFailure = recordRepositoryIndexFailure
+	repository.RecordHistoryFailure = recordRepositoryHistoryFailure
 }
 
 func newMetrics(namespace string, latencyBucketsHTTP,
@@ -80,6 +191,77 @@ func newMetrics(namespace string, latencyBucketsHTTP,
 			},
 			dimensionsRepository,
 		)
+
+		m.repoReload = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "repository_reload_total",
+				Help:      "Repository list reloads.",
+			},
+			[]string{"status"},
+		)
+
+		m.repoCount = promauto.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "repositories",
+				Help:      "Number of repositories in use.",
+			},
+		)
+
+		m.repoDivergence = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "repository_divergent_entries",
+				Help:      "Entries found divergent in repository by the last repair.",
+			},
+			[]string{"repo"},
+		)
+
+		m.repoRepair = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "repository_repair_total",
+				Help:      "Entries rewritten by repair.",
+			},
+			[]string{"repo", "status"},
+		)
+
+		m.repoCircuit = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "repository_circuit_state",
+				Help:      "Repository circuit breaker state: 0=closed 1=half-open 2=open.",
+			},
+			[]string{"repo"},
+		)
+
+		m.repoIndexLag = promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "repository_index_lag_seconds",
+				Help:      "Age of the oldest change not yet merged into the repository index.",
+			},
+			[]string{"repo"},
+		)
+
+		m.repoIndexFail = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "repository_index_failures_total",
+				Help:      "Failed updates of the repository index.",
+			},
+			[]string{"repo"},
+		)
+
+		m.repoHistoryFail = promauto.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "repository_history_failures_total",
+				Help:      "Changes saved without their history entry.",
+			},
+			[]string{"repo"},
+		)
 	}
 
 	if dogstatsdEnable {
@@ -9,6 +9,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
 	"gopkg.in/yaml.v3"
 )
 
@@ -16,7 +17,7 @@ import (
 func TestMultirepoFastestGoodOnly(t *testing.T) {
 	app := newTestAppMultirepo("testdata/repo_mem_good3.yaml")
 
-	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1")
+	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges)
 	if errPut != nil {
 		t.Error(errPut.Error())
 	}
@@ -39,7 +40,7 @@ func TestMultirepoFastestGoodOnly(t *testing.T) {
 func TestMultirepoFastestTwoBad(t *testing.T) {
 	app := newTestAppMultirepo("testdata/repo_mem_bad2.yaml")
 
-	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1")
+	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges)
 	if errPut != nil {
 		t.Error(errPut.Error())
 	}
@@ -64,7 +65,7 @@ func TestMultirepoFastestTimeout(t *testing.T) {
 
 	app.config.repoTimeout = 100 * time.Millisecond
 
-	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1")
+	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges)
 	if errPut != nil {
 		t.Error(errPut.Error())
 	}
@@ -76,6 +77,106 @@ func TestMultirepoFastestTimeout(t *testing.T) {
 	}
 }
 
+// go test -count=1 -run TestMultirepoDumpTombstone ./cmd/gateboard
+func TestMultirepoDumpTombstone(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+
+	errPut := repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges)
+	if errPut != nil {
+		t.Error(errPut.Error())
+	}
+
+	errPut2 := repoPutMultiple(context.TODO(), app, "gw2", "id2", "test", repository.AnyChanges)
+	if errPut2 != nil {
+		t.Error(errPut2.Error())
+	}
+
+	// delete only from first repo, second repo is lagging
+	errDelete := app.repositories().list[0].Delete(context.TODO(), "gw1", "test")
+	if errDelete != nil {
+		t.Error(errDelete.Error())
+	}
+
+	var dump repository.Dump
+	_, errDump := repoDumpMultiple(context.TODO(), app, repository.DumpFilter{}, nil,
+		func(item map[string]interface{}) error {
+			dump = append(dump, item)
+			return nil
+		})
+	if errDump != nil {
+		t.Error(errDump.Error())
+	}
+
+	if len(dump) != 1 {
+		t.Fatalf("expected dump size 1, got %d: %v", len(dump), dump)
+	}
+
+	if name := dump[0]["gateway_name"]; name != "gw2" {
+		t.Errorf("expected gw2 but got: %v", name)
+	}
+}
+
+// go test -count=1 -run TestMultirepoDumpPage ./cmd/gateboard
+func TestMultirepoDumpPage(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+
+	ctx := context.TODO()
+	repo1 := app.repositories().list[0]
+	repo2 := app.repositories().list[1]
+
+	// repositories hold different gateways
+	for _, gw := range []string{"gw1", "gw3", "gw5", "gw7"} {
+		if errPut := repo1.Put(ctx, gw, "id1", "test", repository.AnyChanges); errPut != nil {
+			t.Fatalf("put: %v", errPut)
+		}
+	}
+	for _, gw := range []string{"gw2", "gw4", "gw6", "gw8"} {
+		if errPut := repo2.Put(ctx, gw, "id1", "test", repository.AnyChanges); errPut != nil {
+			t.Fatalf("put: %v", errPut)
+		}
+	}
+
+	// most recent update wins
+	if errPut := repo2.Put(ctx, "gw3", "id2", "test", repository.AnyChanges); errPut != nil {
+		t.Fatalf("put: %v", errPut)
+	}
+	if errDelete := repo1.Delete(ctx, "gw6", "test"); errDelete != nil {
+		t.Fatalf("delete: %v", errDelete)
+	}
+
+	for _, limit := range []int{1, 2, 3, 100} {
+		var names []string
+		var pages int
+		filter := repository.DumpFilter{Limit: limit}
+		for {
+			pages++
+			next, errDump := repoDumpMultiple(ctx, app, filter, nil,
+				func(item map[string]interface{}) error {
+					name := item["gateway_name"].(string)
+					if name == "gw3" && item["gateway_id"] != "id2" {
+						t.Errorf("limit=%d: unexpected gw3: %v", limit, item)
+					}
+					names = append(names, name)
+					return nil
+				})
+			if errDump != nil {
+				t.Fatalf("limit=%d: dump: %v", limit, errDump)
+			}
+			if next == "" {
+				break
+			}
+			filter.After = next
+		}
+		expected := "gw1 gw2 gw3 gw4 gw5 gw7 gw8"
+		if got := strings.Join(names, " "); got != expected {
+			t.Errorf("limit=%d: expected %s got %s", limit, expected, got)
+		}
+		if maxPages := 7/limit + 1; pages > maxPages {
+			t.Errorf("limit=%d: expected at most %d pages, got %d", limit, maxPages, pages)
+		}
+	}
+}
+
 type multirepoTestCase struct {
 	name           string
 	method         string
@@ -153,7 +254,7 @@ func testControllerMultirepo(t *testing.T, app *application, table []multirepoTe
 		}
 
 		if data.expectedID != expectAnyID {
-			response := map[string]string{}
+			response := map[string]any{}
 			errYaml := yaml.Unmarshal(w.Body.Bytes(), &response)
 			if errYaml != nil {
 				t.Errorf("%s: ERROR %s %s body='%s' status=%d responseBody='%v' yaml error: %v",
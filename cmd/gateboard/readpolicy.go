@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// Read policies decide how repositories are queried for GET.
+const (
+	readPolicyFastest  = "fastest"  // query all, first success wins
+	readPolicyOrdered  = "ordered"  // query in configuration order, next one after hedge delay or failure
+	readPolicyFreshest = "freshest" // query all, most recent entry wins
+)
+
+var errRepositoryTimeout = errors.New("repository: cross-repository timeout")
+
+// repoGetOrdered queries the first repository and falls back to the next one
+// in configuration order when the current one fails, reports not found, or
+// does not answer within READ_HEDGE_DELAY. Repositories behind a healthy
+// primary are never queried.
+func repoGetOrdered(ctx context.Context, app *application, gatewayName string) (gateboard.BodyGetReply, string, error) {
+	const me = "repoGetOrdered"
+
+	repoList := app.repositories().list
+
+	// create trace span
+	ctxNew, span := newSpan(ctx, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	if len(repoList) < 1 {
+		e := fmt.Errorf("%s: empty repo list", me)
+		traceError(span, e.Error())
+		return gateboard.BodyGetReply{}, "", e
+	}
+
+	size := len(repoList)
+
+	ch := make(chan repoAnswer, size)
+
+	var launched, pending int
+	var notFound bool
+	var answer repoAnswer
+
+	launch := func() {
+		go queryOneRepo(ctxNew, app.tracer, gatewayName, launched, size, repoList[launched], app.config.debug, ch)
+		launched++
+		pending++
+	}
+
+	launch()
+
+	timeout := time.NewTimer(app.config.repoTimeout)
+	defer timeout.Stop()
+
+	for pending > 0 || launched < size {
+		var hedge <-chan time.Time
+		if launched < size {
+			hedge = time.After(app.config.readHedgeDelay)
+		}
+
+		select {
+		case answer = <-ch:
+			pending--
+			switch answer.err {
+			case nil:
+				if answer.body.Deleted {
+					return answer.body, answer.repoName, repository.ErrGatewayNotFound
+				}
+				return answer.body, answer.repoName, nil
+			case repository.ErrGatewayNotFound:
+				notFound = true
+			}
+			if launched < size {
+				launch() // fall back immediately
+			}
+		case <-hedge:
+			launch() // primary is slow
+		case <-timeout.C:
+			e := errRepositoryTimeout
+			traceError(span, e.Error())
+			return answer.body, "", e
+		}
+	}
+
+	if notFound {
+		return answer.body, answer.repoName, repository.ErrGatewayNotFound
+	}
+
+	return answer.body, answer.repoName, answer.err
+}
+
+// repoGetFreshest queries all repositories and returns the entry with the most
+// recent last_update, then highest changes. It waits for all repositories,
+// or only for a majority when READ_FRESHEST_QUORUM is set. Not found counts
+// as an answer. On timeout, the freshest entry received so far is returned.
+func repoGetFreshest(ctx context.Context, app *application, gatewayName string) (gateboard.BodyGetReply, string, error) {
+	const me = "repoGetFreshest"
+
+	repoList := app.repositories().list
+
+	// create trace span
+	ctxNew, span := newSpan(ctx, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	if len(repoList) < 1 {
+		e := fmt.Errorf("%s: empty repo list", me)
+		traceError(span, e.Error())
+		return gateboard.BodyGetReply{}, "", e
+	}
+
+	size := len(repoList)
+
+	wait := size
+	if app.config.readFreshestQuorum {
+		wait = size/2 + 1
+	}
+
+	ch := make(chan repoAnswer, size)
+
+	for r, repo := range repoList {
+		go queryOneRepo(ctxNew, app.tracer, gatewayName, r, size, repo, app.config.debug, ch)
+	}
+
+	var best repoAnswer
+	var found, notFound bool
+	var answered int
+	var errLast error
+
+	timeout := time.NewTimer(app.config.repoTimeout)
+	defer timeout.Stop()
+
+LOOP:
+	for range size {
+		select {
+		case answer := <-ch:
+			switch answer.err {
+			case nil:
+				answered++
+				if !found || fresher(answer.body, best.body) {
+					best = answer
+					found = true
+				}
+			case repository.ErrGatewayNotFound:
+				answered++
+				notFound = true
+			default:
+				errLast = answer.err
+			}
+			if answered >= wait {
+				break LOOP
+			}
+		case <-timeout.C:
+			traceError(span, errRepositoryTimeout.Error())
+			if !found && !notFound {
+				return best.body, "", errRepositoryTimeout
+			}
+			break LOOP
+		}
+	}
+
+	switch {
+	case found && best.body.Deleted:
+		return best.body, best.repoName, repository.ErrGatewayNotFound
+	case found:
+		return best.body, best.repoName, nil
+	case notFound:
+		return best.body, "", repository.ErrGatewayNotFound
+	}
+
+	return best.body, "", errLast
+}
+
+// fresher reports whether a is more recent than b.
+// Each repository keeps its own changes counter, hence last_update comes first.
+func fresher(a, b gateboard.BodyGetReply) bool {
+	if !a.LastUpdate.Equal(b.LastUpdate) {
+		return a.LastUpdate.After(b.LastUpdate)
+	}
+	return a.Changes > b.Changes
+}
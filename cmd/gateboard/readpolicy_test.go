@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+// go test -v -run TestReadPolicyOrdered ./cmd/gateboard
+func TestReadPolicyOrdered(t *testing.T) {
+	brokenFirst := filepath.Join(t.TempDir(), "repo.yaml")
+	if err := os.WriteFile(brokenFirst, []byte("- kind: mem\n  name: bad\n  mem:\n    broken: true\n- kind: mem\n  name: good\n"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	table := []struct {
+		name     string
+		repo     string
+		hedge    time.Duration
+		expected string
+	}{
+		{"primary answers", "testdata/repo_mem_good3.yaml", time.Second, "mem:mem300"},
+		{"primary slower than hedge", "testdata/repo_mem_good3.yaml", 50 * time.Millisecond, "mem:mem200"},
+		{"primary broken", brokenFirst, time.Second, "mem:good"},
+	}
+
+	for _, data := range table {
+		app := newTestAppMultirepo(data.repo)
+		app.config.readPolicy = readPolicyOrdered
+		app.config.readHedgeDelay = data.hedge
+
+		for _, repo := range app.repositories().list {
+			repo.Put(context.TODO(), "gw1", "id1", "test", repository.AnyChanges)
+		}
+
+		begin := time.Now()
+		body, repoName, err := repoGetMultiple(context.TODO(), app, "gw1")
+		if err != nil {
+			t.Errorf("%s: get: %v", data.name, err)
+			continue
+		}
+		if body.GatewayID != "id1" || repoName != data.expected {
+			t.Errorf("%s: expected id1 from %s, got %s from %s (%v)",
+				data.name, data.expected, body.GatewayID, repoName, time.Since(begin))
+		}
+
+		if _, _, errMissing := repoGetMultiple(context.TODO(), app, "missing"); errMissing != repository.ErrGatewayNotFound {
+			t.Errorf("%s: missing: expected not found, got: %v", data.name, errMissing)
+		}
+	}
+}
+
+// go test -v -run TestReadPolicyFreshest ./cmd/gateboard
+func TestReadPolicyFreshest(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+	app.config.readPolicy = readPolicyFreshest
+
+	ctx := context.TODO()
+	mem1, mem2 := app.repositories().list[0], app.repositories().list[1]
+
+	put := func(repo repository.Repository, name, id string) {
+		t.Helper()
+		if err := repo.Put(ctx, name, id, "test", repository.AnyChanges); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		time.Sleep(time.Millisecond) // keep last_update distinct
+	}
+
+	put(mem1, "gw1", "old")
+	put(mem2, "gw1", "new") // mem1 lagging
+
+	put(mem1, "gw2", "id1")
+	put(mem2, "gw2", "id1")
+	if err := mem1.Delete(ctx, "gw2", "test"); err != nil { // mem2 lagging
+		t.Fatalf("delete: %v", err)
+	}
+
+	for _, quorum := range []bool{false, true} {
+		app.config.readFreshestQuorum = quorum
+
+		for range 10 {
+			body, repoName, err := repoGetMultiple(ctx, app, "gw1")
+			if err != nil || body.GatewayID != "new" || repoName != "mem:mem2" {
+				t.Errorf("quorum=%t: expected new from mem:mem2, got %s from %s: %v",
+					quorum, body.GatewayID, repoName, err)
+			}
+
+			if _, _, errDeleted := repoGetMultiple(ctx, app, "gw2"); errDeleted != repository.ErrGatewayNotFound {
+				t.Errorf("quorum=%t: expected newest tombstone to win, got: %v", quorum, errDeleted)
+			}
+		}
+	}
+
+	if _, _, errMissing := repoGetMultiple(ctx, app, "missing"); errMissing != repository.ErrGatewayNotFound {
+		t.Errorf("missing: expected not found, got: %v", errMissing)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+// readyProbeGateway is queried to probe repositories. Not found is a healthy answer.
+const readyProbeGateway = "gateboard:readiness:probe"
+
+// Readiness policies decide how many repositories down make the pod not ready.
+const (
+	readyPolicyAny    = "any"    // not ready when any repository is down
+	readyPolicyAll    = "all"    // not ready only when all repositories are down
+	readyPolicyQuorum = "quorum" // not ready unless a majority of repositories is up
+)
+
+type readyRepo struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Up      bool   `json:"up"`
+	Latency string `json:"latency"`
+	Error   string `json:"error,omitempty"`
+}
+
+type readyReply struct {
+	Ready        bool        `json:"ready"`
+	Policy       string      `json:"policy"`
+	Repositories []readyRepo `json:"repositories"`
+}
+
+// readyCheck probes all repositories concurrently.
+func readyCheck(ctx context.Context, app *application) readyReply {
+	repos := app.repositories()
+
+	out := readyReply{
+		Policy:       app.config.readyPolicy,
+		Repositories: make([]readyRepo, len(repos.list)),
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, app.config.readyTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+
+	for i, repo := range repos.list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			begin := time.Now()
+			_, err := repo.Get(ctx, readyProbeGateway)
+			if err == repository.ErrGatewayNotFound {
+				err = nil
+			}
+			r := readyRepo{
+				Name:    repo.RepoName(),
+				Kind:    repos.conf[i].Kind,
+				Up:      err == nil,
+				Latency: time.Since(begin).String(),
+			}
+			if err != nil {
+				r.Error = err.Error()
+			}
+			out.Repositories[i] = r
+		}()
+	}
+
+	wg.Wait()
+
+	var up int
+	for _, r := range out.Repositories {
+		if r.Up {
+			up++
+		}
+	}
+
+	total := len(out.Repositories)
+
+	switch app.config.readyPolicy {
+	case readyPolicyAll:
+		out.Ready = up > 0
+	case readyPolicyQuorum:
+		out.Ready = 2*up > total
+	default:
+		out.Ready = up == total
+	}
+
+	return out
+}
+
+// readinessHandler answers 200 when ready, 503 otherwise, with per-repository status.
+func readinessHandler(app *application) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const me = "readinessHandler"
+
+		out := readyCheck(r.Context(), app)
+
+		status := http.StatusOK
+		if !out.Ready {
+			status = http.StatusServiceUnavailable
+			zlog.Errorf("%s: not ready: %s", me, toJSON(r.Context(), out))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			zlog.Errorf("%s: %v", me, err)
+		}
+	}
+}
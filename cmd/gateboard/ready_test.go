@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// go test -v -run TestReadiness ./cmd/gateboard
+func TestReadiness(t *testing.T) {
+	table := []struct {
+		repo     string
+		policy   string
+		expected int
+	}{
+		{"testdata/repo_mem_two_good.yaml", readyPolicyAny, 200},
+		{"testdata/repo_mem_two_good.yaml", readyPolicyAll, 200},
+		{"testdata/repo_mem_two_good.yaml", readyPolicyQuorum, 200},
+		{"testdata/repo_mem_two_goodnbad.yaml", readyPolicyAny, 503},
+		{"testdata/repo_mem_two_goodnbad.yaml", readyPolicyAll, 200},
+		{"testdata/repo_mem_two_goodnbad.yaml", readyPolicyQuorum, 503},
+		{"testdata/repo_mem_two_bad.yaml", readyPolicyAny, 503},
+		{"testdata/repo_mem_two_bad.yaml", readyPolicyAll, 503},
+		{"testdata/repo_mem_two_bad.yaml", readyPolicyQuorum, 503},
+	}
+
+	for _, data := range table {
+		app := newTestAppMultirepo(data.repo)
+		app.config.readyPolicy = data.policy
+
+		req := httptest.NewRequest("GET", "/ready", nil)
+		w := httptest.NewRecorder()
+		readinessHandler(app)(w, req)
+
+		if w.Code != data.expected {
+			t.Errorf("%s policy=%s: expected status=%d got=%d: %s",
+				data.repo, data.policy, data.expected, w.Code, w.Body.String())
+		}
+
+		var out readyReply
+		if errJSON := json.Unmarshal(w.Body.Bytes(), &out); errJSON != nil {
+			t.Errorf("%s policy=%s: json: %v", data.repo, data.policy, errJSON)
+			continue
+		}
+		if out.Ready != (w.Code == http.StatusOK) {
+			t.Errorf("%s policy=%s: ready=%t mismatches status=%d", data.repo, data.policy, out.Ready, w.Code)
+		}
+		if len(out.Repositories) != len(app.repositories().list) {
+			t.Errorf("%s policy=%s: expected %d repositories, got %d",
+				data.repo, data.policy, len(app.repositories().list), len(out.Repositories))
+		}
+		for _, r := range out.Repositories {
+			if r.Up != (r.Error == "") {
+				t.Errorf("%s policy=%s: repo=%s up=%t error=%s", data.repo, data.policy, r.Name, r.Up, r.Error)
+			}
+		}
+	}
+}
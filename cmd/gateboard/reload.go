@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+// repoSet holds the repositories in use along with their configuration.
+// A set is never modified: reload builds a new one and swaps it in.
+type repoSet struct {
+	conf []repository.Config
+	list []repository.Repository
+}
+
+// repositories returns the current repository set, empty before the first
+// set is stored. Callers should keep the returned set for the whole request.
+func (app *application) repositories() *repoSet {
+	if set := app.repos.Load(); set != nil {
+		return set
+	}
+	return &repoSet{}
+}
+
+// newRepoSet creates repositories for conf. Repositories from previous
+// with identical configuration are reused rather than recreated.
+// It also returns the repositories from previous left out of the new set.
+func newRepoSet(sessionName string, config appConfig, conf []repository.Config, previous *repoSet) (*repoSet, *repoSet, error) {
+
+	set := &repoSet{conf: conf}
+	reused := map[int]bool{}
+	var created []int
+
+	for i, c := range conf {
+		if previous != nil {
+			if j := findRepoConf(previous.conf, c, reused); j >= 0 {
+				reused[j] = true
+				set.list = append(set.list, previous.list[j])
+				continue
+			}
+		}
+		zlog.Infof("initializing repository: [%d/%d]: %s", i+1, len(conf), c.Kind)
+		r, errRepo := repository.New(sessionName, config.secretRoleArn, c, config.debug)
+		if errRepo != nil {
+			// release what was created for the abandoned set
+			for _, k := range created {
+				closeRepo(context.TODO(), set.list[k], conf[k])
+			}
+			return nil, nil, errRepo
+		}
+		if config.breakerFailures > 0 {
+			r = newRepoBreaker(r, config.breakerFailures, config.breakerOpenDuration)
+		}
+		created = append(created, i)
+		set.list = append(set.list, r)
+	}
+
+	removed := &repoSet{}
+	if previous != nil {
+		for j, r := range previous.list {
+			if !reused[j] {
+				removed.conf = append(removed.conf, previous.conf[j])
+				removed.list = append(removed.list, r)
+			}
+		}
+	}
+
+	return set, removed, nil
+}
+
+// findRepoConf returns the index of the first unused entry in list equal to c, or -1.
+func findRepoConf(list []repository.Config, c repository.Config, used map[int]bool) int {
+	for j, p := range list {
+		if !used[j] && reflect.DeepEqual(p, c) {
+			return j
+		}
+	}
+	return -1
+}
+
+func closeRepo(ctx context.Context, r repository.Repository, conf repository.Config) {
+	const me = "closeRepo"
+	c, ok := r.(repository.Closer)
+	if !ok {
+		return
+	}
+	if err := c.Close(ctx); err != nil {
+		zlog.Errorf("%s: %s:%s: %v", me, conf.Kind, conf.Name, err)
+		return
+	}
+	zlog.Infof("%s: %s:%s: closed", me, conf.Kind, conf.Name)
+}
+
+// reloadRepos loads REPO_LIST again and swaps in the resulting repositories.
+// Removed repositories are closed after REPO_CLOSE_DELAY, letting in-flight
+// requests holding the previous set finish. On error, the current set is kept.
+func reloadRepos(app *application, reason string) error {
+	const me = "reloadRepos"
+
+	app.reposMutex.Lock()
+	defer app.reposMutex.Unlock()
+
+	conf, errConf := repository.LoadConfig(app.config.repoList)
+	if errConf != nil {
+		recordRepositoryReload(repoStatusError, 0)
+		return errConf
+	}
+	if len(conf) < 1 {
+		recordRepositoryReload(repoStatusError, 0)
+		return fmt.Errorf("%s: empty repo list: %s", me, app.config.repoList)
+	}
+	if errPolicy := app.writePolicy.check(len(conf)); errPolicy != nil {
+		recordRepositoryReload(repoStatusError, 0)
+		return fmt.Errorf("%s: %s: %v", me, app.config.repoList, errPolicy)
+	}
+
+	previous := app.repositories()
+
+	if reflect.DeepEqual(previous.conf, conf) {
+		zlog.Debugf(app.config.debug, "%s: %s: %s: unchanged", me, reason, app.config.repoList)
+		return nil
+	}
+
+	set, removed, errSet := newRepoSet(me, app.config, conf, previous)
+	if errSet != nil {
+		recordRepositoryReload(repoStatusError, 0)
+		return errSet
+	}
+
+	app.repos.Store(set)
+
+	syncRepoFeeds(app, set)
+
+	recordRepositoryReload(repoStatusOK, len(set.list))
+
+	zlog.Infof("%s: %s: %s: repositories: before=%v after=%v removed=%v",
+		me, reason, app.config.repoList, repoNames(previous.list), repoNames(set.list), repoNames(removed.list))
+
+	if len(removed.list) > 0 {
+		time.AfterFunc(app.config.repoCloseDelay, func() {
+			for i, r := range removed.list {
+				closeRepo(context.Background(), r, removed.conf[i])
+			}
+		})
+	}
+
+	return nil
+}
+
+func repoNames(list []repository.Repository) []string {
+	names := make([]string, 0, len(list))
+	for _, r := range list {
+		names = append(names, r.RepoName())
+	}
+	return names
+}
+
+// repoReloader reloads repositories on SIGHUP and, when watcher is not nil,
+// on changes to the directory holding REPO_LIST. The directory is watched,
+// rather than the file, to catch kubernetes ConfigMap volume updates.
+func repoReloader(app *application, watcher *fsnotify.Watcher) {
+	const me = "repoReloader"
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var events chan fsnotify.Event
+	var errs chan error
+
+	if watcher != nil {
+		dir := filepath.Dir(app.config.repoList)
+		if err := watcher.Add(dir); err != nil {
+			zlog.Errorf("%s: watch %s: %v", me, dir, err)
+		}
+		events = watcher.Events
+		errs = watcher.Errors
+	}
+
+	reload := func(reason string) {
+		if err := reloadRepos(app, reason); err != nil {
+			zlog.Errorf("%s: %s: keeping current repositories: %v", me, reason, err)
+		}
+	}
+
+	for {
+		select {
+		case <-hup:
+			reload("SIGHUP")
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			reload(event.String())
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			zlog.Errorf("%s: %v", me, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+// go test -v -run TestReloadRepos ./cmd/gateboard
+func TestReloadRepos(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repo.yaml")
+
+	write := func(conf string) {
+		if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write("- kind: mem\n  name: mem1\n")
+
+	app := newTestAppMultirepo(path)
+
+	mem1 := app.repositories().list[0]
+
+	table := []struct {
+		name     string
+		conf     string
+		errorExp bool
+		expected []string
+	}{
+		{"unchanged", "- kind: mem\n  name: mem1\n", false, []string{"mem:mem1"}},
+		{"add", "- kind: mem\n  name: mem1\n- kind: mem\n  name: mem2\n", false, []string{"mem:mem1", "mem:mem2"}},
+		{"bad kind", "- kind: mem\n  name: mem1\n- kind: bogus\n", true, []string{"mem:mem1", "mem:mem2"}},
+		{"bad yaml", "not a list", true, []string{"mem:mem1", "mem:mem2"}},
+		{"empty", "[]", true, []string{"mem:mem1", "mem:mem2"}},
+		{"reorder", "- kind: mem\n  name: mem2\n- kind: mem\n  name: mem1\n", false, []string{"mem:mem2", "mem:mem1"}},
+		{"change", "- kind: mem\n  name: mem2\n- kind: mem\n  name: mem1\n  mem:\n    broken: true\n", false, []string{"mem:mem2", "mem:mem1"}},
+		{"remove", "- kind: mem\n  name: mem2\n", false, []string{"mem:mem2"}},
+	}
+
+	for _, data := range table {
+		write(data.conf)
+
+		before := app.repositories()
+
+		err := reloadRepos(app, data.name)
+		if data.errorExp != (err != nil) {
+			t.Errorf("%s: expected error=%t got: %v", data.name, data.errorExp, err)
+		}
+		if err != nil && app.repositories() != before {
+			t.Errorf("%s: failed reload must keep current repositories", data.name)
+		}
+
+		names := repoNames(app.repositories().list)
+		if len(names) != len(data.expected) {
+			t.Errorf("%s: expected repositories %v, got %v", data.name, data.expected, names)
+			continue
+		}
+		for i := range names {
+			if names[i] != data.expected[i] {
+				t.Errorf("%s: expected repositories %v, got %v", data.name, data.expected, names)
+				break
+			}
+		}
+
+		if data.name == "reorder" && app.repositories().list[1] != mem1 {
+			t.Errorf("%s: unchanged repository mem1 should have been reused", data.name)
+		}
+		if data.name == "change" && app.repositories().list[1] == mem1 {
+			t.Errorf("%s: changed repository mem1 should have been recreated", data.name)
+		}
+	}
+}
+
+// go test -v -run TestRepositoriesBeforeInit ./cmd/gateboard
+func TestRepositoriesBeforeInit(t *testing.T) {
+	app := &application{config: appConfig{writeRetry: 1}}
+
+	if n := len(app.repositories().list); n != 0 {
+		t.Errorf("expected empty repository set, got %d repositories", n)
+	}
+
+	if _, _, err := repoGetMultiple(context.TODO(), app, "gw1"); err == nil {
+		t.Errorf("expected error from empty repository set")
+	}
+	if err := repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges); err == nil {
+		t.Errorf("expected error from empty repository set")
+	}
+}
+
+// go test -v -run TestReloadReposWritePolicy ./cmd/gateboard
+func TestReloadReposWritePolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repo.yaml")
+
+	write := func(conf string) {
+		if err := os.WriteFile(path, []byte(conf), 0o600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	write("- kind: mem\n  name: mem1\n- kind: mem\n  name: mem2\n")
+
+	app := newTestAppMultirepo(path)
+
+	policy, errPolicy := parseWritePolicy("min:2")
+	if errPolicy != nil {
+		t.Fatalf("policy: %v", errPolicy)
+	}
+	app.writePolicy = policy
+
+	before := app.repositories()
+
+	write("- kind: mem\n  name: mem1\n")
+
+	if err := reloadRepos(app, "shrink"); err == nil {
+		t.Errorf("expected reload rejected by write policy min:2 with one repository")
+	}
+	if app.repositories() != before {
+		t.Errorf("rejected reload must keep current repositories")
+	}
+}
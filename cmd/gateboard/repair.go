@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+// repairSource is recorded in history for changes written by repair.
+const repairSource = "repair"
+
+// repairEntry is one gateway as seen by one repository.
+type repairEntry struct {
+	gatewayID  string
+	deleted    bool
+	changes    int64
+	lastUpdate time.Time
+}
+
+// sameContent reports whether e needs no repair to match winner.
+// Tokens are not compared: PutToken updates neither last_update nor changes,
+// hence the winner does not tell which token is the most recent.
+func (e repairEntry) sameContent(winner repairEntry) bool {
+	if winner.deleted {
+		return e.deleted
+	}
+	return !e.deleted && e.gatewayID == winner.gatewayID
+}
+
+// newer reports whether e wins over other: most recent update wins,
+// then highest changes counter.
+func (e repairEntry) newer(other repairEntry) bool {
+	if !e.lastUpdate.Equal(other.lastUpdate) {
+		return e.lastUpdate.After(other.lastUpdate)
+	}
+	return e.changes > other.changes
+}
+
+type repairRepo struct {
+	Name      string `json:"name"`
+	Entries   int    `json:"entries"`
+	Divergent int    `json:"divergent"`
+	Repaired  int    `json:"repaired"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+type repairReport struct {
+	Gateways     int          `json:"gateways"`
+	Divergent    int          `json:"divergent"`
+	Repaired     int          `json:"repaired"`
+	Failed       int          `json:"failed"`
+	Elapsed      string       `json:"elapsed"`
+	Repositories []repairRepo `json:"repositories"`
+	Error        string       `json:"error,omitempty"`
+}
+
+// repairer periodically reconciles repositories.
+func repairer(app *application) {
+	const me = "repairer"
+
+	zlog.Infof("%s: interval=%v", me, app.config.repairInterval)
+
+	for {
+		time.Sleep(repairJitter(app.config.repairInterval))
+		if _, err := repairRepos(context.TODO(), app); err != nil {
+			zlog.Errorf("%s: %v", me, err)
+		}
+	}
+}
+
+// repairJitter spreads interval randomly between 50% and 150% of its value,
+// so replicas started together do not all repair at the same time.
+func repairJitter(interval time.Duration) time.Duration {
+	return interval/2 + time.Duration(rand.Int63n(int64(interval)))
+}
+
+var errRepairBusy = fmt.Errorf("repair already running")
+
+// repairRepos dumps every repository, finds the winning entry for each
+// gateway and writes it back to repositories holding divergent entries.
+// Repositories that fail to dump are left out of the comparison.
+// Live entries are rewritten with compare-and-swap, hence a concurrent
+// regular write prevails over the repair.
+func repairRepos(ctx context.Context, app *application) (repairReport, error) {
+	const me = "repairRepos"
+
+	var report repairReport
+
+	if !app.repairMutex.TryLock() {
+		return report, errRepairBusy
+	}
+	defer app.repairMutex.Unlock()
+
+	ctxNew, span := newSpan(ctx, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	begin := time.Now()
+
+	repoList := app.repositories().list
+
+	if len(repoList) < 2 {
+		report.Elapsed = time.Since(begin).String()
+		return report, nil // nothing to compare, skip dumping
+	}
+
+	report.Repositories = make([]repairRepo, len(repoList))
+
+	views := make([]map[string]repairEntry, len(repoList))
+	names := map[string]bool{}
+
+	for i, repo := range repoList {
+		report.Repositories[i].Name = repo.RepoName()
+
+		d, errDump := repo.Dump(ctxNew, repository.DumpFilter{})
+		if errDump != nil {
+			report.Repositories[i].Error = errDump.Error()
+			traceError(span, errDump.Error())
+			zlog.CtxErrorf(ctxNew, "%s: repo=%s dump error: %v", me, repo.RepoName(), errDump)
+			continue
+		}
+
+		view := map[string]repairEntry{}
+		for _, item := range d {
+			name, _ := item["gateway_name"].(string)
+			view[name] = repairEntry{
+				gatewayID:  repository.DumpString(item["gateway_id"]),
+				deleted:    repository.DumpBool(item["deleted"]),
+				changes:    repository.DumpInt64(item["changes"]),
+				lastUpdate: repository.DumpTime(item["last_update"]),
+			}
+			names[name] = true
+		}
+		views[i] = view
+		report.Repositories[i].Entries = len(view)
+	}
+
+	var available int
+	for _, view := range views {
+		if view != nil {
+			available++
+		}
+	}
+	if available < 2 {
+		report.Elapsed = time.Since(begin).String()
+		return report, fmt.Errorf("%s: need at least two repositories to compare, got %d/%d",
+			me, available, len(repoList))
+	}
+
+	report.Gateways = len(names)
+
+	for name := range names {
+		var winner repairEntry
+		var found bool
+		for _, view := range views {
+			if e, ok := view[name]; ok && (!found || e.newer(winner)) {
+				winner = e
+				found = true
+			}
+		}
+
+		var divergent bool
+
+		for i, view := range views {
+			if view == nil {
+				continue // dump failed
+			}
+
+			e, exists := view[name]
+			if !exists && winner.deleted {
+				continue // missing and tombstone are equivalent
+			}
+			if exists && e.sameContent(winner) {
+				continue
+			}
+
+			divergent = true
+			report.Repositories[i].Divergent++
+
+			errRepair := repairEntryInRepo(ctxNew, repoList[i], name, winner, e, exists)
+
+			zlog.CtxDebugf(ctxNew, app.config.debug || errRepair != nil,
+				"%s: repo=%s gateway_name=%s winner_id=%s winner_deleted=%t error:%v",
+				me, repoList[i].RepoName(), name, winner.gatewayID, winner.deleted, errRepair)
+
+			if errRepair != nil {
+				report.Repositories[i].Failed++
+				report.Failed++
+				recordRepositoryRepair(repoList[i].RepoName(), repoStatusError)
+				continue
+			}
+
+			report.Repositories[i].Repaired++
+			report.Repaired++
+			recordRepositoryRepair(repoList[i].RepoName(), repoStatusOK)
+		}
+
+		if divergent {
+			report.Divergent++
+		}
+	}
+
+	for _, r := range report.Repositories {
+		recordRepositoryDivergence(r.Name, r.Divergent)
+	}
+
+	report.Elapsed = time.Since(begin).String()
+
+	zlog.CtxInfof(ctxNew, "%s: gateways=%d divergent=%d repaired=%d failed=%d elapsed=%s",
+		me, report.Gateways, report.Divergent, report.Repaired, report.Failed, report.Elapsed)
+
+	return report, nil
+}
+
+// repairEntryInRepo makes repo match winner.
+func repairEntryInRepo(ctx context.Context, repo repository.Repository, name string, winner, current repairEntry, exists bool) error {
+	if winner.deleted {
+		return repo.Delete(ctx, name, repairSource)
+	}
+
+	var expected int64
+	if exists {
+		expected = current.changes
+	}
+
+	return repo.Put(ctx, name, winner.gatewayID, repairSource, expected)
+}
+
+// adminRepair implements POST /admin/repair: runs repair immediately.
+func adminRepair(c *gin.Context, app *application) {
+	const me = "adminRepair"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	fail := func(status int, format string, a ...any) {
+		out := repairReport{Error: fmt.Sprintf(format, a...)}
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s: %s", me, out.Error)
+		c.JSON(status, out)
+	}
+
+	if status, msg := adminUnauthorized(c, app); status != 0 {
+		fail(status, "%s", msg)
+		return
+	}
+
+	report, errRepair := repairRepos(ctx, app)
+	switch {
+	case errRepair == errRepairBusy:
+		fail(http.StatusConflict, "%v", errRepair)
+		return
+	case errRepair != nil:
+		report.Error = errRepair.Error()
+		c.JSON(http.StatusInternalServerError, report)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+// go test -v -run TestRepair ./cmd/gateboard
+func TestRepair(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+
+	ctx := context.TODO()
+	repoList := app.repositories().list
+	mem1, mem2 := repoList[0], repoList[1]
+
+	put := func(repo repository.Repository, name, id string) {
+		t.Helper()
+		if err := repo.Put(ctx, name, id, "test", repository.AnyChanges); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+		time.Sleep(time.Millisecond) // keep last_update distinct
+	}
+
+	put(mem1, "only1", "id1") // missing from mem2
+
+	put(mem1, "updated", "old")
+	put(mem2, "updated", "old")
+	put(mem1, "updated", "new") // mem2 lagging
+
+	put(mem1, "deleted", "id1")
+	put(mem2, "deleted", "id1")
+	if err := mem2.Delete(ctx, "deleted", "test"); err != nil { // mem1 lagging
+		t.Fatalf("delete: %v", err)
+	}
+
+	put(mem1, "same", "id1")
+	put(mem2, "same", "id1")
+
+	app.config.adminToken = "admin1"
+
+	send := func(bearer string) (int, repairReport) {
+		t.Helper()
+		req, _ := http.NewRequest("POST", "/admin/repair", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		w := httptest.NewRecorder()
+		app.serverMain.router.ServeHTTP(w, req)
+		var report repairReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("json: %v: %s", err, w.Body.String())
+		}
+		return w.Code, report
+	}
+
+	if status, _ := send("wrong"); status != 401 {
+		t.Errorf("bad admin token: expected status 401, got %d", status)
+	}
+
+	status, report := send("admin1")
+	if status != 200 {
+		t.Fatalf("repair: status=%d error=%s", status, report.Error)
+	}
+	if report.Gateways != 4 || report.Divergent != 3 || report.Repaired != 3 || report.Failed != 0 {
+		t.Errorf("repair: unexpected report: %+v", report)
+	}
+
+	expect := []struct {
+		name    string
+		id      string
+		deleted bool
+	}{
+		{"only1", "id1", false},
+		{"updated", "new", false},
+		{"deleted", "", true},
+		{"same", "id1", false},
+	}
+
+	for _, e := range expect {
+		for _, repo := range []repository.Repository{mem1, mem2} {
+			body, err := repo.Get(ctx, e.name)
+			if err != nil {
+				t.Errorf("%s: %s: get: %v", repo.RepoName(), e.name, err)
+				continue
+			}
+			if body.GatewayID != e.id || body.Deleted != e.deleted {
+				t.Errorf("%s: %s: expected id=%s deleted=%t, got id=%s deleted=%t",
+					repo.RepoName(), e.name, e.id, e.deleted, body.GatewayID, body.Deleted)
+			}
+		}
+	}
+
+	// repaired repositories converge
+
+	status, report = send("admin1")
+	if status != 200 || report.Divergent != 0 || report.Repaired != 0 {
+		t.Errorf("second repair: expected no divergence, got status=%d report=%+v", status, report)
+	}
+}
+
+// go test -v -run TestRepairBrokenRepo ./cmd/gateboard
+func TestRepairBrokenRepo(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_goodnbad.yaml")
+
+	if _, err := repairRepos(context.TODO(), app); err == nil {
+		t.Errorf("expected error when only one repository can be compared")
+	}
+}
+
+// go test -v -run TestRepairToken ./cmd/gateboard
+func TestRepairToken(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+
+	ctx := context.TODO()
+	repoList := app.repositories().list
+	mem1, mem2 := repoList[0], repoList[1]
+
+	for _, repo := range []repository.Repository{mem2, mem1} { // mem1 wins, most recent
+		if err := repo.Put(ctx, "gw1", "id1", "test", repository.AnyChanges); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		time.Sleep(time.Millisecond) // keep last_update distinct
+	}
+
+	// token issued only in the losing repository
+	if err := mem2.PutToken(ctx, "gw1", "tk1"); err != nil {
+		t.Fatalf("put token: %v", err)
+	}
+
+	report, errRepair := repairRepos(ctx, app)
+	if errRepair != nil {
+		t.Fatalf("repair: %v", errRepair)
+	}
+	if report.Divergent != 0 || report.Repaired != 0 {
+		t.Errorf("repair: tokens alone must not diverge, got %+v", report)
+	}
+
+	// gateway repaired, token kept
+
+	if err := mem1.Put(ctx, "gw1", "id2", "test", repository.AnyChanges); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	report, errRepair = repairRepos(ctx, app)
+	if errRepair != nil {
+		t.Fatalf("repair: %v", errRepair)
+	}
+	if report.Repaired != 1 {
+		t.Errorf("repair: expected 1 repaired, got %+v", report)
+	}
+
+	body, _ := mem2.Get(ctx, "gw1")
+	if body.GatewayID != "id2" {
+		t.Errorf("gateway not repaired: %q", body.GatewayID)
+	}
+	if body.Token != "tk1" {
+		t.Errorf("token overwritten by repair: %q", body.Token)
+	}
+	if body1, _ := mem1.Get(ctx, "gw1"); body1.Token != "" {
+		t.Errorf("token copied by repair: %q", body1.Token)
+	}
+}
+
+// go test -v -run TestRepairSingleRepo ./cmd/gateboard
+func TestRepairSingleRepo(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem.yaml")
+
+	report, errRepair := repairRepos(context.TODO(), app)
+	if errRepair != nil {
+		t.Errorf("single repository: unexpected error: %v", errRepair)
+	}
+	if len(report.Repositories) != 0 {
+		t.Errorf("single repository: unexpected dump: %+v", report)
+	}
+}
+
+// go test -v -run TestRepairJitter ./cmd/gateboard
+func TestRepairJitter(t *testing.T) {
+	const interval = time.Hour
+	for range 100 {
+		if j := repairJitter(interval); j < interval/2 || j >= 3*interval/2 {
+			t.Fatalf("jitter out of range: %v", j)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package repository
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/udhos/boilerplate/awsconfig"
+	"github.com/udhos/boilerplate/secret"
+	"gopkg.in/yaml.v3"
+)
+
+// Config describes a repository, as listed in the repository config file.
+type Config struct {
+	Kind       string          `json:"kind"                  yaml:"kind"` // mem | mongo | redis | dynamodb | s3 | postgres | file | etcd | consul | kubernetes | ssm
+	Name       string          `json:"name"                  yaml:"name"`
+	HistoryMax *int            `json:"history_max,omitempty" yaml:"history_max,omitempty"` // history entries kept per gateway, 0 means unlimited
+	Mongo      *mongoConfig    `json:"mongo,omitempty"       yaml:"mongo,omitempty"`
+	DynamoDB   *dynamoDBConfig `json:"dynamodb,omitempty"    yaml:"dynamodb,omitempty"`
+	Redis      *redisConfig    `json:"redis,omitempty"       yaml:"redis,omitempty"`
+	S3         *s3Config       `json:"s3,omitempty"          yaml:"s3,omitempty"`
+	Postgres   *postgresConfig `json:"postgres,omitempty"    yaml:"postgres,omitempty"`
+	File       *fileConfig     `json:"file,omitempty"        yaml:"file,omitempty"`
+	Etcd       *etcdConfig     `json:"etcd,omitempty"        yaml:"etcd,omitempty"`
+	Consul     *consulConfig   `json:"consul,omitempty"      yaml:"consul,omitempty"`
+	Kube       *kubeConfig     `json:"kubernetes,omitempty"  yaml:"kubernetes,omitempty"`
+	SSM        *ssmConfig      `json:"ssm,omitempty"         yaml:"ssm,omitempty"`
+	Mem        memConfig       `json:"mem,omitempty"         yaml:"mem,omitempty"`
+}
+
+type mongoConfig struct {
+	URI                   string        `json:"uri"                     yaml:"uri"`
+	Database              string        `json:"database"                yaml:"database"`
+	Collection            string        `json:"collection"              yaml:"collection"`
+	Username              string        `json:"username"                yaml:"username"`
+	Password              string        `json:"password"                yaml:"password"`
+	TLSCaFile             string        `json:"tls_ca_file"             yaml:"tls_ca_file"`
+	MinPool               uint64        `json:"min_pool"                yaml:"min_pool"`
+	IndexCreationDisable  bool          `json:"index_creation_disable"  yaml:"index_creation_disable"`
+	IndexCreationRetry    int           `json:"index_creation_retry"    yaml:"index_creation_retry"`
+	IndexCreationCooldown time.Duration `json:"index_creation_cooldown" yaml:"index_creation_cooldown"`
+	ChangeStream          bool          `json:"change_stream"           yaml:"change_stream"`
+	ChangeStreamResumeID  string        `json:"change_stream_resume_id" yaml:"change_stream_resume_id"`
+}
+
+type dynamoDBConfig struct {
+	Table               string   `json:"table"                  yaml:"table"`
+	Region              string   `json:"region"                 yaml:"region"`
+	RoleArn             string   `json:"role_arn"               yaml:"role_arn"`
+	ManualCreate        bool     `json:"manual_create"          yaml:"manual_create"`
+	BillingMode         string   `json:"billing_mode"           yaml:"billing_mode"`
+	ReadCapacity        int64    `json:"read_capacity"          yaml:"read_capacity"`
+	WriteCapacity       int64    `json:"write_capacity"         yaml:"write_capacity"`
+	Replicas            []string `json:"replicas"               yaml:"replicas"`
+	PointInTimeRecovery bool     `json:"point_in_time_recovery" yaml:"point_in_time_recovery"`
+	EndpointURL         string   `json:"endpoint_url"           yaml:"endpoint_url"`
+}
+
+type redisConfig struct {
+	Addr                  string        `json:"addr"                     yaml:"addr"`
+	Password              string        `json:"password"                 yaml:"password"`
+	Key                   string        `json:"key"                      yaml:"key"`
+	TLS                   bool          `json:"tls"                      yaml:"tls"`
+	TLSInsecureSkipVerify bool          `json:"tls_insecure_skip_verify" yaml:"tls_insecure_skip_verify"`
+	ClientName            string        `json:"client_name"              yaml:"client_name"`
+	DB                    int           `json:"db"                       yaml:"db"`
+	Cluster               bool          `json:"cluster"                  yaml:"cluster"`
+	ClusterAddrs          []string      `json:"cluster_addrs"            yaml:"cluster_addrs"`
+	MasterName            string        `json:"master_name"              yaml:"master_name"`
+	SentinelAddrs         []string      `json:"sentinel_addrs"           yaml:"sentinel_addrs"`
+	SentinelPassword      string        `json:"sentinel_password"        yaml:"sentinel_password"`
+	PoolSize              int           `json:"pool_size"                yaml:"pool_size"`
+	MinIdleConns          int           `json:"min_idle_conns"           yaml:"min_idle_conns"`
+	PoolTimeout           time.Duration `json:"pool_timeout"             yaml:"pool_timeout"`
+}
+
+type ssmConfig struct {
+	Prefix   string `json:"prefix"     yaml:"prefix"`
+	Region   string `json:"region"     yaml:"region"`
+	RoleArn  string `json:"role_arn"   yaml:"role_arn"`
+	KmsKeyID string `json:"kms_key_id" yaml:"kms_key_id"`
+}
+
+type s3Config struct {
+	BucketName           string         `json:"bucket_name"            yaml:"bucket_name"`
+	BucketRegion         string         `json:"bucket_region"          yaml:"bucket_region"`
+	Prefix               string         `json:"prefix"                 yaml:"prefix"`
+	RoleArn              string         `json:"role_arn"               yaml:"role_arn"`
+	ManualCreate         bool           `json:"manual_create"          yaml:"manual_create"`
+	ServerSideEncryption string         `json:"server_side_encryption" yaml:"server_side_encryption"`
+	Index                bool           `json:"index"                  yaml:"index"`
+	IndexRebuildInterval *time.Duration `json:"index_rebuild_interval" yaml:"index_rebuild_interval"`
+	EndpointURL          string         `json:"endpoint_url"           yaml:"endpoint_url"`
+	ForcePathStyle       bool           `json:"force_path_style"       yaml:"force_path_style"`
+}
+
+type postgresConfig struct {
+	URL          string `json:"url"           yaml:"url"`
+	Username     string `json:"username"      yaml:"username"`
+	Password     string `json:"password"      yaml:"password"`
+	Table        string `json:"table"         yaml:"table"`
+	MaxConns     int32  `json:"max_conns"     yaml:"max_conns"`
+	ManualCreate bool   `json:"manual_create" yaml:"manual_create"`
+}
+
+type fileConfig struct {
+	Path          string        `json:"path"            yaml:"path"`
+	NoSync        bool          `json:"no_sync"         yaml:"no_sync"`
+	CompactOnOpen bool          `json:"compact_on_open" yaml:"compact_on_open"`
+	LockTimeout   time.Duration `json:"lock_timeout"    yaml:"lock_timeout"`
+}
+
+type etcdConfig struct {
+	Endpoints             []string `json:"endpoints"                yaml:"endpoints"`
+	Username              string   `json:"username"                 yaml:"username"`
+	Password              string   `json:"password"                 yaml:"password"`
+	Prefix                string   `json:"prefix"                   yaml:"prefix"`
+	TLS                   bool     `json:"tls"                      yaml:"tls"`
+	TLSInsecureSkipVerify bool     `json:"tls_insecure_skip_verify" yaml:"tls_insecure_skip_verify"`
+}
+
+type consulConfig struct {
+	Address               string `json:"address"                  yaml:"address"`
+	Scheme                string `json:"scheme"                   yaml:"scheme"`
+	Datacenter            string `json:"datacenter"               yaml:"datacenter"`
+	Token                 string `json:"token"                    yaml:"token"`
+	Prefix                string `json:"prefix"                   yaml:"prefix"`
+	TLSInsecureSkipVerify bool   `json:"tls_insecure_skip_verify" yaml:"tls_insecure_skip_verify"`
+}
+
+type kubeConfig struct {
+	Namespace  string `json:"namespace"   yaml:"namespace"`
+	HistoryMax int    `json:"history_max" yaml:"history_max"`
+}
+
+type memConfig struct {
+	Broken bool          `json:"broken" yaml:"broken"`
+	Delay  time.Duration `json:"delay"  yaml:"delay"`
+}
+
+// LoadConfig reads the list of repositories from the yaml file input.
+func LoadConfig(input string) ([]Config, error) {
+
+	const me = "LoadConfig"
+
+	reader, errOpen := os.Open(input)
+	if errOpen != nil {
+		return nil, fmt.Errorf("%s: open file: %s: %v", me, input, errOpen)
+	}
+
+	buf, errRead := io.ReadAll(reader)
+	if errRead != nil {
+		return nil, fmt.Errorf("%s: read file: %s: %v", me, input, errRead)
+	}
+
+	var conf []Config
+
+	errYaml := yaml.Unmarshal(buf, &conf)
+	if errYaml != nil {
+		return conf, fmt.Errorf("%s: parse yaml: %s: %v", me, input, errYaml)
+	}
+
+	return conf, nil
+}
+
+// New creates the repository described by config.
+// secretRoleArn is assumed to retrieve secrets referenced by config.
+func New(sessionName, secretRoleArn string, config Config, debug bool) (Repository, error) {
+
+	const me = "New"
+
+	awsConfOptions := awsconfig.Options{
+		RoleArn:         secretRoleArn,
+		RoleSessionName: sessionName,
+	}
+
+	sec := secret.New(secret.Options{
+		AwsConfigSource: &secret.AwsConfigSource{AwsConfigOptions: awsConfOptions},
+	})
+
+	kind := config.Kind
+	metricRepoName := kind + ":" + config.Name
+
+	historyMax := historyMaxDefault
+	if config.HistoryMax != nil {
+		historyMax = *config.HistoryMax
+	}
+	if historyMax < 0 {
+		return nil, fmt.Errorf("%s: invalid negative history_max=%d", me, historyMax)
+	}
+
+	switch kind {
+	case "mongo":
+		repo, errMongo := newRepoMongo(repoMongoOptions{
+			metricRepoName:        metricRepoName,
+			debug:                 debug,
+			URI:                   config.Mongo.URI,
+			database:              config.Mongo.Database,
+			collection:            config.Mongo.Collection,
+			username:              config.Mongo.Username,
+			password:              sec.Retrieve(config.Mongo.Password),
+			tlsCAFile:             config.Mongo.TLSCaFile,
+			minPool:               config.Mongo.MinPool,
+			indexCreationDisable:  config.Mongo.IndexCreationDisable,
+			indexCreationRetry:    config.Mongo.IndexCreationRetry,
+			IndexCreationCooldown: config.Mongo.IndexCreationCooldown,
+			timeout:               time.Second * 10,
+			historyMax:            historyMax,
+		})
+		if errMongo != nil {
+			return nil, fmt.Errorf("%s: repo mongo: %v", me, errMongo)
+		}
+		if config.Mongo.ChangeStream {
+			return newRepoMongoStream(repo, config.Mongo.ChangeStreamResumeID), nil
+		}
+		return repo, nil
+	case "dynamodb":
+		repo, errDynamo := newRepoDynamo(repoDynamoOptions{
+			metricRepoName: metricRepoName,
+			debug:          debug,
+			table:          config.DynamoDB.Table,
+			region:         config.DynamoDB.Region,
+			roleArn:        config.DynamoDB.RoleArn,
+			manualCreate:   config.DynamoDB.ManualCreate,
+			sessionName:    sessionName,
+
+			billingMode:         config.DynamoDB.BillingMode,
+			readCapacity:        config.DynamoDB.ReadCapacity,
+			writeCapacity:       config.DynamoDB.WriteCapacity,
+			replicas:            config.DynamoDB.Replicas,
+			pointInTimeRecovery: config.DynamoDB.PointInTimeRecovery,
+			endpointURL:         config.DynamoDB.EndpointURL,
+			historyMax:          historyMax,
+		})
+		if errDynamo != nil {
+			return nil, fmt.Errorf("%s: repo dynamodb: %v", me, errDynamo)
+		}
+		return repo, nil
+	case "ssm":
+		repo, errSSM := newRepoSSM(repoSSMOptions{
+			metricRepoName: metricRepoName,
+			debug:          debug,
+			prefix:         config.SSM.Prefix,
+			region:         config.SSM.Region,
+			roleArn:        config.SSM.RoleArn,
+			kmsKeyID:       config.SSM.KmsKeyID,
+			sessionName:    sessionName,
+			historyMax:     historyMax,
+		})
+		if errSSM != nil {
+			return nil, fmt.Errorf("%s: repo ssm: %v", me, errSSM)
+		}
+		return repo, nil
+	case "redis":
+		opt := repoRedisOptions{
+			metricRepoName:        metricRepoName,
+			debug:                 debug,
+			addr:                  config.Redis.Addr,
+			password:              sec.Retrieve(config.Redis.Password),
+			key:                   config.Redis.Key,
+			tls:                   config.Redis.TLS,
+			tlsInsecureSkipVerify: config.Redis.TLSInsecureSkipVerify,
+			clientName:            config.Redis.ClientName,
+			db:                    config.Redis.DB,
+			cluster:               config.Redis.Cluster,
+			clusterAddrs:          config.Redis.ClusterAddrs,
+			masterName:            config.Redis.MasterName,
+			sentinelAddrs:         config.Redis.SentinelAddrs,
+			sentinelPassword:      sec.Retrieve(config.Redis.SentinelPassword),
+			poolSize:              config.Redis.PoolSize,
+			minIdleConns:          config.Redis.MinIdleConns,
+			poolTimeout:           config.Redis.PoolTimeout,
+			historyMax:            historyMax,
+		}
+		if opt.clientName == "auto" {
+			host, errHost := os.Hostname()
+			if errHost != nil {
+				return nil, fmt.Errorf("%s: repo redis: %v", me, errHost)
+			}
+			opt.clientName = host
+		}
+		repo, errRedis := newRepoRedis(opt)
+		if errRedis != nil {
+			return nil, fmt.Errorf("%s: repo redis: %v", me, errRedis)
+		}
+		return repo, nil
+	case "postgres":
+		repo, errPostgres := newRepoPostgres(repoPostgresOptions{
+			metricRepoName: metricRepoName,
+			debug:          debug,
+			URL:            config.Postgres.URL,
+			username:       config.Postgres.Username,
+			password:       sec.Retrieve(config.Postgres.Password),
+			table:          config.Postgres.Table,
+			maxConns:       config.Postgres.MaxConns,
+			manualCreate:   config.Postgres.ManualCreate,
+			timeout:        time.Second * 10,
+			historyMax:     historyMax,
+		})
+		if errPostgres != nil {
+			return nil, fmt.Errorf("%s: repo postgres: %v", me, errPostgres)
+		}
+		return repo, nil
+	case "file":
+		lockTimeout := config.File.LockTimeout
+		if lockTimeout == 0 {
+			lockTimeout = 5 * time.Second // zero would wait forever
+		}
+		repo, errFile := newRepoFile(repoFileOptions{
+			metricRepoName: metricRepoName,
+			debug:          debug,
+			path:           config.File.Path,
+			noSync:         config.File.NoSync,
+			compactOnOpen:  config.File.CompactOnOpen,
+			lockTimeout:    lockTimeout,
+			historyMax:     historyMax,
+		})
+		if errFile != nil {
+			return nil, fmt.Errorf("%s: repo file: %v", me, errFile)
+		}
+		return repo, nil
+	case "etcd":
+		repo, errEtcd := newRepoEtcd(repoEtcdOptions{
+			metricRepoName:        metricRepoName,
+			debug:                 debug,
+			endpoints:             config.Etcd.Endpoints,
+			username:              config.Etcd.Username,
+			password:              sec.Retrieve(config.Etcd.Password),
+			prefix:                config.Etcd.Prefix,
+			tls:                   config.Etcd.TLS,
+			tlsInsecureSkipVerify: config.Etcd.TLSInsecureSkipVerify,
+			timeout:               time.Second * 10,
+			historyMax:            historyMax,
+		})
+		if errEtcd != nil {
+			return nil, fmt.Errorf("%s: repo etcd: %v", me, errEtcd)
+		}
+		return repo, nil
+	case "consul":
+		repo, errConsul := newRepoConsul(repoConsulOptions{
+			metricRepoName:        metricRepoName,
+			debug:                 debug,
+			address:               config.Consul.Address,
+			scheme:                config.Consul.Scheme,
+			datacenter:            config.Consul.Datacenter,
+			token:                 sec.Retrieve(config.Consul.Token),
+			prefix:                config.Consul.Prefix,
+			tlsInsecureSkipVerify: config.Consul.TLSInsecureSkipVerify,
+			timeout:               time.Second * 10,
+			historyMax:            historyMax,
+		})
+		if errConsul != nil {
+			return nil, fmt.Errorf("%s: repo consul: %v", me, errConsul)
+		}
+		return repo, nil
+	case "kubernetes":
+		opt := repoKubeOptions{
+			metricRepoName: metricRepoName,
+			debug:          debug,
+			historyMax:     historyMax,
+			timeout:        time.Second * 10,
+		}
+		if config.Kube != nil {
+			opt.namespace = config.Kube.Namespace
+			if config.Kube.HistoryMax != 0 && config.HistoryMax == nil {
+				opt.historyMax = config.Kube.HistoryMax // deprecated location
+			}
+		}
+		repo, errKube := newRepoKube(opt)
+		if errKube != nil {
+			return nil, fmt.Errorf("%s: repo kubernetes: %v", me, errKube)
+		}
+		return repo, nil
+	case "mem":
+		return newRepoMem(repoMemOptions{
+			metricRepoName: metricRepoName,
+			broken:         config.Mem.Broken,
+			delay:          config.Mem.Delay,
+			historyMax:     historyMax,
+		}), nil
+	case "s3":
+		indexRebuildInterval := s3IndexRebuildIntervalDefault
+		if config.S3.IndexRebuildInterval != nil {
+			indexRebuildInterval = *config.S3.IndexRebuildInterval
+		}
+		repo, errS3 := newRepoS3(repoS3Options{
+			metricRepoName:       metricRepoName,
+			debug:                debug,
+			bucket:               config.S3.BucketName,
+			region:               config.S3.BucketRegion,
+			prefix:               config.S3.Prefix,
+			roleArn:              config.S3.RoleArn,
+			manualCreate:         config.S3.ManualCreate,
+			serverSideEncryption: config.S3.ServerSideEncryption,
+			index:                config.S3.Index,
+			indexRebuildInterval: indexRebuildInterval,
+			endpointURL:          config.S3.EndpointURL,
+			forcePathStyle:       config.S3.ForcePathStyle,
+			historyMax:           historyMax,
+			sessionName:          sessionName,
+		})
+		if errS3 != nil {
+			return nil, fmt.Errorf("%s: repo s3: %v", me, errS3)
+		}
+		return repo, nil
+	}
+
+	return nil, fmt.Errorf("%s: unsupported repo type: %s (supported types: mongo, dynamodb, mem, redis, s3, postgres, file, etcd, consul, kubernetes, ssm)", me, kind)
+}
@@ -0,0 +1,510 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: Consul KV
+//
+// <prefix>gateway/<name>                   JSON-encoded gateboard.BodyGetReply
+// <prefix>history/<escaped name>/<changes> JSON-encoded gateboard.HistoryEntry
+//
+
+type repoConsulOptions struct {
+	metricRepoName        string // kind:name
+	debug                 bool
+	address               string
+	scheme                string
+	datacenter            string
+	token                 string
+	prefix                string
+	tlsInsecureSkipVerify bool
+	timeout               time.Duration
+	historyMax            int // 0 means unlimited
+}
+
+type repoConsul struct {
+	options repoConsulOptions
+	kv      *api.KV
+	txn     *api.Txn
+}
+
+func newRepoConsul(opt repoConsulOptions) (*repoConsul, error) {
+	const me = "newRepoConsul"
+
+	config := api.DefaultConfig() // honors CONSUL_HTTP_* env vars
+	if opt.address != "" {
+		config.Address = opt.address
+	}
+	if opt.scheme != "" {
+		config.Scheme = opt.scheme
+	}
+	if opt.datacenter != "" {
+		config.Datacenter = opt.datacenter
+	}
+	if opt.token != "" {
+		config.Token = opt.token
+	}
+	if opt.tlsInsecureSkipVerify {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+
+	client, errClient := api.NewClient(config)
+	if errClient != nil {
+		return nil, fmt.Errorf("%s: %v", me, errClient)
+	}
+
+	return &repoConsul{options: opt, kv: client.KV(), txn: client.Txn()}, nil
+}
+
+func (r *repoConsul) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoConsul) DropDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	_, err := r.kv.DeleteTree(r.options.prefix, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+func (r *repoConsul) gatewayPrefix() string {
+	return r.options.prefix + "gateway/"
+}
+
+// historyPrefix escapes the name, otherwise the history of gateway "a"
+// would include the history of gateway "a/b".
+func (r *repoConsul) historyPrefix(gatewayName string) string {
+	return r.options.prefix + "history/" + url.PathEscape(gatewayName) + "/"
+}
+
+// historyKey pads changes so that keys sort by ascending changes counter.
+func (r *repoConsul) historyKey(gatewayName string, changes int64) string {
+	return fmt.Sprintf("%s%020d", r.historyPrefix(gatewayName), changes)
+}
+
+// load returns the entry and its modify index, which is 0 for a missing key.
+func (r *repoConsul) load(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, uint64, error) {
+	body := gateboard.BodyGetReply{GatewayName: gatewayName}
+
+	pair, _, errGet := r.kv.Get(r.gatewayPrefix()+gatewayName, (&api.QueryOptions{}).WithContext(ctx))
+	if errGet != nil {
+		return body, 0, errGet
+	}
+	if pair == nil {
+		return body, 0, nil
+	}
+
+	if errJSON := json.Unmarshal(pair.Value, &body); errJSON != nil {
+		return body, 0, errJSON
+	}
+
+	return body, pair.ModifyIndex, nil
+}
+
+// dump reads every gateway under the name prefix, even for a page,
+// since the consul KV API cannot start listing at a key.
+func (r *repoConsul) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoConsul.dump"
+
+	list := Dump{}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	pairs, _, errList := r.kv.List(r.gatewayPrefix()+filter.NamePrefix(), (&api.QueryOptions{}).WithContext(ctxTimeout))
+	if errList != nil {
+		zlog.CtxErrorf(ctx, "%s: %v", me, errList)
+		return list, errList
+	}
+
+	for _, pair := range pairs {
+		var body gateboard.BodyGetReply
+		if errJSON := json.Unmarshal(pair.Value, &body); errJSON != nil {
+			zlog.CtxErrorf(ctx, "%s: key=%s: %v", me, pair.Key, errJSON)
+			return list, errJSON
+		}
+		if !filter.Match(body.GatewayName, body.LastUpdate) {
+			continue
+		}
+		list = append(list, map[string]interface{}{
+			"gateway_name": body.GatewayName,
+			"gateway_id":   body.GatewayID,
+			"changes":      body.Changes,
+			"last_update":  body.LastUpdate,
+			"token":        body.Token,
+			"deleted":      body.Deleted,
+		})
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+func (r *repoConsul) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoConsul.get"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return gateboard.BodyGetReply{}, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	body, index, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return body, errLoad
+	}
+	if index == 0 {
+		return body, ErrGatewayNotFound
+	}
+
+	return body, nil
+}
+
+// update runs a read-modify-write cycle on the gateway key, retrying while
+// other writers modify the key in between. modify changes the entry and
+// returns additional operations for the same transaction.
+func (r *repoConsul) update(ctx context.Context, gatewayName string,
+	modify func(body *gateboard.BodyGetReply) (api.TxnOps, error)) error {
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	key := r.gatewayPrefix() + gatewayName
+
+	var lastErrors api.TxnErrors
+
+	for range kvCasAttempts {
+		body, index, errLoad := r.load(ctxTimeout, gatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+
+		ops, errModify := modify(&body)
+		if errModify != nil {
+			return errModify
+		}
+
+		buf, errJSON := json.Marshal(body)
+		if errJSON != nil {
+			return errJSON
+		}
+
+		// cas with index 0 only succeeds if the key does not exist
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVCAS, Key: key, Value: buf, Index: index}})
+
+		ok, resp, _, errTxn := r.txn.Txn(ops, (&api.QueryOptions{}).WithContext(ctxTimeout))
+		if errTxn != nil {
+			return errTxn
+		}
+		if ok {
+			return nil
+		}
+		lastErrors = resp.Errors
+	}
+
+	return fmt.Errorf("gave up after %d concurrent modifications: %v", kvCasAttempts, lastErrors)
+}
+
+// change bumps the changes counter and returns the operation recording it in history.
+func (r *repoConsul) change(body *gateboard.BodyGetReply, source string) (api.TxnOps, error) {
+	body.Changes++
+	body.LastUpdate = time.Now()
+
+	buf, errJSON := json.Marshal(gateboard.HistoryEntry{
+		GatewayID: body.GatewayID,
+		Changes:   body.Changes,
+		Timestamp: body.LastUpdate,
+		Source:    source,
+		Deleted:   body.Deleted,
+	})
+	if errJSON != nil {
+		return nil, errJSON
+	}
+
+	return api.TxnOps{
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: r.historyKey(body.GatewayName, body.Changes), Value: buf}},
+	}, nil
+}
+
+func (r *repoConsul) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoConsul.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	var changes int64
+
+	err := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) (api.TxnOps, error) {
+		if expectedChanges != AnyChanges && body.Changes != expectedChanges {
+			return nil, ErrConflict
+		}
+		body.GatewayID = gatewayID
+		body.Deleted = false
+		ops, errChange := r.change(body, source)
+		changes = body.Changes
+		return ops, errChange
+	})
+	if err != nil && err != ErrConflict {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+	if err == nil {
+		r.trimHistory(ctx, gatewayName, changes)
+	}
+
+	return err
+}
+
+func (r *repoConsul) Delete(ctx context.Context, gatewayName, source string) error {
+	const me = "repoConsul.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	var changes int64
+
+	err := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) (api.TxnOps, error) {
+		body.GatewayID = ""
+		body.Deleted = true
+		ops, errChange := r.change(body, source)
+		changes = body.Changes
+		return ops, errChange
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+	if err == nil {
+		r.trimHistory(ctx, gatewayName, changes)
+	}
+
+	return err
+}
+
+// trimHistory removes history expired by the change just recorded. Consul
+// has no range delete, hence keys are listed first. Failures only leave
+// extra entries, removed by later writes.
+func (r *repoConsul) trimHistory(ctx context.Context, gatewayName string, changes int64) {
+	const me = "repoConsul.trimHistory"
+
+	cutoff := historyCutoff(changes, r.options.historyMax)
+	if cutoff == 0 {
+		return
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	keys, _, errKeys := r.kv.Keys(r.historyPrefix(gatewayName), "", (&api.QueryOptions{}).WithContext(ctxTimeout))
+	if errKeys != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errKeys)
+		return
+	}
+	slices.Sort(keys)
+
+	last := r.historyKey(gatewayName, cutoff)
+
+	var ops api.TxnOps
+	for _, k := range keys {
+		if k > last || len(ops) == consulMaxTxnOps {
+			break
+		}
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDelete, Key: k}})
+	}
+	if len(ops) == 0 {
+		return
+	}
+
+	ok, resp, _, errTxn := r.txn.Txn(ops, (&api.QueryOptions{}).WithContext(ctxTimeout))
+	if errTxn == nil && !ok {
+		errTxn = fmt.Errorf("txn: %v", resp.Errors)
+	}
+	if errTxn != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errTxn)
+	}
+}
+
+func (r *repoConsul) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoConsul.history"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	// consul lists keys in lexicographic order
+	pairs, _, errList := r.kv.List(r.historyPrefix(gatewayName), (&api.QueryOptions{}).WithContext(ctxTimeout))
+	if errList != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errList)
+		return nil, errList
+	}
+
+	list := make([]gateboard.HistoryEntry, 0, len(pairs))
+	for _, pair := range pairs {
+		var h gateboard.HistoryEntry
+		if errJSON := json.Unmarshal(pair.Value, &h); errJSON != nil {
+			zlog.CtxErrorf(ctx, "%s: key=%s: %v", me, pair.Key, errJSON)
+			return nil, errJSON
+		}
+		list = append(list, h)
+	}
+
+	return list, nil
+}
+
+func (r *repoConsul) Purge(ctx context.Context, gatewayName string) error {
+	const me = "repoConsul.purge"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	body, index, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return errLoad
+	}
+	if index == 0 || !body.Deleted {
+		return nil
+	}
+
+	// if the tombstone was overwritten meanwhile, the entry is live and must stay
+	ops := api.TxnOps{
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDeleteCAS, Key: r.gatewayPrefix() + gatewayName, Index: index}},
+		// changes counter restarts, so history must go too
+		&api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVDeleteTree, Key: r.historyPrefix(gatewayName)}},
+	}
+
+	_, _, _, errTxn := r.txn.Txn(ops, (&api.QueryOptions{}).WithContext(ctxTimeout))
+	if errTxn != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errTxn)
+	}
+
+	return errTxn
+}
+
+// consulMaxTxnOps is the limit of operations in a consul transaction.
+const consulMaxTxnOps = 64
+
+func (r *repoConsul) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+	const me = "repoConsul.restore"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	if _, errDelete := r.kv.DeleteTree(r.historyPrefix(body.GatewayName), (&api.WriteOptions{}).WithContext(ctxTimeout)); errDelete != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, errDelete)
+		return errDelete
+	}
+
+	var ops api.TxnOps
+	history = historyTail(history, r.options.historyMax)
+	for i, h := range history {
+		buf, errJSON := json.Marshal(h)
+		if errJSON != nil {
+			return errJSON
+		}
+		ops = append(ops, &api.TxnOp{KV: &api.KVTxnOp{Verb: api.KVSet, Key: r.historyKey(body.GatewayName, h.Changes), Value: buf}})
+		if len(ops) < consulMaxTxnOps && i < len(history)-1 {
+			continue
+		}
+		ok, resp, _, errTxn := r.txn.Txn(ops, (&api.QueryOptions{}).WithContext(ctxTimeout))
+		if errTxn == nil && !ok {
+			errTxn = fmt.Errorf("history txn: %v", resp.Errors)
+		}
+		if errTxn != nil {
+			zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, errTxn)
+			return errTxn
+		}
+		ops = nil
+	}
+
+	body.Error = ""
+	body.TTL = 0
+
+	err := r.update(ctx, body.GatewayName, func(current *gateboard.BodyGetReply) (api.TxnOps, error) {
+		*current = body
+		return nil, nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoConsul) PutToken(ctx context.Context, gatewayName, token string) error {
+	const me = "repoConsul.putToken"
+
+	err := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) (api.TxnOps, error) {
+		body.Token = token
+		return nil, nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+// WatchChanges issues blocking queries on the gateway prefix.
+// Consul reports the whole prefix on every change, hence changed keys
+// are found by comparing modify indexes with the previous answer.
+func (r *repoConsul) WatchChanges(ctx context.Context, changed func(gatewayName string)) error {
+	gatewayPrefix := r.gatewayPrefix()
+
+	var waitIndex uint64
+	var known map[string]uint64 // key => modify index, nil before the first answer
+
+	for {
+		q := (&api.QueryOptions{WaitIndex: waitIndex, WaitTime: 5 * time.Minute}).WithContext(ctx)
+		pairs, meta, errList := r.kv.List(gatewayPrefix, q)
+		if errList != nil {
+			return errList
+		}
+
+		current := make(map[string]uint64, len(pairs))
+		for _, pair := range pairs {
+			current[pair.Key] = pair.ModifyIndex
+		}
+
+		if known != nil {
+			for key, index := range current {
+				if known[key] != index {
+					changed(strings.TrimPrefix(key, gatewayPrefix))
+				}
+			}
+			for key := range known {
+				if _, found := current[key]; !found {
+					changed(strings.TrimPrefix(key, gatewayPrefix)) // purged
+				}
+			}
+		}
+		known = current
+
+		// follow the index even when it goes backwards, which means consul state was reset
+		waitIndex = meta.LastIndex
+		if waitIndex < 1 {
+			waitIndex = 1
+		}
+	}
+}
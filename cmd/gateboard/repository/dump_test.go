@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// go test -v -run TestDumpFilter ./cmd/gateboard/repository
+func TestDumpFilter(t *testing.T) {
+	now := time.Now()
+
+	table := []struct {
+		filter     DumpFilter
+		namePrefix string
+		name       string
+		lastUpdate time.Time
+		expected   bool
+	}{
+		{DumpFilter{}, "", "gw1", now, true},
+		{DumpFilter{Prefix: "gw"}, "gw", "gw1", now, true},
+		{DumpFilter{Prefix: "gx"}, "gx", "gw1", now, false},
+		{DumpFilter{Account: "123"}, "123:", "123:us-east-1:gw1", now, true},
+		{DumpFilter{Account: "123"}, "123:", "456:us-east-1:gw1", now, false},
+		{DumpFilter{Account: "123"}, "123:", "123:gw1", now, false},
+		{DumpFilter{Account: "123", Region: "us-east-1"}, "123:us-east-1:", "123:us-east-1:gw1", now, true},
+		{DumpFilter{Account: "123", Region: "us-east-1"}, "123:us-east-1:", "123:sa-east-1:gw1", now, false},
+		{DumpFilter{Region: "us-east-1"}, "", "123:us-east-1:gw1", now, true},
+		{DumpFilter{Region: "us-east-1"}, "", "123:sa-east-1:gw1", now, false},
+		{DumpFilter{Prefix: "123:us", Account: "123"}, "123:us", "123:us-east-1:gw1", now, true},
+		{DumpFilter{Prefix: "1", Account: "123"}, "123:", "123:us-east-1:gw1", now, true},
+		{DumpFilter{Prefix: "9", Account: "123"}, "9", "123:us-east-1:gw1", now, false},
+		{DumpFilter{UpdatedSince: now}, "", "gw1", now, true},
+		{DumpFilter{UpdatedSince: now}, "", "gw1", now.Add(-time.Second), false},
+	}
+
+	for i, data := range table {
+		if p := data.filter.NamePrefix(); p != data.namePrefix {
+			t.Errorf("%d: %+v: namePrefix expected=%q got=%q", i, data.filter, data.namePrefix, p)
+		}
+		if m := data.filter.Match(data.name, data.lastUpdate); m != data.expected {
+			t.Errorf("%d: %+v: match(%s) expected=%t got=%t", i, data.filter, data.name, data.expected, m)
+		}
+	}
+}
+
+// go test -v -run TestGlobEscape ./cmd/gateboard/repository
+func TestGlobEscape(t *testing.T) {
+	table := []struct {
+		input    string
+		expected string
+	}{
+		{"gw1", "gw1"},
+		{"123:us-east-1:", "123:us-east-1:"},
+		{`a*b?c[d]e\f`, `a\*b\?c\[d\]e\\f`},
+	}
+	for _, data := range table {
+		if got := globEscape(data.input); got != data.expected {
+			t.Errorf("globEscape(%q): expected=%q got=%q", data.input, data.expected, got)
+		}
+	}
+}
+
+// go test -count=1 -run TestDumpFields ./cmd/gateboard/repository
+func TestDumpFields(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	timeTable := []interface{}{
+		now,
+		primitive.NewDateTimeFromTime(now),
+		now.Format(time.RFC3339Nano),
+	}
+
+	for _, v := range timeTable {
+		if got := DumpTime(v); !got.Equal(now) {
+			t.Errorf("DumpTime: %[1]T: %[1]v: expected %v got %v", v, now, got)
+		}
+	}
+
+	if !DumpTime(nil).IsZero() {
+		t.Errorf("DumpTime: nil should be zero time")
+	}
+
+	boolTable := []struct {
+		value    interface{}
+		expected bool
+	}{
+		{true, true},
+		{false, false},
+		{"true", true},
+		{"false", false},
+		{"", false},
+		{nil, false},
+	}
+
+	for _, data := range boolTable {
+		if got := DumpBool(data.value); got != data.expected {
+			t.Errorf("DumpBool: %[1]T: %[1]v: expected %v got %v", data.value, data.expected, got)
+		}
+	}
+
+	intTable := []interface{}{
+		int(7),
+		int32(7),
+		int64(7),
+		float64(7),
+		"7",
+	}
+
+	for _, v := range intTable {
+		if got := DumpInt64(v); got != 7 {
+			t.Errorf("DumpInt64: %[1]T: %[1]v: expected 7 got %v", v, got)
+		}
+	}
+}
@@ -0,0 +1,794 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/udhos/boilerplate/awsconfig"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+type repoDynamoOptions struct {
+	metricRepoName string // kind:name
+	table          string
+	region         string
+	roleArn        string
+	sessionName    string
+	debug          bool
+	manualCreate   bool
+
+	// table settings applied by gateboard unless manualCreate
+	billingMode         string // PAY_PER_REQUEST (default) or PROVISIONED
+	readCapacity        int64  // PROVISIONED only
+	writeCapacity       int64  // PROVISIONED only
+	replicas            []string
+	pointInTimeRecovery bool
+
+	endpointURL string // for instance DynamoDB Local
+
+	historyMax int // 0 means unlimited
+}
+
+type repoDynamo struct {
+	options repoDynamoOptions
+	dynamo  *dynamodb.Client
+}
+
+func newRepoDynamo(opt repoDynamoOptions) (*repoDynamo, error) {
+
+	switch opt.billingMode = strings.ToUpper(opt.billingMode); types.BillingMode(opt.billingMode) {
+	case "":
+		opt.billingMode = string(types.BillingModePayPerRequest)
+	case types.BillingModePayPerRequest:
+	case types.BillingModeProvisioned:
+		if opt.readCapacity < 1 {
+			opt.readCapacity = 10
+		}
+		if opt.writeCapacity < 1 {
+			opt.writeCapacity = 10
+		}
+	default:
+		return nil, fmt.Errorf("newRepoDynamo: bad billing mode '%s', supported: %s, %s",
+			opt.billingMode, types.BillingModePayPerRequest, types.BillingModeProvisioned)
+	}
+
+	awsConfOptions := awsconfig.Options{
+		Region:          opt.region,
+		RoleArn:         opt.roleArn,
+		RoleSessionName: opt.sessionName,
+	}
+
+	cfg, errAwsConfig := awsconfig.AwsConfig(awsConfOptions)
+	if errAwsConfig != nil {
+		return nil, errAwsConfig
+	}
+
+	r := &repoDynamo{
+		options: opt,
+		dynamo: dynamodb.NewFromConfig(cfg.AwsConfig, func(o *dynamodb.Options) {
+			if opt.endpointURL != "" {
+				o.BaseEndpoint = aws.String(opt.endpointURL)
+			}
+		}),
+	}
+
+	if !r.options.manualCreate {
+		r.setupTable(r.options.table, nil)
+		r.setupTable(r.historyTable(), &types.KeySchemaElement{
+			AttributeName: aws.String("changes"),
+			KeyType:       types.KeyTypeRange,
+		})
+	}
+
+	return r, nil
+}
+
+// setupTable creates the table, if missing, then applies settings
+// that can also be changed on existing tables.
+func (r *repoDynamo) setupTable(table string, rangeKey *types.KeySchemaElement) {
+	r.createTable(table, rangeKey)
+	if r.options.pointInTimeRecovery {
+		r.enablePointInTimeRecovery(table)
+	}
+	if len(r.options.replicas) > 0 {
+		r.addReplicas(table)
+	}
+}
+
+// enablePointInTimeRecovery turns on continuous backups.
+// A restore creates a new table, so both the table and its history table
+// must be restored under names matching the configured table.
+func (r *repoDynamo) enablePointInTimeRecovery(table string) {
+	const me = "repoDynamo.enablePointInTimeRecovery"
+
+	_, err := r.dynamo.UpdateContinuousBackups(context.TODO(), &dynamodb.UpdateContinuousBackupsInput{
+		TableName: aws.String(table),
+		PointInTimeRecoverySpecification: &types.PointInTimeRecoverySpecification{
+			PointInTimeRecoveryEnabled: aws.Bool(true),
+		},
+	})
+	if err != nil {
+		zlog.Errorf("%s: table '%s': error: %v", me, table, err)
+		return
+	}
+
+	zlog.Infof("%s: table '%s': enabled", me, table)
+}
+
+// addReplicas turns the table into a global table with replicas in the
+// configured regions. Replicas already present are left alone.
+// DynamoDB accepts one replica update at a time, so each one is waited for.
+func (r *repoDynamo) addReplicas(table string) {
+	const me = "repoDynamo.addReplicas"
+
+	t, errDescribe := r.dynamo.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if errDescribe != nil {
+		zlog.Errorf("%s: table '%s': error: %v", me, table, errDescribe)
+		return
+	}
+
+	existing := map[string]bool{r.dynamo.Options().Region: true}
+	for _, replica := range t.Table.Replicas {
+		existing[aws.ToString(replica.RegionName)] = true
+	}
+
+	for _, region := range r.options.replicas {
+		if existing[region] {
+			continue
+		}
+
+		zlog.Infof("%s: table '%s': creating replica in region '%s'", me, table, region)
+
+		_, errUpdate := r.dynamo.UpdateTable(context.TODO(), &dynamodb.UpdateTableInput{
+			TableName: aws.String(table),
+			ReplicaUpdates: []types.ReplicationGroupUpdate{
+				{Create: &types.CreateReplicationGroupMemberAction{RegionName: aws.String(region)}},
+			},
+		})
+		if errUpdate != nil {
+			zlog.Errorf("%s: table '%s': replica region '%s': error: %v", me, table, region, errUpdate)
+			continue
+		}
+
+		waiter := dynamodb.NewTableExistsWaiter(r.dynamo)
+		errWait := waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+			TableName: aws.String(table)}, 30*time.Minute)
+		if errWait != nil {
+			zlog.Errorf("%s: table '%s': waiting for replica region '%s': error: %v", me, table, region, errWait)
+		}
+	}
+}
+
+func (r *repoDynamo) historyTable() string {
+	return r.options.table + "_history"
+}
+
+// createTable creates table with hash key gateway_name and optional numeric range key.
+func (r *repoDynamo) createTable(table string, rangeKey *types.KeySchemaElement) {
+	const me = "repoDynamo.createTable"
+
+	//
+	// Create table
+	//
+
+	input := &dynamodb.CreateTableInput{
+		AttributeDefinitions: []types.AttributeDefinition{
+			{
+				AttributeName: aws.String("gateway_name"),
+				AttributeType: types.ScalarAttributeTypeS,
+			},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("gateway_name"),
+				KeyType:       types.KeyTypeHash,
+			},
+		},
+		TableName: aws.String(table),
+	}
+
+	if rangeKey != nil {
+		input.AttributeDefinitions = append(input.AttributeDefinitions, types.AttributeDefinition{
+			AttributeName: rangeKey.AttributeName,
+			AttributeType: types.ScalarAttributeTypeN,
+		})
+		input.KeySchema = append(input.KeySchema, *rangeKey)
+	}
+
+	input.BillingMode = types.BillingMode(r.options.billingMode)
+
+	if input.BillingMode == types.BillingModeProvisioned {
+		input.ProvisionedThroughput = &types.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(r.options.readCapacity),
+			WriteCapacityUnits: aws.Int64(r.options.writeCapacity),
+		}
+	}
+
+	if len(r.options.replicas) > 0 {
+		// global tables replicate through streams
+		input.StreamSpecification = &types.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: types.StreamViewTypeNewAndOldImages,
+		}
+	}
+
+	output, errCreate := r.dynamo.CreateTable(context.TODO(), input)
+	if errCreate != nil {
+		zlog.Errorf("%s: creating table '%s': error: %v", me, table, errCreate)
+		return
+	}
+
+	zlog.Infof("%s: creating table: '%s': arn=%s status=%s", me, table, *output.TableDescription.TableArn, output.TableDescription.TableStatus)
+
+	//
+	// Waiting for table
+	//
+
+	zlog.Infof("%s: waiting for table '%s'", me, table)
+
+	waiter := dynamodb.NewTableExistsWaiter(r.dynamo)
+	errWait := waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(table)}, 5*time.Minute)
+	if errWait != nil {
+		zlog.Errorf("%s: waiting for table '%s': error: %v", me, table, errWait)
+		return
+	}
+
+	zlog.Infof("%s: waiting for table '%s': done", me, table)
+
+	//
+	// Refuse to run without table
+	//
+
+	const cooldown = 5 * time.Second
+	const maxAttempts = 10
+	for i := 1; i <= maxAttempts; i++ {
+		zlog.Infof("%s: %d/%d table active? '%s'", me, i, maxAttempts, table)
+		active := r.tableActive(table)
+		zlog.Infof("%s: %d/%d table active? '%s': %t", me, i, maxAttempts, table, active)
+		if active {
+			zlog.Infof("%s: %d/%d table active? '%s': %t: done", me, i, maxAttempts, table, active)
+			return
+		}
+		zlog.Infof("%s: %d/%d table active? '%s': %t, sleeping for %v", me, i, maxAttempts, table, active, cooldown)
+		time.Sleep(cooldown)
+	}
+	zlog.Fatalf("%s: table '%s' is not active, ABORTING", me, table)
+}
+
+func (r *repoDynamo) tableActive(table string) bool {
+	const me = "tableActive"
+
+	t, err := r.dynamo.DescribeTable(
+		context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(table)},
+	)
+
+	if err != nil {
+		var notFoundEx *types.ResourceNotFoundException
+		if errors.As(err, &notFoundEx) {
+			zlog.Infof("%s: table '%s' does not exist", me, table)
+		} else {
+			zlog.Errorf("%s: table '%s': error: %v", me, table, err)
+		}
+		return false
+	}
+
+	zlog.Debugf(r.options.debug, "%s: table '%s' status=%s", me, table, t.Table.TableStatus)
+
+	return t.Table.TableStatus == types.TableStatusActive
+}
+
+func (r *repoDynamo) tableExists(table string) bool {
+	const me = "tableExists"
+
+	t, err := r.dynamo.DescribeTable(
+		context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(table)},
+	)
+
+	if err != nil {
+		var notFoundEx *types.ResourceNotFoundException
+		if errors.As(err, &notFoundEx) {
+			zlog.Infof("%s: table '%s' does not exist", me, table)
+		} else {
+			zlog.Errorf("%s: table '%s': error: %v", me, table, err)
+		}
+		return false
+	}
+
+	zlog.Debugf(r.options.debug, "%s: table '%s' status=%s", me, table, t.Table.TableStatus)
+
+	return true
+}
+
+func (r *repoDynamo) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoDynamo) DropDatabase() error {
+	if err := r.dropTable(r.historyTable()); err != nil {
+		zlog.Errorf("repoDynamo.dropDatabase: %v", err) // history table might not exist
+	}
+	return r.dropTable(r.options.table)
+}
+
+func (r *repoDynamo) dropTable(table string) error {
+	const me = "repoDynamo.dropTable"
+
+	_, err := r.dynamo.DeleteTable(context.TODO(), &dynamodb.DeleteTableInput{
+		TableName: aws.String(table)})
+	if err != nil {
+		return err
+	}
+
+	//
+	// Refuse to run with table
+	//
+
+	const cooldown = 5 * time.Second
+	const maxAttempts = 10
+	for i := 1; i <= maxAttempts; i++ {
+		zlog.Infof("%s: %d/%d table exists? '%s'", me, i, maxAttempts, table)
+		exists := r.tableExists(table)
+		zlog.Infof("%s: %d/%d table exists? '%s': %t", me, i, maxAttempts, table, exists)
+		if !exists {
+			zlog.Infof("%s: %d/%d table exists? '%s': %t: done", me, i, maxAttempts, table, exists)
+			return nil
+		}
+		zlog.Infof("%s: %d/%d table exists? '%s': %t, sleeping for %v", me, i, maxAttempts, table, exists, cooldown)
+		time.Sleep(cooldown)
+	}
+	zlog.Fatalf("%s: table '%s' exists, ABORTING", me, table)
+
+	return fmt.Errorf("%s: table '%s' exists, ABORTING", me, table)
+}
+
+func (r *repoDynamo) Dump(_ /*ctx*/ context.Context, filter DumpFilter) (Dump, error) {
+
+	list := Dump{}
+
+	projEx := expression.NamesList(
+		expression.Name("gateway_name"),
+		expression.Name("gateway_id"),
+		expression.Name("changes"),
+		expression.Name("last_update"),
+		expression.Name("token"),
+		expression.Name("deleted"),
+	)
+
+	builder := expression.NewBuilder().WithProjection(projEx)
+
+	// last_update is stored as text with local time zone, so it is not pushed down.
+	// Scan is unordered: the page cuts the reply, but the whole table is read.
+	var cond []expression.ConditionBuilder
+	if namePrefix := filter.NamePrefix(); namePrefix != "" {
+		cond = append(cond, expression.Name("gateway_name").BeginsWith(namePrefix))
+	}
+	if filter.After != "" {
+		cond = append(cond, expression.Name("gateway_name").GreaterThan(expression.Value(filter.After)))
+	}
+	switch len(cond) {
+	case 1:
+		builder = builder.WithFilter(cond[0])
+	case 2:
+		builder = builder.WithFilter(cond[0].And(cond[1]))
+	}
+
+	expr, errEx := builder.Build()
+	if errEx != nil {
+		return list, errEx
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:                 aws.String(r.options.table),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+	}
+
+	p := dynamodb.NewScanPaginator(r.dynamo, input)
+
+	for p.HasMorePages() {
+		page, errScan := p.NextPage(context.TODO())
+		if errScan != nil {
+			return list, errScan
+		}
+
+		var items Dump
+		errUnmarshal := attributevalue.UnmarshalListOfMaps(page.Items, &items)
+		if errUnmarshal != nil {
+			return list, errUnmarshal
+		}
+
+		list = append(list, items...)
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+func (r *repoDynamo) Get(_ /*ctx*/ context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+
+	var body gateboard.BodyGetReply
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return body, errVal
+	}
+
+	av, errMarshal := attributevalue.Marshal(gatewayName)
+	if errMarshal != nil {
+		return body, errMarshal
+	}
+
+	key := map[string]types.AttributeValue{"gateway_name": av}
+
+	response, errGet := r.dynamo.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		Key: key, TableName: aws.String(r.options.table),
+	})
+
+	if errGet != nil {
+		return body, errGet
+	}
+
+	if len(response.Item) == 0 {
+		return body, ErrGatewayNotFound
+	}
+
+	errUnmarshal := attributevalue.UnmarshalMap(response.Item, &body)
+
+	return body, errUnmarshal
+}
+
+func (r *repoDynamo) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoDynamo.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.options.table),
+
+		Key: map[string]types.AttributeValue{
+			"gateway_name": &types.AttributeValueMemberS{Value: gatewayName},
+		},
+
+		UpdateExpression: aws.String("set gateway_id = :id, last_update = :now add changes :inc remove deleted"),
+
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id":  &types.AttributeValueMemberS{Value: gatewayID},
+			":inc": &types.AttributeValueMemberN{Value: "1"},
+			":now": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+		},
+
+		ReturnValues: types.ReturnValueAllNew,
+	}
+
+	switch expectedChanges {
+	case AnyChanges:
+	case 0:
+		input.ConditionExpression = aws.String("attribute_not_exists(changes)")
+	default:
+		input.ConditionExpression = aws.String("changes = :expected")
+		input.ExpressionAttributeValues[":expected"] = &types.AttributeValueMemberN{
+			Value: strconv.FormatInt(expectedChanges, 10),
+		}
+	}
+
+	output, errUpdate := r.dynamo.UpdateItem(context.TODO(), input)
+
+	var errCond *types.ConditionalCheckFailedException
+	if errors.As(errUpdate, &errCond) {
+		return ErrConflict
+	}
+
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	r.appendHistory(ctx, output.Attributes, source)
+
+	return nil
+}
+
+func (r *repoDynamo) Delete(ctx context.Context, gatewayName, source string) error {
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.options.table),
+
+		Key: map[string]types.AttributeValue{
+			"gateway_name": &types.AttributeValueMemberS{Value: gatewayName},
+		},
+
+		UpdateExpression: aws.String("set gateway_id = :empty, deleted = :deleted, last_update = :now add changes :inc"),
+
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":empty":   &types.AttributeValueMemberS{Value: ""},
+			":deleted": &types.AttributeValueMemberBOOL{Value: true},
+			":inc":     &types.AttributeValueMemberN{Value: "1"},
+			":now":     &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+		},
+
+		ReturnValues: types.ReturnValueAllNew,
+	}
+
+	output, errUpdate := r.dynamo.UpdateItem(context.TODO(), input)
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	r.appendHistory(ctx, output.Attributes, source)
+
+	return nil
+}
+
+// appendHistory records the item returned by an update into the history table.
+// The item is already saved, so a failure is only logged and counted:
+// retrying the write would record the change twice.
+func (r *repoDynamo) appendHistory(ctx context.Context, attributes map[string]types.AttributeValue, source string) {
+	const me = "repoDynamo.appendHistory"
+
+	var body gateboard.BodyGetReply
+	if errUnmarshal := attributevalue.UnmarshalMap(attributes, &body); errUnmarshal != nil {
+		zlog.CtxErrorf(ctx, "%s: gateway saved, history not recorded: unmarshal: %v", me, errUnmarshal)
+		RecordHistoryFailure(r.RepoName())
+		return
+	}
+
+	entry := gateboard.HistoryEntry{
+		GatewayID: body.GatewayID,
+		Changes:   body.Changes,
+		Timestamp: body.LastUpdate,
+		Source:    source,
+		Deleted:   body.Deleted,
+	}
+
+	item, errMarshal := attributevalue.MarshalMap(entry)
+	if errMarshal != nil {
+		zlog.CtxErrorf(ctx, "%s: gateway_name=%s gateway saved, history not recorded: marshal: %v", me, body.GatewayName, errMarshal)
+		RecordHistoryFailure(r.RepoName())
+		return
+	}
+	item["gateway_name"] = &types.AttributeValueMemberS{Value: body.GatewayName}
+
+	_, errPut := r.dynamo.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(r.historyTable()),
+		Item:      item,
+	})
+	if errPut != nil {
+		zlog.CtxErrorf(ctx, "%s: gateway_name=%s gateway saved, history not recorded: %v", me, body.GatewayName, errPut)
+		RecordHistoryFailure(r.RepoName())
+		return
+	}
+
+	if cutoff := historyCutoff(body.Changes, r.options.historyMax); cutoff > 0 {
+		if errTrim := r.trimHistory(body.GatewayName, cutoff); errTrim != nil {
+			// expired entries left behind are removed by the next write
+			zlog.CtxErrorf(ctx, "%s: gateway_name=%s trim: %v", me, body.GatewayName, errTrim)
+		}
+	}
+}
+
+// trimHistory removes history entries up to changes cutoff.
+func (r *repoDynamo) trimHistory(gatewayName string, cutoff int64) error {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(r.historyTable()),
+		KeyConditionExpression: aws.String("gateway_name = :name and changes <= :cutoff"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name":   &types.AttributeValueMemberS{Value: gatewayName},
+			":cutoff": &types.AttributeValueMemberN{Value: strconv.FormatInt(cutoff, 10)},
+		},
+		ProjectionExpression: aws.String("changes"),
+	}
+
+	p := dynamodb.NewQueryPaginator(r.dynamo, input)
+
+	for p.HasMorePages() {
+		page, errPage := p.NextPage(context.TODO())
+		if errPage != nil {
+			return errPage
+		}
+		for _, item := range page.Items {
+			_, errDelete := r.dynamo.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+				TableName: aws.String(r.historyTable()),
+				Key: map[string]types.AttributeValue{
+					"gateway_name": &types.AttributeValueMemberS{Value: gatewayName},
+					"changes":      item["changes"],
+				},
+			})
+			if errDelete != nil {
+				return errDelete
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *repoDynamo) History(_ /*ctx*/ context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+
+	list := []gateboard.HistoryEntry{}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return list, errVal
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(r.historyTable()),
+		KeyConditionExpression: aws.String("gateway_name = :name"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: gatewayName},
+		},
+		ScanIndexForward: aws.Bool(true), // ascending changes
+	}
+
+	p := dynamodb.NewQueryPaginator(r.dynamo, input)
+
+	for p.HasMorePages() {
+		page, errPage := p.NextPage(context.TODO())
+		if errPage != nil {
+			return list, errPage
+		}
+
+		var entries []gateboard.HistoryEntry
+		if errUnmarshal := attributevalue.UnmarshalListOfMaps(page.Items, &entries); errUnmarshal != nil {
+			return list, errUnmarshal
+		}
+
+		list = append(list, entries...)
+	}
+
+	return list, nil
+}
+
+func (r *repoDynamo) Purge(ctx context.Context, gatewayName string) error {
+
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.options.table),
+
+		Key: map[string]types.AttributeValue{
+			"gateway_name": &types.AttributeValueMemberS{Value: gatewayName},
+		},
+
+		// only tombstones
+		ConditionExpression: aws.String("deleted = :deleted"),
+
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deleted": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	}
+
+	_, errDelete := r.dynamo.DeleteItem(context.TODO(), input)
+
+	var errCond *types.ConditionalCheckFailedException
+	if errors.As(errDelete, &errCond) {
+		return nil // not a tombstone
+	}
+	if errDelete != nil {
+		return errDelete
+	}
+
+	// changes counter restarts, so history must go too
+
+	history, errHistory := r.History(ctx, gatewayName)
+	if errHistory != nil {
+		return errHistory
+	}
+
+	for _, entry := range history {
+		_, errDeleteHistory := r.dynamo.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(r.historyTable()),
+			Key: map[string]types.AttributeValue{
+				"gateway_name": &types.AttributeValueMemberS{Value: gatewayName},
+				"changes":      &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.Changes, 10)},
+			},
+		})
+		if errDeleteHistory != nil {
+			return errDeleteHistory
+		}
+	}
+
+	return nil
+}
+
+func (r *repoDynamo) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+
+	body.Error = ""
+	body.TTL = 0
+
+	item, errMarshal := attributevalue.MarshalMap(body)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	_, errPut := r.dynamo.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(r.options.table),
+		Item:      item,
+	})
+	if errPut != nil {
+		return errPut
+	}
+
+	// replace history
+
+	previous, errHistory := r.History(ctx, body.GatewayName)
+	if errHistory != nil {
+		return errHistory
+	}
+
+	for _, entry := range previous {
+		_, errDeleteHistory := r.dynamo.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+			TableName: aws.String(r.historyTable()),
+			Key: map[string]types.AttributeValue{
+				"gateway_name": &types.AttributeValueMemberS{Value: body.GatewayName},
+				"changes":      &types.AttributeValueMemberN{Value: strconv.FormatInt(entry.Changes, 10)},
+			},
+		})
+		if errDeleteHistory != nil {
+			return errDeleteHistory
+		}
+	}
+
+	for _, entry := range historyTail(history, r.options.historyMax) {
+		historyItem, errMarshalHistory := attributevalue.MarshalMap(entry)
+		if errMarshalHistory != nil {
+			return errMarshalHistory
+		}
+		historyItem["gateway_name"] = &types.AttributeValueMemberS{Value: body.GatewayName}
+
+		_, errPutHistory := r.dynamo.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String(r.historyTable()),
+			Item:      historyItem,
+		})
+		if errPutHistory != nil {
+			return errPutHistory
+		}
+	}
+
+	return nil
+}
+
+func (r *repoDynamo) PutToken(_ /*ctx*/ context.Context, gatewayName, token string) error {
+	update := expression.Set(expression.Name("token"), expression.Value(token))
+
+	expr, errBuild := expression.NewBuilder().WithUpdate(update).Build()
+	if errBuild != nil {
+		return errBuild
+	}
+
+	av, errMarshal := attributevalue.Marshal(gatewayName)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	key := map[string]types.AttributeValue{"gateway_name": av}
+
+	_, errUpdate := r.dynamo.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.options.table),
+		Key:                       key,
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+		ReturnValues:              types.ReturnValueUpdatedNew,
+	})
+
+	return errUpdate
+}
@@ -0,0 +1,466 @@
+package repository
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: etcd
+//
+// <prefix>gateway/<name>                   JSON-encoded gateboard.BodyGetReply
+// <prefix>history/<escaped name>/<changes> JSON-encoded gateboard.HistoryEntry
+//
+
+type repoEtcdOptions struct {
+	metricRepoName        string // kind:name
+	debug                 bool
+	endpoints             []string
+	username              string
+	password              string
+	prefix                string
+	tls                   bool
+	tlsInsecureSkipVerify bool
+	timeout               time.Duration
+	historyMax            int // 0 means unlimited
+}
+
+type repoEtcd struct {
+	options repoEtcdOptions
+	client  *clientv3.Client
+}
+
+func newRepoEtcd(opt repoEtcdOptions) (*repoEtcd, error) {
+	const me = "newRepoEtcd"
+
+	if len(opt.endpoints) < 1 {
+		return nil, fmt.Errorf("%s: missing endpoints", me)
+	}
+
+	config := clientv3.Config{
+		Endpoints:   opt.endpoints,
+		Username:    opt.username,
+		Password:    opt.password,
+		DialTimeout: opt.timeout,
+	}
+
+	if opt.tls || opt.tlsInsecureSkipVerify {
+		config.TLS = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opt.tlsInsecureSkipVerify,
+		}
+	}
+
+	client, errClient := clientv3.New(config)
+	if errClient != nil {
+		return nil, fmt.Errorf("%s: %v", me, errClient)
+	}
+
+	return &repoEtcd{options: opt, client: client}, nil
+}
+
+func (r *repoEtcd) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoEtcd) Close(_ /*ctx*/ context.Context) error {
+	return r.client.Close()
+}
+
+func (r *repoEtcd) DropDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	_, err := r.client.Delete(ctx, r.options.prefix, clientv3.WithPrefix())
+	return err
+}
+
+func (r *repoEtcd) gatewayPrefix() string {
+	return r.options.prefix + "gateway/"
+}
+
+// historyPrefix escapes the name, otherwise the history of gateway "a"
+// would include the history of gateway "a/b".
+func (r *repoEtcd) historyPrefix(gatewayName string) string {
+	return r.options.prefix + "history/" + url.PathEscape(gatewayName) + "/"
+}
+
+// historyKey pads changes so that keys sort by ascending changes counter.
+func (r *repoEtcd) historyKey(gatewayName string, changes int64) string {
+	return fmt.Sprintf("%s%020d", r.historyPrefix(gatewayName), changes)
+}
+
+// load returns the entry and its mod revision, which is 0 for a missing key.
+func (r *repoEtcd) load(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, int64, error) {
+	body := gateboard.BodyGetReply{GatewayName: gatewayName}
+
+	resp, errGet := r.client.Get(ctx, r.gatewayPrefix()+gatewayName)
+	if errGet != nil {
+		return body, 0, errGet
+	}
+	if len(resp.Kvs) == 0 {
+		return body, 0, nil
+	}
+
+	kv := resp.Kvs[0]
+	if errJSON := json.Unmarshal(kv.Value, &body); errJSON != nil {
+		return body, 0, errJSON
+	}
+
+	return body, kv.ModRevision, nil
+}
+
+// etcdDumpBatch bounds keys fetched by each request of a paged dump.
+const etcdDumpBatch = 500
+
+func (r *repoEtcd) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoEtcd.dump"
+
+	list := Dump{}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	// keys are ordered by gateway name: a page is a key range starting after
+	// filter.After, fetched in batches until full
+	keyPrefix := r.gatewayPrefix() + filter.NamePrefix()
+	start := keyPrefix
+	if after := r.gatewayPrefix() + filter.After + "\x00"; filter.After != "" && after > start {
+		start = after
+	}
+	end := clientv3.GetPrefixRangeEnd(keyPrefix)
+
+	for {
+		opts := []clientv3.OpOption{clientv3.WithRange(end)}
+		if filter.Limit > 0 {
+			opts = append(opts, clientv3.WithLimit(etcdDumpBatch))
+		}
+
+		resp, errGet := r.client.Get(ctxTimeout, start, opts...)
+		if errGet != nil {
+			zlog.CtxErrorf(ctx, "%s: %v", me, errGet)
+			return list, errGet
+		}
+
+		for _, kv := range resp.Kvs {
+			var body gateboard.BodyGetReply
+			if errJSON := json.Unmarshal(kv.Value, &body); errJSON != nil {
+				zlog.CtxErrorf(ctx, "%s: key=%s: %v", me, kv.Key, errJSON)
+				return list, errJSON
+			}
+			if !filter.Match(body.GatewayName, body.LastUpdate) {
+				continue
+			}
+			list = append(list, map[string]interface{}{
+				"gateway_name": body.GatewayName,
+				"gateway_id":   body.GatewayID,
+				"changes":      body.Changes,
+				"last_update":  body.LastUpdate,
+				"token":        body.Token,
+				"deleted":      body.Deleted,
+			})
+			if filter.Limit > 0 && len(list) >= filter.Limit {
+				return list, nil
+			}
+		}
+
+		if !resp.More || len(resp.Kvs) == 0 {
+			return list, nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+func (r *repoEtcd) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoEtcd.get"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return gateboard.BodyGetReply{}, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	body, rev, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return body, errLoad
+	}
+	if rev == 0 {
+		return body, ErrGatewayNotFound
+	}
+
+	return body, nil
+}
+
+// update runs a read-modify-write cycle on the gateway key, retrying while
+// other writers modify the key in between. modify changes the entry and
+// returns additional operations for the same transaction.
+func (r *repoEtcd) update(ctx context.Context, gatewayName string,
+	modify func(body *gateboard.BodyGetReply) ([]clientv3.Op, error)) error {
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	key := r.gatewayPrefix() + gatewayName
+
+	for range kvCasAttempts {
+		body, rev, errLoad := r.load(ctxTimeout, gatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+
+		ops, errModify := modify(&body)
+		if errModify != nil {
+			return errModify
+		}
+
+		buf, errJSON := json.Marshal(body)
+		if errJSON != nil {
+			return errJSON
+		}
+
+		resp, errTxn := r.client.Txn(ctxTimeout).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+			Then(append(ops, clientv3.OpPut(key, string(buf)))...).
+			Commit()
+		if errTxn != nil {
+			return errTxn
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("gave up after %d concurrent modifications", kvCasAttempts)
+}
+
+// change bumps the changes counter and returns the operations recording it
+// in history and removing expired history.
+func (r *repoEtcd) change(body *gateboard.BodyGetReply, source string) ([]clientv3.Op, error) {
+	body.Changes++
+	body.LastUpdate = time.Now()
+
+	buf, errJSON := json.Marshal(gateboard.HistoryEntry{
+		GatewayID: body.GatewayID,
+		Changes:   body.Changes,
+		Timestamp: body.LastUpdate,
+		Source:    source,
+		Deleted:   body.Deleted,
+	})
+	if errJSON != nil {
+		return nil, errJSON
+	}
+
+	ops := []clientv3.Op{clientv3.OpPut(r.historyKey(body.GatewayName, body.Changes), string(buf))}
+
+	if cutoff := historyCutoff(body.Changes, r.options.historyMax); cutoff > 0 {
+		// range end is exclusive
+		ops = append(ops, clientv3.OpDelete(r.historyPrefix(body.GatewayName),
+			clientv3.WithRange(r.historyKey(body.GatewayName, cutoff+1))))
+	}
+
+	return ops, nil
+}
+
+func (r *repoEtcd) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoEtcd.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	err := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) ([]clientv3.Op, error) {
+		if expectedChanges != AnyChanges && body.Changes != expectedChanges {
+			return nil, ErrConflict
+		}
+		body.GatewayID = gatewayID
+		body.Deleted = false
+		return r.change(body, source)
+	})
+	if err != nil && err != ErrConflict {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoEtcd) Delete(ctx context.Context, gatewayName, source string) error {
+	const me = "repoEtcd.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	err := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) ([]clientv3.Op, error) {
+		body.GatewayID = ""
+		body.Deleted = true
+		return r.change(body, source)
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoEtcd) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoEtcd.history"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	resp, errGet := r.client.Get(ctxTimeout, r.historyPrefix(gatewayName),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if errGet != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errGet)
+		return nil, errGet
+	}
+
+	list := make([]gateboard.HistoryEntry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var h gateboard.HistoryEntry
+		if errJSON := json.Unmarshal(kv.Value, &h); errJSON != nil {
+			zlog.CtxErrorf(ctx, "%s: key=%s: %v", me, kv.Key, errJSON)
+			return nil, errJSON
+		}
+		list = append(list, h)
+	}
+
+	return list, nil
+}
+
+func (r *repoEtcd) Purge(ctx context.Context, gatewayName string) error {
+	const me = "repoEtcd.purge"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	body, rev, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return errLoad
+	}
+	if rev == 0 || !body.Deleted {
+		return nil
+	}
+
+	key := r.gatewayPrefix() + gatewayName
+
+	// if the tombstone was overwritten meanwhile, the entry is live and must stay
+	_, errTxn := r.client.Txn(ctxTimeout).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).
+		Then(
+			clientv3.OpDelete(key),
+			// changes counter restarts, so history must go too
+			clientv3.OpDelete(r.historyPrefix(gatewayName), clientv3.WithPrefix()),
+		).
+		Commit()
+	if errTxn != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errTxn)
+	}
+
+	return errTxn
+}
+
+// etcdMaxTxnOps stays below the default --max-txn-ops of etcd.
+const etcdMaxTxnOps = 100
+
+// restore rewrites history before the entry, since etcd refuses
+// a transaction deleting and putting overlapping keys.
+func (r *repoEtcd) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+	const me = "repoEtcd.restore"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	if _, errDelete := r.client.Delete(ctxTimeout, r.historyPrefix(body.GatewayName), clientv3.WithPrefix()); errDelete != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, errDelete)
+		return errDelete
+	}
+
+	var ops []clientv3.Op
+	history = historyTail(history, r.options.historyMax)
+	for i, h := range history {
+		buf, errJSON := json.Marshal(h)
+		if errJSON != nil {
+			return errJSON
+		}
+		ops = append(ops, clientv3.OpPut(r.historyKey(body.GatewayName, h.Changes), string(buf)))
+		if len(ops) < etcdMaxTxnOps && i < len(history)-1 {
+			continue
+		}
+		if _, errTxn := r.client.Txn(ctxTimeout).Then(ops...).Commit(); errTxn != nil {
+			zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, errTxn)
+			return errTxn
+		}
+		ops = nil
+	}
+
+	body.Error = ""
+	body.TTL = 0
+
+	err := r.update(ctx, body.GatewayName, func(current *gateboard.BodyGetReply) ([]clientv3.Op, error) {
+		*current = body
+		return nil, nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoEtcd) PutToken(ctx context.Context, gatewayName, token string) error {
+	const me = "repoEtcd.putToken"
+
+	err := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) ([]clientv3.Op, error) {
+		body.Token = token
+		return nil, nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoEtcd) WatchChanges(ctx context.Context, changed func(gatewayName string)) error {
+	gatewayPrefix := r.gatewayPrefix()
+
+	// require leader so that a partitioned member does not silently stall the watch
+	ch := r.client.Watch(clientv3.WithRequireLeader(ctx), gatewayPrefix, clientv3.WithPrefix())
+
+	for resp := range ch {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range resp.Events {
+			changed(strings.TrimPrefix(string(ev.Kv.Key), gatewayPrefix))
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("watch channel closed")
+}
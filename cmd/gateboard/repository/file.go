@@ -0,0 +1,497 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	bolterrors "go.etcd.io/bbolt/errors"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: File
+//
+// Embedded bbolt database for single-node deployments.
+// Bucket "gateways" maps gateway name to JSON-encoded fileEntry.
+// Bucket "history" holds one nested bucket per gateway, mapping
+// the big-endian changes counter to JSON-encoded gateboard.HistoryEntry.
+//
+
+var (
+	fileBucketGateways = []byte("gateways")
+	fileBucketHistory  = []byte("history")
+)
+
+type fileEntry struct {
+	GatewayID  string    `json:"gateway_id"`
+	Changes    int64     `json:"changes"`
+	LastUpdate time.Time `json:"last_update"`
+	Token      string    `json:"token,omitempty"`
+	Deleted    bool      `json:"deleted,omitempty"`
+}
+
+type repoFileOptions struct {
+	metricRepoName string // kind:name
+	debug          bool
+	path           string
+	noSync         bool          // skip fsync on commit: faster, but a crash may lose recent writes
+	compactOnOpen  bool          // rewrite the file on open to reclaim free pages
+	lockTimeout    time.Duration // how long to wait for the file lock held by another process
+	historyMax     int           // 0 means unlimited
+}
+
+type repoFile struct {
+	options repoFileOptions
+	db      *bolt.DB
+}
+
+func newRepoFile(opt repoFileOptions) (*repoFile, error) {
+	const me = "newRepoFile"
+
+	if opt.path == "" {
+		return nil, fmt.Errorf("%s: missing file path", me)
+	}
+
+	if opt.compactOnOpen {
+		if errCompact := compactFile(opt.path, opt.lockTimeout); errCompact != nil {
+			return nil, fmt.Errorf("%s: %v", me, errCompact)
+		}
+	}
+
+	db, errOpen := bolt.Open(opt.path, 0o600, &bolt.Options{
+		Timeout: opt.lockTimeout,
+		NoSync:  opt.noSync,
+	})
+	if errOpen != nil {
+		return nil, fmt.Errorf("%s: open: %s: %v", me, opt.path, errOpen)
+	}
+
+	errBuckets := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{fileBucketGateways, fileBucketHistory} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errBuckets != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: create buckets: %s: %v", me, opt.path, errBuckets)
+	}
+
+	return &repoFile{options: opt, db: db}, nil
+}
+
+// compactFile rewrites path into a fresh file, dropping free pages left
+// behind by deletes and purges, then replaces the original.
+// bbolt never shrinks a file by itself.
+func compactFile(path string, lockTimeout time.Duration) error {
+	const me = "compactFile"
+
+	info, errStat := os.Stat(path)
+	if os.IsNotExist(errStat) {
+		return nil // nothing to compact yet
+	}
+	if errStat != nil {
+		return fmt.Errorf("%s: %v", me, errStat)
+	}
+
+	src, errSrc := bolt.Open(path, 0o600, &bolt.Options{ReadOnly: true, Timeout: lockTimeout})
+	if errSrc != nil {
+		return fmt.Errorf("%s: open source: %s: %v", me, path, errSrc)
+	}
+	defer src.Close()
+
+	tmp := path + ".compact"
+	os.Remove(tmp) // leftover from interrupted compaction
+
+	dst, errDst := bolt.Open(tmp, 0o600, &bolt.Options{Timeout: lockTimeout})
+	if errDst != nil {
+		return fmt.Errorf("%s: open destination: %s: %v", me, tmp, errDst)
+	}
+
+	errCompact := bolt.Compact(dst, src, 64*1024)
+	if errClose := dst.Close(); errCompact == nil {
+		errCompact = errClose
+	}
+	if errCompact != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: %s: %v", me, path, errCompact)
+	}
+
+	if errRename := os.Rename(tmp, path); errRename != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("%s: rename %s to %s: %v", me, tmp, path, errRename)
+	}
+
+	var after int64
+	if infoAfter, err := os.Stat(path); err == nil {
+		after = infoAfter.Size()
+	}
+
+	zlog.Infof("%s: %s: size %d -> %d bytes", me, path, info.Size(), after)
+
+	return nil
+}
+
+func (r *repoFile) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoFile) Close(_ /*ctx*/ context.Context) error {
+	return r.db.Close()
+}
+
+func (r *repoFile) DropDatabase() error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{fileBucketGateways, fileBucketHistory} {
+			if err := tx.DeleteBucket(b); err != nil && !errors.Is(err, bolterrors.ErrBucketNotFound) {
+				return err
+			}
+			if _, err := tx.CreateBucket(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// historyKey sorts history by ascending changes counter.
+func historyKey(changes int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(changes))
+}
+
+func fileLoad(gateways *bolt.Bucket, gatewayName string) (fileEntry, bool, error) {
+	var e fileEntry
+	buf := gateways.Get([]byte(gatewayName))
+	if buf == nil {
+		return e, false, nil
+	}
+	err := json.Unmarshal(buf, &e)
+	return e, true, err
+}
+
+func fileStore(gateways *bolt.Bucket, gatewayName string, e fileEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return gateways.Put([]byte(gatewayName), buf)
+}
+
+func (r *repoFile) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoFile.dump"
+
+	list := Dump{}
+
+	prefix := []byte(filter.NamePrefix())
+
+	// keys are ordered by gateway name, so the page starts right after filter.After
+	start := prefix
+	if after := []byte(filter.After + "\x00"); filter.After != "" && bytes.Compare(after, start) > 0 {
+		start = after
+	}
+
+	errView := r.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(fileBucketGateways).Cursor()
+		for k, v := c.Seek(start); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			if filter.Limit > 0 && len(list) >= filter.Limit {
+				break
+			}
+			var e fileEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("gateway_name=%s: decode: %v", k, err)
+			}
+			if !filter.Match(string(k), e.LastUpdate) {
+				continue
+			}
+			list = append(list, map[string]interface{}{
+				"gateway_name": string(k),
+				"gateway_id":   e.GatewayID,
+				"changes":      e.Changes,
+				"last_update":  e.LastUpdate,
+				"token":        e.Token,
+				"deleted":      e.Deleted,
+			})
+		}
+		return nil
+	})
+	if errView != nil {
+		zlog.CtxErrorf(ctx, "%s: %v", me, errView)
+		return list, errView
+	}
+
+	return list, nil
+}
+
+func (r *repoFile) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoFile.get"
+
+	result := gateboard.BodyGetReply{GatewayName: gatewayName}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return result, errVal
+	}
+
+	var e fileEntry
+	var found bool
+
+	errView := r.db.View(func(tx *bolt.Tx) error {
+		var err error
+		e, found, err = fileLoad(tx.Bucket(fileBucketGateways), gatewayName)
+		return err
+	})
+	if errView != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errView)
+		return result, errView
+	}
+
+	if !found {
+		return result, ErrGatewayNotFound
+	}
+
+	result.GatewayID = e.GatewayID
+	result.Changes = e.Changes
+	result.LastUpdate = e.LastUpdate
+	result.Token = e.Token
+	result.Deleted = e.Deleted
+
+	return result, nil
+}
+
+// write loads the entry, lets change modify it, bumps changes and
+// last_update, then saves it along with its history in one transaction.
+func (r *repoFile) write(gatewayName, source string, expectedChanges int64, change func(e *fileEntry)) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		gateways := tx.Bucket(fileBucketGateways)
+
+		e, _, errLoad := fileLoad(gateways, gatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+
+		if expectedChanges != AnyChanges && e.Changes != expectedChanges {
+			return ErrConflict
+		}
+
+		change(&e)
+		e.Changes++
+		e.LastUpdate = time.Now()
+
+		if err := fileStore(gateways, gatewayName, e); err != nil {
+			return err
+		}
+
+		hist, errHist := tx.Bucket(fileBucketHistory).CreateBucketIfNotExists([]byte(gatewayName))
+		if errHist != nil {
+			return errHist
+		}
+		buf, errJSON := json.Marshal(gateboard.HistoryEntry{
+			GatewayID: e.GatewayID,
+			Changes:   e.Changes,
+			Timestamp: e.LastUpdate,
+			Source:    source,
+			Deleted:   e.Deleted,
+		})
+		if errJSON != nil {
+			return errJSON
+		}
+		if err := hist.Put(historyKey(e.Changes), buf); err != nil {
+			return err
+		}
+		return fileTrimHistory(hist, historyCutoff(e.Changes, r.options.historyMax))
+	})
+}
+
+// fileTrimHistory removes history entries up to changes cutoff.
+func fileTrimHistory(hist *bolt.Bucket, cutoff int64) error {
+	if cutoff < 1 {
+		return nil
+	}
+	last := historyKey(cutoff)
+	var expired [][]byte
+	c := hist.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, last) <= 0; k, _ = c.Next() {
+		expired = append(expired, k) // deleting while iterating skips keys
+	}
+	for _, k := range expired {
+		if err := hist.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repoFile) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoFile.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	err := r.write(gatewayName, source, expectedChanges, func(e *fileEntry) {
+		e.GatewayID = gatewayID
+		e.Deleted = false
+	})
+	if err != nil && err != ErrConflict {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoFile) Delete(ctx context.Context, gatewayName, source string) error {
+	const me = "repoFile.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	err := r.write(gatewayName, source, AnyChanges, func(e *fileEntry) {
+		e.GatewayID = ""
+		e.Deleted = true
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoFile) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoFile.history"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	var list []gateboard.HistoryEntry
+
+	errView := r.db.View(func(tx *bolt.Tx) error {
+		hist := tx.Bucket(fileBucketHistory).Bucket([]byte(gatewayName))
+		if hist == nil {
+			return nil
+		}
+		return hist.ForEach(func(_, v []byte) error {
+			var h gateboard.HistoryEntry
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			list = append(list, h)
+			return nil
+		})
+	})
+	if errView != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errView)
+		return nil, errView
+	}
+
+	return list, nil
+}
+
+func (r *repoFile) Purge(ctx context.Context, gatewayName string) error {
+	const me = "repoFile.purge"
+
+	errUpdate := r.db.Update(func(tx *bolt.Tx) error {
+		gateways := tx.Bucket(fileBucketGateways)
+		e, found, errLoad := fileLoad(gateways, gatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+		if !found || !e.Deleted {
+			return nil
+		}
+		if err := gateways.Delete([]byte(gatewayName)); err != nil {
+			return err
+		}
+		// changes counter restarts, so history must go too
+		err := tx.Bucket(fileBucketHistory).DeleteBucket([]byte(gatewayName))
+		if errors.Is(err, bolterrors.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+	if errUpdate != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errUpdate)
+	}
+
+	return errUpdate
+}
+
+func (r *repoFile) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+	const me = "repoFile.restore"
+
+	errUpdate := r.db.Update(func(tx *bolt.Tx) error {
+		e := fileEntry{
+			GatewayID:  body.GatewayID,
+			Changes:    body.Changes,
+			LastUpdate: body.LastUpdate,
+			Token:      body.Token,
+			Deleted:    body.Deleted,
+		}
+		if err := fileStore(tx.Bucket(fileBucketGateways), body.GatewayName, e); err != nil {
+			return err
+		}
+
+		histories := tx.Bucket(fileBucketHistory)
+		errDelete := histories.DeleteBucket([]byte(body.GatewayName))
+		if errDelete != nil && !errors.Is(errDelete, bolterrors.ErrBucketNotFound) {
+			return errDelete
+		}
+		if len(history) == 0 {
+			return nil
+		}
+		hist, errHist := histories.CreateBucket([]byte(body.GatewayName))
+		if errHist != nil {
+			return errHist
+		}
+		for _, h := range historyTail(history, r.options.historyMax) {
+			buf, errJSON := json.Marshal(h)
+			if errJSON != nil {
+				return errJSON
+			}
+			if err := hist.Put(historyKey(h.Changes), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if errUpdate != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, errUpdate)
+	}
+
+	return errUpdate
+}
+
+func (r *repoFile) PutToken(ctx context.Context, gatewayName, token string) error {
+	const me = "repoFile.putToken"
+
+	errUpdate := r.db.Update(func(tx *bolt.Tx) error {
+		gateways := tx.Bucket(fileBucketGateways)
+		e, _, errLoad := fileLoad(gateways, gatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+		e.Token = token
+		return fileStore(gateways, gatewayName, e)
+	})
+	if errUpdate != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errUpdate)
+	}
+
+	return errUpdate
+}
@@ -0,0 +1,524 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: Kubernetes
+//
+// One Gateway custom resource per gateway, see charts/gateboard/templates/crd.yaml.
+// History is kept in the resource itself, capped to history_max entries.
+//
+
+var gatewayGVR = schema.GroupVersionResource{
+	Group:    "gateboard.udhos.github.io",
+	Version:  "v1",
+	Resource: "gateways",
+}
+
+const gatewayKind = "Gateway"
+
+// kubeGatewaySpec is the spec of the Gateway resource.
+// Timestamps are RFC3339Nano strings, since metav1.Time drops sub-second
+// precision needed to compare entries across repositories.
+type kubeGatewaySpec struct {
+	GatewayName string            `json:"gatewayName"`
+	GatewayID   string            `json:"gatewayID"`
+	Changes     int64             `json:"changes"`
+	LastUpdate  string            `json:"lastUpdate,omitempty"`
+	Token       string            `json:"token,omitempty"`
+	Deleted     bool              `json:"deleted,omitempty"`
+	History     []kubeHistoryItem `json:"history,omitempty"`
+}
+
+type kubeHistoryItem struct {
+	GatewayID string `json:"gatewayID"`
+	Changes   int64  `json:"changes"`
+	Timestamp string `json:"timestamp"`
+	Source    string `json:"source,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+type repoKubeOptions struct {
+	metricRepoName string // kind:name
+	debug          bool
+	namespace      string            // empty means namespace from kubeconfig or pod
+	historyMax     int               // 0 means unlimited
+	client         dynamic.Interface // nil means client from KUBECONFIG, ~/.kube/config or in-cluster config
+	timeout        time.Duration
+}
+
+type repoKube struct {
+	options  repoKubeOptions
+	resource dynamic.ResourceInterface
+}
+
+func newRepoKube(opt repoKubeOptions) (*repoKube, error) {
+	const me = "newRepoKube"
+
+	if opt.client == nil || opt.namespace == "" {
+		clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(), &clientcmd.ConfigOverrides{})
+
+		if opt.namespace == "" {
+			ns, _, errNs := clientConfig.Namespace()
+			if errNs != nil {
+				return nil, fmt.Errorf("%s: namespace: %v", me, errNs)
+			}
+			opt.namespace = ns
+		}
+
+		if opt.client == nil {
+			restConfig, errConfig := clientConfig.ClientConfig()
+			if errConfig != nil {
+				return nil, fmt.Errorf("%s: cluster config: %v", me, errConfig)
+			}
+			client, errClient := dynamic.NewForConfig(restConfig)
+			if errClient != nil {
+				return nil, fmt.Errorf("%s: client: %v", me, errClient)
+			}
+			opt.client = client
+		}
+	}
+
+	zlog.Infof("%s: %s: namespace=%s", me, opt.metricRepoName, opt.namespace)
+
+	return &repoKube{
+		options:  opt,
+		resource: opt.client.Resource(gatewayGVR).Namespace(opt.namespace),
+	}, nil
+}
+
+// kubeObjectName maps a gateway name to the resource name. Names valid for
+// kubernetes are used as is, so that GitOps manifests stay readable.
+// Others (e.g. "123:us-east-1:gw1") are sanitized and suffixed with a hash.
+func kubeObjectName(gatewayName string) string {
+	if len(validation.IsDNS1123Subdomain(gatewayName)) == 0 {
+		return gatewayName
+	}
+
+	base := strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			return c
+		}
+		return '-'
+	}, strings.ToLower(gatewayName))
+
+	if len(base) > 40 {
+		base = base[:40]
+	}
+
+	base = strings.Trim(base, "-")
+	if base == "" {
+		base = "gw"
+	}
+
+	sum := sha256.Sum256([]byte(gatewayName))
+
+	return base + "-" + hex.EncodeToString(sum[:])[:12]
+}
+
+func (r *repoKube) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoKube) DropDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	return r.resource.DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{})
+}
+
+func kubeSpec(obj *unstructured.Unstructured) (kubeGatewaySpec, error) {
+	var spec kubeGatewaySpec
+	m, found, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil || !found {
+		return spec, fmt.Errorf("%s: missing spec: %v", obj.GetName(), err)
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(m, &spec)
+	return spec, err
+}
+
+func kubeParseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s) // zero time for entries created without lastUpdate, e.g. by GitOps
+	return t
+}
+
+// load returns the resource and its spec, or a nil resource when not found.
+func (r *repoKube) load(ctx context.Context, gatewayName string) (*unstructured.Unstructured, kubeGatewaySpec, error) {
+	spec := kubeGatewaySpec{GatewayName: gatewayName}
+
+	obj, errGet := r.resource.Get(ctx, kubeObjectName(gatewayName), metav1.GetOptions{})
+	if apierrors.IsNotFound(errGet) {
+		return nil, spec, nil
+	}
+	if errGet != nil {
+		return nil, spec, errGet
+	}
+
+	spec, errSpec := kubeSpec(obj)
+	if errSpec != nil {
+		return nil, spec, errSpec
+	}
+
+	if spec.GatewayName != gatewayName {
+		return nil, spec, fmt.Errorf("resource %s holds gateway '%s', not '%s'",
+			obj.GetName(), spec.GatewayName, gatewayName)
+	}
+
+	return obj, spec, nil
+}
+
+// dump lists every resource, even for a page, since object names
+// are not ordered by gateway name.
+func (r *repoKube) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoKube.dump"
+
+	list := Dump{}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	opts := metav1.ListOptions{Limit: 500}
+
+	for {
+		page, errList := r.resource.List(ctxTimeout, opts)
+		if errList != nil {
+			zlog.CtxErrorf(ctx, "%s: %v", me, errList)
+			return list, errList
+		}
+
+		for i := range page.Items {
+			spec, errSpec := kubeSpec(&page.Items[i])
+			if errSpec != nil {
+				zlog.CtxErrorf(ctx, "%s: %v", me, errSpec)
+				return list, errSpec
+			}
+			lastUpdate := kubeParseTime(spec.LastUpdate)
+			if !filter.Match(spec.GatewayName, lastUpdate) {
+				continue
+			}
+			list = append(list, map[string]interface{}{
+				"gateway_name": spec.GatewayName,
+				"gateway_id":   spec.GatewayID,
+				"changes":      spec.Changes,
+				"last_update":  lastUpdate,
+				"token":        spec.Token,
+				"deleted":      spec.Deleted,
+			})
+		}
+
+		opts.Continue = page.GetContinue()
+		if opts.Continue == "" {
+			break
+		}
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+func (r *repoKube) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoKube.get"
+
+	body := gateboard.BodyGetReply{GatewayName: gatewayName}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return body, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	obj, spec, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return body, errLoad
+	}
+	if obj == nil {
+		return body, ErrGatewayNotFound
+	}
+
+	body.GatewayID = spec.GatewayID
+	body.Changes = spec.Changes
+	body.LastUpdate = kubeParseTime(spec.LastUpdate)
+	body.Token = spec.Token
+	body.Deleted = spec.Deleted
+
+	return body, nil
+}
+
+// update runs a read-modify-write cycle on the resource, retrying on
+// resource version conflicts caused by concurrent writers.
+func (r *repoKube) update(ctx context.Context, gatewayName string, modify func(spec *kubeGatewaySpec) error) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	for range kvCasAttempts {
+		obj, spec, errLoad := r.load(ctxTimeout, gatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+
+		if errModify := modify(&spec); errModify != nil {
+			return errModify
+		}
+
+		m, errConv := runtime.DefaultUnstructuredConverter.ToUnstructured(&spec)
+		if errConv != nil {
+			return errConv
+		}
+
+		var errWrite error
+		if obj == nil {
+			obj = &unstructured.Unstructured{}
+			obj.SetAPIVersion(gatewayGVR.GroupVersion().String())
+			obj.SetKind(gatewayKind)
+			obj.SetName(kubeObjectName(gatewayName))
+			obj.Object["spec"] = m
+			_, errWrite = r.resource.Create(ctxTimeout, obj, metav1.CreateOptions{})
+		} else {
+			obj.Object["spec"] = m // resource version carried by obj turns update into compare-and-swap
+			_, errWrite = r.resource.Update(ctxTimeout, obj, metav1.UpdateOptions{})
+		}
+
+		if apierrors.IsConflict(errWrite) || apierrors.IsAlreadyExists(errWrite) {
+			continue
+		}
+
+		return errWrite
+	}
+
+	return fmt.Errorf("gave up after %d concurrent modifications", kvCasAttempts)
+}
+
+// change bumps the changes counter and records it in history.
+func (r *repoKube) change(spec *kubeGatewaySpec, source string) {
+	now := time.Now().Format(time.RFC3339Nano)
+
+	spec.Changes++
+	spec.LastUpdate = now
+
+	spec.History = append(spec.History, kubeHistoryItem{
+		GatewayID: spec.GatewayID,
+		Changes:   spec.Changes,
+		Timestamp: now,
+		Source:    source,
+		Deleted:   spec.Deleted,
+	})
+
+	if limit := r.options.historyMax; limit > 0 && len(spec.History) > limit {
+		spec.History = spec.History[len(spec.History)-limit:]
+	}
+}
+
+func (r *repoKube) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoKube.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	err := r.update(ctx, gatewayName, func(spec *kubeGatewaySpec) error {
+		if expectedChanges != AnyChanges && spec.Changes != expectedChanges {
+			return ErrConflict
+		}
+		spec.GatewayID = gatewayID
+		spec.Deleted = false
+		r.change(spec, source)
+		return nil
+	})
+	if err != nil && err != ErrConflict {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoKube) Delete(ctx context.Context, gatewayName, source string) error {
+	const me = "repoKube.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	err := r.update(ctx, gatewayName, func(spec *kubeGatewaySpec) error {
+		spec.GatewayID = ""
+		spec.Deleted = true
+		r.change(spec, source)
+		return nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoKube) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoKube.history"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	_, spec, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return nil, errLoad
+	}
+
+	list := make([]gateboard.HistoryEntry, 0, len(spec.History))
+	for _, h := range spec.History {
+		list = append(list, gateboard.HistoryEntry{
+			GatewayID: h.GatewayID,
+			Changes:   h.Changes,
+			Timestamp: kubeParseTime(h.Timestamp),
+			Source:    h.Source,
+			Deleted:   h.Deleted,
+		})
+	}
+
+	return list, nil
+}
+
+func (r *repoKube) Purge(ctx context.Context, gatewayName string) error {
+	const me = "repoKube.purge"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	obj, spec, errLoad := r.load(ctxTimeout, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return errLoad
+	}
+	if obj == nil || !spec.Deleted {
+		return nil
+	}
+
+	// if the tombstone was overwritten meanwhile, the entry is live and must stay
+	rv := obj.GetResourceVersion()
+	errDelete := r.resource.Delete(ctxTimeout, obj.GetName(), metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{ResourceVersion: &rv},
+	})
+	if apierrors.IsConflict(errDelete) || apierrors.IsNotFound(errDelete) {
+		return nil
+	}
+	if errDelete != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errDelete)
+	}
+
+	return errDelete
+}
+
+// restore keeps only the most recent history_max history entries.
+func (r *repoKube) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+	const me = "repoKube.restore"
+
+	if limit := r.options.historyMax; limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+
+	err := r.update(ctx, body.GatewayName, func(spec *kubeGatewaySpec) error {
+		*spec = kubeGatewaySpec{
+			GatewayName: body.GatewayName,
+			GatewayID:   body.GatewayID,
+			Changes:     body.Changes,
+			LastUpdate:  body.LastUpdate.Format(time.RFC3339Nano),
+			Token:       body.Token,
+			Deleted:     body.Deleted,
+		}
+		for _, h := range history {
+			spec.History = append(spec.History, kubeHistoryItem{
+				GatewayID: h.GatewayID,
+				Changes:   h.Changes,
+				Timestamp: h.Timestamp.Format(time.RFC3339Nano),
+				Source:    h.Source,
+				Deleted:   h.Deleted,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, body.GatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoKube) PutToken(ctx context.Context, gatewayName, token string) error {
+	const me = "repoKube.putToken"
+
+	err := r.update(ctx, gatewayName, func(spec *kubeGatewaySpec) error {
+		spec.Token = token
+		return nil
+	})
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+// WatchChanges reports changes made by any gateboard instance, as well as
+// edits applied directly to the resources, e.g. by kubectl or GitOps tools.
+// The API server ends watches periodically; they are resumed right away.
+func (r *repoKube) WatchChanges(ctx context.Context, changed func(gatewayName string)) error {
+	for {
+		// start from current state, rather than replaying every resource as added
+		list, errList := r.resource.List(ctx, metav1.ListOptions{Limit: 1})
+		if errList != nil {
+			return errList
+		}
+
+		w, errWatch := r.resource.Watch(ctx, metav1.ListOptions{ResourceVersion: list.GetResourceVersion()})
+		if errWatch != nil {
+			return errWatch
+		}
+
+		for ev := range w.ResultChan() {
+			if ev.Type == watch.Error {
+				w.Stop()
+				return apierrors.FromObject(ev.Object)
+			}
+			obj, isUnstructured := ev.Object.(*unstructured.Unstructured)
+			if !isUnstructured {
+				continue
+			}
+			if spec, errSpec := kubeSpec(obj); errSpec == nil {
+				changed(spec.GatewayName)
+			}
+		}
+
+		w.Stop()
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newTestRepoKube(t *testing.T) *repoKube {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{gatewayGVR: "GatewayList"})
+	r, err := newRepoKube(repoKubeOptions{
+		metricRepoName: "kubernetes:test",
+		namespace:      "gateboard",
+		client:         client,
+		timeout:        5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("error initializing kubernetes: %v", err)
+	}
+	return r
+}
+
+// go test -v -run TestKubeObjectName ./cmd/gateboard/repository
+func TestKubeObjectName(t *testing.T) {
+	table := []struct {
+		gatewayName string
+		expected    string // empty means hashed
+	}{
+		{"gw1", "gw1"},
+		{"my-gateway.prod", "my-gateway.prod"},
+		{"123:us-east-1:gw1", ""},
+		{"GW1", ""},
+		{":::", ""},
+		{"a-very-long-gateway-name-that-exceeds-the-forty-character-base", ""},
+	}
+
+	seen := map[string]string{}
+
+	for _, data := range table {
+		name := kubeObjectName(data.gatewayName)
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			t.Errorf("%s: invalid object name '%s': %v", data.gatewayName, name, errs)
+		}
+		if data.expected != "" && name != data.expected {
+			t.Errorf("%s: expected object name '%s', got '%s'", data.gatewayName, data.expected, name)
+		}
+		if other, found := seen[name]; found {
+			t.Errorf("%s: object name '%s' collides with %s", data.gatewayName, name, other)
+		}
+		seen[name] = data.gatewayName
+	}
+}
+
+// go test -v -run TestRepoKubeWatch ./cmd/gateboard/repository
+func TestRepoKubeWatch(t *testing.T) {
+	r := newTestRepoKube(t)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	ch := make(chan string, 10)
+	go r.WatchChanges(ctx, func(gatewayName string) { ch <- gatewayName })
+
+	time.Sleep(100 * time.Millisecond) // let the watch start
+
+	if err := r.Put(context.TODO(), "123:us-east-1:gw1", "id1", "test", AnyChanges); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	select {
+	case name := <-ch:
+		if name != "123:us-east-1:gw1" {
+			t.Errorf("expected change for 123:us-east-1:gw1, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("missing change from watch")
+	}
+}
@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: Memory
+//
+
+type memEntry struct {
+	id         string
+	changes    int64
+	lastUpdate time.Time
+	token      string
+	deleted    bool
+}
+
+type repoMem struct {
+	options repoMemOptions
+	tab     map[string]memEntry                 // name => id
+	hist    map[string][]gateboard.HistoryEntry // name => history
+	lock    sync.Mutex
+}
+
+type repoMemOptions struct {
+	metricRepoName string // kind:name
+	broken         bool
+	delay          time.Duration
+	historyMax     int // 0 means unlimited
+}
+
+func newRepoMem(opt repoMemOptions) *repoMem {
+	return &repoMem{
+		options: opt,
+		tab:     map[string]memEntry{},
+		hist:    map[string][]gateboard.HistoryEntry{},
+	}
+}
+
+func (r *repoMem) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoMem) Dump(_ /*ctx*/ context.Context, filter DumpFilter) (Dump, error) {
+
+	if r.options.delay > 0 {
+		defer time.Sleep(r.options.delay)
+	}
+
+	if r.options.broken {
+		return nil, fmt.Errorf("repo mem broken")
+	}
+
+	list := make(Dump, 0, len(r.tab))
+	r.lock.Lock()
+
+	for name, e := range r.tab {
+		if !filter.Match(name, e.lastUpdate) {
+			continue
+		}
+		item := map[string]interface{}{
+			"gateway_name": name,
+			"gateway_id":   e.id,
+			"changes":      e.changes,
+			"last_update":  e.lastUpdate,
+			"token":        e.token,
+			"deleted":      e.deleted,
+		}
+		list = append(list, item)
+	}
+
+	r.lock.Unlock()
+	return dumpSelect(list, filter), nil
+}
+
+func (r *repoMem) Get(_ /*ctx*/ context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	var result gateboard.BodyGetReply
+
+	if r.options.delay > 0 {
+		defer time.Sleep(r.options.delay)
+	}
+
+	if r.options.broken {
+		return result, fmt.Errorf("repo mem broken")
+	}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return result, errVal
+	}
+
+	r.lock.Lock()
+	e, found := r.tab[gatewayName]
+	r.lock.Unlock()
+	result.GatewayName = gatewayName
+	if found {
+		result.GatewayID = e.id
+		result.Changes = e.changes
+		result.LastUpdate = e.lastUpdate
+		result.Token = e.token
+		result.Deleted = e.deleted
+		return result, nil
+	}
+	return result, ErrGatewayNotFound
+}
+
+func (r *repoMem) Put(_ /*ctx*/ context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+
+	if r.options.delay > 0 {
+		defer time.Sleep(r.options.delay)
+	}
+
+	if r.options.broken {
+		return fmt.Errorf("repo mem broken")
+	}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("repoMem.put: bad gateway id: '%s'", gatewayID)
+	}
+
+	now := time.Now()
+	r.lock.Lock()
+	e := r.tab[gatewayName]
+	if expectedChanges != AnyChanges && e.changes != expectedChanges {
+		r.lock.Unlock()
+		return ErrConflict
+	}
+	e.id = gatewayID
+	e.changes++
+	e.lastUpdate = now
+	e.deleted = false
+	r.tab[gatewayName] = e
+	r.appendHistory(gatewayName, e, source)
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *repoMem) Delete(_ /*ctx*/ context.Context, gatewayName, source string) error {
+
+	if r.options.delay > 0 {
+		defer time.Sleep(r.options.delay)
+	}
+
+	if r.options.broken {
+		return fmt.Errorf("repo mem broken")
+	}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	now := time.Now()
+	r.lock.Lock()
+	e := r.tab[gatewayName]
+	e.id = ""
+	e.changes++
+	e.lastUpdate = now
+	e.deleted = true
+	r.tab[gatewayName] = e
+	r.appendHistory(gatewayName, e, source)
+	r.lock.Unlock()
+	return nil
+}
+
+// appendHistory must be called with lock held.
+func (r *repoMem) appendHistory(gatewayName string, e memEntry, source string) {
+	r.hist[gatewayName] = append(r.hist[gatewayName], gateboard.HistoryEntry{
+		GatewayID: e.id,
+		Changes:   e.changes,
+		Timestamp: e.lastUpdate,
+		Source:    source,
+		Deleted:   e.deleted,
+	})
+	r.hist[gatewayName] = historyTail(r.hist[gatewayName], r.options.historyMax)
+}
+
+func (r *repoMem) History(_ /*ctx*/ context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+
+	if r.options.delay > 0 {
+		defer time.Sleep(r.options.delay)
+	}
+
+	if r.options.broken {
+		return nil, fmt.Errorf("repo mem broken")
+	}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	r.lock.Lock()
+	list := slices.Clone(r.hist[gatewayName])
+	r.lock.Unlock()
+
+	return list, nil
+}
+
+func (r *repoMem) Purge(_ /*ctx*/ context.Context, gatewayName string) error {
+
+	if r.options.broken {
+		return fmt.Errorf("repo mem broken")
+	}
+
+	r.lock.Lock()
+	if e, found := r.tab[gatewayName]; found && e.deleted {
+		delete(r.tab, gatewayName)
+		delete(r.hist, gatewayName) // changes counter restarts, so history must go too
+	}
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *repoMem) Restore(_ /*ctx*/ context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+
+	if r.options.broken {
+		return fmt.Errorf("repo mem broken")
+	}
+
+	r.lock.Lock()
+	r.tab[body.GatewayName] = memEntry{
+		id:         body.GatewayID,
+		changes:    body.Changes,
+		lastUpdate: body.LastUpdate,
+		token:      body.Token,
+		deleted:    body.Deleted,
+	}
+	r.hist[body.GatewayName] = slices.Clone(historyTail(history, r.options.historyMax))
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *repoMem) PutToken(_ /*ctx*/ context.Context, gatewayName, token string) error {
+	r.lock.Lock()
+	e := r.tab[gatewayName]
+	e.token = token
+	r.tab[gatewayName] = e
+	r.lock.Unlock()
+	return nil
+}
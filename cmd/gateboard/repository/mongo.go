@@ -0,0 +1,570 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/udhos/mongodbclient/mongodbclient"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: Mongo
+//
+
+type repoMongoOptions struct {
+	metricRepoName        string // kind:name
+	debug                 bool
+	URI                   string
+	database              string
+	collection            string
+	username              string
+	password              string
+	tlsCAFile             string
+	minPool               uint64
+	indexCreationDisable  bool
+	indexCreationRetry    int
+	IndexCreationCooldown time.Duration
+	timeout               time.Duration
+	historyMax            int // 0 means unlimited
+}
+
+type repoMongo struct {
+	options repoMongoOptions
+	client  *mongo.Client
+}
+
+func newRepoMongo(opt repoMongoOptions) (*repoMongo, error) {
+	const me = "newRepoMongo"
+
+	r := &repoMongo{options: opt}
+
+	{
+		clientOptions := mongodbclient.Options{
+			URI:         opt.URI,
+			Username:    opt.username,
+			Password:    opt.password,
+			TLSCAFile:   opt.tlsCAFile,
+			Timeout:     opt.timeout,
+			MinPoolSize: opt.minPool,
+			Debug:       opt.debug,
+		}
+		client, errConnect := mongodbclient.New(clientOptions)
+		if errConnect != nil {
+			return nil, errConnect
+		}
+		r.client = client
+	}
+
+	//
+	// create index
+	//
+
+	if !opt.indexCreationDisable {
+		const field = "gateway_name"
+
+		model := mongo.IndexModel{
+			Keys: bson.M{
+				field: 1, // index in ascending order
+			}, Options: options.Index().SetUnique(true), // create UniqueIndex option
+		}
+
+		r.createIndex(r.options.collection, field, model)
+
+		modelHistory := mongo.IndexModel{
+			Keys: bson.D{
+				{Key: field, Value: 1},     // index in ascending order
+				{Key: "changes", Value: 1}, // index in ascending order
+			},
+		}
+
+		r.createIndex(r.historyCollection(), field, modelHistory)
+	}
+
+	return r, nil
+}
+
+func (r *repoMongo) createIndex(collectionName, field string, model mongo.IndexModel) {
+	const me = "repoMongo.createIndex"
+
+	collection := r.client.Database(r.options.database).Collection(collectionName)
+
+	// withstand temporary errors (istio sidecar not ready)
+	cooldown := r.options.IndexCreationCooldown
+	if cooldown == 0 {
+		cooldown = 5 * time.Second
+	}
+	retry := r.options.indexCreationRetry
+	if retry == 0 {
+		retry = 5
+	}
+	for i := 1; i <= retry; i++ {
+		ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+		defer cancel()
+		indexName, errCreate := collection.Indexes().CreateOne(ctxTimeout, model)
+		if errCreate != nil {
+			zlog.Errorf("%s: attempt=%d/%d create index for collection=%s field=%s: index=%s: error: %v, sleeping %v",
+				me, i, retry, collectionName, field, indexName, errCreate, cooldown)
+			time.Sleep(cooldown)
+			continue
+		}
+		zlog.Infof("%s: attempt=%d/%d create index for collection=%s field=%s: index=%s: success",
+			me, i, retry, collectionName, field, indexName)
+		break
+	}
+}
+
+func (r *repoMongo) historyCollection() string {
+	return r.options.collection + "_history"
+}
+
+func (r *repoMongo) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoMongo) Close(ctx context.Context) error {
+	return r.client.Disconnect(ctx)
+}
+
+func (r *repoMongo) DropDatabase() error {
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	return r.client.Database(r.options.database).Drop(ctxTimeout)
+}
+
+func (r *repoMongo) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	list := Dump{}
+
+	const me = "repoMongo.dump"
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	query := bson.D{}
+	nameQuery := bson.D{}
+	if namePrefix := filter.NamePrefix(); namePrefix != "" {
+		// anchored regex can use the gateway_name index
+		nameQuery = append(nameQuery, bson.E{Key: "$regex", Value: "^" + regexp.QuoteMeta(namePrefix)})
+	}
+	if filter.After != "" {
+		nameQuery = append(nameQuery, bson.E{Key: "$gt", Value: filter.After})
+	}
+	if len(nameQuery) > 0 {
+		query = append(query, bson.E{Key: "gateway_name", Value: nameQuery})
+	}
+	if !filter.UpdatedSince.IsZero() {
+		query = append(query, bson.E{Key: "last_update", Value: bson.D{
+			{Key: "$gte", Value: primitive.NewDateTimeFromTime(filter.UpdatedSince)},
+		}})
+	}
+	findOptions := options.Find()
+	if filter.Limit > 0 {
+		// walk the gateway_name index, stopping once the page is full
+		findOptions.SetSort(bson.D{{Key: "gateway_name", Value: 1}})
+		findOptions.SetBatchSize(int32(min(filter.Limit, 1000)))
+	}
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	cursor, errFind := collection.Find(ctxTimeout, query, findOptions)
+
+	if errFind != nil {
+		zlog.CtxErrorf(ctx, "%s: dump find error: %v", me, errFind)
+		return list, errFind
+	}
+
+	if filter.Limit > 0 {
+		defer cursor.Close(context.Background())
+		ctxTimeout2, cancel2 := context.WithTimeout(context.Background(), r.options.timeout)
+		defer cancel2()
+		for len(list) < filter.Limit && cursor.Next(ctxTimeout2) {
+			var item map[string]interface{}
+			if errDecode := cursor.Decode(&item); errDecode != nil {
+				zlog.CtxErrorf(ctx, "%s: dump decode error: %v", me, errDecode)
+				return list, errDecode
+			}
+			if filter.Match(DumpName(item), DumpTime(item["last_update"])) {
+				list = append(list, item)
+			}
+		}
+		if errCursor := cursor.Err(); errCursor != nil {
+			zlog.CtxErrorf(ctx, "%s: dump cursor error: %v", me, errCursor)
+			return list, errCursor
+		}
+		return list, nil
+	}
+
+	ctxTimeout2, cancel2 := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel2()
+	errAll := cursor.All(ctxTimeout2, &list)
+
+	switch errAll {
+	case mongo.ErrNoDocuments:
+		return list, ErrGatewayNotFound
+	case nil:
+		return list, nil
+	}
+
+	zlog.CtxErrorf(ctx, "%s: dump cursor error: %v", me, errAll)
+
+	return list, errAll
+}
+
+func (r *repoMongo) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+
+	const me = "repoMongo.get"
+
+	var body gateboard.BodyGetReply
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return body, errVal
+	}
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	// Literal value queries return the same value as the $eq comparison operator.
+	// For example, the following query filters produce the same result:
+	// filter := bson.D{{"type", "Oolong"}}
+	// filter := bson.D{{"type", bson.D{{"$eq", "Oolong"}}}}
+	//
+	// https://www.mongodb.com/docs/drivers/go/current/fundamentals/crud/read-operations/query-document/
+	//
+	filter := bson.D{{Key: "gateway_name", Value: gatewayName}}
+
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	errFind := collection.FindOne(ctxTimeout, filter).Decode(&body)
+
+	switch errFind {
+	case mongo.ErrNoDocuments:
+		return body, ErrGatewayNotFound
+	case nil:
+		return body, nil
+	}
+
+	zlog.CtxErrorf(ctx, "%s: gatewayName=%s find error: %v",
+		me, gatewayName, errFind)
+
+	return body, errFind
+}
+
+func (r *repoMongo) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+
+	const me = "repoMongo.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	filter := bson.D{{Key: "gateway_name", Value: gatewayName}}
+	upsert := true
+	switch expectedChanges {
+	case AnyChanges:
+	case 0:
+		// an existing document fails the filter, then upsert hits the unique index
+		filter = append(filter, bson.E{Key: "changes", Value: bson.D{{Key: "$exists", Value: false}}})
+	default:
+		filter = append(filter, bson.E{Key: "changes", Value: expectedChanges})
+		upsert = false // a missing document means mismatch
+	}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "gateway_id", Value: gatewayID}}},                                  // update ID
+		{Key: "$inc", Value: bson.D{{Key: "changes", Value: 1}}},                                             // increment changes counter
+		{Key: "$set", Value: bson.D{{Key: "last_update", Value: primitive.NewDateTimeFromTime(time.Now())}}}, // last update
+		{Key: "$unset", Value: bson.D{{Key: "deleted", Value: ""}}},                                          // clear tombstone
+	}
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	opts := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
+	defer cancel()
+	var body gateboard.BodyGetReply
+	errUpdate := collection.FindOneAndUpdate(ctxTimeout, filter, update, opts).Decode(&body)
+
+	if expectedChanges != AnyChanges &&
+		(errUpdate == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(errUpdate)) {
+		return ErrConflict
+	}
+
+	if errUpdate != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s gatewayID=%s update error:%v",
+			me, gatewayName, gatewayID, errUpdate)
+		return errUpdate
+	}
+
+	r.appendHistory(ctx, gatewayName, body, source)
+
+	return nil
+}
+
+func (r *repoMongo) Delete(ctx context.Context, gatewayName, source string) error {
+
+	const me = "repoMongo.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	filter := bson.D{{Key: "gateway_name", Value: gatewayName}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "gateway_id", Value: ""},                                         // clear ID
+			{Key: "deleted", Value: true},                                          // tombstone
+			{Key: "last_update", Value: primitive.NewDateTimeFromTime(time.Now())}, // last update
+		}},
+		{Key: "$inc", Value: bson.D{{Key: "changes", Value: 1}}}, // increment changes counter
+	}
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	defer cancel()
+	var body gateboard.BodyGetReply
+	errUpdate := collection.FindOneAndUpdate(ctxTimeout, filter, update, opts).Decode(&body)
+
+	if errUpdate != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s update error:%v",
+			me, gatewayName, errUpdate)
+		return errUpdate
+	}
+
+	r.appendHistory(ctx, gatewayName, body, source)
+
+	return nil
+}
+
+// appendHistory records the change just written to the gateway collection.
+// Without multi-document transactions, available only on replica sets, the
+// gateway entry is already saved, so a failure is only logged and counted:
+// retrying the write would record the change twice.
+func (r *repoMongo) appendHistory(ctx context.Context, gatewayName string, body gateboard.BodyGetReply, source string) {
+
+	const me = "repoMongo.appendHistory"
+
+	collection := r.client.Database(r.options.database).Collection(r.historyCollection())
+
+	doc := bson.D{
+		{Key: "gateway_name", Value: gatewayName},
+		{Key: "gateway_id", Value: body.GatewayID},
+		{Key: "changes", Value: body.Changes},
+		{Key: "timestamp", Value: primitive.NewDateTimeFromTime(body.LastUpdate)},
+		{Key: "source", Value: source},
+	}
+	if body.Deleted {
+		doc = append(doc, bson.E{Key: "deleted", Value: true})
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	_, errInsert := collection.InsertOne(ctxTimeout, doc)
+
+	if errInsert != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s gateway saved, history not recorded: insert error:%v",
+			me, gatewayName, errInsert)
+		RecordHistoryFailure(r.RepoName())
+		return
+	}
+
+	cutoff := historyCutoff(body.Changes, r.options.historyMax)
+	if cutoff == 0 {
+		return
+	}
+
+	// expired entries left behind by a failure are removed by the next write
+	ctxTimeout2, cancel2 := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel2()
+	_, errTrim := collection.DeleteMany(ctxTimeout2, bson.D{
+		{Key: "gateway_name", Value: gatewayName},
+		{Key: "changes", Value: bson.D{{Key: "$lte", Value: cutoff}}},
+	})
+	if errTrim != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s trim error:%v",
+			me, gatewayName, errTrim)
+	}
+}
+
+func (r *repoMongo) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+
+	const me = "repoMongo.history"
+
+	list := []gateboard.HistoryEntry{}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return list, errVal
+	}
+
+	collection := r.client.Database(r.options.database).Collection(r.historyCollection())
+
+	filter := bson.D{{Key: "gateway_name", Value: gatewayName}}
+	findOptions := options.Find().SetSort(bson.D{{Key: "changes", Value: 1}})
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	cursor, errFind := collection.Find(ctxTimeout, filter, findOptions)
+
+	if errFind != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s find error: %v", me, gatewayName, errFind)
+		return list, errFind
+	}
+
+	ctxTimeout2, cancel2 := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel2()
+	errAll := cursor.All(ctxTimeout2, &list)
+
+	if errAll != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s cursor error: %v", me, gatewayName, errAll)
+	}
+
+	return list, errAll
+}
+
+func (r *repoMongo) Purge(ctx context.Context, gatewayName string) error {
+
+	const me = "repoMongo.purge"
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	filter := bson.D{
+		{Key: "gateway_name", Value: gatewayName},
+		{Key: "deleted", Value: true}, // only tombstones
+	}
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	result, errDelete := collection.DeleteOne(ctxTimeout, filter)
+
+	if errDelete != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s delete error:%v",
+			me, gatewayName, errDelete)
+		return errDelete
+	}
+
+	if result.DeletedCount == 0 {
+		return nil // not a tombstone
+	}
+
+	// changes counter restarts, so history must go too
+
+	collectionHistory := r.client.Database(r.options.database).Collection(r.historyCollection())
+
+	ctxTimeout2, cancel2 := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel2()
+	_, errDeleteHistory := collectionHistory.DeleteMany(ctxTimeout2,
+		bson.D{{Key: "gateway_name", Value: gatewayName}})
+
+	if errDeleteHistory != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s delete history error:%v",
+			me, gatewayName, errDeleteHistory)
+	}
+
+	return errDeleteHistory
+}
+
+func (r *repoMongo) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+
+	const me = "repoMongo.restore"
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	doc := bson.D{
+		{Key: "gateway_name", Value: body.GatewayName},
+		{Key: "gateway_id", Value: body.GatewayID},
+		{Key: "changes", Value: body.Changes},
+		{Key: "last_update", Value: primitive.NewDateTimeFromTime(body.LastUpdate)},
+		{Key: "token", Value: body.Token},
+	}
+	if body.Deleted {
+		doc = append(doc, bson.E{Key: "deleted", Value: true})
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	_, errReplace := collection.ReplaceOne(ctxTimeout, bson.D{{Key: "gateway_name", Value: body.GatewayName}},
+		doc, options.Replace().SetUpsert(true))
+	if errReplace != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s replace error:%v", me, body.GatewayName, errReplace)
+		return errReplace
+	}
+
+	collectionHistory := r.client.Database(r.options.database).Collection(r.historyCollection())
+
+	ctxTimeout2, cancel2 := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel2()
+	_, errDeleteHistory := collectionHistory.DeleteMany(ctxTimeout2,
+		bson.D{{Key: "gateway_name", Value: body.GatewayName}})
+	if errDeleteHistory != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s delete history error:%v", me, body.GatewayName, errDeleteHistory)
+		return errDeleteHistory
+	}
+
+	history = historyTail(history, r.options.historyMax)
+
+	if len(history) == 0 {
+		return nil
+	}
+
+	docs := make([]interface{}, 0, len(history))
+	for _, h := range history {
+		d := bson.D{
+			{Key: "gateway_name", Value: body.GatewayName},
+			{Key: "gateway_id", Value: h.GatewayID},
+			{Key: "changes", Value: h.Changes},
+			{Key: "timestamp", Value: primitive.NewDateTimeFromTime(h.Timestamp)},
+			{Key: "source", Value: h.Source},
+		}
+		if h.Deleted {
+			d = append(d, bson.E{Key: "deleted", Value: true})
+		}
+		docs = append(docs, d)
+	}
+
+	ctxTimeout3, cancel3 := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel3()
+	_, errInsert := collectionHistory.InsertMany(ctxTimeout3, docs)
+	if errInsert != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s insert history error:%v", me, body.GatewayName, errInsert)
+	}
+
+	return errInsert
+}
+
+func (r *repoMongo) PutToken(ctx context.Context, gatewayName, token string) error {
+
+	const me = "repoMongo.putToken"
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	filter := bson.D{{Key: "gateway_name", Value: gatewayName}}
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "token", Value: token}}},
+	}
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	opts := options.Update().SetUpsert(true)
+	defer cancel()
+	response, errUpdate := collection.UpdateOne(ctxTimeout, filter, update, opts)
+
+	if errUpdate != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s token update error:%v response:%v",
+			me, gatewayName, errUpdate, mongoResultString(response))
+		return errUpdate
+	}
+
+	return nil
+}
+
+func mongoResultString(response *mongo.UpdateResult) string {
+	if response == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("%v", *response)
+}
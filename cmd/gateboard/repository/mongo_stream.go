@@ -0,0 +1,262 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+//
+// Repository: Mongo with change stream
+//
+// Change streams require a replica set or sharded cluster, hence
+// the feed is only offered by this wrapper, enabled by change_stream.
+//
+
+// repoMongoStream reports changes to the gateway collection,
+// including writes performed directly in mongo.
+type repoMongoStream struct {
+	*repoMongo
+	resumeID string // document holding the resume token
+
+	// deletes only carry the document _id, so names are learned
+	// from inserts and updates seen by the stream
+	names map[string]string // raw _id => gateway_name
+}
+
+// Saving the resume token on every event would double the writes of a busy
+// collection, so it is saved after mongoResumeSaveEvents events or
+// mongoResumeSaveInterval, whichever comes first, and when the stream stops.
+// A server that crashes replays the events seen since the last save,
+// which only invalidates caches once more.
+const (
+	mongoResumeSaveEvents   = 100
+	mongoResumeSaveInterval = 5 * time.Second
+	mongoResumeExpire       = 24 * time.Hour // tokens of servers gone for longer are removed
+)
+
+// newRepoMongoStream keys the resume token by resumeID, by default kind:name:hostname,
+// since every server watches the stream independently.
+func newRepoMongoStream(r *repoMongo, resumeID string) *repoMongoStream {
+	if resumeID == "" {
+		hostname, _ := os.Hostname()
+		resumeID = r.options.metricRepoName + ":" + hostname
+	}
+	return &repoMongoStream{
+		repoMongo: r,
+		resumeID:  resumeID,
+		names:     map[string]string{},
+	}
+}
+
+// resumeCollection keeps one resume token per resumeID, so that
+// a restarted server resumes the stream where it stopped.
+func (r *repoMongoStream) resumeCollection() *mongo.Collection {
+	return r.client.Database(r.options.database).Collection(r.options.collection + "_resume")
+}
+
+// expireResumeTokens creates a TTL index removing resume tokens not saved for
+// mongoResumeExpire, left behind by servers that are gone.
+func (r *repoMongoStream) expireResumeTokens() {
+	const me = "repoMongoStream.expireResumeTokens"
+
+	if r.options.indexCreationDisable {
+		return
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+
+	model := mongo.IndexModel{
+		Keys:    bson.D{{Key: "last_update", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(mongoResumeExpire.Seconds())),
+	}
+
+	if _, errCreate := r.resumeCollection().Indexes().CreateOne(ctxTimeout, model); errCreate != nil {
+		zlog.Errorf("%s: %v", me, errCreate)
+	}
+}
+
+func (r *repoMongoStream) loadResumeToken() (bson.Raw, error) {
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+
+	errFind := r.resumeCollection().FindOne(ctxTimeout, bson.D{{Key: "_id", Value: r.resumeID}}).Decode(&doc)
+	if errFind == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+
+	return doc.Token, errFind
+}
+
+func (r *repoMongoStream) saveResumeToken(token bson.Raw) error {
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "token", Value: token},
+		{Key: "last_update", Value: time.Now()},
+	}}}
+
+	_, errUpdate := r.resumeCollection().UpdateOne(ctxTimeout,
+		bson.D{{Key: "_id", Value: r.resumeID}}, update, options.Update().SetUpsert(true))
+
+	return errUpdate
+}
+
+func (r *repoMongoStream) clearResumeToken() error {
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+
+	_, errDelete := r.resumeCollection().DeleteOne(ctxTimeout, bson.D{{Key: "_id", Value: r.resumeID}})
+
+	return errDelete
+}
+
+// isResumeTokenLost reports whether the stream cannot resume from the token,
+// as the oplog no longer holds it.
+func isResumeTokenLost(err error) bool {
+	var errServer mongo.ServerError
+	if !errors.As(err, &errServer) {
+		return false
+	}
+	const (
+		changeStreamFatalError  = 280
+		changeStreamHistoryLost = 286
+	)
+	return errServer.HasErrorCode(changeStreamFatalError) || errServer.HasErrorCode(changeStreamHistoryLost)
+}
+
+type mongoChangeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID bson.RawValue `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *struct {
+		GatewayName string `bson:"gateway_name"`
+	} `bson:"fullDocument"`
+}
+
+func (r *repoMongoStream) WatchChanges(ctx context.Context, changed func(gatewayName string)) error {
+	const me = "repoMongoStream.WatchChanges"
+
+	r.expireResumeTokens()
+
+	token, errLoad := r.loadResumeToken()
+	if errLoad != nil {
+		return fmt.Errorf("%s: load resume token: %w", me, errLoad)
+	}
+
+	collection := r.client.Database(r.options.database).Collection(r.options.collection)
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "operationType", Value: bson.D{
+			{Key: "$in", Value: bson.A{"insert", "update", "replace", "delete", "invalidate"}},
+		}}}}},
+	}
+
+	// getMore waits at most maxAwaitTime for events, so the token
+	// can be saved on time even when the collection is idle
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup).SetMaxAwaitTime(time.Second)
+	if token != nil {
+		opts.SetStartAfter(token)
+	}
+
+	stream, errWatch := collection.Watch(ctx, pipeline, opts)
+	if errWatch != nil && token != nil && isResumeTokenLost(errWatch) {
+		zlog.Errorf("%s: resume token lost, changes made meanwhile were missed: %v", me, errWatch)
+		if errClear := r.clearResumeToken(); errClear != nil {
+			return fmt.Errorf("%s: clear resume token: %w", me, errClear)
+		}
+		stream, errWatch = collection.Watch(ctx, pipeline, opts.SetStartAfter(nil))
+	}
+	if errWatch != nil {
+		return errWatch
+	}
+	defer stream.Close(context.Background())
+
+	var unsaved int // events since last save
+	lastSave := time.Now()
+
+	save := func() error {
+		if errSave := r.saveResumeToken(stream.ResumeToken()); errSave != nil {
+			return fmt.Errorf("%s: save resume token: %w", me, errSave)
+		}
+		unsaved = 0
+		lastSave = time.Now()
+		return nil
+	}
+
+	for {
+		if !stream.TryNext(ctx) {
+			if errCtx := ctx.Err(); errCtx != nil {
+				if unsaved > 0 {
+					return errors.Join(errCtx, save()) // stopping
+				}
+				return errCtx
+			}
+			if errStream := stream.Err(); errStream != nil {
+				return errStream
+			}
+			// idle: also refresh the token now and then to keep it from expiring
+			if since := time.Since(lastSave); (unsaved > 0 && since >= mongoResumeSaveInterval) || since >= mongoResumeExpire/4 {
+				if errSave := save(); errSave != nil {
+					return errSave
+				}
+			}
+			continue
+		}
+
+		var event mongoChangeEvent
+		if errDecode := stream.Decode(&event); errDecode != nil {
+			return fmt.Errorf("%s: decode: %w", me, errDecode)
+		}
+
+		if event.OperationType == "invalidate" {
+			// collection dropped or renamed, restart after the invalidate event
+			clear(r.names)
+			if errSave := save(); errSave != nil {
+				return errSave
+			}
+			return fmt.Errorf("%s: change stream invalidated", me)
+		}
+
+		id := string(event.DocumentKey.ID.Value)
+
+		var gatewayName string
+		if event.FullDocument != nil {
+			gatewayName = event.FullDocument.GatewayName
+			r.names[id] = gatewayName
+		} else {
+			gatewayName = r.names[id] // delete, or update of a document deleted meanwhile
+		}
+		if event.OperationType == "delete" {
+			delete(r.names, id)
+		}
+
+		if gatewayName == "" {
+			zlog.Debugf(r.options.debug, "%s: %s of unknown document: %s", me, event.OperationType, event.DocumentKey.ID)
+		} else {
+			changed(gatewayName)
+		}
+
+		unsaved++
+		if unsaved >= mongoResumeSaveEvents || time.Since(lastSave) >= mongoResumeSaveInterval {
+			if errSave := save(); errSave != nil {
+				return errSave
+			}
+		}
+	}
+}
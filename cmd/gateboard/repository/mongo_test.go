@@ -0,0 +1,94 @@
+package repository
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// go test -v -run TestRepoMongoChangeStream ./cmd/gateboard/repository
+func TestRepoMongoChangeStream(t *testing.T) {
+
+	env := gateboard.NewEnv("TestRepoMongoChangeStream")
+
+	if !env.Bool("TEST_REPO_MONGO_CHANGE_STREAM", false) {
+		t.Skip("TEST_REPO_MONGO_CHANGE_STREAM not enabled, requires mongo replica set")
+	}
+
+	const table = "gateboard_test_stream"
+
+	r, err := newRepoMongo(repoMongoOptions{
+		URI:        env.String("MONGO_URL", "mongodb://localhost:27017"),
+		database:   table,
+		collection: table,
+		timeout:    time.Second * 10,
+	})
+	if err != nil {
+		t.Fatalf("error initializing mongodb: %v", err)
+	}
+	if errDrop := r.DropDatabase(); errDrop != nil {
+		t.Fatalf("dropping database: %v", errDrop)
+	}
+
+	stream := newRepoMongoStream(r, "test")
+
+	changes := make(chan string, 10)
+	startFeed := func() context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		go stream.WatchChanges(ctx, func(gatewayName string) { changes <- gatewayName })
+		return cancel
+	}
+
+	expect := func(gatewayName string, write func()) {
+		t.Helper()
+		deadline := time.After(10 * time.Second)
+		for {
+			if write != nil {
+				write()
+			}
+			select {
+			case name := <-changes:
+				if name == gatewayName {
+					return
+				}
+				// replay of earlier writes
+			case <-time.After(200 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("missing change for %s", gatewayName)
+			}
+		}
+	}
+
+	ctx := context.TODO()
+
+	// stream opens asynchronously, so write until the first change shows up
+	cancel := startFeed()
+	expect("gw1", func() { save(t, r, table, "gw1", "id1", false) })
+	cancel()
+	time.Sleep(time.Second) // feed stopped
+
+	// a change made while the feed is down is resumed from the saved token
+	if errPut := r.Put(ctx, "gw2", "id2", "test", AnyChanges); errPut != nil {
+		t.Fatalf("put: %v", errPut)
+	}
+	cancel = startFeed()
+	defer cancel()
+	expect("gw2", nil)
+}
+
+// go test -v -run TestRepoMongoStreamResumeID ./cmd/gateboard/repository
+func TestRepoMongoStreamResumeID(t *testing.T) {
+	r := &repoMongo{options: repoMongoOptions{metricRepoName: "mongo:mongo1"}}
+
+	hostname, _ := os.Hostname()
+
+	if id := newRepoMongoStream(r, "").resumeID; id != "mongo:mongo1:"+hostname {
+		t.Errorf("default resume id: expected per server id, got %s", id)
+	}
+	if id := newRepoMongoStream(r, "shared").resumeID; id != "shared" {
+		t.Errorf("explicit resume id: expected shared, got %s", id)
+	}
+}
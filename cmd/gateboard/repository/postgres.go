@@ -0,0 +1,465 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: Postgres
+//
+
+type repoPostgresOptions struct {
+	metricRepoName string // kind:name
+	debug          bool
+	URL            string
+	username       string
+	password       string
+	table          string
+	maxConns       int32
+	manualCreate   bool
+	timeout        time.Duration
+	historyMax     int // 0 means unlimited
+}
+
+type repoPostgres struct {
+	options      repoPostgresOptions
+	pool         *pgxpool.Pool
+	table        string // sanitized identifier
+	historyTable string // sanitized identifier
+}
+
+func newRepoPostgres(opt repoPostgresOptions) (*repoPostgres, error) {
+	const me = "newRepoPostgres"
+
+	if opt.table == "" {
+		return nil, fmt.Errorf("%s: missing table name", me)
+	}
+
+	config, errConfig := pgxpool.ParseConfig(opt.URL)
+	if errConfig != nil {
+		return nil, fmt.Errorf("%s: parse url: %v", me, errConfig)
+	}
+	if opt.username != "" {
+		config.ConnConfig.User = opt.username
+	}
+	if opt.password != "" {
+		config.ConnConfig.Password = opt.password
+	}
+	if opt.maxConns > 0 {
+		config.MaxConns = opt.maxConns
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), opt.timeout)
+	defer cancel()
+
+	pool, errPool := pgxpool.NewWithConfig(ctx, config)
+	if errPool != nil {
+		return nil, fmt.Errorf("%s: connect: %v", me, errPool)
+	}
+
+	r := &repoPostgres{
+		options:      opt,
+		pool:         pool,
+		table:        pgx.Identifier{opt.table}.Sanitize(),
+		historyTable: pgx.Identifier{opt.table + "_history"}.Sanitize(),
+	}
+
+	if !opt.manualCreate {
+		if errMigrate := r.migrate(ctx); errMigrate != nil {
+			pool.Close()
+			return nil, fmt.Errorf("%s: %v", me, errMigrate)
+		}
+	}
+
+	return r, nil
+}
+
+// migrate creates the schema, or upgrades an older one.
+// Every statement must be idempotent since it runs on every startup.
+func (r *repoPostgres) migrate(ctx context.Context) error {
+	const me = "repoPostgres.migrate"
+
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + r.table + ` (
+			gateway_name TEXT PRIMARY KEY,
+			gateway_id   TEXT NOT NULL DEFAULT '',
+			changes      BIGINT NOT NULL DEFAULT 0,
+			last_update  TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		`ALTER TABLE ` + r.table + ` ADD COLUMN IF NOT EXISTS token TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE ` + r.table + ` ADD COLUMN IF NOT EXISTS deleted BOOLEAN NOT NULL DEFAULT false`,
+		`CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{r.options.table + "_last_update"}.Sanitize() +
+			` ON ` + r.table + ` (last_update)`,
+		`CREATE TABLE IF NOT EXISTS ` + r.historyTable + ` (
+			gateway_name TEXT NOT NULL,
+			gateway_id   TEXT NOT NULL,
+			changes      BIGINT NOT NULL,
+			timestamp    TIMESTAMPTZ NOT NULL,
+			source       TEXT NOT NULL DEFAULT '',
+			deleted      BOOLEAN NOT NULL DEFAULT false,
+			PRIMARY KEY (gateway_name, changes)
+		)`,
+	}
+
+	for i, stmt := range statements {
+		if _, err := r.pool.Exec(ctx, stmt); err != nil {
+			return fmt.Errorf("%s: step %d/%d: %v", me, i+1, len(statements), err)
+		}
+	}
+
+	zlog.Infof("%s: table=%s: schema ready", me, r.options.table)
+
+	return nil
+}
+
+func (r *repoPostgres) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoPostgres) Close(_ /*ctx*/ context.Context) error {
+	r.pool.Close()
+	return nil
+}
+
+func (r *repoPostgres) DropDatabase() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.options.timeout)
+	defer cancel()
+	_, err := r.pool.Exec(ctx, `DROP TABLE IF EXISTS `+r.table+`, `+r.historyTable)
+	return err
+}
+
+// likeEscape escapes LIKE wildcards in s, for use with ESCAPE '\'.
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (r *repoPostgres) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoPostgres.dump"
+
+	list := Dump{}
+
+	query := `SELECT gateway_name, gateway_id, changes, last_update, token, deleted FROM ` + r.table
+	var where []string
+	var args []any
+	if namePrefix := filter.NamePrefix(); namePrefix != "" {
+		args = append(args, likeEscape(namePrefix)+"%")
+		where = append(where, fmt.Sprintf(`gateway_name LIKE $%d ESCAPE '\'`, len(args)))
+	}
+	if !filter.UpdatedSince.IsZero() {
+		args = append(args, filter.UpdatedSince)
+		where = append(where, fmt.Sprintf(`last_update >= $%d`, len(args)))
+	}
+	if filter.After != "" {
+		args = append(args, filter.After)
+		where = append(where, fmt.Sprintf(`gateway_name > $%d COLLATE "C"`, len(args)))
+	}
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	if filter.Limit > 0 {
+		// byte order, as compared by dump callers
+		query += ` ORDER BY gateway_name COLLATE "C"`
+		if filter.Account == "" && filter.Region == "" {
+			// prefix and updated_since are fully evaluated by the query
+			args = append(args, filter.Limit)
+			query += fmt.Sprintf(` LIMIT $%d`, len(args))
+		}
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	rows, errQuery := r.pool.Query(ctxTimeout, query, args...)
+	if errQuery != nil {
+		zlog.CtxErrorf(ctx, "%s: query error: %v", me, errQuery)
+		return list, errQuery
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, id, token string
+		var changes int64
+		var lastUpdate time.Time
+		var deleted bool
+		if errScan := rows.Scan(&name, &id, &changes, &lastUpdate, &token, &deleted); errScan != nil {
+			zlog.CtxErrorf(ctx, "%s: scan error: %v", me, errScan)
+			return list, errScan
+		}
+		if filter.Limit > 0 && !filter.Match(name, lastUpdate) {
+			continue // account or region
+		}
+		list = append(list, map[string]interface{}{
+			"gateway_name": name,
+			"gateway_id":   id,
+			"changes":      changes,
+			"last_update":  lastUpdate,
+			"token":        token,
+			"deleted":      deleted,
+		})
+		if filter.Limit > 0 && len(list) >= filter.Limit {
+			break
+		}
+	}
+
+	if errRows := rows.Err(); errRows != nil {
+		zlog.CtxErrorf(ctx, "%s: rows error: %v", me, errRows)
+		return list, errRows
+	}
+
+	return list, nil
+}
+
+func (r *repoPostgres) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoPostgres.get"
+
+	var body gateboard.BodyGetReply
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return body, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	errQuery := r.pool.QueryRow(ctxTimeout,
+		`SELECT gateway_name, gateway_id, changes, last_update, token, deleted FROM `+r.table+` WHERE gateway_name = $1`,
+		gatewayName).Scan(&body.GatewayName, &body.GatewayID, &body.Changes, &body.LastUpdate, &body.Token, &body.Deleted)
+
+	switch {
+	case errors.Is(errQuery, pgx.ErrNoRows):
+		return body, ErrGatewayNotFound
+	case errQuery != nil:
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s query error: %v", me, gatewayName, errQuery)
+		return body, errQuery
+	}
+
+	return body, nil
+}
+
+// write runs statement, which must return gateway_id, changes, last_update and deleted,
+// and appends the result to history in the same transaction.
+// No row returned means compare-and-swap mismatch.
+func (r *repoPostgres) write(ctx context.Context, me, gatewayName, source, statement string, args ...any) error {
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	errTx := pgx.BeginFunc(ctxTimeout, r.pool, func(tx pgx.Tx) error {
+		var e gateboard.HistoryEntry
+		errWrite := tx.QueryRow(ctxTimeout, statement, args...).Scan(&e.GatewayID, &e.Changes, &e.Timestamp, &e.Deleted)
+		if errors.Is(errWrite, pgx.ErrNoRows) {
+			return ErrConflict
+		}
+		if errWrite != nil {
+			return errWrite
+		}
+
+		_, errHistory := tx.Exec(ctxTimeout,
+			`INSERT INTO `+r.historyTable+` (gateway_name, gateway_id, changes, timestamp, source, deleted)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (gateway_name, changes) DO NOTHING`,
+			gatewayName, e.GatewayID, e.Changes, e.Timestamp, source, e.Deleted)
+		if errHistory != nil {
+			return errHistory
+		}
+
+		if cutoff := historyCutoff(e.Changes, r.options.historyMax); cutoff > 0 {
+			_, errTrim := tx.Exec(ctxTimeout,
+				`DELETE FROM `+r.historyTable+` WHERE gateway_name = $1 AND changes <= $2`,
+				gatewayName, cutoff)
+			return errTrim
+		}
+
+		return nil
+	})
+
+	if errTx != nil && errTx != ErrConflict {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s error: %v", me, gatewayName, errTx)
+	}
+
+	return errTx
+}
+
+func (r *repoPostgres) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoPostgres.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	const returning = ` RETURNING gateway_id, changes, last_update, deleted`
+
+	now := time.Now()
+
+	if expectedChanges > 0 {
+		// a missing row means mismatch
+		return r.write(ctx, me, gatewayName, source,
+			`UPDATE `+r.table+` SET gateway_id = $2, changes = changes + 1, last_update = $3, deleted = false
+			WHERE gateway_name = $1 AND changes = $4`+returning,
+			gatewayName, gatewayID, now, expectedChanges)
+	}
+
+	upsert := `INSERT INTO ` + r.table + ` AS t (gateway_name, gateway_id, changes, last_update, deleted)
+		VALUES ($1, $2, 1, $3, false)
+		ON CONFLICT (gateway_name) DO UPDATE SET gateway_id = EXCLUDED.gateway_id,
+		changes = t.changes + 1, last_update = EXCLUDED.last_update, deleted = false`
+
+	if expectedChanges == 0 {
+		// an entry holding only a token has changes=0
+		return r.write(ctx, me, gatewayName, source, upsert+` WHERE t.changes = 0`+returning,
+			gatewayName, gatewayID, now)
+	}
+
+	return r.write(ctx, me, gatewayName, source, upsert+returning, gatewayName, gatewayID, now)
+}
+
+func (r *repoPostgres) Delete(ctx context.Context, gatewayName, source string) error {
+	const me = "repoPostgres.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	return r.write(ctx, me, gatewayName, source,
+		`INSERT INTO `+r.table+` AS t (gateway_name, gateway_id, changes, last_update, deleted)
+		VALUES ($1, '', 1, $2, true)
+		ON CONFLICT (gateway_name) DO UPDATE SET gateway_id = '',
+		changes = t.changes + 1, last_update = EXCLUDED.last_update, deleted = true
+		RETURNING gateway_id, changes, last_update, deleted`,
+		gatewayName, time.Now())
+}
+
+func (r *repoPostgres) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoPostgres.history"
+
+	list := []gateboard.HistoryEntry{}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return list, errVal
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	rows, errQuery := r.pool.Query(ctxTimeout,
+		`SELECT gateway_id, changes, timestamp, source, deleted FROM `+r.historyTable+
+			` WHERE gateway_name = $1 ORDER BY changes`, gatewayName)
+	if errQuery != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s query error: %v", me, gatewayName, errQuery)
+		return list, errQuery
+	}
+
+	list, errCollect := pgx.AppendRows(list, rows, func(row pgx.CollectableRow) (gateboard.HistoryEntry, error) {
+		var e gateboard.HistoryEntry
+		err := row.Scan(&e.GatewayID, &e.Changes, &e.Timestamp, &e.Source, &e.Deleted)
+		return e, err
+	})
+	if errCollect != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s scan error: %v", me, gatewayName, errCollect)
+	}
+
+	return list, errCollect
+}
+
+func (r *repoPostgres) Purge(ctx context.Context, gatewayName string) error {
+	const me = "repoPostgres.purge"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	errTx := pgx.BeginFunc(ctxTimeout, r.pool, func(tx pgx.Tx) error {
+		tag, errDelete := tx.Exec(ctxTimeout,
+			`DELETE FROM `+r.table+` WHERE gateway_name = $1 AND deleted`, gatewayName)
+		if errDelete != nil {
+			return errDelete
+		}
+		if tag.RowsAffected() == 0 {
+			return nil // not a tombstone
+		}
+
+		// changes counter restarts, so history must go too
+		_, errHistory := tx.Exec(ctxTimeout,
+			`DELETE FROM `+r.historyTable+` WHERE gateway_name = $1`, gatewayName)
+		return errHistory
+	})
+
+	if errTx != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s error: %v", me, gatewayName, errTx)
+	}
+
+	return errTx
+}
+
+func (r *repoPostgres) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+	const me = "repoPostgres.restore"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	errTx := pgx.BeginFunc(ctxTimeout, r.pool, func(tx pgx.Tx) error {
+		_, errUpsert := tx.Exec(ctxTimeout,
+			`INSERT INTO `+r.table+` (gateway_name, gateway_id, changes, last_update, token, deleted)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (gateway_name) DO UPDATE SET gateway_id = EXCLUDED.gateway_id,
+				changes = EXCLUDED.changes, last_update = EXCLUDED.last_update,
+				token = EXCLUDED.token, deleted = EXCLUDED.deleted`,
+			body.GatewayName, body.GatewayID, body.Changes, body.LastUpdate, body.Token, body.Deleted)
+		if errUpsert != nil {
+			return errUpsert
+		}
+
+		_, errDelete := tx.Exec(ctxTimeout,
+			`DELETE FROM `+r.historyTable+` WHERE gateway_name = $1`, body.GatewayName)
+		if errDelete != nil {
+			return errDelete
+		}
+
+		for _, e := range historyTail(history, r.options.historyMax) {
+			_, errHistory := tx.Exec(ctxTimeout,
+				`INSERT INTO `+r.historyTable+` (gateway_name, gateway_id, changes, timestamp, source, deleted)
+				VALUES ($1, $2, $3, $4, $5, $6)`,
+				body.GatewayName, e.GatewayID, e.Changes, e.Timestamp, e.Source, e.Deleted)
+			if errHistory != nil {
+				return errHistory
+			}
+		}
+
+		return nil
+	})
+
+	if errTx != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s error: %v", me, body.GatewayName, errTx)
+	}
+
+	return errTx
+}
+
+func (r *repoPostgres) PutToken(ctx context.Context, gatewayName, token string) error {
+	const me = "repoPostgres.putToken"
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, r.options.timeout)
+	defer cancel()
+
+	_, errExec := r.pool.Exec(ctxTimeout,
+		`INSERT INTO `+r.table+` (gateway_name, token) VALUES ($1, $2)
+		ON CONFLICT (gateway_name) DO UPDATE SET token = EXCLUDED.token`,
+		gatewayName, token)
+	if errExec != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s token update error: %v", me, gatewayName, errExec)
+	}
+
+	return errExec
+}
@@ -0,0 +1,515 @@
+package repository
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+type repoRedisOptions struct {
+	metricRepoName        string // kind:name
+	debug                 bool
+	addr                  string
+	password              string
+	key                   string
+	tls                   bool
+	tlsInsecureSkipVerify bool
+	clientName            string
+	db                    int
+	cluster               bool
+	clusterAddrs          []string // defaults to addr
+	masterName            string   // sentinel master name, enables sentinel
+	sentinelAddrs         []string
+	sentinelPassword      string
+	poolSize              int // 0 means go-redis default
+	minIdleConns          int
+	poolTimeout           time.Duration
+	historyMax            int // 0 means unlimited
+}
+
+type repoRedis struct {
+	options     repoRedisOptions
+	redisClient redis.UniversalClient
+}
+
+func newRepoRedis(opt repoRedisOptions) (*repoRedis, error) {
+
+	if opt.cluster && opt.masterName != "" {
+		return nil, fmt.Errorf("newRepoRedis: cluster and sentinel master_name are mutually exclusive")
+	}
+
+	if opt.cluster && opt.db != 0 {
+		return nil, fmt.Errorf("newRepoRedis: cluster supports only db 0, got db=%d", opt.db)
+	}
+
+	redisOptions := &redis.UniversalOptions{
+		Addrs:            []string{opt.addr},
+		Password:         opt.password,
+		DB:               opt.db,
+		ClientName:       opt.clientName,
+		PoolSize:         opt.poolSize,
+		MinIdleConns:     opt.minIdleConns,
+		PoolTimeout:      opt.poolTimeout,
+		IsClusterMode:    opt.cluster,
+		MasterName:       opt.masterName,
+		SentinelPassword: opt.sentinelPassword,
+	}
+
+	switch {
+	case opt.masterName != "":
+		if len(opt.sentinelAddrs) == 0 {
+			return nil, fmt.Errorf("newRepoRedis: sentinel master_name=%s requires sentinel_addrs", opt.masterName)
+		}
+		redisOptions.Addrs = opt.sentinelAddrs
+	case opt.cluster && len(opt.clusterAddrs) > 0:
+		redisOptions.Addrs = opt.clusterAddrs
+	}
+
+	if opt.tls || opt.tlsInsecureSkipVerify {
+		redisOptions.TLSConfig = &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: opt.tlsInsecureSkipVerify,
+		}
+	}
+
+	r := &repoRedis{
+		options:     opt,
+		redisClient: redis.NewUniversalClient(redisOptions),
+	}
+
+	return r, nil
+}
+
+func (r *repoRedis) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoRedis) Close(_ /*ctx*/ context.Context) error {
+	return r.redisClient.Close()
+}
+
+func (r *repoRedis) DropDatabase() error {
+	ctx := context.TODO()
+
+	// history keys are found from the hash, since KEYS would
+	// visit a single node of a cluster
+	fields, errFields := r.redisClient.HKeys(ctx, r.options.key).Result()
+	if errFields != nil {
+		return errFields
+	}
+
+	keys := []string{r.options.key}
+	const changesPrefix = prefix + "changes:"
+	for _, f := range fields {
+		if gatewayName, found := strings.CutPrefix(f, changesPrefix); found {
+			keys = append(keys, r.historyKey(gatewayName))
+		}
+	}
+
+	// one key at a time, keys might live in distinct cluster slots
+	for _, k := range keys {
+		if errDel := r.redisClient.Del(ctx, k).Err(); errDel != nil {
+			return errDel
+		}
+	}
+
+	return nil
+}
+
+const (
+	prefix = "gateway:"
+	match  = prefix + "*"
+)
+
+// dump scans the whole hash, even for a page, since hash fields are unordered.
+func (r *repoRedis) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoRedis.dump"
+
+	list := Dump{}
+
+	tab := map[string]map[string]interface{}{}
+
+	isKey := true
+	var gatewayField string
+	var gatewayName string
+
+	// fields are gateway:<attribute>:<gateway_name>
+	pattern := match
+	if namePrefix := filter.NamePrefix(); namePrefix != "" {
+		pattern = prefix + "*:" + globEscape(namePrefix) + "*"
+	}
+
+	iter := r.redisClient.HScan(ctx, r.options.key, 0, pattern, 0).Iterator()
+	for iter.Next(ctx) {
+		if err := iter.Err(); err != nil {
+			return list, err
+		}
+		val := iter.Val()
+		zlog.CtxDebugf(ctx, r.options.debug, "%s: isKey=%-5v value:%s", me, isKey, val)
+		if isKey {
+			// found key: gateway:gateway_id:gw1
+			_, after, _ := strings.Cut(val, ":")
+			gatewayField, gatewayName, _ = strings.Cut(after, ":")
+		} else {
+			// found value: id1
+			gateway, found := tab[gatewayName]
+			if !found {
+				gateway = map[string]interface{}{
+					"gateway_name": gatewayName,
+				}
+				tab[gatewayName] = gateway
+			}
+			gateway[gatewayField] = val
+		}
+		isKey = !isKey
+	}
+
+	for _, g := range tab {
+		list = append(list, g)
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+// globEscape quotes glob special characters for redis MATCH.
+func globEscape(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// prefix:field_name:gateway_name = field_value
+//
+// gateway:gateway_id:gateway1    = id1
+// gateway:changes:gateway1       = 4
+func field(gatewayName, field string) string {
+	return prefix + field + ":" + gatewayName
+}
+
+func (r *repoRedis) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoRedis.get"
+
+	body := gateboard.BodyGetReply{GatewayName: gatewayName}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return body, errVal
+	}
+
+	fieldID := field(gatewayName, "gateway_id")
+	fieldChanges := field(gatewayName, "changes")
+	fieldLastUpdate := field(gatewayName, "last_update")
+	fieldToken := field(gatewayName, "token")
+	fieldDeleted := field(gatewayName, "deleted")
+
+	cmdMGet := r.redisClient.HMGet(ctx, r.options.key, fieldID, fieldChanges, fieldLastUpdate, fieldToken, fieldDeleted)
+	errMGet := cmdMGet.Err()
+	if errMGet == redis.Nil {
+		return body, ErrGatewayNotFound
+	}
+	if errMGet != nil {
+		return body, cmdMGet.Err()
+	}
+	fieldValues := cmdMGet.Val()
+
+	// missing fields come as nil; a token alone does not make a gateway
+	if fieldValues[0] == nil && fieldValues[1] == nil {
+		return body, ErrGatewayNotFound
+	}
+
+	var ok bool
+
+	//
+	// gateway id
+	//
+	valueGatewayID := fieldValues[0]
+	body.GatewayID, ok = valueGatewayID.(string)
+	if !ok {
+		return body, fmt.Errorf("field gateway_id not string: %[1]T: %[1]v", valueGatewayID)
+	}
+
+	//
+	// changes
+	//
+	valueChanges := fieldValues[1]
+	var changesStr string
+	changesStr, ok = valueChanges.(string)
+	if !ok {
+		return body, fmt.Errorf("field changes not string: %[1]T: %[1]v", valueChanges)
+	}
+	changes, errConv := strconv.ParseInt(changesStr, 10, 64)
+	if errConv != nil {
+		zlog.CtxErrorf(ctx, "%s: parse changes: %v", me, errConv)
+	}
+	body.Changes = changes
+
+	//
+	// last update
+	//
+	valueLastUpdate := fieldValues[2]
+	var lastUpdateStr string
+	lastUpdateStr, ok = valueLastUpdate.(string)
+	if !ok {
+		return body, fmt.Errorf("field last_update not string: %[1]T: %[1]v", valueLastUpdate)
+	}
+	lastUpdate, errParse := time.Parse(time.RFC3339, lastUpdateStr)
+	if errParse != nil {
+		zlog.CtxErrorf(ctx, "%s: last update parse: %v", me, errParse)
+	}
+	body.LastUpdate = lastUpdate
+
+	//
+	// token
+	//
+	valueToken := fieldValues[3]
+	if valueToken != nil {
+		body.Token, ok = valueToken.(string)
+		if !ok {
+			return body, fmt.Errorf("field token not string: %[1]T: %[1]v", valueToken)
+		}
+	}
+
+	//
+	// deleted
+	//
+	valueDeleted := fieldValues[4]
+	if valueDeleted != nil {
+		var deletedStr string
+		deletedStr, ok = valueDeleted.(string)
+		if !ok {
+			return body, fmt.Errorf("field deleted not string: %[1]T: %[1]v", valueDeleted)
+		}
+		deleted, errParseBool := strconv.ParseBool(deletedStr)
+		if errParseBool != nil {
+			zlog.CtxErrorf(ctx, "%s: parse deleted: %v", me, errParseBool)
+		}
+		body.Deleted = deleted
+	}
+
+	return body, nil
+}
+
+func (r *repoRedis) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoRedis.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	return r.write(ctx, gatewayName, gatewayID, source, false, expectedChanges)
+}
+
+func (r *repoRedis) Delete(ctx context.Context, gatewayName, source string) error {
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	return r.write(ctx, gatewayName, "", source, true, AnyChanges)
+}
+
+// redisWriteScript updates all gateway fields, bumps the changes counter
+// and appends the history entry as a single atomic step.
+//
+// KEYS[1]: hash key
+// KEYS[2]: history key
+// ARGV[1..4]: fields gateway_id, changes, last_update, deleted
+// ARGV[5]: gateway id
+// ARGV[6]: last update
+// ARGV[7]: expected changes, -1 means any
+// ARGV[8]: "true" for tombstone
+// ARGV[9]: history entry JSON, changes is filled in by the script
+// ARGV[10]: history entries kept, 0 means unlimited
+//
+// Returns the new changes counter, or -1 on conflict.
+var redisWriteScript = redis.NewScript(`
+local changes = tonumber(redis.call('HGET', KEYS[1], ARGV[2]) or '0')
+local expected = tonumber(ARGV[7])
+if expected >= 0 and changes ~= expected then
+	return -1
+end
+changes = changes + 1
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[5], ARGV[2], changes, ARGV[3], ARGV[6])
+if ARGV[8] == 'true' then
+	redis.call('HSET', KEYS[1], ARGV[4], 'true')
+else
+	redis.call('HDEL', KEYS[1], ARGV[4])
+end
+local entry = cjson.decode(ARGV[9])
+entry['changes'] = changes
+local size = redis.call('RPUSH', KEYS[2], cjson.encode(entry))
+local keep = tonumber(ARGV[10])
+if keep > 0 and size > keep then
+	redis.call('LTRIM', KEYS[2], -keep, -1)
+end
+return changes
+`)
+
+func (r *repoRedis) write(ctx context.Context, gatewayName, gatewayID, source string, deleted bool, expectedChanges int64) error {
+	const me = "repoRedis.write"
+
+	now := time.Now()
+
+	buf, errMarshal := json.Marshal(gateboard.HistoryEntry{
+		GatewayID: gatewayID,
+		Timestamp: now,
+		Source:    source,
+		Deleted:   deleted,
+	})
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	keys := []string{r.options.key, r.historyKey(gatewayName)}
+
+	changes, errRun := redisWriteScript.Run(ctx, r.redisClient, keys,
+		field(gatewayName, "gateway_id"),
+		field(gatewayName, "changes"),
+		field(gatewayName, "last_update"),
+		field(gatewayName, "deleted"),
+		gatewayID,
+		now.Format(time.RFC3339),
+		expectedChanges,
+		strconv.FormatBool(deleted),
+		buf,
+		r.options.historyMax).Int64()
+	if errRun != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errRun)
+		return errRun
+	}
+
+	if changes < 0 {
+		return ErrConflict
+	}
+
+	zlog.CtxDebugf(ctx, r.options.debug, "%s: gatewayName=%s changes=%d", me, gatewayName, changes)
+
+	return nil
+}
+
+// historyKey holds one list per gateway.
+//
+// gateboard:history:gateway1 = [ {entry1}, {entry2}, ... ]
+//
+// In cluster mode the hash key is wrapped in a hash tag, so that
+// history and hash share the slot required by redisWriteScript:
+//
+// {gateboard}:history:gateway1 = [ {entry1}, {entry2}, ... ]
+func (r *repoRedis) historyKey(gatewayName string) string {
+	if r.options.cluster {
+		return "{" + r.options.key + "}:history:" + gatewayName
+	}
+	return r.options.key + ":history:" + gatewayName
+}
+
+func (r *repoRedis) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	values, errRange := r.redisClient.LRange(ctx, r.historyKey(gatewayName), 0, -1).Result()
+	if errRange != nil {
+		return nil, errRange
+	}
+
+	list := make([]gateboard.HistoryEntry, 0, len(values))
+
+	for _, v := range values {
+		var entry gateboard.HistoryEntry
+		if errUnmarshal := json.Unmarshal([]byte(v), &entry); errUnmarshal != nil {
+			return list, errUnmarshal
+		}
+		list = append(list, entry)
+	}
+
+	return list, nil
+}
+
+// redisPurgeScript removes a tombstone along with its history.
+//
+// KEYS[1]: hash key
+// KEYS[2]: history key
+// ARGV[1..5]: fields deleted, gateway_id, changes, last_update, token
+var redisPurgeScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= 'true' then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1], ARGV[2], ARGV[3], ARGV[4], ARGV[5])
+redis.call('DEL', KEYS[2])
+return 1
+`)
+
+func (r *repoRedis) Purge(ctx context.Context, gatewayName string) error {
+	keys := []string{r.options.key, r.historyKey(gatewayName)}
+
+	// changes counter restarts, so history must go too
+	return redisPurgeScript.Run(ctx, r.redisClient, keys,
+		field(gatewayName, "deleted"),
+		field(gatewayName, "gateway_id"),
+		field(gatewayName, "changes"),
+		field(gatewayName, "last_update"),
+		field(gatewayName, "token")).Err()
+}
+
+func (r *repoRedis) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+
+	gatewayName := body.GatewayName
+
+	history = historyTail(history, r.options.historyMax)
+
+	entries := make([]interface{}, 0, len(history))
+	for _, h := range history {
+		buf, errMarshal := json.Marshal(h)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		entries = append(entries, buf)
+	}
+
+	// MULTI/EXEC, keys share the slot in cluster mode
+	_, errExec := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, r.options.key,
+			field(gatewayName, "gateway_id"), body.GatewayID,
+			field(gatewayName, "changes"), body.Changes,
+			field(gatewayName, "last_update"), body.LastUpdate.Format(time.RFC3339),
+			field(gatewayName, "token"), body.Token)
+		if body.Deleted {
+			pipe.HSet(ctx, r.options.key, field(gatewayName, "deleted"), "true")
+		} else {
+			pipe.HDel(ctx, r.options.key, field(gatewayName, "deleted"))
+		}
+		pipe.Del(ctx, r.historyKey(gatewayName))
+		if len(entries) > 0 {
+			pipe.RPush(ctx, r.historyKey(gatewayName), entries...)
+		}
+		return nil
+	})
+
+	return errExec
+}
+
+// putToken is a single HSET, hence atomic. Tokens are not versioned,
+// so the changes counter is left alone.
+func (r *repoRedis) PutToken(ctx context.Context, gatewayName, token string) error {
+	fieldToken := field(gatewayName, "token")
+	return r.redisClient.HSet(ctx, r.options.key, fieldToken, token).Err()
+}
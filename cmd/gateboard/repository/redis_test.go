@@ -0,0 +1,28 @@
+package repository
+
+import "testing"
+
+// go test -v -run TestRepoRedisOptions ./cmd/gateboard/repository
+func TestRepoRedisOptions(t *testing.T) {
+	bad := []repoRedisOptions{
+		{key: "gateboard", cluster: true, masterName: "mymaster", sentinelAddrs: []string{"localhost:26379"}},
+		{key: "gateboard", cluster: true, db: 1},
+		{key: "gateboard", masterName: "mymaster"},
+	}
+	for _, opt := range bad {
+		if _, err := newRepoRedis(opt); err == nil {
+			t.Errorf("expected error for options: %+v", opt)
+		}
+	}
+
+	r, errCluster := newRepoRedis(repoRedisOptions{key: "gateboard", cluster: true, addr: "localhost:6379"})
+	if errCluster != nil {
+		t.Fatalf("cluster: %v", errCluster)
+	}
+	defer r.Close(t.Context())
+
+	// hash tag must place history in the slot of the hash key
+	if h := r.historyKey("gw1"); h != "{gateboard}:history:gw1" {
+		t.Errorf("unexpected cluster history key: %s", h)
+	}
+}
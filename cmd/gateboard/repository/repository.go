@@ -0,0 +1,272 @@
+// Package repository stores gateways in the backends supported by gateboard.
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/udhos/gateboard/gateboard"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Repository stores gateways, their history and tokens.
+type Repository interface {
+	Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error)
+
+	// Put saves gatewayID and appends the change to the gateway history.
+	// source describes who requested the change.
+	// Unless expectedChanges is AnyChanges, the write only happens if the
+	// current changes counter equals expectedChanges (0 for a missing entry),
+	// otherwise ErrConflict is returned.
+	Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error
+
+	// Delete replaces the entry with a tombstone: gateway_id is cleared,
+	// deleted is set, changes is incremented and last_update is refreshed.
+	Delete(ctx context.Context, gatewayName, source string) error
+
+	// History returns recorded changes ordered by ascending changes counter.
+	History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error)
+
+	// Purge physically removes a tombstone. Live entries are left untouched.
+	Purge(ctx context.Context, gatewayName string) error
+
+	// Dump returns entries, including tombstones, selected by filter.
+	// Repositories push down as much of the filter as their query allows,
+	// hence they might return extra entries, but never fewer.
+	// When filter.Limit is positive, dump returns instead exactly the first
+	// filter.Limit entries fully matching the filter in ascending gateway
+	// name order, or fewer when there are no more.
+	Dump(ctx context.Context, filter DumpFilter) (Dump, error)
+	PutToken(ctx context.Context, gatewayName, token string) error
+	RepoName() string
+}
+
+// Restorer is implemented by repositories able to store a gateway
+// exactly as given, keeping changes, last_update, token and history,
+// as required by migrate. Existing entry and history are replaced.
+type Restorer interface {
+	Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error
+}
+
+// Dump holds entries as returned by Repository.Dump.
+type Dump []map[string]interface{}
+
+// DumpFilter selects gateways for dump. Zero value selects all.
+// Account and Region refer to names in the format account:region:name,
+// as written by gateboard-discovery.
+// After and Limit select a page: dump is then ordered by gateway name.
+type DumpFilter struct {
+	Prefix       string
+	Account      string
+	Region       string
+	UpdatedSince time.Time
+	After        string // only gateway names sorting after this one
+	Limit        int    // 0 means unlimited
+}
+
+// NamePrefix returns the longest gateway name prefix implied by the filter.
+func (f DumpFilter) NamePrefix() string {
+	var p string
+	if f.Account != "" {
+		p = f.Account + ":"
+		if f.Region != "" {
+			p += f.Region + ":"
+		}
+	}
+	if strings.HasPrefix(p, f.Prefix) {
+		return p
+	}
+	return f.Prefix
+}
+
+// Match fully evaluates the filter.
+func (f DumpFilter) Match(gatewayName string, lastUpdate time.Time) bool {
+	if !strings.HasPrefix(gatewayName, f.Prefix) {
+		return false
+	}
+	if f.After != "" && gatewayName <= f.After {
+		return false
+	}
+	if f.Account != "" || f.Region != "" {
+		fields := strings.SplitN(gatewayName, ":", 3)
+		if len(fields) < 3 {
+			return false
+		}
+		if f.Account != "" && fields[0] != f.Account {
+			return false
+		}
+		if f.Region != "" && fields[1] != f.Region {
+			return false
+		}
+	}
+	if !f.UpdatedSince.IsZero() && lastUpdate.Before(f.UpdatedSince) {
+		return false
+	}
+	return true
+}
+
+// dumpSelect fully applies filter to entries read without pushing down
+// the page, as required from repositories unable to list entries in
+// gateway name order.
+func dumpSelect(list Dump, filter DumpFilter) Dump {
+	if filter.Limit < 1 && filter.After == "" {
+		return list // extra entries are accepted
+	}
+
+	selected := Dump{}
+	for _, item := range list {
+		if filter.Match(DumpName(item), DumpTime(item["last_update"])) {
+			selected = append(selected, item)
+		}
+	}
+
+	if filter.Limit < 1 {
+		return selected
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return DumpName(selected[i]) < DumpName(selected[j])
+	})
+
+	if len(selected) > filter.Limit {
+		selected = selected[:filter.Limit]
+	}
+
+	return selected
+}
+
+// DumpName extracts the gateway name from a dump item.
+func DumpName(item map[string]interface{}) string {
+	name, _ := item["gateway_name"].(string)
+	return name
+}
+
+// DumpTime extracts last_update from a dump item.
+// Each repository kind reports last_update with a distinct type.
+func DumpTime(v interface{}) time.Time {
+	switch t := v.(type) {
+	case time.Time:
+		return t
+	case primitive.DateTime:
+		return t.Time()
+	case string:
+		if tt, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return tt
+		}
+	}
+	return time.Time{}
+}
+
+// DumpBool extracts a boolean field from a dump item.
+func DumpBool(v interface{}) bool {
+	switch b := v.(type) {
+	case bool:
+		return b
+	case string:
+		bb, _ := strconv.ParseBool(b)
+		return bb
+	}
+	return false
+}
+
+// DumpString extracts a string field from a dump item.
+func DumpString(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// DumpInt64 extracts an integer field from a dump item.
+// Each repository kind reports numbers with a distinct type.
+func DumpInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	case string:
+		i, _ := strconv.ParseInt(n, 10, 64)
+		return i
+	}
+	return 0
+}
+
+// ValidateGatewayName checks that gatewayName can be stored.
+func ValidateGatewayName(gatewayName string) error {
+	const me = "ValidateGatewayName"
+	if strings.TrimSpace(gatewayName) == "" {
+		return fmt.Errorf("%s: invalid blank gateway name: '%s'", me, gatewayName)
+	}
+	if index := strings.IndexAny(gatewayName, " ${}"); index >= 0 {
+		return fmt.Errorf("%s: invalid character '%c' in gateway name: '%s'",
+			me, gatewayName[index], gatewayName)
+	}
+	// s3 repository keeps index and history objects next to gateway objects,
+	// under keys cleaned as paths
+	key := strings.TrimPrefix(path.Clean("/"+gatewayName), "/")
+	if key == s3IndexObject || key == s3HistoryDir || strings.HasPrefix(key, s3HistoryDir+"/") {
+		return fmt.Errorf("%s: reserved name '%s' in gateway name: '%s'",
+			me, key, gatewayName)
+	}
+	return nil
+}
+
+// historyMaxDefault is the number of history entries kept for each gateway,
+// unless the repository sets history_max. Zero keeps history unlimited.
+const historyMaxDefault = 100
+
+// historyCutoff returns the highest changes counter whose history entry
+// must be removed once changes is recorded, or 0 when nothing expires.
+func historyCutoff(changes int64, historyMax int) int64 {
+	if historyMax <= 0 || changes <= int64(historyMax) {
+		return 0
+	}
+	return changes - int64(historyMax)
+}
+
+// historyTail keeps the most recent historyMax entries of an ascending history.
+func historyTail(history []gateboard.HistoryEntry, historyMax int) []gateboard.HistoryEntry {
+	if historyMax > 0 && len(history) > historyMax {
+		return history[len(history)-historyMax:]
+	}
+	return history
+}
+
+// AnyChanges disables the compare-and-swap check in put.
+const AnyChanges int64 = -1
+
+// kvCasAttempts bounds read-modify-write retries in key-value repositories
+// (etcd, consul, kubernetes) while concurrent writers keep modifying the same key.
+const kvCasAttempts = 10
+
+var (
+	// ErrGatewayNotFound is returned when the gateway is missing.
+	ErrGatewayNotFound = errors.New("repository: gateway not found error")
+
+	// ErrConflict is returned when put finds an unexpected changes counter.
+	ErrConflict = errors.New("repository: changes conflict error")
+)
+
+// Closer is implemented by repositories holding connections
+// that must be released when the repository is removed.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// RecordIndexLag and RecordIndexFailure report s3 index metrics.
+// RecordHistoryFailure reports a change saved without its history entry.
+// They do nothing unless replaced by the application.
+var (
+	RecordIndexLag       = func(repo string, lag time.Duration) {}
+	RecordIndexFailure   = func(repo string) {}
+	RecordHistoryFailure = func(repo string) {}
+)
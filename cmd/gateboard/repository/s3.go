@@ -0,0 +1,1057 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/goccy/go-json"
+	"gopkg.in/yaml.v3"
+
+	"github.com/udhos/boilerplate/awsconfig"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+type repoS3Options struct {
+	metricRepoName       string // kind:name
+	bucket               string
+	region               string
+	prefix               string
+	roleArn              string
+	sessionName          string
+	debug                bool
+	manualCreate         bool
+	serverSideEncryption string
+	index                bool          // maintain index object for dump
+	indexRebuildInterval time.Duration // 0 disables periodic index rebuild
+	endpointURL          string        // for instance a local S3-compatible server
+	forcePathStyle       bool
+	historyMax           int // 0 means unlimited
+}
+
+type repoS3 struct {
+	options  repoS3Options
+	s3Client *s3.Client
+
+	indexLock       sync.Mutex
+	indexQueue      map[string]s3IndexChange // changes not yet merged into the index
+	indexQueueSince time.Time                // oldest change in indexQueue
+	indexStop       chan struct{}
+	indexStopOnce   sync.Once
+	indexStopped    chan struct{}
+}
+
+func newRepoS3(opt repoS3Options) (*repoS3, error) {
+
+	awsConfOptions := awsconfig.Options{
+		Region:          opt.region,
+		RoleArn:         opt.roleArn,
+		RoleSessionName: opt.sessionName,
+	}
+
+	cfg, errAwsConfig := awsconfig.AwsConfig(awsConfOptions)
+	if errAwsConfig != nil {
+		return nil, errAwsConfig
+	}
+
+	r := &repoS3{
+		options: opt,
+		s3Client: s3.NewFromConfig(cfg.AwsConfig, func(o *s3.Options) {
+			if opt.endpointURL != "" {
+				o.BaseEndpoint = aws.String(opt.endpointURL)
+			}
+			o.UsePathStyle = opt.forcePathStyle
+		}),
+	}
+
+	if !r.options.manualCreate {
+		r.createBucket()
+	}
+
+	if r.options.index {
+		r.indexQueue = map[string]s3IndexChange{}
+		r.indexStop = make(chan struct{})
+		r.indexStopped = make(chan struct{})
+		go r.indexLoop()
+	}
+
+	return r, nil
+}
+
+func (r *repoS3) createBucket() {
+	const me = "repoS3.createBucket"
+
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(r.options.bucket),
+	}
+
+	// cant specify us-east-1
+	if r.options.region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(r.options.region),
+		}
+	}
+
+	_, errCreate := r.s3Client.CreateBucket(context.TODO(), input)
+
+	if errCreate != nil {
+		zlog.Errorf("%s: error: %v", me, errCreate)
+		return
+	}
+
+	zlog.Debugf(r.options.debug, "%s: bucket created: %s", me, r.options.bucket)
+}
+
+func (r *repoS3) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoS3) DropDatabase() error {
+
+	keys, errList := r.listKeys()
+	if errList != nil {
+		return errList
+	}
+
+	var objectIDs []s3types.ObjectIdentifier
+	for _, key := range keys {
+		objectIDs = append(objectIDs, s3types.ObjectIdentifier{Key: aws.String(key)})
+	}
+	input := s3.DeleteObjectsInput{
+		Bucket: aws.String(r.options.bucket),
+		Delete: &s3types.Delete{Objects: objectIDs},
+	}
+
+	_, err := r.s3Client.DeleteObjects(context.TODO(), &input)
+
+	return err
+}
+
+func (r *repoS3) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+
+	if r.options.index {
+		return r.dumpIndex(ctx, filter)
+	}
+
+	return r.dumpObjects(ctx, filter)
+}
+
+// dumpIndex reads all gateways from the index object in a single request.
+// The index lags behind gateway objects written by other replicas until
+// they merge their changes.
+func (r *repoS3) dumpIndex(ctx context.Context, filter DumpFilter) (Dump, error) {
+
+	list := Dump{}
+
+	index, _, errIndex := r.loadIndex(ctx)
+	if errIndex != nil {
+		return list, errIndex
+	}
+
+	// changes from this replica not yet merged into the index object
+	for _, change := range r.indexQueued() {
+		change.apply(index)
+	}
+
+	for _, body := range index {
+		if !filter.Match(body.GatewayName, body.LastUpdate) {
+			continue
+		}
+		list = append(list, s3DumpItem(body))
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+func s3DumpItem(body gateboard.BodyGetReply) map[string]interface{} {
+	return map[string]interface{}{
+		"gateway_name": body.GatewayName,
+		"gateway_id":   body.GatewayID,
+		"changes":      body.Changes,
+		"last_update":  body.LastUpdate,
+		"token":        body.Token,
+		"deleted":      body.Deleted,
+	}
+}
+
+// dumpObjects lists gateway objects and fetches them one by one.
+// Keys are listed in name order, so a page starts after the key of
+// filter.After and listing stops once the page is full.
+func (r *repoS3) dumpObjects(ctx context.Context, filter DumpFilter) (Dump, error) {
+
+	list := Dump{}
+
+	keyPrefix := r.options.prefix
+
+	// s3key cleans the path, so the name prefix is pushed down only
+	// when it maps into a key prefix unchanged by the cleaning
+	if namePrefix := filter.NamePrefix(); namePrefix != "" {
+		if k := r.s3key(namePrefix); r.s3key(namePrefix+"x") == k+"x" {
+			keyPrefix = k
+		}
+	}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.options.bucket),
+		Prefix: aws.String(keyPrefix),
+	}
+	if filter.After != "" {
+		input.StartAfter = aws.String(r.s3key(filter.After))
+	}
+
+	p := s3.NewListObjectsV2Paginator(r.s3Client, input)
+
+	for p.HasMorePages() {
+		page, errPage := p.NextPage(context.TODO())
+		if errPage != nil {
+			return list, errPage
+		}
+
+		for _, o := range page.Contents {
+			gatewayName, isGateway := r.gatewayNameFromKey(aws.ToString(o.Key))
+			if !isGateway {
+				continue
+			}
+
+			body, errGet := r.Get(ctx, gatewayName)
+			if errGet != nil {
+				return list, errGet
+			}
+
+			if !filter.Match(body.GatewayName, body.LastUpdate) {
+				continue
+			}
+
+			list = append(list, s3DumpItem(body))
+
+			if filter.Limit > 0 && len(list) >= filter.Limit {
+				return dumpSelect(list, filter), nil
+			}
+		}
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+// gatewayNameFromKey skips keys not holding gateways.
+func (r *repoS3) gatewayNameFromKey(key string) (string, bool) {
+	gatewayName := strings.TrimPrefix(key, r.options.prefix)
+	if gatewayName == "/" {
+		return "", false // zero-size folder
+	}
+	if strings.HasPrefix(strings.TrimPrefix(gatewayName, "/"), s3HistoryDir+"/") {
+		return "", false // history
+	}
+	if strings.TrimPrefix(gatewayName, "/") == s3IndexObject {
+		return "", false // index
+	}
+	return gatewayName, true
+}
+
+// loadObjects fetches every gateway object under keyPrefix.
+func (r *repoS3) loadObjects(ctx context.Context, keyPrefix string) ([]gateboard.BodyGetReply, error) {
+
+	keys, errList := r.listKeysInput(&s3.ListObjectsV2Input{
+		Bucket: aws.String(r.options.bucket),
+		Prefix: aws.String(keyPrefix),
+	})
+	if errList != nil {
+		return nil, errList
+	}
+
+	var list []gateboard.BodyGetReply
+
+	for _, key := range keys {
+
+		gatewayName, isGateway := r.gatewayNameFromKey(key)
+		if !isGateway {
+			continue
+		}
+
+		body, errGet := r.Get(ctx, gatewayName)
+		if errGet != nil {
+			return list, errGet
+		}
+
+		list = append(list, body)
+	}
+
+	return list, nil
+}
+
+func (r *repoS3) listKeys() ([]string, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(r.options.bucket),
+		Prefix: aws.String(r.options.prefix),
+	}
+	return r.listKeysInput(input)
+}
+
+func (r *repoS3) listKeysInput(input *s3.ListObjectsV2Input) ([]string, error) {
+	var maxKeys int32 = 1000
+
+	// Create the Paginator for the ListObjectsV2 operation.
+	p := s3.NewListObjectsV2Paginator(r.s3Client, input, func(o *s3.ListObjectsV2PaginatorOptions) {
+		o.Limit = maxKeys
+	})
+
+	var list []string
+
+	for p.HasMorePages() {
+		// Next Page takes a new context for each page retrieval. This is where
+		// you could add timeouts or deadlines.
+		page, errPage := p.NextPage(context.TODO())
+		if errPage != nil {
+			return list, errPage
+		}
+
+		for _, o := range page.Contents {
+			key := *o.Key
+			list = append(list, key)
+		}
+	}
+
+	return list, nil
+}
+
+func (r *repoS3) Get(_ /*ctx*/ context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return gateboard.BodyGetReply{}, errVal
+	}
+
+	body, _, errGet := r.getWithETag(gatewayName)
+
+	return body, errGet
+}
+
+// getWithETag also returns the object ETag, used for conditional writes.
+func (r *repoS3) getWithETag(gatewayName string) (gateboard.BodyGetReply, string, error) {
+
+	var body gateboard.BodyGetReply
+
+	buf, etag, errGet := r.getObject(r.s3key(gatewayName))
+	if errGet != nil {
+		return body, "", errGet
+	}
+
+	// We put as JSON and get as YAML
+	errYaml := yaml.Unmarshal(buf, &body)
+
+	return body, etag, errYaml
+}
+
+// getObject returns ErrGatewayNotFound for missing object.
+func (r *repoS3) getObject(key string) ([]byte, string, error) {
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(r.options.bucket),
+		Key:    aws.String(key),
+	}
+
+	result, errS3 := r.s3Client.GetObject(context.TODO(), input)
+	if errS3 != nil {
+
+		// not found error?
+		var errAPI smithy.APIError
+		if errors.As(errS3, &errAPI) {
+			switch errAPI.(type) {
+			case *s3types.NoSuchBucket, *s3types.NoSuchKey, *s3types.NotFound:
+				return nil, "", ErrGatewayNotFound
+			}
+		}
+
+		return nil, "", errS3
+	}
+
+	defer result.Body.Close()
+
+	buf, errRead := io.ReadAll(result.Body)
+	if errRead != nil {
+		return nil, "", errRead
+	}
+
+	return buf, aws.ToString(result.ETag), nil
+}
+
+func (r *repoS3) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoS3.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	body, errUpdate := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) error {
+		if expectedChanges != AnyChanges && body.Changes != expectedChanges {
+			return ErrConflict
+		}
+		body.GatewayID = gatewayID
+		body.LastUpdate = time.Now()
+		body.Changes++
+		body.Deleted = false
+		return nil
+	})
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	r.appendHistory(ctx, body, source)
+
+	return nil
+}
+
+func (r *repoS3) Delete(ctx context.Context, gatewayName, source string) error {
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	body, errUpdate := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) error {
+		// turn item into tombstone
+		body.GatewayID = ""
+		body.LastUpdate = time.Now()
+		body.Changes++
+		body.Deleted = true
+		return nil
+	})
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	r.appendHistory(ctx, body, source)
+
+	return nil
+}
+
+// update applies modify to the current object and saves it only if the
+// object has not changed since it was read, retrying on concurrent writes.
+// Conflicts returned by modify itself are not retried.
+func (r *repoS3) update(ctx context.Context, gatewayName string, modify func(body *gateboard.BodyGetReply) error) (gateboard.BodyGetReply, error) {
+	const me = "repoS3.update"
+
+	for i := 1; i <= kvCasAttempts; i++ {
+		body, etag, errGet := r.getWithETag(gatewayName)
+		switch errGet {
+		case nil:
+		case ErrGatewayNotFound:
+			body.GatewayName = gatewayName
+		default:
+			return body, errGet
+		}
+
+		if errModify := modify(&body); errModify != nil {
+			return body, errModify
+		}
+
+		errPut := r.s3putConditional(gatewayName, body, etag)
+		if errPut == nil {
+			r.updateIndex(ctx, body)
+			return body, nil
+		}
+		if errPut != ErrConflict {
+			return body, errPut
+		}
+
+		zlog.CtxDebugf(ctx, r.options.debug, "%s: gatewayName=%s attempt=%d/%d: concurrent write",
+			me, gatewayName, i, kvCasAttempts)
+	}
+
+	return gateboard.BodyGetReply{}, ErrConflict
+}
+
+// s3HistoryDir holds one object per change under prefix/.history/gateway_name/changes
+const s3HistoryDir = ".history"
+
+func (r *repoS3) historyDir(gatewayName string) string {
+	return path.Join(r.options.prefix, s3HistoryDir, gatewayName) + "/"
+}
+
+// historyKey is zero padded to keep lexicographic listing in changes order.
+func (r *repoS3) historyKey(gatewayName string, changes int64) string {
+	return r.historyDir(gatewayName) + fmt.Sprintf("%020d", changes)
+}
+
+// appendHistory records a change already saved in the gateway object,
+// hence a failure is only logged and counted: retrying the write
+// would record the change twice.
+func (r *repoS3) appendHistory(ctx context.Context, body gateboard.BodyGetReply, source string) {
+	const me = "repoS3.appendHistory"
+
+	entry := gateboard.HistoryEntry{
+		GatewayID: body.GatewayID,
+		Changes:   body.Changes,
+		Timestamp: body.LastUpdate,
+		Source:    source,
+		Deleted:   body.Deleted,
+	}
+
+	buf, errMarshal := json.Marshal(entry)
+	if errMarshal != nil {
+		zlog.CtxErrorf(ctx, "%s: gateway_name=%s gateway saved, history not recorded: marshal: %v", me, body.GatewayName, errMarshal)
+		RecordHistoryFailure(r.RepoName())
+		return
+	}
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(r.options.bucket),
+		Key:                  aws.String(r.historyKey(body.GatewayName, body.Changes)),
+		Body:                 bytes.NewBuffer(buf),
+		ServerSideEncryption: s3types.ServerSideEncryption(r.options.serverSideEncryption),
+	}
+
+	if _, errS3 := r.s3Client.PutObject(context.TODO(), input); errS3 != nil {
+		zlog.CtxErrorf(ctx, "%s: gateway_name=%s gateway saved, history not recorded: %v", me, body.GatewayName, errS3)
+		RecordHistoryFailure(r.RepoName())
+		return
+	}
+
+	if cutoff := historyCutoff(body.Changes, r.options.historyMax); cutoff > 0 {
+		if errTrim := r.trimHistory(body.GatewayName, cutoff); errTrim != nil {
+			zlog.CtxErrorf(ctx, "%s: gateway_name=%s trim: %v", me, body.GatewayName, errTrim)
+		}
+	}
+}
+
+// s3TrimBatch bounds the history objects examined by each write. Listing
+// returns the oldest first, so entries left behind by a failed trim are
+// removed by later writes.
+const s3TrimBatch = 10
+
+// trimHistory removes history objects up to changes cutoff.
+func (r *repoS3) trimHistory(gatewayName string, cutoff int64) error {
+	out, errList := r.s3Client.ListObjectsV2(context.TODO(), &s3.ListObjectsV2Input{
+		Bucket:    aws.String(r.options.bucket),
+		Prefix:    aws.String(r.historyDir(gatewayName)),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int32(s3TrimBatch),
+	})
+	if errList != nil {
+		return errList
+	}
+
+	last := r.historyKey(gatewayName, cutoff)
+
+	for _, obj := range out.Contents {
+		key := aws.ToString(obj.Key)
+		if key > last {
+			break
+		}
+		_, errS3 := r.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(r.options.bucket),
+			Key:    aws.String(key),
+		})
+		if errS3 != nil {
+			return errS3
+		}
+	}
+
+	return nil
+}
+
+func (r *repoS3) History(_ /*ctx*/ context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+
+	list := []gateboard.HistoryEntry{}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return list, errVal
+	}
+
+	keys, errList := r.listKeysInput(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(r.options.bucket),
+		Prefix:    aws.String(r.historyDir(gatewayName)),
+		Delimiter: aws.String("/"), // skip history of gateway names nested below this one
+	})
+	if errList != nil {
+		return list, errList
+	}
+
+	for _, key := range keys {
+		result, errS3 := r.s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(r.options.bucket),
+			Key:    aws.String(key),
+		})
+		if errS3 != nil {
+			return list, errS3
+		}
+
+		buf, errRead := io.ReadAll(result.Body)
+		result.Body.Close()
+		if errRead != nil {
+			return list, errRead
+		}
+
+		var entry gateboard.HistoryEntry
+		if errJSON := json.Unmarshal(buf, &entry); errJSON != nil {
+			return list, errJSON
+		}
+
+		list = append(list, entry)
+	}
+
+	return list, nil
+}
+
+func (r *repoS3) Purge(ctx context.Context, gatewayName string) error {
+
+	body, etag, errGet := r.getWithETag(gatewayName)
+	switch errGet {
+	case nil:
+	case ErrGatewayNotFound:
+		return nil
+	default:
+		return errGet
+	}
+
+	if !body.Deleted {
+		return nil // not a tombstone
+	}
+
+	// a write since the tombstone was read keeps the gateway
+	input := &s3.DeleteObjectInput{
+		Bucket:  aws.String(r.options.bucket),
+		Key:     aws.String(r.s3key(gatewayName)),
+		IfMatch: aws.String(etag),
+	}
+
+	if _, errS3 := r.s3Client.DeleteObject(context.TODO(), input); errS3 != nil {
+		if isS3PreconditionFailed(errS3) {
+			return nil // no longer a tombstone
+		}
+		return errS3
+	}
+
+	r.removeFromIndex(ctx, gatewayName)
+
+	// changes counter restarts, so history must go too
+
+	keys, errList := r.listKeysInput(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(r.options.bucket),
+		Prefix:    aws.String(r.historyDir(gatewayName)),
+		Delimiter: aws.String("/"),
+	})
+	if errList != nil {
+		return errList
+	}
+
+	for _, key := range keys {
+		_, errS3 := r.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(r.options.bucket),
+			Key:    aws.String(key),
+		})
+		if errS3 != nil {
+			return errS3
+		}
+	}
+
+	return nil
+}
+
+func (r *repoS3) s3key(gatewayName string) string {
+	return path.Join(r.options.prefix, gatewayName)
+}
+
+// s3putConditional saves the object only if its current ETag matches etag.
+// Blank etag means the object must not exist.
+func (r *repoS3) s3putConditional(gatewayName string, body gateboard.BodyGetReply, etag string) error {
+
+	// We put as JSON and get as YAML
+	buf, errMarshal := json.Marshal(body)
+	if errMarshal != nil {
+		return errMarshal
+	}
+
+	return r.putObjectConditional(r.s3key(gatewayName), buf, etag)
+}
+
+// putObjectConditional returns ErrConflict when the ETag condition fails.
+func (r *repoS3) putObjectConditional(key string, buf []byte, etag string) error {
+
+	input := &s3.PutObjectInput{
+		Bucket:               aws.String(r.options.bucket),
+		Key:                  aws.String(key),
+		Body:                 bytes.NewBuffer(buf),
+		ServerSideEncryption: s3types.ServerSideEncryption(r.options.serverSideEncryption),
+	}
+
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = aws.String(etag)
+	}
+
+	_, errS3 := r.s3Client.PutObject(context.TODO(), input)
+
+	if isS3PreconditionFailed(errS3) {
+		return ErrConflict
+	}
+
+	return errS3
+}
+
+// isS3PreconditionFailed reports whether a conditional request lost to a concurrent write.
+func isS3PreconditionFailed(err error) bool {
+	var errAPI smithy.APIError
+	if errors.As(err, &errAPI) {
+		switch errAPI.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+func (r *repoS3) Restore(ctx context.Context, body gateboard.BodyGetReply, history []gateboard.HistoryEntry) error {
+
+	body.Error = ""
+	body.TTL = 0
+
+	_, errUpdate := r.update(ctx, body.GatewayName, func(current *gateboard.BodyGetReply) error {
+		*current = body
+		return nil
+	})
+	if errUpdate != nil {
+		return errUpdate
+	}
+
+	// replace history
+
+	keys, errList := r.listKeysInput(&s3.ListObjectsV2Input{
+		Bucket:    aws.String(r.options.bucket),
+		Prefix:    aws.String(r.historyDir(body.GatewayName)),
+		Delimiter: aws.String("/"),
+	})
+	if errList != nil {
+		return errList
+	}
+
+	for _, key := range keys {
+		_, errS3 := r.s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+			Bucket: aws.String(r.options.bucket),
+			Key:    aws.String(key),
+		})
+		if errS3 != nil {
+			return errS3
+		}
+	}
+
+	for _, entry := range historyTail(history, r.options.historyMax) {
+		buf, errMarshal := json.Marshal(entry)
+		if errMarshal != nil {
+			return errMarshal
+		}
+		_, errS3 := r.s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket:               aws.String(r.options.bucket),
+			Key:                  aws.String(r.historyKey(body.GatewayName, entry.Changes)),
+			Body:                 bytes.NewBuffer(buf),
+			ServerSideEncryption: s3types.ServerSideEncryption(r.options.serverSideEncryption),
+		})
+		if errS3 != nil {
+			return errS3
+		}
+	}
+
+	return nil
+}
+
+func (r *repoS3) PutToken(ctx context.Context, gatewayName, token string) error {
+	_, errUpdate := r.update(ctx, gatewayName, func(body *gateboard.BodyGetReply) error {
+		body.Token = token
+		return nil
+	})
+	return errUpdate
+}
+
+// s3IndexObject consolidates all gateways into prefix/.index, so that dump
+// takes a single request. Writes only queue their change in memory, and a
+// background loop merges queued changes into the index every
+// s3IndexFlushInterval, so the whole index is rewritten at most once per
+// interval per replica rather than on every write. Changes that fail to be
+// merged stay queued for the next round. The index is also rebuilt from
+// gateway objects every indexRebuildInterval, in order to recover changes
+// lost by a replica stopped before merging them, and when it is missing.
+const s3IndexObject = ".index"
+
+const (
+	s3IndexFlushInterval          = time.Second
+	s3IndexRebuildIntervalDefault = time.Hour
+)
+
+// s3Index maps gateway name to gateway.
+type s3Index map[string]gateboard.BodyGetReply
+
+// s3IndexChange is a gateway change waiting to be merged into the index.
+type s3IndexChange struct {
+	body   gateboard.BodyGetReply
+	remove bool // tombstone purged
+}
+
+// apply merges change into index, reporting whether index was modified.
+func (change s3IndexChange) apply(index s3Index) bool {
+	name := change.body.GatewayName
+	current, found := index[name]
+	if change.remove {
+		if !found || !current.Deleted {
+			return false // rewritten after purge
+		}
+		delete(index, name)
+		return true
+	}
+	if found && current.Changes > change.body.Changes {
+		return false // a later write already updated the index
+	}
+	index[name] = change.body
+	return true
+}
+
+func (r *repoS3) indexKey() string {
+	return path.Join(r.options.prefix, s3IndexObject)
+}
+
+// loadIndex returns the index along with its ETag.
+func (r *repoS3) loadIndex(ctx context.Context) (s3Index, string, error) {
+	const me = "repoS3.loadIndex"
+
+	for i := 1; i <= kvCasAttempts; i++ {
+		buf, etag, errGet := r.getObject(r.indexKey())
+		if errGet == nil {
+			index := s3Index{}
+			errJSON := json.Unmarshal(buf, &index)
+			return index, etag, errJSON
+		}
+		if errGet != ErrGatewayNotFound {
+			return nil, "", errGet
+		}
+
+		zlog.CtxInfof(ctx, "%s: rebuilding missing index: %s", me, r.indexKey())
+
+		index, errBuild := r.buildIndex(ctx)
+		if errBuild != nil {
+			return nil, "", errBuild
+		}
+		errPut := r.putIndex(index, "")
+		if errPut == nil {
+			continue // read back for the ETag
+		}
+		if errPut != ErrConflict {
+			return nil, "", errPut
+		}
+		// index created concurrently
+	}
+
+	return nil, "", ErrConflict
+}
+
+// buildIndex reads every gateway object.
+func (r *repoS3) buildIndex(ctx context.Context) (s3Index, error) {
+	gateways, errLoad := r.loadObjects(ctx, r.options.prefix)
+	if errLoad != nil {
+		return nil, errLoad
+	}
+	index := s3Index{}
+	for _, body := range gateways {
+		index[body.GatewayName] = body
+	}
+	return index, nil
+}
+
+func (r *repoS3) putIndex(index s3Index, etag string) error {
+	buf, errMarshal := json.Marshal(index)
+	if errMarshal != nil {
+		return errMarshal
+	}
+	return r.putObjectConditional(r.indexKey(), buf, etag)
+}
+
+// queueIndex records a change to be merged into the index by indexLoop.
+func (r *repoS3) queueIndex(change s3IndexChange) {
+	if !r.options.index {
+		return
+	}
+
+	name := change.body.GatewayName
+
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+
+	if prev, found := r.indexQueue[name]; found && !prev.remove && !change.remove &&
+		prev.body.Changes > change.body.Changes {
+		return // concurrent writes finished out of order
+	}
+	if len(r.indexQueue) == 0 {
+		r.indexQueueSince = time.Now()
+	}
+	r.indexQueue[name] = change
+}
+
+func (r *repoS3) updateIndex(_ /*ctx*/ context.Context, body gateboard.BodyGetReply) {
+	r.queueIndex(s3IndexChange{body: body})
+}
+
+func (r *repoS3) removeFromIndex(_ /*ctx*/ context.Context, gatewayName string) {
+	r.queueIndex(s3IndexChange{body: gateboard.BodyGetReply{GatewayName: gatewayName}, remove: true})
+}
+
+// indexQueued returns a copy of the queued changes.
+func (r *repoS3) indexQueued() map[string]s3IndexChange {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+	queued := make(map[string]s3IndexChange, len(r.indexQueue))
+	for name, change := range r.indexQueue {
+		queued[name] = change
+	}
+	return queued
+}
+
+// indexMerged drops merged changes from the queue, unless replaced meanwhile.
+func (r *repoS3) indexMerged(merged map[string]s3IndexChange, since time.Time) {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+	for name, change := range merged {
+		if r.indexQueue[name] == change {
+			delete(r.indexQueue, name)
+		}
+	}
+	if len(r.indexQueue) > 0 {
+		r.indexQueueSince = since // remaining changes were queued after the copy
+	}
+}
+
+// indexLag is the age of the oldest change not yet merged into the index.
+func (r *repoS3) indexLag() time.Duration {
+	r.indexLock.Lock()
+	defer r.indexLock.Unlock()
+	if len(r.indexQueue) == 0 {
+		return 0
+	}
+	return time.Since(r.indexQueueSince)
+}
+
+// flushIndex merges queued changes into the index, retrying on concurrent writes.
+// When rebuild is true, the index is rebuilt from gateway objects beforehand.
+func (r *repoS3) flushIndex(ctx context.Context, rebuild bool) error {
+	copied := time.Now()
+	queued := r.indexQueued()
+
+	if len(queued) == 0 && !rebuild {
+		return nil
+	}
+
+	for i := 1; i <= kvCasAttempts; i++ {
+		index, etag, errLoad := r.loadIndex(ctx)
+		if errLoad != nil {
+			return errLoad
+		}
+
+		modified := rebuild
+		if rebuild {
+			listed := time.Now()
+			objects, errBuild := r.buildIndex(ctx)
+			if errBuild != nil {
+				return errBuild
+			}
+			for name, body := range index {
+				current, found := objects[name]
+				if (found && current.Changes < body.Changes) || (!found && body.LastUpdate.After(listed)) {
+					objects[name] = body // written while listing objects
+				}
+			}
+			index = objects
+		}
+
+		for _, change := range queued {
+			if change.apply(index) {
+				modified = true
+			}
+		}
+
+		if modified {
+			errPut := r.putIndex(index, etag)
+			if errPut == ErrConflict {
+				continue
+			}
+			if errPut != nil {
+				return errPut
+			}
+		}
+
+		r.indexMerged(queued, copied)
+		return nil
+	}
+
+	return ErrConflict
+}
+
+// indexLoop periodically merges queued changes into the index until close.
+func (r *repoS3) indexLoop() {
+	const me = "repoS3.indexLoop"
+
+	defer close(r.indexStopped)
+
+	ticker := time.NewTicker(s3IndexFlushInterval)
+	defer ticker.Stop()
+
+	nextRebuild := r.nextIndexRebuild()
+
+	for {
+		var stop bool
+
+		select {
+		case <-r.indexStop:
+			stop = true // last flush
+		case <-ticker.C:
+		}
+
+		rebuild := !stop && !nextRebuild.IsZero() && time.Now().After(nextRebuild)
+
+		errFlush := r.flushIndex(context.TODO(), rebuild)
+		if errFlush != nil {
+			zlog.Errorf("%s: %s: rebuild=%t: %v", me, r.RepoName(), rebuild, errFlush)
+			RecordIndexFailure(r.RepoName())
+		} else if rebuild {
+			nextRebuild = r.nextIndexRebuild()
+		}
+
+		RecordIndexLag(r.RepoName(), r.indexLag())
+
+		if stop {
+			return
+		}
+	}
+}
+
+// nextIndexRebuild spreads rebuilds randomly between 50% and 150% of
+// indexRebuildInterval, so replicas do not rebuild at the same time.
+// Zero means rebuild is disabled.
+func (r *repoS3) nextIndexRebuild() time.Time {
+	interval := r.options.indexRebuildInterval
+	if interval <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(interval/2 + time.Duration(rand.Int63n(int64(interval))))
+}
+
+// close stops indexLoop after merging queued changes.
+func (r *repoS3) Close(_ /*ctx*/ context.Context) error {
+	if !r.options.index {
+		return nil
+	}
+	r.indexStopOnce.Do(func() { close(r.indexStop) })
+	<-r.indexStopped
+	return nil
+}
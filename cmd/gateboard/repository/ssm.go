@@ -0,0 +1,470 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+
+	"github.com/udhos/boilerplate/awsconfig"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+//
+// Repository: SSM Parameter Store
+//
+// <prefix>/gateway/<escaped name> String: JSON-encoded ssmEntry
+// <prefix>/token/<escaped name>   SecureString: token
+//
+// The changes counter is the parameter version, which Parameter Store
+// increments on every write and restarts when the parameter is deleted.
+// History is the parameter history, hence limited to the 100 most
+// recent versions kept by Parameter Store, or fewer with history_max.
+//
+
+type ssmEntry struct {
+	GatewayName string    `json:"gateway_name"`
+	GatewayID   string    `json:"gateway_id"`
+	LastUpdate  time.Time `json:"last_update"`
+	Source      string    `json:"source,omitempty"`
+	Deleted     bool      `json:"deleted,omitempty"`
+}
+
+type repoSSMOptions struct {
+	metricRepoName string // kind:name
+	prefix         string
+	region         string
+	roleArn        string
+	kmsKeyID       string // for token SecureString, empty means AWS managed key
+	sessionName    string
+	debug          bool
+	historyMax     int // 0 means all versions kept by Parameter Store
+}
+
+type repoSSM struct {
+	options repoSSMOptions
+	ssm     *ssm.Client
+}
+
+func newRepoSSM(opt repoSSMOptions) (*repoSSM, error) {
+
+	opt.prefix = "/" + strings.Trim(opt.prefix, "/")
+	if opt.prefix == "/" {
+		return nil, errors.New("newRepoSSM: missing parameter path prefix")
+	}
+
+	awsConfOptions := awsconfig.Options{
+		Region:          opt.region,
+		RoleArn:         opt.roleArn,
+		RoleSessionName: opt.sessionName,
+	}
+
+	cfg, errAwsConfig := awsconfig.AwsConfig(awsConfOptions)
+	if errAwsConfig != nil {
+		return nil, errAwsConfig
+	}
+
+	r := &repoSSM{
+		options: opt,
+		ssm:     ssm.NewFromConfig(cfg.AwsConfig),
+	}
+
+	return r, nil
+}
+
+// ssmEscape maps a gateway name into a single parameter name level.
+// Parameter names only allow [a-zA-Z0-9_.-] within a level, hence any
+// other byte, and the escape character itself, is written as _XX in hex.
+func ssmEscape(gatewayName string) string {
+	var b strings.Builder
+	for i := 0; i < len(gatewayName); i++ {
+		c := gatewayName[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '.' || c == '-' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "_%02X", c)
+	}
+	return b.String()
+}
+
+func (r *repoSSM) gatewayPath() string {
+	return r.options.prefix + "/gateway"
+}
+
+func (r *repoSSM) tokenPath() string {
+	return r.options.prefix + "/token"
+}
+
+func (r *repoSSM) gatewayParam(gatewayName string) string {
+	return r.gatewayPath() + "/" + ssmEscape(gatewayName)
+}
+
+func (r *repoSSM) tokenParam(gatewayName string) string {
+	return r.tokenPath() + "/" + ssmEscape(gatewayName)
+}
+
+func (r *repoSSM) RepoName() string {
+	return r.options.metricRepoName
+}
+
+func (r *repoSSM) DropDatabase() error {
+	ctx := context.TODO()
+
+	var names []string
+	for _, p := range []string{r.gatewayPath(), r.tokenPath()} {
+		params, errList := r.listPath(ctx, p, false)
+		if errList != nil {
+			return errList
+		}
+		for _, param := range params {
+			names = append(names, aws.ToString(param.Name))
+		}
+	}
+
+	// DeleteParameters accepts at most 10 names
+	for len(names) > 0 {
+		n := min(10, len(names))
+		if _, err := r.ssm.DeleteParameters(ctx, &ssm.DeleteParametersInput{Names: names[:n]}); err != nil {
+			return err
+		}
+		names = names[n:]
+	}
+
+	return nil
+}
+
+func (r *repoSSM) listPath(ctx context.Context, p string, decrypt bool) ([]ssmtypes.Parameter, error) {
+	var list []ssmtypes.Parameter
+
+	pages := ssm.NewGetParametersByPathPaginator(r.ssm, &ssm.GetParametersByPathInput{
+		Path:           aws.String(p),
+		WithDecryption: aws.Bool(decrypt),
+	})
+
+	for pages.HasMorePages() {
+		page, errPage := pages.NextPage(ctx)
+		if errPage != nil {
+			return nil, errPage
+		}
+		list = append(list, page.Parameters...)
+	}
+
+	return list, nil
+}
+
+func (r *repoSSM) Dump(ctx context.Context, filter DumpFilter) (Dump, error) {
+	const me = "repoSSM.dump"
+
+	list := Dump{}
+
+	// GetParametersByPath cannot filter by name nor start at a name,
+	// the filter and the page are applied here
+
+	params, errList := r.listPath(ctx, r.gatewayPath(), false)
+	if errList != nil {
+		zlog.CtxErrorf(ctx, "%s: %s: %v", me, r.gatewayPath(), errList)
+		return list, errList
+	}
+
+	tokenParams, errTokens := r.listPath(ctx, r.tokenPath(), true)
+	if errTokens != nil {
+		zlog.CtxErrorf(ctx, "%s: %s: %v", me, r.tokenPath(), errTokens)
+		return list, errTokens
+	}
+
+	tokens := map[string]string{} // escaped name => token
+	for _, t := range tokenParams {
+		tokens[path.Base(aws.ToString(t.Name))] = aws.ToString(t.Value)
+	}
+
+	for _, param := range params {
+		var e ssmEntry
+		if errJSON := json.Unmarshal([]byte(aws.ToString(param.Value)), &e); errJSON != nil {
+			zlog.CtxErrorf(ctx, "%s: %s: %v", me, aws.ToString(param.Name), errJSON)
+			return list, errJSON
+		}
+		if !filter.Match(e.GatewayName, e.LastUpdate) {
+			continue
+		}
+		list = append(list, map[string]interface{}{
+			"gateway_name": e.GatewayName,
+			"gateway_id":   e.GatewayID,
+			"changes":      param.Version,
+			"last_update":  e.LastUpdate,
+			"token":        tokens[path.Base(aws.ToString(param.Name))],
+			"deleted":      e.Deleted,
+		})
+	}
+
+	return dumpSelect(list, filter), nil
+}
+
+// load returns the entry and its version, which is 0 for a missing entry.
+func (r *repoSSM) load(ctx context.Context, gatewayName string) (ssmEntry, int64, error) {
+	e := ssmEntry{GatewayName: gatewayName}
+
+	out, errGet := r.ssm.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String(r.gatewayParam(gatewayName)),
+	})
+
+	var notFound *ssmtypes.ParameterNotFound
+	if errors.As(errGet, &notFound) {
+		return e, 0, nil
+	}
+	if errGet != nil {
+		return e, 0, errGet
+	}
+
+	if errJSON := json.Unmarshal([]byte(aws.ToString(out.Parameter.Value)), &e); errJSON != nil {
+		return e, 0, errJSON
+	}
+
+	return e, out.Parameter.Version, nil
+}
+
+func (r *repoSSM) Get(ctx context.Context, gatewayName string) (gateboard.BodyGetReply, error) {
+	const me = "repoSSM.get"
+
+	body := gateboard.BodyGetReply{GatewayName: gatewayName}
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return body, errVal
+	}
+
+	gatewayParam := r.gatewayParam(gatewayName)
+
+	// missing names are reported in InvalidParameters, not as error
+	out, errGet := r.ssm.GetParameters(ctx, &ssm.GetParametersInput{
+		Names:          []string{gatewayParam, r.tokenParam(gatewayName)},
+		WithDecryption: aws.Bool(true),
+	})
+	if errGet != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errGet)
+		return body, errGet
+	}
+
+	var found bool
+
+	for _, param := range out.Parameters {
+		if aws.ToString(param.Name) != gatewayParam {
+			body.Token = aws.ToString(param.Value)
+			continue
+		}
+		var e ssmEntry
+		if errJSON := json.Unmarshal([]byte(aws.ToString(param.Value)), &e); errJSON != nil {
+			zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errJSON)
+			return body, errJSON
+		}
+		found = true
+		body.GatewayID = e.GatewayID
+		body.Changes = param.Version
+		body.LastUpdate = e.LastUpdate
+		body.Deleted = e.Deleted
+	}
+
+	if !found {
+		return body, ErrGatewayNotFound
+	}
+
+	return body, nil
+}
+
+// write saves e unless the current version differs from expectedChanges.
+// Parameter Store has no conditional overwrite, so the version is checked
+// right before the write, and checked again in the version returned by
+// the write. Only create-only writes (expectedChanges 0) are atomic.
+func (r *repoSSM) write(ctx context.Context, e ssmEntry, expectedChanges int64) error {
+	if expectedChanges > 0 {
+		_, version, errLoad := r.load(ctx, e.GatewayName)
+		if errLoad != nil {
+			return errLoad
+		}
+		if version != expectedChanges {
+			return ErrConflict
+		}
+	}
+
+	buf, errJSON := json.Marshal(e)
+	if errJSON != nil {
+		return errJSON
+	}
+
+	out, errPut := r.ssm.PutParameter(ctx, &ssm.PutParameterInput{
+		Name:      aws.String(r.gatewayParam(e.GatewayName)),
+		Value:     aws.String(string(buf)),
+		Type:      ssmtypes.ParameterTypeString,
+		Overwrite: aws.Bool(expectedChanges != 0),
+	})
+
+	var exists *ssmtypes.ParameterAlreadyExists
+	if errors.As(errPut, &exists) {
+		return ErrConflict
+	}
+	if errPut != nil {
+		return errPut
+	}
+
+	if expectedChanges > 0 && out.Version != expectedChanges+1 {
+		return ErrConflict // a concurrent write slipped between check and write
+	}
+
+	return nil
+}
+
+func (r *repoSSM) Put(ctx context.Context, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	const me = "repoSSM.put"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	if strings.TrimSpace(gatewayID) == "" {
+		return fmt.Errorf("%s: bad gateway id: '%s'", me, gatewayID)
+	}
+
+	err := r.write(ctx, ssmEntry{
+		GatewayName: gatewayName,
+		GatewayID:   gatewayID,
+		LastUpdate:  time.Now(),
+		Source:      source,
+	}, expectedChanges)
+	if err != nil && err != ErrConflict {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoSSM) Delete(ctx context.Context, gatewayName, source string) error {
+	const me = "repoSSM.delete"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return errVal
+	}
+
+	err := r.write(ctx, ssmEntry{
+		GatewayName: gatewayName,
+		LastUpdate:  time.Now(),
+		Source:      source,
+		Deleted:     true,
+	}, AnyChanges)
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
+
+func (r *repoSSM) History(ctx context.Context, gatewayName string) ([]gateboard.HistoryEntry, error) {
+	const me = "repoSSM.history"
+
+	if errVal := ValidateGatewayName(gatewayName); errVal != nil {
+		return nil, errVal
+	}
+
+	var list []gateboard.HistoryEntry
+
+	pages := ssm.NewGetParameterHistoryPaginator(r.ssm, &ssm.GetParameterHistoryInput{
+		Name: aws.String(r.gatewayParam(gatewayName)),
+	})
+
+	for pages.HasMorePages() {
+		page, errPage := pages.NextPage(ctx)
+		var notFound *ssmtypes.ParameterNotFound
+		if errors.As(errPage, &notFound) {
+			return nil, nil
+		}
+		if errPage != nil {
+			zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errPage)
+			return nil, errPage
+		}
+		for _, h := range page.Parameters {
+			var e ssmEntry
+			if errJSON := json.Unmarshal([]byte(aws.ToString(h.Value)), &e); errJSON != nil {
+				zlog.CtxErrorf(ctx, "%s: gatewayName=%s version=%d: %v", me, gatewayName, h.Version, errJSON)
+				return nil, errJSON
+			}
+			list = append(list, gateboard.HistoryEntry{
+				GatewayID: e.GatewayID,
+				Changes:   h.Version,
+				Timestamp: e.LastUpdate,
+				Source:    e.Source,
+				Deleted:   e.Deleted,
+			})
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Changes < list[j].Changes })
+
+	return historyTail(list, r.options.historyMax), nil
+}
+
+// purge deletes the tombstone along with its token.
+// Parameter Store has no conditional delete, so a write racing
+// with purge might be lost.
+func (r *repoSSM) Purge(ctx context.Context, gatewayName string) error {
+	const me = "repoSSM.purge"
+
+	e, version, errLoad := r.load(ctx, gatewayName)
+	if errLoad != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errLoad)
+		return errLoad
+	}
+	if version == 0 || !e.Deleted {
+		return nil
+	}
+
+	// deleting the parameter also removes its history, as changes counter restarts
+	_, errDelete := r.ssm.DeleteParameters(ctx, &ssm.DeleteParametersInput{
+		Names: []string{r.gatewayParam(gatewayName), r.tokenParam(gatewayName)},
+	})
+	if errDelete != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, errDelete)
+	}
+
+	return errDelete
+}
+
+// putToken keeps the token in its own SecureString parameter,
+// so that token updates do not create gateway versions.
+func (r *repoSSM) PutToken(ctx context.Context, gatewayName, token string) error {
+	const me = "repoSSM.putToken"
+
+	var err error
+
+	if token == "" {
+		// parameter values cannot be empty
+		_, err = r.ssm.DeleteParameter(ctx, &ssm.DeleteParameterInput{Name: aws.String(r.tokenParam(gatewayName))})
+		var notFound *ssmtypes.ParameterNotFound
+		if errors.As(err, &notFound) {
+			err = nil
+		}
+	} else {
+		input := &ssm.PutParameterInput{
+			Name:      aws.String(r.tokenParam(gatewayName)),
+			Value:     aws.String(token),
+			Type:      ssmtypes.ParameterTypeSecureString,
+			Overwrite: aws.Bool(true),
+		}
+		if r.options.kmsKeyID != "" {
+			input.KeyId = aws.String(r.options.kmsKeyID)
+		}
+		_, err = r.ssm.PutParameter(ctx, input)
+	}
+
+	if err != nil {
+		zlog.CtxErrorf(ctx, "%s: gatewayName=%s: %v", me, gatewayName, err)
+	}
+
+	return err
+}
@@ -0,0 +1,25 @@
+package repository
+
+import "testing"
+
+// go test -v -run TestSSMEscape ./cmd/gateboard/repository
+func TestSSMEscape(t *testing.T) {
+	table := []struct {
+		gatewayName string
+		expected    string
+	}{
+		{"gw1", "gw1"},
+		{"my-gw.v2", "my-gw.v2"},
+		{"123:us-east-1:gw1", "123_3Aus-east-1_3Agw1"},
+		{"gw_1", "gw_5F1"},
+		{"gw/1", "gw_2F1"},
+		{"gw 1", "gw_201"},
+	}
+
+	for _, data := range table {
+		result := ssmEscape(data.gatewayName)
+		if result != data.expected {
+			t.Errorf("gatewayName=%q: expected=%q got=%q", data.gatewayName, data.expected, result)
+		}
+	}
+}
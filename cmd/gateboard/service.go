@@ -4,13 +4,17 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/modernprogram/groupcache/v2"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
 	"github.com/udhos/gateboard/cmd/gateboard/zlog"
 	"github.com/udhos/gateboard/gateboard"
 	"go.opentelemetry.io/otel/trace"
@@ -22,71 +26,163 @@ func randomRepo(n int) int {
 	return rand.Intn(n)
 }
 
-// repoDumpMultiple returns merged contents from all repositories.
-func repoDumpMultiple(ctx context.Context, app *application) (repoDump, error) {
+// dumpBatch is the number of entries requested from each repository
+// at a time when the dump has no limit.
+const dumpBatch = 1000
+
+// repoDumpMultiple merges contents from all repositories, selected by filter,
+// and calls emit for each resulting gateway in ascending name order, skipping
+// tombstones and gateways rejected by accept (nil accepts all).
+// Repositories are read in batches starting after filter.After, so no more than
+// a batch per repository is held in memory. When filter.Limit is positive, at most
+// filter.Limit gateways are emitted and next is the cursor for the following page,
+// empty when there are no more gateways.
+func repoDumpMultiple(ctx context.Context, app *application, filter repository.DumpFilter,
+	accept func(gatewayName string) bool,
+	emit func(item map[string]interface{}) error) (string, error) {
+
 	const me = "repoDumpMultiple"
 
+	repoList := app.repositories().list
+
 	// create trace span
 	ctxNew, span := newSpan(ctx, me, app.tracer)
 	if span != nil {
 		defer span.End()
 	}
 
-	merge := map[string]interface{}{}
 	var errLast error
+	var emitted int
 
-	size := len(app.repoList)
+	size := len(repoList)
 
-	r := randomRepo(size)
+	batch := filter
+	batch.Limit = dumpBatch
 
-	for count := 1; count <= size; count++ {
-		r = (r + 1) % size
-		repo := app.repoList[r]
+	for {
+		if filter.Limit > 0 {
+			batch.Limit = filter.Limit - emitted
+		}
 
-		begin := time.Now()
-		d, err := repo.dump(ctxNew)
-		elap := time.Since(begin)
+		merge := map[string]map[string]interface{}{}
+		var answered int
+		var truncated bool
+		var boundary string // last name known to be complete in this batch
 
-		if err == nil {
-			recordRepositoryLatency("dump", repoStatusOK, repo.repoName(), elap)
-		} else {
-			errLast = err
-			traceError(span, err.Error())
-			recordRepositoryLatency("dump", repoStatusError, repo.repoName(), elap)
-		}
+		r := randomRepo(size)
 
-		zlog.CtxDebugf(ctxNew, app.config.debug || err != nil,
-			"%s: attempt=%d/%d repo=%d error:%v",
-			me, count, len(app.repoList), r, err)
+		for count := 1; count <= size; count++ {
+			r = (r + 1) % size
+			repo := repoList[r]
 
-		// merge dump
-		for _, i := range d {
-			name := i["gateway_name"].(string)
+			begin := time.Now()
+			d, err := repo.Dump(ctxNew, batch)
+			elap := time.Since(begin)
 
-			item := map[string]interface{}{
-				"gateway_name": name,
-				"gateway_id":   i["gateway_id"],
-				"changes":      i["changes"],
-				"last_update":  i["last_update"],
-				"token":        i["token"],
+			if err == nil {
+				recordRepositoryLatency("dump", repoStatusOK, repo.RepoName(), elap)
+			} else {
+				errLast = err
+				traceError(span, err.Error())
+				recordRepositoryLatency("dump", repoStatusError, repo.RepoName(), elap)
 			}
 
-			merge[name] = item
+			zlog.CtxDebugf(ctxNew, app.config.debug || err != nil,
+				"%s: attempt=%d/%d repo=%d after=%q limit=%d size=%d error:%v",
+				me, count, len(repoList), r, batch.After, batch.Limit, len(d), err)
+
+			if err != nil {
+				continue
+			}
+
+			answered++
+
+			if len(d) >= batch.Limit {
+				// repository may hold more entries beyond its last one
+				var last string
+				for _, i := range d {
+					last = max(last, repository.DumpName(i))
+				}
+				if !truncated || last < boundary {
+					boundary = last
+				}
+				truncated = true
+			}
+
+			// merge dump: most recent update wins
+			for _, i := range d {
+				name := repository.DumpName(i)
+
+				item := map[string]interface{}{
+					"gateway_name": name,
+					"gateway_id":   i["gateway_id"],
+					"changes":      i["changes"],
+					"last_update":  i["last_update"],
+					"token":        i["token"],
+					"deleted":      repository.DumpBool(i["deleted"]),
+				}
+
+				if prev, found := merge[name]; found {
+					if !repository.DumpTime(item["last_update"]).After(repository.DumpTime(prev["last_update"])) {
+						continue // keep previous item
+					}
+				}
+
+				merge[name] = item
+			}
+		}
+
+		if answered == 0 {
+			return "", errLast
+		}
+
+		// entries after boundary may be missing from truncated repositories,
+		// they are fetched again by the next batch
+		names := make([]string, 0, len(merge))
+		for name := range merge {
+			if truncated && name > boundary {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for i, name := range names {
+			item := merge[name]
+			if item["deleted"].(bool) {
+				continue // hide tombstone
+			}
+			if !filter.Match(name, repository.DumpTime(item["last_update"])) {
+				continue // repository returned extra entry
+			}
+			if accept != nil && !accept(name) {
+				continue
+			}
+			delete(item, "deleted")
+			if err := emit(item); err != nil {
+				return "", err
+			}
+			emitted++
+			if filter.Limit > 0 && emitted >= filter.Limit {
+				if truncated || i < len(names)-1 {
+					return name, nil // more entries may follow
+				}
+				return "", nil
+			}
 		}
-	}
 
-	var dump repoDump
+		if !truncated {
+			break
+		}
 
-	for _, v := range merge {
-		vv := v.(map[string]interface{})
-		dump = append(dump, vv)
+		batch.After = boundary
 	}
 
-	if len(dump) < 1 {
-		return dump, errLast
+	if emitted < 1 {
+		return "", errLast
 	}
 
-	return dump, nil
+	return "", nil
 }
 
 func gatewayDump(c *gin.Context, app *application) {
@@ -97,7 +193,29 @@ func gatewayDump(c *gin.Context, app *application) {
 		defer span.End()
 	}
 
-	zlog.CtxInfof(ctx, "%s", me)
+	type output struct {
+		Error string
+	}
+
+	var out output
+
+	query, errQuery := parseDumpQuery(c)
+	if errQuery != nil {
+		out.Error = fmt.Sprintf("%s: %v", me, errQuery)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
+	zlog.CtxInfof(ctx, "%s: filter=%+v ndjson=%t", me, query.filter, query.ndjson)
+
+	var accept func(string) bool
+	if grant := authGrantFrom(c); grant != nil {
+		accept = func(gatewayName string) bool { return grant.allowed(gatewayName, false) }
+	}
+
+	w := dumpWriter{c: c, ndjson: query.ndjson}
 
 	//
 	// dump gateways
@@ -105,22 +223,47 @@ func gatewayDump(c *gin.Context, app *application) {
 
 	begin := time.Now()
 
-	type output struct {
-		Error string
+	var next string
+	var errDump error
+
+	if query.filter.Limit > 0 {
+		// a page is buffered, since the cursor header must precede the body
+		page := repository.Dump{}
+		next, errDump = repoDumpMultiple(ctx, app, query.filter, accept,
+			func(item map[string]interface{}) error {
+				page = append(page, item)
+				return nil
+			})
+		if errDump == nil {
+			if next != "" {
+				c.Header(headerDumpNext, encodeDumpNext(next))
+			}
+			for _, item := range page {
+				if errDump = w.write(item); errDump != nil {
+					break
+				}
+			}
+		}
+	} else {
+		// a full dump is streamed as it is merged
+		_, errDump = repoDumpMultiple(ctx, app, query.filter, accept, w.write)
 	}
 
-	var out output
-
-	dump, errDump := repoDumpMultiple(ctx, app)
-
 	elap := time.Since(begin)
 
 	zlog.CtxDebugf(ctx, app.config.debug, "%s: repo_dump_latency: elapsed=%v (error:%v)",
 		me, elap, errDump)
 
+	if errDump != nil && w.started {
+		// too late to report the error: the client detects the truncated dump
+		traceError(span, errDump.Error())
+		zlog.CtxErrorf(ctx, "%s: dump interrupted: %v", me, errDump)
+		return
+	}
+
 	switch errDump {
 	case nil:
-	case errRepositoryGatewayNotFound:
+	case repository.ErrGatewayNotFound:
 		out.Error = fmt.Sprintf("%s: error: %v", me, errDump)
 		traceError(span, out.Error)
 		zlog.CtxErrorf(ctx, "%s", out.Error)
@@ -134,7 +277,7 @@ func gatewayDump(c *gin.Context, app *application) {
 		return
 	}
 
-	c.JSON(http.StatusOK, dump)
+	w.close()
 }
 
 type repoAnswer struct {
@@ -143,7 +286,7 @@ type repoAnswer struct {
 	err      error
 }
 
-func queryOneRepo(ctx context.Context, tracer trace.Tracer, gatewayName string, r, size int, repo repository, debug bool, ch chan<- repoAnswer) {
+func queryOneRepo(ctx context.Context, tracer trace.Tracer, gatewayName string, r, size int, repo repository.Repository, debug bool, ch chan<- repoAnswer) {
 	const me = "queryOneRepo"
 
 	// create trace span
@@ -153,30 +296,43 @@ func queryOneRepo(ctx context.Context, tracer trace.Tracer, gatewayName string,
 	}
 
 	begin := time.Now()
-	body, err := repo.get(ctxNew, gatewayName)
+	body, err := repo.Get(ctxNew, gatewayName)
 	elap := time.Since(begin)
 
 	zlog.CtxDebugf(ctxNew, debug || err != nil,
 		"%s: attempt=%d/%d repo=%s gateway_name=%s error:%v",
-		me, r, size, repo.repoName(), gatewayName, err)
+		me, r, size, repo.RepoName(), gatewayName, err)
 
 	switch err {
 	case nil:
-		recordRepositoryLatency("get", repoStatusOK, repo.repoName(), elap)
-	case errRepositoryGatewayNotFound:
+		recordRepositoryLatency("get", repoStatusOK, repo.RepoName(), elap)
+	case repository.ErrGatewayNotFound:
 		traceError(span, err.Error())
-		recordRepositoryLatency("get", repoStatusNotFound, repo.repoName(), elap)
+		recordRepositoryLatency("get", repoStatusNotFound, repo.RepoName(), elap)
 	default:
 		traceError(span, err.Error())
-		recordRepositoryLatency("get", repoStatusError, repo.repoName(), elap)
+		recordRepositoryLatency("get", repoStatusError, repo.RepoName(), elap)
 	}
 
-	ch <- repoAnswer{body: body, repoName: repo.repoName(), err: err}
+	ch <- repoAnswer{body: body, repoName: repo.RepoName(), err: err}
 }
 
-// repoGetMultiple returns the first non-errored result from repository list.
+// repoGetMultiple queries repositories according to READ_POLICY.
 func repoGetMultiple(ctx context.Context, app *application, gatewayName string) (gateboard.BodyGetReply, string, error) {
-	const me = "repoGetMultiple"
+	switch app.config.readPolicy {
+	case readPolicyOrdered:
+		return repoGetOrdered(ctx, app, gatewayName)
+	case readPolicyFreshest:
+		return repoGetFreshest(ctx, app, gatewayName)
+	}
+	return repoGetFastest(ctx, app, gatewayName)
+}
+
+// repoGetFastest returns the first non-errored result from repository list.
+func repoGetFastest(ctx context.Context, app *application, gatewayName string) (gateboard.BodyGetReply, string, error) {
+	const me = "repoGetFastest"
+
+	repoList := app.repositories().list
 
 	// create trace span
 	ctxNew, span := newSpan(ctx, me, app.tracer)
@@ -186,13 +342,13 @@ func repoGetMultiple(ctx context.Context, app *application, gatewayName string)
 
 	var answer repoAnswer
 
-	if len(app.repoList) < 1 {
+	if len(repoList) < 1 {
 		e := fmt.Errorf("%s: empty repo list", me)
 		traceError(span, e.Error())
 		return answer.body, "", e
 	}
 
-	size := len(app.repoList)
+	size := len(repoList)
 
 	var notFound bool
 
@@ -200,7 +356,7 @@ func repoGetMultiple(ctx context.Context, app *application, gatewayName string)
 
 	// spawn one goroutine for each repo
 	for r := range size {
-		repo := app.repoList[r]
+		repo := repoList[r]
 		go queryOneRepo(ctxNew, app.tracer, gatewayName, r, size, repo, app.config.debug, ch)
 	}
 
@@ -210,8 +366,12 @@ func repoGetMultiple(ctx context.Context, app *application, gatewayName string)
 		case answer = <-ch:
 			switch answer.err {
 			case nil:
+				if answer.body.Deleted {
+					// done (found fastest answer as tombstone)
+					return answer.body, answer.repoName, repository.ErrGatewayNotFound
+				}
 				return answer.body, answer.repoName, nil // done (found fastest answer)
-			case errRepositoryGatewayNotFound:
+			case repository.ErrGatewayNotFound:
 				notFound = true
 				// read next answer (got not found error)
 			default:
@@ -231,61 +391,196 @@ func repoGetMultiple(ctx context.Context, app *application, gatewayName string)
 	// most accurate response.
 	// This is useful to stabilize results for testing.
 	if notFound {
-		return answer.body, answer.repoName, errRepositoryGatewayNotFound
+		return answer.body, answer.repoName, repository.ErrGatewayNotFound
 	}
 
 	return answer.body, answer.repoName, answer.err
 }
 
-// repoPutMultiple saves in all repositories.
-func repoPutMultiple(ctx context.Context, app *application, gatewayName, gatewayID string) error {
+// repoPutMultiple saves in all repositories, see repoPutMultipleAccepted.
+func repoPutMultiple(ctx context.Context, app *application, gatewayName, gatewayID, source string, expectedChanges int64) error {
+	_, err := repoPutMultipleAccepted(ctx, app, gatewayName, gatewayID, source, expectedChanges)
+	return err
+}
+
+// repoPutMultipleAccepted saves in all repositories concurrently and
+// returns the names of repositories that accepted the write.
+// It succeeds if as many repositories as required by WRITE_POLICY accept the write.
+// repository.ErrConflict is returned only when no repository accepted
+// the write and at least one refused it due to expectedChanges mismatch.
+// errWritePolicy is returned when some, but not enough, repositories accepted the write.
+func repoPutMultipleAccepted(ctx context.Context, app *application, gatewayName, gatewayID, source string, expectedChanges int64) ([]string, error) {
 	const me = "repoPutMultiple"
 
+	repoList := app.repositories().list
+
 	// create trace span
 	ctxNew, span := newSpan(ctx, "repoPut", app.tracer)
 	if span != nil {
 		defer span.End()
 	}
 
-	if len(app.repoList) < 1 {
+	if len(repoList) < 1 {
 		err := fmt.Errorf("%s: empty repo list", me)
 		traceError(span, err.Error())
-		return err
+		return nil, err
 	}
 
-	var countSuccess int
+	size := len(repoList)
+
+	results := make([]error, size)
+
+	var wg sync.WaitGroup
+
+	for r, repo := range repoList {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			begin := time.Now()
+			err := repo.Put(ctxNew, gatewayName, gatewayID, source, expectedChanges)
+			elap := time.Since(begin)
+
+			switch err {
+			case nil:
+				recordRepositoryLatency("put", repoStatusOK, repo.RepoName(), elap)
+			case repository.ErrConflict:
+				// the repository answered properly, so this is not a repository error
+				recordRepositoryLatency("put", repoStatusOK, repo.RepoName(), elap)
+			default:
+				traceError(span, err.Error())
+				recordRepositoryLatency("put", repoStatusError, repo.RepoName(), elap)
+			}
+
+			zlog.CtxDebugf(ctxNew, app.config.debug || err != nil,
+				"%s: repo=%d/%d %s gateway_name=%s error:%v",
+				me, r+1, size, repo.RepoName(), gatewayName, err)
+
+			results[r] = err
+		}()
+	}
+
+	wg.Wait()
+
+	var accepted []string
+	var countConflict int
 	var errLast error
 
-	size := len(app.repoList)
+	for r, err := range results {
+		switch err {
+		case nil:
+			accepted = append(accepted, repoList[r].RepoName())
+		case repository.ErrConflict:
+			countConflict++
+		default:
+			errLast = err
+		}
+	}
 
-	r := randomRepo(size)
+	if len(accepted) < 1 {
+		if countConflict > 0 {
+			return nil, repository.ErrConflict
+		}
+		return nil, errLast
+	}
 
-	for count := 1; count <= size; count++ {
-		r = (r + 1) % size
-		repo := app.repoList[r]
+	if required := app.writePolicy.required(size); len(accepted) < required {
+		if errLast == nil {
+			errLast = repository.ErrConflict
+		}
+		err := errWritePolicy{
+			policy:   app.writePolicy,
+			accepted: len(accepted),
+			required: required,
+			total:    size,
+			last:     errLast,
+		}
+		traceError(span, err.Error())
+		return accepted, err
+	}
 
-		begin := time.Now()
-		err := repo.put(ctxNew, gatewayName, gatewayID)
-		elap := time.Since(begin)
+	return accepted, nil
+}
+
+// repoDeleteMultiple saves tombstone in all repositories concurrently.
+// It succeeds if as many repositories as required by WRITE_POLICY accept the delete.
+// errWritePolicy is returned when some, but not enough, repositories accepted the delete.
+func repoDeleteMultiple(ctx context.Context, app *application, gatewayName, source string) error {
+	const me = "repoDeleteMultiple"
+
+	repoList := app.repositories().list
+
+	// create trace span
+	ctxNew, span := newSpan(ctx, "repoDelete", app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	if len(repoList) < 1 {
+		err := fmt.Errorf("%s: empty repo list", me)
+		traceError(span, err.Error())
+		return err
+	}
 
+	size := len(repoList)
+
+	results := make([]error, size)
+
+	var wg sync.WaitGroup
+
+	for r, repo := range repoList {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			begin := time.Now()
+			err := repo.Delete(ctxNew, gatewayName, source)
+			elap := time.Since(begin)
+
+			if err == nil {
+				recordRepositoryLatency("delete", repoStatusOK, repo.RepoName(), elap)
+			} else {
+				traceError(span, err.Error())
+				recordRepositoryLatency("delete", repoStatusError, repo.RepoName(), elap)
+			}
+
+			zlog.CtxDebugf(ctxNew, app.config.debug || err != nil,
+				"%s: repo=%d/%d %s gateway_name=%s error:%v",
+				me, r+1, size, repo.RepoName(), gatewayName, err)
+
+			results[r] = err
+		}()
+	}
+
+	wg.Wait()
+
+	var countSuccess int
+	var errLast error
+
+	for _, err := range results {
 		if err == nil {
 			countSuccess++
-			recordRepositoryLatency("put", repoStatusOK, repo.repoName(), elap)
 		} else {
 			errLast = err
-			traceError(span, err.Error())
-			recordRepositoryLatency("put", repoStatusError, repo.repoName(), elap)
 		}
-
-		zlog.CtxDebugf(ctxNew, app.config.debug || err != nil,
-			"%s: attempt=%d/%d repo=%d gateway_name=%s error:%v",
-			me, count, len(app.repoList), r, gatewayName, err)
 	}
 
 	if countSuccess < 1 {
 		return errLast
 	}
 
+	if required := app.writePolicy.required(size); countSuccess < required {
+		err := errWritePolicy{
+			policy:   app.writePolicy,
+			accepted: countSuccess,
+			required: required,
+			total:    size,
+			last:     errLast,
+		}
+		traceError(span, err.Error())
+		return err
+	}
+
 	return nil
 }
 
@@ -293,23 +588,25 @@ func repoPutMultiple(ctx context.Context, app *application, gatewayName, gateway
 func repoPutTokenMultiple(ctx context.Context, app *application, gatewayName, token string) error {
 	const me = "repoPutTokenMultiple"
 
+	repoList := app.repositories().list
+
 	var errLast error
 
-	size := len(app.repoList)
+	size := len(repoList)
 
 	r := randomRepo(size)
 
 	for count := 1; count <= size; count++ {
 		r = (r + 1) % size
-		repo := app.repoList[r]
+		repo := repoList[r]
 
-		err := repo.putToken(ctx, gatewayName, token)
+		err := repo.PutToken(ctx, gatewayName, token)
 		if err != nil {
 			errLast = err
 		}
 
 		zlog.CtxDebugf(ctx, app.config.debug, "%s: attempt=%d/%d repo=%d gateway_name=%s error:%v",
-			me, count, len(app.repoList), r, gatewayName, err)
+			me, count, len(repoList), r, gatewayName, err)
 	}
 
 	return errLast
@@ -379,10 +676,15 @@ func gatewayGet(c *gin.Context, app *application) {
 	ctx2, cancel := context.WithTimeout(ctx2, timeout) // add timeout
 	defer cancel()                                     // ensure resources are cleaned up
 
+	changesKnown := true
+
 	if app.config.groupCache {
 		// cache query
-		errID = app.cache.Get(ctx2, gatewayName,
-			groupcache.StringSink(&out.GatewayID), nil)
+		var cached cachedGateway
+		cached, changesKnown, errID = cacheGet(ctx2, app, gatewayName)
+		out.GatewayName = gatewayName
+		out.GatewayID = cached.GatewayID
+		out.Changes = cached.Changes
 	} else {
 		// direct query
 		out, _, errID = repoGetMultiple(ctx2, app, gatewayName)
@@ -411,7 +713,7 @@ func gatewayGet(c *gin.Context, app *application) {
 
 	switch errID {
 	case nil:
-	case errRepositoryGatewayNotFound:
+	case repository.ErrGatewayNotFound:
 		out.GatewayName = gatewayName
 		out.Error = fmt.Sprintf("%s: not found: %v", me, errID)
 		traceError(span, out.Error)
@@ -427,6 +729,11 @@ func gatewayGet(c *gin.Context, app *application) {
 		return
 	}
 
+	// clients may send it back as If-Match for compare-and-swap PUT
+	if changesKnown {
+		c.Header("ETag", strconv.Quote(strconv.FormatInt(out.Changes, 10)))
+	}
+
 	c.JSON(http.StatusOK, out)
 }
 
@@ -487,6 +794,19 @@ func gatewayPut(c *gin.Context, app *application) {
 
 	out.GatewayID = gatewayID
 
+	//
+	// optional compare-and-swap
+	//
+
+	expectedChanges, errExpected := putExpectedChanges(c, in)
+	if errExpected != nil {
+		out.Error = errExpected.Error()
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
+	}
+
 	//
 	// check write token
 	//
@@ -505,80 +825,215 @@ func gatewayPut(c *gin.Context, app *application) {
 	// save gateway_id
 	//
 
+	errPut := repoWriteRetry(ctx, app, span, me, gatewayName, func() error {
+		accepted, err := repoPutMultipleAccepted(ctx, app, gatewayName, gatewayID, sourceHTTP(c), expectedChanges)
+		out.Accepted = accepted
+		return err
+	})
+	if errPut == repository.ErrConflict {
+		out.Error = fmt.Sprintf("%s: expected_changes=%d: %v", me, expectedChanges, errPut)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusConflict, out)
+		return
+	}
+	if _, partial := errPut.(errWritePolicy); partial {
+		// written to some repositories, but fewer than required
+		out.Error = errPut.Error()
+		c.JSON(http.StatusServiceUnavailable, out)
+		return
+	}
+	if errPut != nil {
+		out.Error = errPut.Error()
+		c.JSON(http.StatusInternalServerError, out)
+		return
+	}
+
+	// PUT success
+
+	gatewayChanged(ctx, app, gatewayName)
+
+	c.JSON(http.StatusOK, out)
+}
+
+// repoWriteRetry invokes write up to WRITE_RETRY attempts.
+func repoWriteRetry(ctx context.Context, app *application, span trace.Span, caller, gatewayName string, write func() error) error {
+
 	maxRetry := app.config.writeRetry
 
+	errWrite := fmt.Errorf("%s: no write attempt: WRITE_RETRY=%d", caller, maxRetry)
+
 	for attempt := 1; attempt <= maxRetry; attempt++ {
 
 		begin := time.Now()
 
-		errPut := repoPutMultiple(ctx, app, gatewayName, gatewayID)
+		errRepo := write()
 
 		elap := time.Since(begin)
 
-		zlog.CtxDebugf(ctx, app.config.debug, "%s: gateway_name=%s repo_put_latency: elapsed=%v (error:%v)",
-			me, gatewayName, elap, errPut)
+		zlog.CtxDebugf(ctx, app.config.debug, "%s: gateway_name=%s repo_write_latency: elapsed=%v (error:%v)",
+			caller, gatewayName, elap, errRepo)
 
-		if errPut == nil {
-
-			// PUT success
+		if errRepo == nil {
+			return nil
+		}
 
-			if app.config.groupCache {
-				app.cache.Remove(ctx, gatewayName)
-			}
+		if errRepo == repository.ErrConflict {
+			return errRepo // retrying would not help
+		}
 
-			out.Error = ""
-			c.JSON(http.StatusOK, out)
-			return
+		if _, partial := errRepo.(errWritePolicy); partial {
+			// retrying would record the change twice in repositories that accepted it
+			traceError(span, errRepo.Error())
+			zlog.CtxErrorf(ctx, "%s: attempt=%d/%d error: %v", caller, attempt, maxRetry, errRepo)
+			return errRepo
 		}
 
-		out.Error = fmt.Sprintf("%s: attempt=%d/%d error: %v",
-			me, attempt, maxRetry, errPut)
-		traceError(span, out.Error)
-		zlog.CtxErrorf(ctx, "%s", out.Error)
+		errWrite = fmt.Errorf("%s: attempt=%d/%d error: %v",
+			caller, attempt, maxRetry, errRepo)
+		traceError(span, errWrite.Error())
+		zlog.CtxErrorf(ctx, "%s", errWrite.Error())
 
 		if attempt < maxRetry {
 			zlog.CtxInfof(ctx, "%s: attempt=%d/%d sleeping %v",
-				me, attempt, app.config.writeRetry, app.config.writeRetryInterval)
+				caller, attempt, maxRetry, app.config.writeRetryInterval)
 			time.Sleep(app.config.writeRetryInterval)
 		}
 	}
 
-	c.JSON(http.StatusInternalServerError, out)
+	return errWrite
 }
 
-func toJSON(ctx context.Context, v interface{}) string {
-	b, err := json.Marshal(v)
-	if err != nil {
-		zlog.CtxErrorf(ctx, "toJSON: %v", err)
+// putExpectedChanges finds the changes counter required for compare-and-swap,
+// either from body field expected_changes or from header If-Match.
+// The body field takes precedence.
+func putExpectedChanges(c *gin.Context, in gateboard.BodyPutRequest) (int64, error) {
+	if in.ExpectedChanges != nil {
+		if *in.ExpectedChanges < 0 {
+			return repository.AnyChanges, fmt.Errorf("invalid negative expected_changes=%d", *in.ExpectedChanges)
+		}
+		return *in.ExpectedChanges, nil
 	}
-	return string(b)
+
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return repository.AnyChanges, nil
+	}
+
+	// accept both quoted (ETag) and bare values
+	value := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+
+	changes, errParse := strconv.ParseInt(value, 10, 64)
+	if errParse != nil || changes < 0 {
+		return repository.AnyChanges, fmt.Errorf("invalid If-Match header: '%s'", ifMatch)
+	}
+
+	return changes, nil
+}
+
+// sourceHTTP describes the origin of a change requested over HTTP.
+func sourceHTTP(c *gin.Context) string {
+	return "http:" + c.ClientIP()
 }
 
-func invalidToken(ctx context.Context, app *application, gatewayName, token string) bool {
-	const me = "invalidToken"
+func gatewayDelete(c *gin.Context, app *application) {
+	const me = "gatewayDelete"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	gatewayName := strings.TrimPrefix(c.Param("gateway_name"), "/")
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s", me, gatewayName)
+
+	var out gateboard.BodyDeleteReply
+	out.GatewayName = gatewayName
 
-	if token == "" {
-		return true // empty token is always invalid
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		out.Error = errVal.Error()
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
 	}
 
-	result, _, errID := repoGetMultiple(ctx, app, gatewayName)
-	if errID != nil {
-		zlog.CtxErrorf(ctx, "%s: error: %v", me, errID)
-		return true
+	//
+	// parse optional body to get token
+	//
+
+	dec := yaml.NewDecoder(c.Request.Body)
+	var in gateboard.BodyDeleteRequest
+	errYaml := dec.Decode(&in)
+	if errYaml != nil && errYaml != io.EOF {
+		out.Error = fmt.Sprintf("%s: body yaml: %v", me, errYaml)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s", out.Error)
+		c.JSON(http.StatusBadRequest, out)
+		return
 	}
 
-	return result.Token != token
+	//
+	// check write token
+	//
+
+	if app.config.writeToken {
+		if invalidToken(ctx, app, gatewayName, in.Token) {
+			out.Error = "invalid token"
+			traceError(span, out.Error)
+			zlog.CtxErrorf(ctx, "%s", out.Error)
+			c.JSON(http.StatusUnauthorized, out)
+			return
+		}
+	}
+
+	//
+	// save tombstone
+	//
+
+	errDelete := repoWriteRetry(ctx, app, span, me, gatewayName, func() error {
+		return repoDeleteMultiple(ctx, app, gatewayName, sourceHTTP(c))
+	})
+	if _, partial := errDelete.(errWritePolicy); partial {
+		// deleted from some repositories, but fewer than required
+		out.Error = errDelete.Error()
+		c.JSON(http.StatusServiceUnavailable, out)
+		return
+	}
+	if errDelete != nil {
+		out.Error = errDelete.Error()
+		c.JSON(http.StatusInternalServerError, out)
+		return
+	}
+
+	// DELETE success
+
+	gatewayChanged(ctx, app, gatewayName)
+
+	c.JSON(http.StatusOK, out)
+}
+
+func toJSON(ctx context.Context, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		zlog.CtxErrorf(ctx, "toJSON: %v", err)
+	}
+	return string(b)
 }
 
 // validateInputGatewayName checks that gatewayName is valid.
 func validateInputGatewayName(gatewayName string) error {
 	const me = "validateGatewayName"
-	if strings.TrimSpace(gatewayName) == "" {
-		return fmt.Errorf("%s: invalid blank gateway name: '%s'", me, gatewayName)
+	if err := repository.ValidateGatewayName(gatewayName); err != nil {
+		return err
 	}
-	if index := strings.IndexAny(gatewayName, " ${}"); index >= 0 {
-		return fmt.Errorf("%s: invalid character '%c' in gateway name: '%s'",
-			me, gatewayName[index], gatewayName)
+	// routed to history and rollback, such gateways could never be read back
+	for _, suffix := range []string{suffixHistory, suffixRollback} {
+		if strings.HasSuffix(gatewayName, suffix) {
+			return fmt.Errorf("%s: reserved suffix '%s' in gateway name: '%s'",
+				me, suffix, gatewayName)
+		}
 	}
 	return nil
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/sqs"
 	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
 	"github.com/udhos/boilerplate/awsconfig"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
 	"github.com/udhos/gateboard/cmd/gateboard/zlog"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -178,13 +179,15 @@ func sqsListener(app *application) {
 				}
 			}
 
-			errPut := repoPutMultiple(context.TODO(), app, put.GatewayName, put.GatewayID)
+			errPut := repoPutMultiple(context.TODO(), app, put.GatewayName, put.GatewayID, "sqs:"+msg.id(), repository.AnyChanges)
 			if errPut != nil {
 				zlog.Errorf("%s: gateway_name=[%s] gateway_id=[%s] MessageId=%s repo error: %v",
 					me, put.GatewayName, put.GatewayID, msg.id(), errPut)
 				continue
 			}
 
+			gatewayChanged(context.TODO(), app, put.GatewayName)
+
 			deleteMessage(app.sqsClient, msg, put.GatewayName, put.GatewayID)
 		}
 	}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+// tlsListenerConfig holds TLS options for one listener.
+// An empty certFile means plain HTTP.
+type tlsListenerConfig struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // optional, requires and verifies client certificates
+	minVersion   string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsReloader serves the TLS configuration loaded from files,
+// reloading it whenever the files change.
+type tlsReloader struct {
+	label   string
+	conf    tlsListenerConfig
+	current atomic.Pointer[tls.Config]
+}
+
+func newTLSReloader(label string, conf tlsListenerConfig) (*tlsReloader, error) {
+	r := &tlsReloader{label: label, conf: conf}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *tlsReloader) load() error {
+	minVersion, found := tlsVersions[r.conf.minVersion]
+	if !found {
+		return fmt.Errorf("%s: bad tls min version: '%s'", r.label, r.conf.minVersion)
+	}
+
+	cert, errCert := tls.LoadX509KeyPair(r.conf.certFile, r.conf.keyFile)
+	if errCert != nil {
+		return fmt.Errorf("%s: certificate: %v", r.label, errCert)
+	}
+
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+
+	if r.conf.clientCAFile != "" {
+		buf, errRead := os.ReadFile(r.conf.clientCAFile)
+		if errRead != nil {
+			return fmt.Errorf("%s: client ca: %v", r.label, errRead)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("%s: client ca: no certificate found in %s", r.label, r.conf.clientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.current.Store(conf)
+
+	return nil
+}
+
+// serverConfig returns a configuration that always resolves to the latest loaded one.
+func (r *tlsReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current.Load(), nil
+		},
+	}
+}
+
+// watch reloads files on change. Directories are watched, rather than files,
+// to catch atomic replacements like kubernetes secret volume updates.
+// On reload failure, the previous configuration is kept.
+func (r *tlsReloader) watch(watcher *fsnotify.Watcher) {
+	const me = "tlsReloader.watch"
+
+	dirs := map[string]bool{}
+	for _, f := range []string{r.conf.certFile, r.conf.keyFile, r.conf.clientCAFile} {
+		if f != "" {
+			dirs[filepath.Dir(f)] = true
+		}
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			zlog.Errorf("%s: %s: watch %s: %v", me, r.label, dir, err)
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Chmod) {
+				continue
+			}
+			if err := r.load(); err != nil {
+				zlog.Errorf("%s: %s: reload: %v", me, r.label, err)
+				continue
+			}
+			zlog.Infof("%s: %s: reloaded after: %v", me, r.label, event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			zlog.Errorf("%s: %s: %v", me, r.label, err)
+		}
+	}
+}
+
+// listenAndServe serves plain HTTP, or TLS when conf holds a certificate.
+func listenAndServe(s *http.Server, label string, conf tlsListenerConfig) error {
+	if conf.certFile == "" {
+		return s.ListenAndServe()
+	}
+
+	r, errTLS := newTLSReloader(label, conf)
+	if errTLS != nil {
+		zlog.Fatalf("%v", errTLS)
+	}
+
+	watcher, errWatch := fsnotify.NewWatcher()
+	if errWatch != nil {
+		zlog.Errorf("%s: certificate reload disabled: %v", label, errWatch)
+	} else {
+		defer watcher.Close()
+		go r.watch(watcher)
+	}
+
+	s.TLSConfig = r.serverConfig()
+
+	zlog.Infof("%s: tls: cert=%s client_ca=%s min_version=%s",
+		label, conf.certFile, conf.clientCAFile, conf.minVersion)
+
+	return s.ListenAndServeTLS("", "")
+}
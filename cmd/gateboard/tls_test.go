@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		t.Fatalf("ca key: %v", errKey)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, errCert := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if errCert != nil {
+		t.Fatalf("ca cert: %v", errCert)
+	}
+	cert, errParse := x509.ParseCertificate(der)
+	if errParse != nil {
+		t.Fatalf("ca cert: %v", errParse)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate signed by ca into dir as <name>.crt and <name>.key.
+func (ca testCA) issue(t *testing.T, dir, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	key, errKey := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		t.Fatalf("key: %v", errKey)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, errCert := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if errCert != nil {
+		t.Fatalf("cert: %v", errCert)
+	}
+	keyDer, errMarshal := x509.MarshalECPrivateKey(key)
+	if errMarshal != nil {
+		t.Fatalf("key: %v", errMarshal)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	// write then rename, as a secret volume update would
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("write %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("rename %s: %v", path, err)
+	}
+}
+
+// go test -v -run TestTLSReloader ./cmd/gateboard
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+
+	caFile := filepath.Join(dir, "ca.crt")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+
+	serverCert, serverKey := ca.issue(t, dir, "server", 10, x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", 20, x509.ExtKeyUsageClientAuth)
+
+	if _, errVersion := newTLSReloader("test", tlsListenerConfig{certFile: serverCert, keyFile: serverKey, minVersion: "9.9"}); errVersion == nil {
+		t.Errorf("expected error for bad min version")
+	}
+
+	r, errReloader := newTLSReloader("test", tlsListenerConfig{
+		certFile:     serverCert,
+		keyFile:      serverKey,
+		clientCAFile: caFile,
+		minVersion:   "1.2",
+	})
+	if errReloader != nil {
+		t.Fatalf("reloader: %v", errReloader)
+	}
+
+	watcher, errWatch := fsnotify.NewWatcher()
+	if errWatch != nil {
+		t.Fatalf("watcher: %v", errWatch)
+	}
+	defer watcher.Close()
+	go r.watch(watcher)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = r.serverConfig()
+	ts.StartTLS()
+	defer ts.Close()
+
+	noCert, errNoCert := gateboard.TLSClientConfig("", "", caFile)
+	if errNoCert != nil {
+		t.Fatalf("client tls: %v", errNoCert)
+	}
+	if _, err := getServerSerial(ts.URL, noCert); err == nil {
+		t.Errorf("expected mutual TLS to refuse client without certificate")
+	}
+
+	withCert, errWithCert := gateboard.TLSClientConfig(clientCert, clientKey, caFile)
+	if errWithCert != nil {
+		t.Fatalf("client tls: %v", errWithCert)
+	}
+	serial, errGet := getServerSerial(ts.URL, withCert)
+	if errGet != nil {
+		t.Fatalf("mutual TLS: %v", errGet)
+	}
+	if serial != 10 {
+		t.Errorf("expected server certificate serial 10, got %d", serial)
+	}
+
+	// rotate server certificate
+
+	ca.issue(t, dir, "server", 11, x509.ExtKeyUsageServerAuth)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for serial != 11 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		serial, _ = getServerSerial(ts.URL, withCert)
+	}
+	if serial != 11 {
+		t.Errorf("expected reloaded server certificate serial 11, got %d", serial)
+	}
+}
+
+// getServerSerial returns the serial number of the server certificate.
+func getServerSerial(url string, tlsConfig *tls.Config) (int64, error) {
+	transport := &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true}
+	client := http.Client{Transport: transport, Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].SerialNumber.Int64(), nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Write tokens are stored in repositories as a space-separated list of credentials:
+//
+//	hmac-sha256$<salt>$<sum>[$<expires>]
+//
+// sum is the HMAC-SHA256 of salt and token, keyed by TOKEN_HASH_KEY,
+// which is required whenever tokens are in use.
+// expires, in unix seconds, is only present on previous tokens that are
+// still accepted during a rotation grace period.
+// A stored value without the scheme prefix is a legacy clear text token,
+// replaced by its hash on the first successful check.
+const tokenScheme = "hmac-sha256"
+
+const tokenSaltSize = 16
+
+type tokenCredential struct {
+	salt    []byte
+	sum     []byte
+	expires time.Time
+}
+
+func (cred tokenCredential) String() string {
+	s := tokenScheme + "$" + base64.RawStdEncoding.EncodeToString(cred.salt) +
+		"$" + base64.RawStdEncoding.EncodeToString(cred.sum)
+	if !cred.expires.IsZero() {
+		s += "$" + strconv.FormatInt(cred.expires.Unix(), 10)
+	}
+	return s
+}
+
+func tokenSum(key, salt []byte, token string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(salt)
+	mac.Write([]byte(token))
+	return mac.Sum(nil)
+}
+
+func tokenNewCredential(key []byte, token string, expires time.Time) tokenCredential {
+	salt := make([]byte, tokenSaltSize)
+	rand.Read(salt) // never returns an error
+	return tokenCredential{salt: salt, sum: tokenSum(key, salt, token), expires: expires}
+}
+
+// tokenHash returns the stored form of a single token.
+func tokenHash(key []byte, token string) string {
+	return tokenNewCredential(key, token, time.Time{}).String()
+}
+
+func tokenLegacy(stored string) bool {
+	return stored != "" && !strings.HasPrefix(stored, tokenScheme+"$")
+}
+
+// tokenParse decodes stored credentials, silently skipping malformed ones.
+func tokenParse(stored string) []tokenCredential {
+	var list []tokenCredential
+	for _, s := range strings.Fields(stored) {
+		fields := strings.Split(s, "$")
+		if len(fields) < 3 || len(fields) > 4 || fields[0] != tokenScheme {
+			continue
+		}
+		salt, errSalt := base64.RawStdEncoding.DecodeString(fields[1])
+		sum, errSum := base64.RawStdEncoding.DecodeString(fields[2])
+		if errSalt != nil || errSum != nil {
+			continue
+		}
+		cred := tokenCredential{salt: salt, sum: sum}
+		if len(fields) == 4 {
+			sec, errExp := strconv.ParseInt(fields[3], 10, 64)
+			if errExp != nil {
+				continue
+			}
+			cred.expires = time.Unix(sec, 0)
+		}
+		list = append(list, cred)
+	}
+	return list
+}
+
+// tokenVerify checks token against stored credentials in constant time.
+func tokenVerify(key []byte, stored, token string, now time.Time) bool {
+	if token == "" || stored == "" {
+		return false
+	}
+
+	if tokenLegacy(stored) {
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(token)) == 1
+	}
+
+	var valid bool
+	for _, cred := range tokenParse(stored) {
+		if !cred.expires.IsZero() && !now.Before(cred.expires) {
+			continue // grace period is over
+		}
+		if hmac.Equal(cred.sum, tokenSum(key, cred.salt, token)) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// tokenRotate returns the stored form for the new token, keeping unexpired
+// stored credentials accepted until now+grace at most.
+// graceUntil is zero when no previous credential is kept.
+func tokenRotate(key []byte, stored, token string, grace time.Duration, now time.Time) (string, time.Time) {
+	list := []string{tokenHash(key, token)}
+
+	if grace <= 0 || stored == "" {
+		return list[0], time.Time{}
+	}
+
+	until := now.Add(grace)
+
+	if tokenLegacy(stored) {
+		list = append(list, tokenNewCredential(key, stored, until).String())
+		return strings.Join(list, " "), until
+	}
+
+	var kept bool
+	for _, cred := range tokenParse(stored) {
+		if !cred.expires.IsZero() && !now.Before(cred.expires) {
+			continue // drop expired
+		}
+		if cred.expires.IsZero() || cred.expires.After(until) {
+			cred.expires = until
+		}
+		list = append(list, cred.String())
+		kept = true
+	}
+
+	if !kept {
+		return list[0], time.Time{}
+	}
+
+	return strings.Join(list, " "), until
+}
+
+// tokenStored retrieves the stored write token credentials for a gateway.
+func tokenStored(ctx context.Context, app *application, gatewayName string) (string, error) {
+	result, _, errID := repoGetMultiple(ctx, app, gatewayName)
+	switch {
+	case errID == nil:
+	case errID == repository.ErrGatewayNotFound && result.Deleted:
+		// tombstone retains token
+	default:
+		return "", errID
+	}
+	return result.Token, nil
+}
+
+func invalidToken(ctx context.Context, app *application, gatewayName, token string) bool {
+	const me = "invalidToken"
+
+	if token == "" {
+		return true // empty token is always invalid
+	}
+
+	stored, errID := tokenStored(ctx, app, gatewayName)
+	if errID != nil {
+		zlog.CtxErrorf(ctx, "%s: error: %v", me, errID)
+		return true
+	}
+
+	key := []byte(app.config.tokenHashKey)
+
+	if !tokenVerify(key, stored, token, time.Now()) {
+		return true
+	}
+
+	if tokenLegacy(stored) {
+		tokenRehash(ctx, app, gatewayName, stored, token)
+	}
+
+	return false
+}
+
+// tokenRehash replaces a legacy clear text token, just verified, with its hash.
+// Failure is only logged, the clear text token is retried on the next check.
+func tokenRehash(ctx context.Context, app *application, gatewayName, legacy, token string) {
+	const me = "tokenRehash"
+
+	// skip if a concurrent rotation already replaced the legacy token
+	stored, errStored := tokenStored(ctx, app, gatewayName)
+	if errStored != nil || stored != legacy {
+		return
+	}
+
+	if errPut := repoPutTokenMultiple(ctx, app, gatewayName, tokenHash([]byte(app.config.tokenHashKey), token)); errPut != nil {
+		zlog.CtxErrorf(ctx, "%s: gateway_name=%s: %v", me, gatewayName, errPut)
+		return
+	}
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s: clear text token replaced by hash", me, gatewayName)
+}
+
+// checkTokenHashKey refuses an empty TOKEN_HASH_KEY when tokens are in use,
+// since the HMAC would then be just a salted SHA-256 of the token.
+func checkTokenHashKey(config appConfig) error {
+	if config.tokenHashKey != "" {
+		return nil
+	}
+	if config.writeToken || config.tokens != "" || config.adminToken != "" {
+		return fmt.Errorf("TOKEN_HASH_KEY is required when WRITE_TOKEN, TOKENS or ADMIN_TOKEN is set")
+	}
+	return nil
+}
+
+// preloadTokens saves tokens from TOKENS file. Tokens already accepted by
+// the repository are skipped, to not reset a grace period on every restart.
+func preloadTokens(ctx context.Context, app *application, tokens map[string]string) error {
+	key := []byte(app.config.tokenHashKey)
+	for gw, tk := range tokens {
+		stored, errStored := tokenStored(ctx, app, gw)
+		if errStored == nil && tokenVerify(key, stored, tk, time.Now()) && !tokenLegacy(stored) {
+			continue
+		}
+		if errPut := repoPutTokenMultiple(ctx, app, gw, tokenHash(key, tk)); errPut != nil {
+			return fmt.Errorf("gateway '%s': %v", gw, errPut)
+		}
+	}
+	return nil
+}
+
+// adminUnauthorized checks the bearer token required by /admin endpoints.
+// It returns the HTTP status to refuse the request with, or 0 to accept it.
+func adminUnauthorized(c *gin.Context, app *application) (int, string) {
+	if app.config.adminToken == "" {
+		return http.StatusForbidden, "admin api disabled: ADMIN_TOKEN is unset"
+	}
+	bearer, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(bearer), []byte(app.config.adminToken)) != 1 {
+		return http.StatusUnauthorized, "invalid admin token"
+	}
+	return 0, ""
+}
+
+func tokenGenerate() string {
+	buf := make([]byte, 32)
+	rand.Read(buf) // never returns an error
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// adminTokenPut implements PUT /admin/token/{name}: sets a new write token,
+// keeping the previous one valid for the grace period.
+func adminTokenPut(c *gin.Context, app *application) {
+	const me = "adminTokenPut"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	gatewayName := strings.TrimPrefix(c.Param("gateway_name"), "/")
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s", me, gatewayName)
+
+	out := gateboard.BodyTokenReply{GatewayName: gatewayName}
+
+	fail := func(status int, format string, a ...any) {
+		out.Error = fmt.Sprintf(format, a...)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s: %s", me, out.Error)
+		c.JSON(status, out)
+	}
+
+	if status, msg := adminUnauthorized(c, app); status != 0 {
+		fail(status, "%s", msg)
+		return
+	}
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		fail(http.StatusBadRequest, "%v", errVal)
+		return
+	}
+
+	dec := yaml.NewDecoder(c.Request.Body)
+	var in gateboard.BodyTokenPutRequest
+	if errYaml := dec.Decode(&in); errYaml != nil && errYaml != io.EOF {
+		fail(http.StatusBadRequest, "body yaml: %v", errYaml)
+		return
+	}
+
+	grace := app.config.tokenRotationGrace
+	if in.GracePeriod != "" {
+		var errGrace error
+		grace, errGrace = time.ParseDuration(in.GracePeriod)
+		if errGrace != nil || grace < 0 {
+			fail(http.StatusBadRequest, "bad grace_period='%s'", in.GracePeriod)
+			return
+		}
+	}
+
+	token := strings.TrimSpace(in.Token)
+	if token == "" {
+		token = tokenGenerate()
+	}
+
+	stored, errStored := tokenStored(ctx, app, gatewayName)
+	if errStored != nil && errStored != repository.ErrGatewayNotFound {
+		fail(http.StatusInternalServerError, "%v", errStored)
+		return
+	}
+
+	value, until := tokenRotate([]byte(app.config.tokenHashKey), stored, token, grace, time.Now())
+
+	errPut := repoWriteRetry(ctx, app, span, me, gatewayName, func() error {
+		return repoPutTokenMultiple(ctx, app, gatewayName, value)
+	})
+	if errPut != nil {
+		fail(http.StatusInternalServerError, "%v", errPut)
+		return
+	}
+
+	out.Token = token
+	out.GraceUntil = until
+
+	c.JSON(http.StatusOK, out)
+}
+
+// adminTokenDelete implements DELETE /admin/token/{name}: revokes every
+// write token for the gateway immediately.
+func adminTokenDelete(c *gin.Context, app *application) {
+	const me = "adminTokenDelete"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	gatewayName := strings.TrimPrefix(c.Param("gateway_name"), "/")
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s", me, gatewayName)
+
+	out := gateboard.BodyTokenReply{GatewayName: gatewayName}
+
+	fail := func(status int, format string, a ...any) {
+		out.Error = fmt.Sprintf(format, a...)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s: %s", me, out.Error)
+		c.JSON(status, out)
+	}
+
+	if status, msg := adminUnauthorized(c, app); status != 0 {
+		fail(status, "%s", msg)
+		return
+	}
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		fail(http.StatusBadRequest, "%v", errVal)
+		return
+	}
+
+	errPut := repoWriteRetry(ctx, app, span, me, gatewayName, func() error {
+		return repoPutTokenMultiple(ctx, app, gatewayName, "")
+	})
+	if errPut != nil {
+		fail(http.StatusInternalServerError, "%v", errPut)
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
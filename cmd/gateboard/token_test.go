@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// go test -v -run TestTokenVerify ./cmd/gateboard
+func TestTokenVerify(t *testing.T) {
+	key := []byte("key1")
+	now := time.Now()
+
+	stored := tokenHash(key, "tk1")
+
+	if strings.Contains(stored, "tk1") {
+		t.Errorf("clear text token leaked into stored form: %s", stored)
+	}
+	if tokenHash(key, "tk1") == stored {
+		t.Errorf("expected distinct salt for every hash")
+	}
+
+	table := []struct {
+		name     string
+		key      []byte
+		stored   string
+		token    string
+		expected bool
+	}{
+		{"hashed good", key, stored, "tk1", true},
+		{"hashed bad", key, stored, "tk2", false},
+		{"hashed empty", key, stored, "", false},
+		{"wrong key", []byte("key2"), stored, "tk1", false},
+		{"nothing stored", key, "", "tk1", false},
+		{"nothing stored empty", key, "", "", false},
+		{"legacy good", key, "tk1", "tk1", true},
+		{"legacy bad", key, "tk1", "tk2", false},
+		{"malformed", key, tokenScheme + "$!!$!!", "tk1", false},
+	}
+
+	for _, data := range table {
+		if got := tokenVerify(data.key, data.stored, data.token, now); got != data.expected {
+			t.Errorf("%s: expected=%t got=%t", data.name, data.expected, got)
+		}
+	}
+}
+
+// go test -v -run TestTokenRotate ./cmd/gateboard
+func TestTokenRotate(t *testing.T) {
+	key := []byte("key1")
+	now := time.Now()
+	grace := time.Hour
+
+	expect := func(label, stored string, when time.Time, accepted, refused []string) {
+		t.Helper()
+		for _, tk := range accepted {
+			if !tokenVerify(key, stored, tk, when) {
+				t.Errorf("%s: token %s should be accepted", label, tk)
+			}
+		}
+		for _, tk := range refused {
+			if tokenVerify(key, stored, tk, when) {
+				t.Errorf("%s: token %s should be refused", label, tk)
+			}
+		}
+	}
+
+	s1, until1 := tokenRotate(key, "", "tk1", grace, now)
+	if !until1.IsZero() {
+		t.Errorf("first token: unexpected grace until %v", until1)
+	}
+	expect("first token", s1, now, []string{"tk1"}, []string{"tk2"})
+
+	s2, until2 := tokenRotate(key, s1, "tk2", grace, now)
+	if !until2.Equal(now.Add(grace)) {
+		t.Errorf("second token: expected grace until %v, got %v", now.Add(grace), until2)
+	}
+	expect("second token within grace", s2, now, []string{"tk1", "tk2"}, nil)
+	expect("second token after grace", s2, now.Add(2*grace), []string{"tk2"}, []string{"tk1"})
+
+	// third rotation after grace drops tk1 for good
+	later := now.Add(2 * grace)
+	s3, _ := tokenRotate(key, s2, "tk3", grace, later)
+	if n := len(tokenParse(s3)); n != 2 {
+		t.Errorf("third token: expected 2 credentials, got %d: %s", n, s3)
+	}
+	expect("third token", s3, later, []string{"tk2", "tk3"}, []string{"tk1"})
+
+	s4, until4 := tokenRotate(key, s3, "tk4", 0, later)
+	if !until4.IsZero() {
+		t.Errorf("zero grace: unexpected grace until %v", until4)
+	}
+	expect("zero grace", s4, later, []string{"tk4"}, []string{"tk2", "tk3"})
+
+	// legacy clear text token is hashed while kept during grace
+	s5, _ := tokenRotate(key, "legacy", "tk5", grace, now)
+	if strings.Contains(s5, "legacy") {
+		t.Errorf("legacy token leaked into stored form: %s", s5)
+	}
+	expect("legacy", s5, now, []string{"legacy", "tk5"}, nil)
+}
+
+func sendAdmin(t *testing.T, app *application, method, path, bearer, body string) (int, gateboard.BodyTokenReply) {
+	req, errReq := http.NewRequest(method, path, strings.NewReader(body))
+	if errReq != nil {
+		t.Fatalf("NewRequest: %v", errReq)
+	}
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	t.Logf("%s %s: status=%d response: %s", method, path, w.Code, w.Body.String())
+	var out gateboard.BodyTokenReply
+	if errJSON := json.Unmarshal(w.Body.Bytes(), &out); errJSON != nil {
+		t.Errorf("%s %s: json error: %v", method, path, errJSON)
+	}
+	return w.Code, out
+}
+
+// go test -v -run TestAdminToken ./cmd/gateboard
+func TestAdminToken(t *testing.T) {
+	app := newTestApp(true)
+
+	const path = "/admin/token/gw1"
+
+	if status, _ := sendAdmin(t, app, "PUT", path, "", `{"token":"tk1"}`); status != 403 {
+		t.Errorf("admin disabled: expected status 403, got %d", status)
+	}
+
+	app.config.adminToken = "admin1"
+
+	if status, _ := sendAdmin(t, app, "PUT", path, "wrong", `{"token":"tk1"}`); status != 401 {
+		t.Errorf("bad admin token: expected status 401, got %d", status)
+	}
+
+	if status, _ := sendAdmin(t, app, "PUT", path, "admin1", `{"grace_period":"-1s"}`); status != 400 {
+		t.Errorf("bad grace: expected status 400, got %d", status)
+	}
+
+	status, out := sendAdmin(t, app, "PUT", path, "admin1", "")
+	if status != 200 || out.Token == "" {
+		t.Fatalf("generate token: status=%d token=%q", status, out.Token)
+	}
+	tk1 := out.Token
+
+	stored, errStored := tokenStored(t.Context(), app, "gw1")
+	if errStored != nil {
+		t.Fatalf("stored token: %v", errStored)
+	}
+	if strings.Contains(stored, tk1) {
+		t.Errorf("clear text token leaked into repository: %s", stored)
+	}
+
+	status, out = sendAdmin(t, app, "PUT", path, "admin1", `{"token":"tk2"}`)
+	if status != 200 || out.Token != "tk2" || out.GraceUntil.IsZero() {
+		t.Errorf("rotate: status=%d token=%q grace_until=%v", status, out.Token, out.GraceUntil)
+	}
+
+	for _, data := range []struct {
+		token   string
+		invalid bool
+	}{
+		{tk1, false},
+		{"tk2", false},
+		{"tk3", true},
+	} {
+		if got := invalidToken(t.Context(), app, "gw1", data.token); got != data.invalid {
+			t.Errorf("after rotate: token %s: expected invalid=%t got=%t", data.token, data.invalid, got)
+		}
+	}
+
+	if status, _ := sendAdmin(t, app, "PUT", path, "admin1", `{"token":"tk3","grace_period":"0s"}`); status != 200 {
+		t.Errorf("rotate without grace: status=%d", status)
+	}
+
+	if !invalidToken(t.Context(), app, "gw1", "tk2") {
+		t.Errorf("rotate without grace: previous token should be invalid")
+	}
+
+	if status, _ := sendAdmin(t, app, "DELETE", path, "admin1", ""); status != 200 {
+		t.Errorf("delete: status=%d", status)
+	}
+
+	if !invalidToken(t.Context(), app, "gw1", "tk3") {
+		t.Errorf("delete: token should be revoked")
+	}
+}
+
+// go test -v -run TestPreloadTokens ./cmd/gateboard
+func TestPreloadTokens(t *testing.T) {
+	app := newTestApp(true)
+
+	// legacy clear text token is rehashed
+	if errPut := repoPutTokenMultiple(t.Context(), app, "gw2", "tk2"); errPut != nil {
+		t.Fatalf("put token: %v", errPut)
+	}
+
+	if errPreload := preloadTokens(t.Context(), app, map[string]string{"gw1": "tk1", "gw2": "tk2"}); errPreload != nil {
+		t.Fatalf("preload: %v", errPreload)
+	}
+
+	stored1, _ := tokenStored(t.Context(), app, "gw1")
+
+	for _, name := range []string{"gw1", "gw2"} {
+		stored, _ := tokenStored(t.Context(), app, name)
+		if tokenLegacy(stored) {
+			t.Errorf("%s: token stored in clear text: %s", name, stored)
+		}
+	}
+
+	if errPreload := preloadTokens(t.Context(), app, map[string]string{"gw1": "tk1"}); errPreload != nil {
+		t.Fatalf("preload again: %v", errPreload)
+	}
+
+	if stored, _ := tokenStored(t.Context(), app, "gw1"); stored != stored1 {
+		t.Errorf("preload should skip token already stored")
+	}
+}
+
+// go test -v -run TestTokenRehash ./cmd/gateboard
+func TestTokenRehash(t *testing.T) {
+	app := newTestApp(true)
+	app.config.tokenHashKey = "key1"
+
+	if errPut := repoPutTokenMultiple(t.Context(), app, "gw1", "tk1"); errPut != nil {
+		t.Fatalf("put token: %v", errPut)
+	}
+
+	// failed check keeps legacy token
+	if !invalidToken(t.Context(), app, "gw1", "tk2") {
+		t.Errorf("wrong token accepted")
+	}
+	if stored, _ := tokenStored(t.Context(), app, "gw1"); stored != "tk1" {
+		t.Errorf("failed check changed stored token: %s", stored)
+	}
+
+	// successful check rehashes legacy token
+	if invalidToken(t.Context(), app, "gw1", "tk1") {
+		t.Errorf("legacy token refused")
+	}
+	stored, _ := tokenStored(t.Context(), app, "gw1")
+	if tokenLegacy(stored) {
+		t.Errorf("token still stored in clear text: %s", stored)
+	}
+	if invalidToken(t.Context(), app, "gw1", "tk1") {
+		t.Errorf("rehashed token refused")
+	}
+}
+
+// go test -v -run TestCheckTokenHashKey ./cmd/gateboard
+func TestCheckTokenHashKey(t *testing.T) {
+	table := []struct {
+		name   string
+		config appConfig
+		valid  bool
+	}{
+		{"tokens unused", appConfig{}, true},
+		{"write token without key", appConfig{writeToken: true}, false},
+		{"tokens file without key", appConfig{tokens: "tokens.yaml"}, false},
+		{"admin token without key", appConfig{adminToken: "admin1"}, false},
+		{"write token with key", appConfig{writeToken: true, tokenHashKey: "key1"}, true},
+	}
+	for _, data := range table {
+		if err := checkTokenHashKey(data.config); (err == nil) != data.valid {
+			t.Errorf("%s: expected valid=%t got error: %v", data.name, data.valid, err)
+		}
+	}
+}
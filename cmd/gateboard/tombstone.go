@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+)
+
+// tombstonePurger periodically removes expired tombstones from all repositories.
+func tombstonePurger(app *application) {
+	const me = "tombstonePurger"
+
+	interval := app.config.tombstonePurgeInterval
+
+	zlog.Infof("%s: interval=%v ttl=%v", me, interval, app.config.tombstoneTTL)
+
+	for {
+		time.Sleep(interval)
+		purgeTombstones(context.TODO(), app)
+	}
+}
+
+// purgeTombstones removes tombstones older than TOMBSTONE_TTL from every repository.
+// Purging is performed independently on each repository because
+// a lagging repository might hold tombstones the others have already removed.
+func purgeTombstones(ctx context.Context, app *application) int {
+	const me = "purgeTombstones"
+
+	repoList := app.repositories().list
+
+	var purged int
+
+	for _, repo := range repoList {
+
+		d, errDump := repo.Dump(ctx, repository.DumpFilter{})
+		if errDump != nil {
+			zlog.CtxErrorf(ctx, "%s: repo=%s dump error: %v",
+				me, repo.RepoName(), errDump)
+			continue
+		}
+
+		for _, i := range d {
+			if !repository.DumpBool(i["deleted"]) {
+				continue // live entry
+			}
+
+			if time.Since(repository.DumpTime(i["last_update"])) < app.config.tombstoneTTL {
+				continue // tombstone not expired yet
+			}
+
+			name, _ := i["gateway_name"].(string)
+
+			errPurge := repo.Purge(ctx, name)
+
+			zlog.CtxDebugf(ctx, app.config.debug || errPurge != nil,
+				"%s: repo=%s gateway_name=%s error:%v",
+				me, repo.RepoName(), name, errPurge)
+
+			if errPurge == nil {
+				purged++
+			}
+		}
+	}
+
+	zlog.CtxInfof(ctx, "%s: purged=%d", me, purged)
+
+	return purged
+}
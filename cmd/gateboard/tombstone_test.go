@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+)
+
+// go test -count=1 -run TestPurgeTombstones ./cmd/gateboard
+func TestPurgeTombstones(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_two_good.yaml")
+
+	for _, gw := range []string{"gw1", "gw2", "gw3"} {
+		if errPut := repoPutMultiple(context.TODO(), app, gw, "id1", "test", repository.AnyChanges); errPut != nil {
+			t.Error(errPut.Error())
+		}
+	}
+
+	if errDelete := repoDeleteMultiple(context.TODO(), app, "gw1", "test"); errDelete != nil {
+		t.Error(errDelete.Error())
+	}
+
+	// delete only from first repo
+	if errDelete := app.repositories().list[0].Delete(context.TODO(), "gw2", "test"); errDelete != nil {
+		t.Error(errDelete.Error())
+	}
+
+	app.config.tombstoneTTL = time.Hour
+
+	if purged := purgeTombstones(context.TODO(), app); purged != 0 {
+		t.Errorf("expected no tombstone purged before TTL, got %d", purged)
+	}
+
+	app.config.tombstoneTTL = 0
+
+	if purged := purgeTombstones(context.TODO(), app); purged != 3 {
+		t.Errorf("expected 3 tombstones purged after TTL, got %d", purged)
+	}
+
+	for i, repo := range app.repositories().list {
+		d, errDump := repo.Dump(context.TODO(), repository.DumpFilter{})
+		if errDump != nil {
+			t.Error(errDump.Error())
+		}
+		for _, item := range d {
+			if repository.DumpBool(item["deleted"]) {
+				t.Errorf("repo %d: unexpected tombstone: %v", i, item)
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/cmd/gateboard/zlog"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// watchHub delivers in-process notifications about changed gateways.
+// Changes performed by other server instances are only notified by
+// repositories with a change feed (see repoWatcher), hence watchers
+// also poll repositories every WATCH_POLL_INTERVAL.
+type watchHub struct {
+	lock sync.Mutex
+	subs map[string]map[chan string]struct{}
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{subs: map[string]map[chan string]struct{}{}}
+}
+
+// watchChannelBuffer absorbs bursts of notifications.
+// When full, further notifications are dropped and the watcher relies on polling.
+const watchChannelBuffer = 16
+
+func (h *watchHub) subscribe(gatewayNames []string) chan string {
+	ch := make(chan string, watchChannelBuffer)
+	h.lock.Lock()
+	for _, name := range gatewayNames {
+		set, found := h.subs[name]
+		if !found {
+			set = map[chan string]struct{}{}
+			h.subs[name] = set
+		}
+		set[ch] = struct{}{}
+	}
+	h.lock.Unlock()
+	return ch
+}
+
+func (h *watchHub) unsubscribe(ch chan string, gatewayNames []string) {
+	h.lock.Lock()
+	for _, name := range gatewayNames {
+		set := h.subs[name]
+		delete(set, ch)
+		if len(set) == 0 {
+			delete(h.subs, name)
+		}
+	}
+	h.lock.Unlock()
+}
+
+func (h *watchHub) notify(gatewayName string) {
+	h.lock.Lock()
+	for ch := range h.subs[gatewayName] {
+		select {
+		case ch <- gatewayName:
+		default:
+		}
+	}
+	h.lock.Unlock()
+}
+
+// gatewayChanged must be called after every successful write to a gateway.
+func gatewayChanged(ctx context.Context, app *application, gatewayName string) {
+	if app.config.groupCache {
+		app.cache.Remove(ctx, gatewayName)
+	}
+	app.watch.notify(gatewayName)
+}
+
+// watchRead queries repositories directly: groupcache keeps no tombstones,
+// and it may serve a stale changes counter after writes from other instances.
+// Missing gateways are reported with zero changes, tombstones are reported as deleted.
+func watchRead(ctx context.Context, app *application, gatewayName string) (gateboard.BodyGetReply, error) {
+	body, _, err := repoGetMultiple(ctx, app, gatewayName)
+	if err == repository.ErrGatewayNotFound {
+		err = nil
+		if !body.Deleted {
+			body = gateboard.BodyGetReply{}
+		}
+	}
+	body.GatewayName = gatewayName
+	body.Token = "" // prevent token leaking
+	body.TTL = app.config.TTL
+	return body, err
+}
+
+// watchTicker returns a nil channel when polling is disabled.
+func watchTicker(app *application) (<-chan time.Time, func()) {
+	if app.config.watchPollInterval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(app.config.watchPollInterval)
+	return ticker.C, ticker.Stop
+}
+
+// gatewayWait implements long-poll GET /gateway/{name}?wait=30s&since=<changes>.
+// It answers as soon as the changes counter differs from since,
+// or 304 Not Modified when the wait expires.
+// If since is omitted, it waits for the next change.
+func gatewayWait(c *gin.Context, app *application, gatewayName string) {
+	const me = "gatewayWait"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	out := gateboard.BodyGetReply{GatewayName: gatewayName, TTL: app.config.TTL}
+
+	fail := func(status int, format string, a ...any) {
+		out.Error = fmt.Sprintf(format, a...)
+		traceError(span, out.Error)
+		zlog.CtxErrorf(ctx, "%s: %s", me, out.Error)
+		c.JSON(status, out)
+	}
+
+	if errVal := validateInputGatewayName(gatewayName); errVal != nil {
+		fail(http.StatusBadRequest, "%v", errVal)
+		return
+	}
+
+	wait, errWait := time.ParseDuration(c.Query("wait"))
+	if errWait != nil || wait < 0 {
+		fail(http.StatusBadRequest, "bad query parameter wait='%s'", c.Query("wait"))
+		return
+	}
+	wait = min(wait, app.config.watchMaxWait)
+
+	// subscribe before reading to not miss a change in between
+	ch := app.watch.subscribe([]string{gatewayName})
+	defer app.watch.unsubscribe(ch, []string{gatewayName})
+
+	var since int64
+
+	if str := c.Query("since"); str != "" {
+		var errSince error
+		since, errSince = strconv.ParseInt(str, 10, 64)
+		if errSince != nil {
+			fail(http.StatusBadRequest, "bad query parameter since='%s': %v", str, errSince)
+			return
+		}
+	} else {
+		body, errRead := watchRead(ctx, app, gatewayName)
+		if errRead != nil {
+			fail(http.StatusInternalServerError, "%v", errRead)
+			return
+		}
+		since = body.Changes
+	}
+
+	zlog.CtxInfof(ctx, "%s: gateway_name=%s wait=%v since=%d", me, gatewayName, wait, since)
+
+	poll, stop := watchTicker(app)
+	defer stop()
+
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for {
+		body, errRead := watchRead(ctx, app, gatewayName)
+		if errRead != nil {
+			fail(http.StatusInternalServerError, "%v", errRead)
+			return
+		}
+
+		if body.Changes != since {
+			c.Header("ETag", strconv.Quote(strconv.FormatInt(body.Changes, 10)))
+			status := http.StatusOK
+			if body.GatewayID == "" {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, body)
+			return
+		}
+
+		select {
+		case <-ch:
+		case <-poll:
+		case <-deadline.C:
+			c.Header("ETag", strconv.Quote(strconv.FormatInt(since, 10)))
+			c.Status(http.StatusNotModified)
+			return
+		case <-c.Request.Context().Done():
+			return // client gone
+		}
+	}
+}
+
+// gatewayWatch implements server-sent events GET /watch?names=gw1,gw2.
+// Every gateway is sent on connect, then again whenever its changes counter moves.
+func gatewayWatch(c *gin.Context, app *application) {
+	const me = "gatewayWatch"
+
+	ctx, span := newSpanGin(c, me, app.tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	grant := authGrantFrom(c)
+
+	var names []string
+	seen := map[string]bool{}
+	for _, name := range strings.Split(c.Query("names"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		if errVal := validateInputGatewayName(name); errVal != nil {
+			c.JSON(http.StatusBadRequest, gateboard.BodyGetReply{GatewayName: name, Error: errVal.Error()})
+			return
+		}
+		if !grant.allowed(name, false) {
+			c.JSON(http.StatusForbidden, gateboard.BodyGetReply{GatewayName: name, Error: "forbidden"})
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+
+	if errSize := batchSizeError(app, len(names)); errSize != nil {
+		msg := fmt.Sprintf("%s: names: %v", me, errSize)
+		traceError(span, msg)
+		zlog.CtxErrorf(ctx, "%s", msg)
+		c.JSON(http.StatusBadRequest, gateboard.BodyGetReply{Error: msg})
+		return
+	}
+
+	zlog.CtxInfof(ctx, "%s: names=%v", me, names)
+
+	ch := app.watch.subscribe(names)
+	defer app.watch.unsubscribe(ch, names)
+
+	last := map[string]int64{}
+
+	// send reports whether an event was written
+	send := func(name string) bool {
+		body, errRead := watchRead(ctx, app, name)
+		if errRead != nil {
+			zlog.CtxErrorf(ctx, "%s: gateway_name=%s: %v", me, name, errRead)
+			return false
+		}
+		if changes, found := last[name]; found && changes == body.Changes {
+			return false
+		}
+		last[name] = body.Changes
+		c.SSEvent("gateway", body)
+		return true
+	}
+
+	c.Header("Cache-Control", "no-cache")
+
+	for _, name := range names {
+		send(name)
+	}
+	c.Writer.Flush()
+
+	poll, stop := watchTicker(app)
+	defer stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case name := <-ch:
+			send(name)
+		case <-poll:
+			var sent bool
+			for _, name := range names {
+				sent = send(name) || sent
+			}
+			if !sent {
+				fmt.Fprint(w, ": keepalive\n\n") // keep proxies from closing idle stream
+			}
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// go test -v -run TestWatchHub ./cmd/gateboard
+func TestWatchHub(t *testing.T) {
+	h := newWatchHub()
+
+	ch := h.subscribe([]string{"gw1", "gw2"})
+
+	h.notify("gw3") // not subscribed
+	h.notify("gw2")
+
+	select {
+	case name := <-ch:
+		if name != "gw2" {
+			t.Errorf("unexpected notification: %s", name)
+		}
+	default:
+		t.Errorf("missing notification")
+	}
+
+	h.unsubscribe(ch, []string{"gw1", "gw2"})
+
+	h.notify("gw1")
+
+	select {
+	case name := <-ch:
+		t.Errorf("unexpected notification after unsubscribe: %s", name)
+	default:
+	}
+
+	if len(h.subs) != 0 {
+		t.Errorf("leaked subscriptions: %v", h.subs)
+	}
+}
+
+func sendRequest(app *application, method, path, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	app.serverMain.router.ServeHTTP(w, req)
+	return w
+}
+
+// go test -v -run TestGatewayWait ./cmd/gateboard
+func TestGatewayWait(t *testing.T) {
+	app := newTestApp(false)
+	app.config.watchPollInterval = 0 // rely on notifications only
+
+	if w := sendRequest(app, "PUT", "/gateway/gw1", `{"gateway_id":"id1"}`); w.Code != 200 {
+		t.Fatalf("PUT: status=%d", w.Code)
+	}
+
+	table := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedID     string
+	}{
+		{"changed already", "/gateway/gw1?wait=1s&since=0", 200, "id1"},
+		{"unchanged", "/gateway/gw1?wait=50ms&since=1", 304, ""},
+		{"next change unchanged", "/gateway/gw1?wait=50ms", 304, ""},
+		{"missing gateway", "/gateway/gw2?wait=50ms&since=0", 304, ""},
+		{"bad wait", "/gateway/gw1?wait=x", 400, ""},
+		{"bad since", "/gateway/gw1?wait=1s&since=x", 400, ""},
+	}
+
+	for _, data := range table {
+		w := sendRequest(app, "GET", data.path, "")
+		if w.Code != data.expectedStatus {
+			t.Errorf("%s: status=%d expected=%d", data.name, w.Code, data.expectedStatus)
+		}
+		if data.expectedID != "" {
+			var body gateboard.BodyGetReply
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body.GatewayID != data.expectedID {
+				t.Errorf("%s: id=%s expected=%s", data.name, body.GatewayID, data.expectedID)
+			}
+		}
+	}
+
+	// change gateway while waiting
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sendRequest(app, "PUT", "/gateway/gw1", `{"gateway_id":"id2"}`)
+	}()
+
+	begin := time.Now()
+	w := sendRequest(app, "GET", "/gateway/gw1?wait=5s&since=1", "")
+	elap := time.Since(begin)
+
+	if w.Code != 200 {
+		t.Errorf("wait change: status=%d", w.Code)
+	}
+	if etag := w.Header().Get("ETag"); etag != `"2"` {
+		t.Errorf("wait change: ETag=%s", etag)
+	}
+	if elap > 3*time.Second {
+		t.Errorf("wait change: took too long: %v", elap)
+	}
+
+	// delete is a change too
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sendRequest(app, "DELETE", "/gateway/gw1", "")
+	}()
+
+	if w := sendRequest(app, "GET", "/gateway/gw1?wait=5s&since=2", ""); w.Code != 404 {
+		t.Errorf("wait delete: status=%d", w.Code)
+	}
+}
+
+// go test -v -run TestGatewayWatch ./cmd/gateboard
+func TestGatewayWatch(t *testing.T) {
+	app := newTestApp(false)
+	app.config.watchPollInterval = 0 // rely on notifications only
+
+	sendRequest(app, "PUT", "/gateway/gw1", `{"gateway_id":"id1"}`)
+
+	server := httptest.NewServer(app.serverMain.router)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/watch?names=gw1,gw2", nil)
+	resp, errGet := http.DefaultClient.Do(req)
+	if errGet != nil {
+		t.Fatalf("watch: %v", errGet)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		t.Errorf("watch: unexpected content-type: %s", ct)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	next := func() gateboard.BodyGetReply {
+		var body gateboard.BodyGetReply
+		for scanner.Scan() {
+			line := scanner.Text()
+			if data, found := strings.CutPrefix(line, "data:"); found {
+				if errJSON := json.Unmarshal([]byte(data), &body); errJSON != nil {
+					t.Errorf("watch: json: %v: %s", errJSON, data)
+				}
+				return body
+			}
+		}
+		t.Fatalf("watch: stream ended: %v", scanner.Err())
+		return body
+	}
+
+	initial := map[string]string{}
+	for range 2 {
+		body := next()
+		initial[body.GatewayName] = body.GatewayID
+	}
+	if initial["gw1"] != "id1" || initial["gw2"] != "" {
+		t.Errorf("watch: unexpected initial events: %v", initial)
+	}
+
+	sendRequest(app, "PUT", "/gateway/gw2", `{"gateway_id":"id2"}`)
+
+	if body := next(); body.GatewayName != "gw2" || body.GatewayID != "id2" || body.Changes != 1 {
+		t.Errorf("watch: unexpected event: %v", body)
+	}
+
+	sendRequest(app, "DELETE", "/gateway/gw1", "")
+
+	if body := next(); body.GatewayName != "gw1" || body.GatewayID != "" || !body.Deleted {
+		t.Errorf("watch: unexpected event: %v", body)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Write policies decide how many repositories must accept a PUT.
+const (
+	writePolicyAny    = "any"    // at least one repository
+	writePolicyAll    = "all"    // every repository
+	writePolicyQuorum = "quorum" // a majority of repositories
+	writePolicyMin    = "min:"   // at least N repositories, as in min:2
+)
+
+type writePolicy struct {
+	name string
+	n    int // for min:N
+}
+
+func parseWritePolicy(s string) (writePolicy, error) {
+	switch s {
+	case writePolicyAny, writePolicyAll, writePolicyQuorum:
+		return writePolicy{name: s}, nil
+	}
+	if n, found := strings.CutPrefix(s, writePolicyMin); found {
+		count, errConv := strconv.Atoi(n)
+		if errConv != nil || count < 1 {
+			return writePolicy{}, fmt.Errorf("bad write policy '%s': N must be a positive integer", s)
+		}
+		return writePolicy{name: s, n: count}, nil
+	}
+	return writePolicy{}, fmt.Errorf("bad write policy '%s', valid values: %s, %s, %s, %sN",
+		s, writePolicyAny, writePolicyAll, writePolicyQuorum, writePolicyMin)
+}
+
+// check rejects min:N with N above total, which could never be satisfied.
+func (p writePolicy) check(total int) error {
+	if p.n > total {
+		return fmt.Errorf("write policy %s: requires %d repositories, only %d configured", p, p.n, total)
+	}
+	return nil
+}
+
+// required returns how many of total repositories must accept the write.
+func (p writePolicy) required(total int) int {
+	switch p.name {
+	case writePolicyAll:
+		return total
+	case writePolicyQuorum:
+		return total/2 + 1
+	case "", writePolicyAny:
+		return 1
+	}
+	return p.n
+}
+
+func (p writePolicy) String() string {
+	if p.name == "" {
+		return writePolicyAny
+	}
+	return p.name
+}
+
+// errWritePolicy reports a write accepted by fewer repositories than required.
+type errWritePolicy struct {
+	policy   writePolicy
+	accepted int
+	required int
+	total    int
+	last     error
+}
+
+func (e errWritePolicy) Error() string {
+	return fmt.Sprintf("write policy %s: accepted by %d/%d repositories, required %d: last error: %v",
+		e.policy, e.accepted, e.total, e.required, e.last)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/udhos/gateboard/cmd/gateboard/repository"
+	"github.com/udhos/gateboard/gateboard"
+)
+
+// go test -v -run TestParseWritePolicy ./cmd/gateboard
+func TestParseWritePolicy(t *testing.T) {
+	table := []struct {
+		policy   string
+		errorExp bool
+		required int // out of 3
+	}{
+		{"any", false, 1},
+		{"all", false, 3},
+		{"quorum", false, 2},
+		{"min:2", false, 2},
+		{"min:5", false, 5},
+		{"min:0", true, 0},
+		{"min:x", true, 0},
+		{"most", true, 0},
+		{"", true, 0},
+	}
+
+	for _, data := range table {
+		p, err := parseWritePolicy(data.policy)
+		if data.errorExp != (err != nil) {
+			t.Errorf("%q: expected error=%t got: %v", data.policy, data.errorExp, err)
+			continue
+		}
+		if err == nil && p.required(3) != data.required {
+			t.Errorf("%q: expected required=%d got %d", data.policy, data.required, p.required(3))
+		}
+		if err == nil && (p.check(3) != nil) != (data.required > 3) {
+			t.Errorf("%q: unexpected check result for 3 repositories: %v", data.policy, p.check(3))
+		}
+	}
+}
+
+// go test -v -run TestWritePolicy ./cmd/gateboard
+func TestWritePolicy(t *testing.T) {
+	table := []struct {
+		repo     string
+		policy   string
+		status   int
+		accepted []string
+	}{
+		{"testdata/repo_mem_two_good.yaml", "any", 200, []string{"mem:mem1", "mem:mem2"}},
+		{"testdata/repo_mem_two_good.yaml", "all", 200, []string{"mem:mem1", "mem:mem2"}},
+		{"testdata/repo_mem_two_good.yaml", "min:3", 503, []string{"mem:mem1", "mem:mem2"}},
+		{"testdata/repo_mem_two_goodnbad.yaml", "any", 200, []string{"mem:mem1"}},
+		{"testdata/repo_mem_two_goodnbad.yaml", "quorum", 503, []string{"mem:mem1"}},
+		{"testdata/repo_mem_two_goodnbad.yaml", "all", 503, []string{"mem:mem1"}},
+		{"testdata/repo_mem_two_goodnbad.yaml", "min:1", 200, []string{"mem:mem1"}},
+		{"testdata/repo_mem_two_bad.yaml", "any", 500, nil},
+	}
+
+	for _, data := range table {
+		app := newTestAppMultirepo(data.repo)
+		policy, errPolicy := parseWritePolicy(data.policy)
+		if errPolicy != nil {
+			t.Fatalf("policy: %v", errPolicy)
+		}
+		app.writePolicy = policy
+
+		req, _ := http.NewRequest("PUT", "/gateway/gw1", strings.NewReader(`{"gateway_id":"id1"}`))
+		w := httptest.NewRecorder()
+		app.serverMain.router.ServeHTTP(w, req)
+
+		if w.Code != data.status {
+			t.Errorf("%s policy=%s: expected status=%d got=%d: %s",
+				data.repo, data.policy, data.status, w.Code, w.Body.String())
+		}
+
+		var out gateboard.BodyPutReply
+		if errJSON := json.Unmarshal(w.Body.Bytes(), &out); errJSON != nil {
+			t.Errorf("%s policy=%s: json: %v", data.repo, data.policy, errJSON)
+			continue
+		}
+		if strings.Join(out.Accepted, ",") != strings.Join(data.accepted, ",") {
+			t.Errorf("%s policy=%s: expected accepted=%v got=%v",
+				data.repo, data.policy, data.accepted, out.Accepted)
+		}
+
+		// rollback and delete honor the policy as well
+
+		for _, send := range []struct {
+			method string
+			path   string
+		}{
+			{"POST", "/gateway/gw1/rollback?to=1"},
+			{"DELETE", "/gateway/gw1"},
+		} {
+			req, _ := http.NewRequest(send.method, send.path, strings.NewReader(""))
+			w := httptest.NewRecorder()
+			app.serverMain.router.ServeHTTP(w, req)
+
+			if w.Code != data.status {
+				t.Errorf("%s policy=%s: %s %s: expected status=%d got=%d: %s",
+					data.repo, data.policy, send.method, send.path, data.status, w.Code, w.Body.String())
+			}
+		}
+	}
+}
+
+// go test -v -run TestWritePolicyConcurrent ./cmd/gateboard
+func TestWritePolicyConcurrent(t *testing.T) {
+	app := newTestAppMultirepo("testdata/repo_mem_good3.yaml") // delays 300ms+200ms+400ms
+
+	begin := time.Now()
+	if err := repoPutMultiple(context.TODO(), app, "gw1", "id1", "test", repository.AnyChanges); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if elap := time.Since(begin); elap >= 900*time.Millisecond {
+		t.Errorf("expected concurrent writes to take about the slowest repository, took %v", elap)
+	}
+
+	begin = time.Now()
+	if err := repoDeleteMultiple(context.TODO(), app, "gw1", "test"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if elap := time.Since(begin); elap >= 900*time.Millisecond {
+		t.Errorf("expected concurrent deletes to take about the slowest repository, took %v", elap)
+	}
+}
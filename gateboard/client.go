@@ -20,18 +20,21 @@
 package gateboard
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/singleflight"
 
@@ -46,6 +49,7 @@ type Client struct {
 	TTL         time.Duration
 	flightGroup singleflight.Group
 	random      *rand.Rand
+	httpClient  *http.Client
 }
 
 const (
@@ -57,6 +61,9 @@ const (
 
 	// CacheTTLDefault defines default value for TTL.
 	CacheTTLDefault = 5 * time.Minute
+
+	// WatchRetryDefault defines default interval for Watch to reconnect to server.
+	WatchRetryDefault = 5 * time.Second
 )
 
 type gatewayEntry struct {
@@ -66,12 +73,16 @@ type gatewayEntry struct {
 
 // ClientOptions defines options for the client.
 type ClientOptions struct {
-	ServerURL  string        // required main centralized server
-	TTLMin     time.Duration // optional, if unspecified defaults to CacheTTLMinimum
-	TTLMax     time.Duration // optional, if unspecified defaults to CacheTTLMax
-	TTLDefault time.Duration // optional, if unspecified defaults to CacheTTLDefault
-	Debug      bool          // optional, log debug information
-	Tracer     trace.Tracer
+	ServerURL   string        // required main centralized server
+	BatchGetURL string        // optional, if unspecified defaults to ServerURL with suffix /gateway replaced by /gateways:batchGet
+	WatchURL    string        // optional, if unspecified defaults to ServerURL with suffix /gateway replaced by /watch
+	WatchRetry  time.Duration // optional, if unspecified defaults to WatchRetryDefault
+	TTLMin      time.Duration // optional, if unspecified defaults to CacheTTLMinimum
+	TTLMax      time.Duration // optional, if unspecified defaults to CacheTTLMax
+	TTLDefault  time.Duration // optional, if unspecified defaults to CacheTTLDefault
+	Debug       bool          // optional, log debug information
+	Tracer      trace.Tracer
+	TLSConfig   *tls.Config // optional, for custom CA or client certificate, see TLSClientConfig
 }
 
 // NewClient creates a new gateboard client.
@@ -85,11 +96,15 @@ func NewClient(options ClientOptions) *Client {
 	if options.TTLDefault == 0 {
 		options.TTLDefault = CacheTTLDefault
 	}
+	if options.WatchRetry == 0 {
+		options.WatchRetry = WatchRetryDefault
+	}
 	return &Client{
-		options: options,
-		cache:   map[string]gatewayEntry{},
-		TTL:     options.TTLDefault,
-		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		options:    options,
+		cache:      map[string]gatewayEntry{},
+		TTL:        options.TTLDefault,
+		random:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		httpClient: newHTTPClient(options.TLSConfig),
 	}
 }
 
@@ -121,13 +136,14 @@ func (c *Client) getTTL() time.Duration {
 
 // BodyGetReply defines the payload format for a GET request.
 type BodyGetReply struct {
-	GatewayName string    `json:"gateway_name"    yaml:"gateway_name"    bson:"gateway_name"    dynamodbav:"gateway_name"`
-	GatewayID   string    `json:"gateway_id"      yaml:"gateway_id"      bson:"gateway_id"      dynamodbav:"gateway_id"`
-	Changes     int64     `json:"changes"         yaml:"changes"         bson:"changes"         dynamodbav:"changes"`
-	LastUpdate  time.Time `json:"last_update"     yaml:"last_update"     bson:"last_update"     dynamodbav:"last_update"`
-	Error       string    `json:"error,omitempty" yaml:"error,omitempty" bson:"error,omitempty" dynamodbav:"error,omitempty"`
-	TTL         int       `json:"TTL,omitempty"   yaml:"TTL,omitempty"   bson:"TTL,omitempty"   dynamodbav:"TTL,omitempty"`
-	Token       string    `json:"token,omitempty" yaml:"token,omitempty" bson:"token,omitempty" dynamodbav:"token,omitempty"`
+	GatewayName string    `json:"gateway_name"      yaml:"gateway_name"      bson:"gateway_name"      dynamodbav:"gateway_name"`
+	GatewayID   string    `json:"gateway_id"        yaml:"gateway_id"        bson:"gateway_id"        dynamodbav:"gateway_id"`
+	Changes     int64     `json:"changes"           yaml:"changes"           bson:"changes"           dynamodbav:"changes"`
+	LastUpdate  time.Time `json:"last_update"       yaml:"last_update"       bson:"last_update"       dynamodbav:"last_update"`
+	Error       string    `json:"error,omitempty"   yaml:"error,omitempty"   bson:"error,omitempty"   dynamodbav:"error,omitempty"`
+	TTL         int       `json:"TTL,omitempty"     yaml:"TTL,omitempty"     bson:"TTL,omitempty"     dynamodbav:"TTL,omitempty"`
+	Token       string    `json:"token,omitempty"   yaml:"token,omitempty"   bson:"token,omitempty"   dynamodbav:"token,omitempty"`
+	Deleted     bool      `json:"deleted,omitempty" yaml:"deleted,omitempty" bson:"deleted,omitempty" dynamodbav:"deleted,omitempty"`
 }
 
 func (c *Client) cacheGet(gatewayName string) (gatewayEntry, bool) {
@@ -144,6 +160,12 @@ func (c *Client) cachePut(gatewayName, gatewayID string) {
 	c.lock.Unlock()
 }
 
+func (c *Client) cacheDelete(gatewayName string) {
+	c.lock.Lock()
+	delete(c.cache, gatewayName)
+	c.lock.Unlock()
+}
+
 // GatewayID retrieves the gateway ID for a 'gatewayName' from local fast cache.
 // If the ID is not found in the local fast cache, it will use 'singleflight' to fetch up-to-date data.
 func (c *Client) GatewayID(ctx context.Context, gatewayName string) string {
@@ -182,6 +204,76 @@ func (c *Client) GatewayID(ctx context.Context, gatewayName string) string {
 	return id
 }
 
+// GatewayIDs retrieves gateway IDs for many gateway names at once, as GatewayID does for a single one.
+// Names missing from the local fast cache are fetched from server in a single batchGet request,
+// then the local fast cache is filled with the results.
+// The returned map holds one key for every requested name; IDs not found are blank.
+func (c *Client) GatewayIDs(ctx context.Context, gatewayNames []string) map[string]string {
+	const me = "gateboard.Client.GatewayIDs"
+
+	ctxNew, span := newSpan(ctx, me, c.options.Tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	begin := time.Now()
+
+	lists := map[string]string{}
+	var missing []string
+
+	TTL := c.getTTL()
+
+	for _, name := range gatewayNames {
+		if _, seen := lists[name]; seen {
+			continue
+		}
+		lists[name] = ""
+		if entry, found := c.cacheGet(name); found && time.Since(entry.creation) < TTL {
+			lists[name] = entry.gatewayID
+			continue
+		}
+		missing = append(missing, name)
+	}
+
+	if len(missing) > 0 {
+		found, serverTTL, errBatch := c.queryServerBatch(ctxNew, missing)
+		if errBatch != nil {
+			// older servers lack batchGet, fall back to one query per name
+			log.Printf("%s: batch error, falling back to single queries: %v", me, errBatch)
+			for _, name := range missing {
+				lists[name], _ = c.getID(ctxNew, name)
+			}
+		} else {
+			c.updateTTL(serverTTL)
+			for name, list := range found {
+				c.cachePut(name, list)
+				lists[name] = list
+			}
+		}
+	}
+
+	result := make(map[string]string, len(lists))
+
+	for name, list := range lists {
+		if list == "" {
+			result[name] = ""
+			continue
+		}
+		id, errPick := c.pickOne(name, list)
+		if errPick != nil {
+			log.Printf("%s: name=%s id=%s error: %v", me, name, id, errPick)
+		}
+		result[name] = id
+	}
+
+	if c.options.Debug {
+		log.Printf("%s: names=%d missing=%d elapsed:%v",
+			me, len(lists), len(missing), time.Since(begin))
+	}
+
+	return result
+}
+
 func (c *Client) getID(ctx context.Context, gatewayName string) (string, bool) {
 	const me = "gateboard.Client.getID"
 
@@ -356,7 +448,7 @@ func (c *Client) queryServer(ctx context.Context, URL, gatewayName string) (stri
 		return "", 0, err
 	}
 
-	client := http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	client := c.httpClient
 
 	resp, errGet := client.Do(req)
 	if errGet != nil {
@@ -384,6 +476,200 @@ func (c *Client) queryServer(ctx context.Context, URL, gatewayName string) (stri
 	return reply.GatewayID, reply.TTL, nil
 }
 
+// batchGetURL finds the batchGet endpoint from the options.
+func (c *Client) batchGetURL() (string, error) {
+	if c.options.BatchGetURL != "" {
+		return c.options.BatchGetURL, nil
+	}
+	return serverSiblingURL(c.options.ServerURL, "/gateways:batchGet")
+}
+
+// watchURL finds the watch endpoint from the options.
+func (c *Client) watchURL() (string, error) {
+	if c.options.WatchURL != "" {
+		return c.options.WatchURL, nil
+	}
+	return serverSiblingURL(c.options.ServerURL, "/watch")
+}
+
+// serverSiblingURL replaces suffix /gateway in serverURL with path.
+func serverSiblingURL(serverURL, path string) (string, error) {
+	u, errParse := url.Parse(serverURL)
+	if errParse != nil {
+		return "", errParse
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/gateway") + path
+	return u.String(), nil
+}
+
+// Watch subscribes to server-sent events for gatewayNames, updating the local fast cache
+// as soon as the server reports changes, instead of waiting for cache TTL expiration.
+// Watch blocks until ctx is canceled, reconnecting to server after failures,
+// hence it should be invoked in its own goroutine.
+func (c *Client) Watch(ctx context.Context, gatewayNames []string) {
+	const me = "gateboard.Client.Watch"
+
+	for {
+		err := c.watchOnce(ctx, gatewayNames)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("%s: reconnecting in %v: %v", me, c.options.WatchRetry, err)
+
+		select {
+		case <-time.After(c.options.WatchRetry):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchOnce consumes the event stream until it breaks.
+func (c *Client) watchOnce(ctx context.Context, gatewayNames []string) error {
+	const me = "gateboard.Client.watchOnce"
+
+	path, errPath := c.watchURL()
+	if errPath != nil {
+		return fmt.Errorf("%s: URL=%s error: %v", me, c.options.ServerURL, errPath)
+	}
+
+	u, errParse := url.Parse(path)
+	if errParse != nil {
+		return fmt.Errorf("%s: URL=%s parse error: %v", me, path, errParse)
+	}
+	query := u.Query()
+	query.Set("names", strings.Join(gatewayNames, ","))
+	u.RawQuery = query.Encode()
+
+	req, errReq := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if errReq != nil {
+		return fmt.Errorf("%s: URL=%s request error: %v", me, u, errReq)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	client := c.httpClient
+
+	resp, errGet := client.Do(req)
+	if errGet != nil {
+		return fmt.Errorf("%s: URL=%s server error: %v", me, u, errGet)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: URL=%s bad status: %d", me, u, resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	var data []string
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line != "" {
+			if d, found := strings.CutPrefix(line, "data:"); found {
+				data = append(data, d)
+			}
+			continue // event, id and comment lines are ignored
+		}
+
+		// blank line dispatches the event
+
+		if len(data) == 0 {
+			continue
+		}
+
+		var body BodyGetReply
+		errJSON := json.Unmarshal([]byte(strings.Join(data, "\n")), &body)
+		data = data[:0]
+		if errJSON != nil {
+			log.Printf("%s: URL=%s json error: %v", me, u, errJSON)
+			continue
+		}
+
+		c.watchApply(body)
+	}
+
+	return fmt.Errorf("%s: URL=%s stream closed: %v", me, u, scanner.Err())
+}
+
+// watchApply updates the local fast cache from one watch event.
+func (c *Client) watchApply(body BodyGetReply) {
+	if c.options.Debug {
+		log.Printf("watchApply: gateway: %v", toJSON(body))
+	}
+
+	c.updateTTL(body.TTL)
+
+	if body.GatewayID == "" || body.Deleted {
+		c.cacheDelete(body.GatewayName)
+		return
+	}
+
+	c.cachePut(body.GatewayName, body.GatewayID)
+}
+
+// queryServerBatch returns the ID list for every gateway found by server.
+func (c *Client) queryServerBatch(ctx context.Context, gatewayNames []string) (map[string]string, int, error) {
+	const me = "gateboard.Client.queryServerBatch"
+
+	ctxNew, span := newSpan(ctx, me, c.options.Tracer)
+	if span != nil {
+		defer span.End()
+	}
+
+	path, errPath := c.batchGetURL()
+	if errPath != nil {
+		return nil, 0, fmt.Errorf("%s: URL=%s error: %v", me, c.options.ServerURL, errPath)
+	}
+
+	buf, errJSON := json.Marshal(BodyBatchGetRequest{GatewayNames: gatewayNames})
+	if errJSON != nil {
+		return nil, 0, fmt.Errorf("%s: URL=%s json error: %v", me, path, errJSON)
+	}
+
+	req, errReq := http.NewRequestWithContext(ctxNew, "POST", path, bytes.NewBuffer(buf))
+	if errReq != nil {
+		return nil, 0, fmt.Errorf("%s: URL=%s request error: %v", me, path, errReq)
+	}
+
+	client := c.httpClient
+
+	resp, errPost := client.Do(req)
+	if errPost != nil {
+		return nil, 0, fmt.Errorf("%s: URL=%s server error: %v", me, path, errPost)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("%s: URL=%s bad status: %d", me, path, resp.StatusCode)
+	}
+
+	var reply BodyBatchGetReply
+
+	dec := yaml.NewDecoder(resp.Body)
+	if errYaml := dec.Decode(&reply); errYaml != nil {
+		return nil, 0, fmt.Errorf("%s: URL=%s yaml error: %v", me, path, errYaml)
+	}
+
+	if c.options.Debug {
+		log.Printf("%s: URL=%s gateways: %v", me, path, toJSON(reply))
+	}
+
+	found := map[string]string{}
+
+	for _, item := range reply.Gateways {
+		if item.Status == http.StatusOK && item.GatewayID != "" {
+			found[item.GatewayName] = item.GatewayID
+		}
+	}
+
+	return found, reply.TTL, nil
+}
+
 func toJSON(v interface{}) string {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -393,14 +679,121 @@ func toJSON(v interface{}) string {
 }
 
 // BodyPutRequest defines the payload format for a PUT request.
+// ExpectedChanges, when set, requests a compare-and-swap: the server
+// only saves GatewayID if the current changes counter matches it,
+// otherwise it answers 409 Conflict. Use 0 to create a new gateway only.
 type BodyPutRequest struct {
-	GatewayID string `json:"gateway_id"      yaml:"gateway_id"`
-	Token     string `json:"token,omitempty" yaml:"token,omitempty"`
+	GatewayID       string `json:"gateway_id"                 yaml:"gateway_id"`
+	Token           string `json:"token,omitempty"            yaml:"token,omitempty"`
+	ExpectedChanges *int64 `json:"expected_changes,omitempty" yaml:"expected_changes,omitempty"`
 }
 
 // BodyPutReply defines the payload format for a PUT response.
 type BodyPutReply struct {
+	GatewayName string   `json:"gateway_name"       yaml:"gateway_name"`
+	GatewayID   string   `json:"gateway_id"         yaml:"gateway_id"`
+	Accepted    []string `json:"accepted,omitempty" yaml:"accepted,omitempty"` // repositories that accepted the write
+	Error       string   `json:"error,omitempty"    yaml:"error,omitempty"`
+}
+
+// BodyDeleteRequest defines the optional payload format for a DELETE request.
+type BodyDeleteRequest struct {
+	Token string `json:"token,omitempty" yaml:"token,omitempty"`
+}
+
+// BodyDeleteReply defines the payload format for a DELETE response.
+type BodyDeleteReply struct {
+	GatewayName string `json:"gateway_name"    yaml:"gateway_name"`
+	Error       string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// HistoryEntry defines one recorded change for a gateway.
+type HistoryEntry struct {
+	GatewayID string    `json:"gateway_id"        yaml:"gateway_id"        bson:"gateway_id"        dynamodbav:"gateway_id"`
+	Changes   int64     `json:"changes"           yaml:"changes"           bson:"changes"           dynamodbav:"changes"`
+	Timestamp time.Time `json:"timestamp"         yaml:"timestamp"         bson:"timestamp"         dynamodbav:"timestamp"`
+	Source    string    `json:"source"            yaml:"source"            bson:"source"            dynamodbav:"source"`
+	Deleted   bool      `json:"deleted,omitempty" yaml:"deleted,omitempty" bson:"deleted,omitempty" dynamodbav:"deleted,omitempty"`
+}
+
+// BodyHistoryReply defines the payload format for a GET history request.
+type BodyHistoryReply struct {
+	GatewayName string         `json:"gateway_name"    yaml:"gateway_name"`
+	History     []HistoryEntry `json:"history"         yaml:"history"`
+	Error       string         `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// BodyRollbackRequest defines the optional payload format for a POST rollback request.
+type BodyRollbackRequest struct {
+	Token string `json:"token,omitempty" yaml:"token,omitempty"`
+}
+
+// BodyBatchGetRequest defines the payload format for a POST batchGet request.
+type BodyBatchGetRequest struct {
+	GatewayNames []string `json:"gateway_names" yaml:"gateway_names"`
+}
+
+// BatchGetItem defines the result for one gateway in a batchGet response.
+// Status holds the HTTP status code a single GET would have answered.
+type BatchGetItem struct {
+	GatewayName string `json:"gateway_name"    yaml:"gateway_name"`
+	GatewayID   string `json:"gateway_id"      yaml:"gateway_id"`
+	Changes     int64  `json:"changes"         yaml:"changes"`
+	Status      int    `json:"status"          yaml:"status"`
+	Error       string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// BodyBatchGetReply defines the payload format for a POST batchGet response.
+// Gateways is ordered as the request GatewayNames.
+type BodyBatchGetReply struct {
+	Gateways []BatchGetItem `json:"gateways"        yaml:"gateways"`
+	TTL      int            `json:"TTL,omitempty"   yaml:"TTL,omitempty"`
+	Error    string         `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// BatchPutItem defines one gateway to save in a batchPut request.
+type BatchPutItem struct {
+	GatewayName     string `json:"gateway_name"               yaml:"gateway_name"`
+	GatewayID       string `json:"gateway_id"                 yaml:"gateway_id"`
+	Token           string `json:"token,omitempty"            yaml:"token,omitempty"`
+	ExpectedChanges *int64 `json:"expected_changes,omitempty" yaml:"expected_changes,omitempty"`
+}
+
+// BodyBatchPutRequest defines the payload format for a POST batchPut request.
+type BodyBatchPutRequest struct {
+	Gateways []BatchPutItem `json:"gateways" yaml:"gateways"`
+}
+
+// BatchPutResult defines the result for one gateway in a batchPut response.
+// Status holds the HTTP status code a single PUT would have answered.
+type BatchPutResult struct {
 	GatewayName string `json:"gateway_name"    yaml:"gateway_name"`
 	GatewayID   string `json:"gateway_id"      yaml:"gateway_id"`
+	Status      int    `json:"status"          yaml:"status"`
 	Error       string `json:"error,omitempty" yaml:"error,omitempty"`
 }
+
+// BodyBatchPutReply defines the payload format for a POST batchPut response.
+// Gateways is ordered as the request Gateways.
+type BodyBatchPutReply struct {
+	Gateways []BatchPutResult `json:"gateways"        yaml:"gateways"`
+	Error    string           `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// BodyTokenPutRequest defines the optional payload format for a PUT /admin/token request.
+// A blank Token asks the server to generate a random token.
+// GracePeriod is how long the previous token is still accepted, like "1h".
+// When omitted, the server default TOKEN_ROTATION_GRACE applies.
+type BodyTokenPutRequest struct {
+	Token       string `json:"token,omitempty"        yaml:"token,omitempty"`
+	GracePeriod string `json:"grace_period,omitempty" yaml:"grace_period,omitempty"`
+}
+
+// BodyTokenReply defines the payload format for a PUT or DELETE /admin/token response.
+// Token is only reported back by PUT, since the server keeps just a hash of it.
+type BodyTokenReply struct {
+	GatewayName string    `json:"gateway_name"         yaml:"gateway_name"`
+	Token       string    `json:"token,omitempty"      yaml:"token,omitempty"`
+	GraceUntil  time.Time `json:"grace_until,omitzero" yaml:"grace_until,omitempty"`
+	Error       string    `json:"error,omitempty"      yaml:"error,omitempty"`
+}
@@ -3,10 +3,13 @@ package gateboard
 import (
 	"context"
 	"encoding/json"
+	"encoding/pem"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -140,3 +143,247 @@ func TestClient(t *testing.T) {
 	t.Logf("sleeping for %v", sleep)
 	time.Sleep(sleep)
 }
+
+// go test -v -run TestClientGatewayIDs ./gateboard
+func TestClientGatewayIDs(t *testing.T) {
+
+	dbMain := map[string]string{"gateway1": "id1", "gateway2": "id2"}
+
+	var batchRequests, singleRequests int
+
+	main := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("main server: %s %s", r.Method, r.URL)
+
+		if r.Method == "POST" && r.URL.Path == "/gateways:batchGet" {
+			batchRequests++
+			var in BodyBatchGetRequest
+			if errJSON := json.NewDecoder(r.Body).Decode(&in); errJSON != nil {
+				jsonWrite(w, 400, BodyBatchGetReply{Error: errJSON.Error()})
+				return
+			}
+			out := BodyBatchGetReply{TTL: 10}
+			for _, name := range in.GatewayNames {
+				item := BatchGetItem{GatewayName: name, Status: 404}
+				if id, found := dbMain[name]; found {
+					item.GatewayID = id
+					item.Status = 200
+				}
+				out.Gateways = append(out.Gateways, item)
+			}
+			jsonWrite(w, 200, &out)
+			return
+		}
+
+		singleRequests++
+		gatewayName := strings.TrimPrefix(r.URL.Path, "/gateway/")
+		id, found := dbMain[gatewayName]
+		resultGet(w, gatewayName, id, found)
+	}))
+	defer main.Close()
+	mainURL, _ := url.JoinPath(main.URL, "/gateway")
+
+	client := NewClient(ClientOptions{
+		ServerURL: mainURL,
+	})
+
+	names := []string{"gateway1", "gateway2", "gateway3", "gateway1"}
+
+	ids := client.GatewayIDs(context.TODO(), names)
+
+	expected := map[string]string{"gateway1": "id1", "gateway2": "id2", "gateway3": ""}
+
+	for name, id := range expected {
+		if ids[name] != id {
+			t.Errorf("gateway=%s expectedID=[%s] foundID=[%s]", name, id, ids[name])
+		}
+	}
+	if len(ids) != len(expected) {
+		t.Errorf("expected %d results, got %d: %v", len(expected), len(ids), ids)
+	}
+	if batchRequests != 1 || singleRequests != 0 {
+		t.Errorf("expected one batch request only: batch=%d single=%d", batchRequests, singleRequests)
+	}
+
+	// found names must have been cached
+	if id := client.GatewayID(context.TODO(), "gateway2"); id != "id2" {
+		t.Errorf("cached gateway2: expectedID=[id2] foundID=[%s]", id)
+	}
+	if singleRequests != 0 {
+		t.Errorf("gateway2 should be served from cache: single=%d", singleRequests)
+	}
+
+	// only the missing name goes to server
+	client.GatewayIDs(context.TODO(), []string{"gateway1", "gateway3"})
+	if batchRequests != 2 {
+		t.Errorf("expected second batch request: batch=%d", batchRequests)
+	}
+}
+
+// go test -v -run TestClientGatewayIDsFallback ./gateboard
+func TestClientGatewayIDsFallback(t *testing.T) {
+
+	dbMain := map[string]string{"gateway1": "id1"}
+
+	// server without batchGet
+	main := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("main server: %s %s", r.Method, r.URL)
+		if r.Method != "GET" {
+			w.WriteHeader(404)
+			return
+		}
+		gatewayName := strings.TrimPrefix(r.URL.Path, "/gateway/")
+		id, found := dbMain[gatewayName]
+		resultGet(w, gatewayName, id, found)
+	}))
+	defer main.Close()
+	mainURL, _ := url.JoinPath(main.URL, "/gateway")
+
+	client := NewClient(ClientOptions{
+		ServerURL: mainURL,
+	})
+
+	ids := client.GatewayIDs(context.TODO(), []string{"gateway1", "gateway2"})
+
+	if ids["gateway1"] != "id1" || ids["gateway2"] != "" {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+}
+
+// go test -v -run TestClientBatchGetURL ./gateboard
+func TestClientBatchGetURL(t *testing.T) {
+	table := []struct {
+		serverURL   string
+		batchGetURL string
+		expected    string
+	}{
+		{"http://localhost:8080/gateway", "", "http://localhost:8080/gateways:batchGet"},
+		{"http://localhost:8080/gateway/", "", "http://localhost:8080/gateways:batchGet"},
+		{"http://localhost:8080/prefix/gateway", "", "http://localhost:8080/prefix/gateways:batchGet"},
+		{"http://localhost:8080/gateway", "http://other/batch", "http://other/batch"},
+	}
+	for _, data := range table {
+		client := NewClient(ClientOptions{ServerURL: data.serverURL, BatchGetURL: data.batchGetURL})
+		u, err := client.batchGetURL()
+		if err != nil {
+			t.Errorf("serverURL=%s error: %v", data.serverURL, err)
+		}
+		if u != data.expected {
+			t.Errorf("serverURL=%s expected=%s got=%s", data.serverURL, data.expected, u)
+		}
+	}
+}
+
+// go test -v -run TestClientWatch ./gateboard
+func TestClientWatch(t *testing.T) {
+
+	events := make(chan BodyGetReply)
+
+	main := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Logf("main server: %s %s", r.Method, r.URL)
+		if r.URL.Path != "/watch" || r.URL.Query().Get("names") != "gateway1,gateway2" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case body := <-events:
+				buf, _ := json.Marshal(body)
+				w.Write([]byte("event:gateway\ndata:" + string(buf) + "\n\n"))
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer main.Close()
+	mainURL, _ := url.JoinPath(main.URL, "/gateway")
+
+	client := NewClient(ClientOptions{
+		ServerURL:  mainURL,
+		WatchRetry: 10 * time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		client.Watch(ctx, []string{"gateway1", "gateway2"})
+		close(done)
+	}()
+
+	waitCache := func(gatewayName, expectedID string) {
+		for range 100 {
+			entry, found := client.cacheGet(gatewayName)
+			if entry.gatewayID == expectedID && found == (expectedID != "") {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("gateway=%s expectedID=[%s] not found in cache", gatewayName, expectedID)
+	}
+
+	events <- BodyGetReply{GatewayName: "gateway1", GatewayID: "id1", Changes: 1}
+	waitCache("gateway1", "id1")
+
+	events <- BodyGetReply{GatewayName: "gateway1", GatewayID: "id2", Changes: 2}
+	waitCache("gateway1", "id2")
+
+	if id := client.GatewayID(context.TODO(), "gateway1"); id != "id2" {
+		t.Errorf("GatewayID: expectedID=[id2] foundID=[%s]", id)
+	}
+
+	events <- BodyGetReply{GatewayName: "gateway1", Changes: 3, Deleted: true}
+	waitCache("gateway1", "")
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Watch did not return after cancel")
+	}
+}
+
+// go test -v -run TestClientTLS ./gateboard
+func TestClientTLS(t *testing.T) {
+
+	main := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gatewayName := strings.TrimPrefix(r.URL.Path, "/gateway/")
+		resultGet(w, gatewayName, "id1", true)
+	}))
+	defer main.Close()
+	mainURL, _ := url.JoinPath(main.URL, "/gateway")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: main.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+
+	if _, err := TLSClientConfig("", "", filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Errorf("expected error for missing ca bundle")
+	}
+
+	if _, err := TLSClientConfig("missing.crt", "missing.key", ""); err == nil {
+		t.Errorf("expected error for missing client certificate")
+	}
+
+	untrusted := NewClient(ClientOptions{ServerURL: mainURL})
+	if id := untrusted.GatewayID(context.TODO(), "gateway1"); id != "" {
+		t.Errorf("expected no id from untrusted server, got %s", id)
+	}
+
+	tlsConfig, errTLS := TLSClientConfig("", "", caFile)
+	if errTLS != nil {
+		t.Fatalf("tls config: %v", errTLS)
+	}
+
+	client := NewClient(ClientOptions{ServerURL: mainURL, TLSConfig: tlsConfig})
+	if id := client.GatewayID(context.TODO(), "gateway1"); id != "id1" {
+		t.Errorf("expected id1, got %s", id)
+	}
+}
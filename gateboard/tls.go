@@ -0,0 +1,64 @@
+package gateboard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// TLSClientConfig builds a TLS configuration for clients of the gateboard server.
+// caFile, if not empty, holds the PEM bundle used instead of system roots to verify the server.
+// certFile and keyFile, if not empty, hold the client certificate presented for mutual TLS.
+// The client certificate is read again on every new connection, hence rotated files are picked up.
+func TLSClientConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, errCA := loadCertPool(caFile)
+		if errCA != nil {
+			return nil, errCA
+		}
+		conf.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		// fail early on bad files
+		if _, errCert := tls.LoadX509KeyPair(certFile, keyFile); errCert != nil {
+			return nil, fmt.Errorf("client certificate: %v", errCert)
+		}
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, errCert := tls.LoadX509KeyPair(certFile, keyFile)
+			if errCert != nil {
+				return nil, fmt.Errorf("client certificate: %v", errCert)
+			}
+			return &cert, nil
+		}
+	}
+
+	return conf, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	buf, errRead := os.ReadFile(caFile)
+	if errRead != nil {
+		return nil, fmt.Errorf("ca bundle: %v", errRead)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("ca bundle: no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// newHTTPClient creates a traced http client. A nil tlsConfig keeps default TLS settings.
+func newHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: otelhttp.NewTransport(transport)}
+}